@@ -7,22 +7,36 @@ import (
 	"github.com/ptsim/vecbackup/internal/vecbackup"
 	"math"
 	"os"
+	"path/filepath"
 	"runtime/pprof"
+	"time"
 )
 
 func usageAndExit() {
 	fmt.Fprintf(os.Stderr, `Usage:
   vecbackup help
-  vecbackup init [-pw <pwfile>] [-chunk-size size] [-pbkdf2-iterations num] -r <repo>
-  vecbackup backup [-v] [-f] [-n] [-version <version>] [-pw <pwfile>] [-exclude-from <file>] [-lock-file <file>] [-check-chunks] [-max-dop n] -r <repo> <src> [<src> ...]
+  vecbackup init [-pw <pwfile>] [-chunk-size size] [-chunking mode] [-min-chunk-size size] [-max-chunk-size size] [-pack-size size] [-kdf kdf] [-pbkdf2-iterations num] [-argon2-memory mib] [-argon2-time num] [-argon2-threads num] [-asymmetric] [-compress mode] [-compress-type type] [-compress-level level] [-padding mode] -r <repo>
+  vecbackup backup [-v] [-f] [-n] [-version <version>] [-pw <pwfile>] [-exclude-from <file>] [-lock-file <file>] [-break-stale-lock] [-mirror <repo> ...] [-check-chunks] [-max-dop n] -r <repo> <src> [<src> ...]
   vecbackup ls [-version <version>] [-pw <pwfile>] -r <repo>
   vecbackup versions [-pw <pwfile>] -r <repo>
   vecbackup restore [-v] [-n] [-version <version>] [-merge] [-pw <pwfile>] [-verify-only] [-max-dop n] -r <repo> -target <restoredir> [<path> ...]
   vecbackup delete-version [-pw <pwfile>] -r <repo> -version <version>
   vecbackup delete-old-versions [-n] [-pw <pwfile>] -r <repo>
   vecbackup verify-repo [-pw <pwfile>] [-quick] [-max-dop n] -r <repo>
-  vecbackup purge-unused [-v] [-pw <pwfile>] [-n] -r <repo>
-  vecbackup remove-lock [-r <repo>] [-lock-file <file>]
+  vecbackup purge-unused [-v] [-pw <pwfile>] [-n] [-grace-period <duration>] -r <repo>
+  vecbackup set-mode [-pw <pwfile>] -mode <mode> -r <repo>
+  vecbackup recompress [-v] [-n] [-pw <pwfile>] [-compress-type type] [-compress-level level] [-max-dop n] -to <mode> -r <repo>
+  vecbackup rotate-key [-v] [-remove-other-keys] [-lock-file <file>] [-break-stale-lock] [-max-dop n] -pw <pwfile> -new-pw <pwfile> -r <repo>
+  vecbackup copy [-v] [-version <version>] [-pw <pwfile>] [-new-pw <pwfile>] [-lock-file <file>] [-break-stale-lock] [-max-dop n] -r <repo> -to <repo>
+  vecbackup upgrade-kdf [-kdf kdf] [-pbkdf2-iterations num] [-argon2-memory mib] [-argon2-time num] [-argon2-threads num] -pw <pwfile> -r <repo>
+  vecbackup change-password [-kdf kdf] [-pbkdf2-iterations num] [-argon2-memory mib] [-argon2-time num] [-argon2-threads num] -pw <pwfile> -new-pw <pwfile> -r <repo>
+  vecbackup key add [-kdf kdf] [-pbkdf2-iterations num] [-argon2-memory mib] [-argon2-time num] [-argon2-threads num] [-write-only] -label <label> -pw <pwfile> -new-pw <pwfile> -r <repo>
+  vecbackup key list -r <repo>
+  vecbackup key remove -label <label> -pw <pwfile> -r <repo>
+  vecbackup key export -pw <pwfile> -r <repo>
+  vecbackup key import [-f] [-in <file>] [-kdf kdf] [-pbkdf2-iterations num] [-argon2-memory mib] [-argon2-time num] [-argon2-threads num] -new-pw <pwfile> -r <repo>
+  vecbackup remove-lock [-f] [-r <repo>] [-lock-file <file>]
+  vecbackup serve [-v] [-append-only] [-tls-cert <file> -tls-key <file>] -listen <addr> -r <repo>
 `)
 	os.Exit(1)
 }
@@ -30,11 +44,41 @@ func usageAndExit() {
 func help() {
 	fmt.Printf(`Usage:
   vecbackup help
-  vecbackup init [-pw <pwfile>] [-chunk-size size] [-pbkdf2-iterations num] [-compress mode] -r <repo>
+  vecbackup init [-pw <pwfile>] [-chunk-size size] [-chunking mode] [-min-chunk-size size] [-max-chunk-size size] [-pack-size size] [-kdf kdf] [-pbkdf2-iterations num] [-argon2-memory mib] [-argon2-time num] [-argon2-threads num] [-asymmetric] [-compress mode] [-compress-type type] [-compress-level level] [-padding mode] -r <repo>
       -chunk-size   files are broken into chunks of this size.
+                    With content-defined chunking, this is the average chunk size.
+      -chunking     Chunking mode. Default fixed. Modes:
+                      fixed    Files are cut into chunks at fixed offsets.
+                      cdc      Content-defined chunking. Chunk boundaries are
+                               chosen from the file contents so that inserting
+                               or removing data only changes the chunks around
+                               the change. Good for large files that change in
+                               place such as VM images and mailboxes.
+      -min-chunk-size
+                    minimum chunk size for content-defined chunking.
+                    Default is 1/4 of -chunk-size.
+      -max-chunk-size
+                    maximum chunk size for content-defined chunking.
+                    Default is 4 times -chunk-size.
+      -pack-size    store chunks in pack files of about this size instead of
+                    one file per chunk. Useful for remote storage with per object
+                    costs or limits. Default 0, one file per chunk.
+      -kdf          key derivation function used to derive the key from the password.
+                    Default pbkdf2.
+                      pbkdf2   PBKDF2 with SHA-1. Compatible with older versions of vecbackup.
+                      argon2id Argon2id, much harder to crack with GPUs.
       -pbkdf2-iterations
                     number of iterations for PBKDF2 key generation.
                     Minimum 100,000.
+      -argon2-memory
+                    memory used by Argon2id in MiB. Default 64.
+      -argon2-time  number of passes over the memory for Argon2id. Default 3.
+      -argon2-threads
+                    number of threads used by Argon2id. Default 4.
+      -asymmetric   encrypts the data with a public key so that backup clients
+                    using a write-only key cannot read it. Needs a password. The
+                    password can restore. Use "key add -write-only" to add
+                    a key for backup clients.
       -compress     Compress mode. Default auto. Modes:
                       auto     Compresses most chunks but skip small chunks
                                and only check if compression saves space on
@@ -43,16 +87,38 @@ func help() {
                                version if it is smaller.
                       no       Never compress chunks.
                       yes      Compress all chunks.
+      -compress-type
+                    Compression algorithm for chunks and version files. Default zlib.
+                      zlib     Compatible with older versions of vecbackup.
+                      zstd     Faster and compresses better than zlib.
+      -compress-level
+                    Compression level. 1 to 9 for zlib, 1 to 22 for zstd.
+                    Default 0, the default level for the compression type.
+      -padding      Pads chunks and version files before encryption so that
+                    their sizes do not give away the sizes of the files.
+                    Needs a password. Default no. Modes:
+                      no       No padding.
+                      pow2     Pads to the next power of two. Up to 100%%
+                               overhead.
+                      padme    Padme. Up to 12%% overhead, most of the
+                               size is still hidden.
 
     Initialize a new backup repository.
 
-  vecbackup backup [-v] [-f] [-n] [-version <version>] [-pw <pwfile>] [-exclude-from <file>] [-lock-file <file>] [-check-chunks] [-max-dop n] -r <repo> <src> [<src> ...]
+  vecbackup backup [-v] [-f] [-n] [-version <version>] [-pw <pwfile>] [-exclude-from <file>] [-lock-file <file>] [-break-stale-lock] [-mirror <repo> ...] [-check-chunks] [-max-dop n] -r <repo> <src> [<src> ...]
     Incrementally and recursively backs up one or more <src> to <repo>.
     The files, directories and symbolic links backed up. Other file types are silently ignored.
     Files that have not changed in same size and timestamp are not backed up.
     A lock file is created to prevent starting another backup operation when one is
     already in progress. It is removed when done. Running simultaneous backups isn't
     recommended. It is slow because the second backup is repeating the work of the first.
+    The lock file records the host, process id, user, command and start time, and its
+    heartbeat is refreshed every minute. A lock is stale if its heartbeat is more than
+    10 minutes old or its process on this host is no longer running.
+    The backup also holds a shared lock in <repo>/locks, like restore, verify-repo
+    and copy. purge-unused, delete-version, delete-old-versions, recompress and
+    rotate-key hold an exclusive lock there, so they fail while another command
+    uses the repository and the other commands fail while they run.
       -v            verbose, prints the items that are added (+) or removed (-).
       -f            force, always check file contents 
       -check-chunks check and add missing chunks
@@ -60,6 +126,18 @@ func help() {
       -version      save as the given version, instead of the current time
       -exclude-from reads list of exclude patterns from specified file
       -lock-file    path to lock file if different from default (<repo>/lock)
+      -break-stale-lock
+                    remove a stale lock file instead of failing. Also for
+                    the other commands that take locks.
+      -mirror       another repository that is written together with <repo>.
+                    Can be given more than once. The sources are read once and
+                    new chunks and the version are written to every mirror.
+                    A mirror must have the same keys as <repo>; one that does
+                    not exist is created with a copy of the config file of
+                    <repo>. If a mirror fails, the backup continues without
+                    it and the versions it missed because of that are copied
+                    to it by the next backup with it. Versions deleted from a
+                    mirror are not copied again.
 
   vecbackup versions [-pw <pwfile>] -r <repo>
     Lists all backup versions in chronological order. The version name is a
@@ -100,30 +178,228 @@ func help() {
     can be read and match their checksums.
       -quick        Quick, just checks that the chunks exist.
 
-  vecbackup purge-unused [-pw <pwfile>] [-n] -r <repo>
+  vecbackup purge-unused [-v] [-pw <pwfile>] [-n] [-grace-period <duration>] -r <repo>
     Deletes chunks that are not used by any file in any backup version.
+    The unused chunks are first put on a pending deletion list in the
+    repository. They are only deleted by a later purge-unused, if they are
+    still unused and have been on the list for the grace period. A backup
+    that uses a chunk on the list keeps it for another grace period.
       -n            dry run, shows number of chunks to be deleted.
       -v            prints the chunks being deleted
+      -grace-period time unused chunks stay on the list before they are
+                    deleted, for example 48h. Default 24h. It should be longer
+                    than the longest backup. 0 deletes unused chunks at once.
 
-  vecbackup remove-lock [-lock-file <file>] [-r repo]
+  vecbackup set-mode [-pw <pwfile>] -mode <mode> -r <repo>
+    Sets the operations allowed on the repository. The mode is kept in the
+    config file, so the password is needed to change it. Modes:
+      read-write    all operations are allowed. This is the default.
+      append-only   backups can be added but files in the repository cannot
+                    be overwritten or deleted, so delete-version,
+                    delete-old-versions and purge-unused fail.
+      read-only     no files can be added, overwritten or deleted. Only
+                    commands like restore, ls and verify-repo work.
+    The mode is enforced by vecbackup, not by the storage. Use
+    "serve -append-only" to protect a repository from other clients.
+
+  vecbackup recompress [-v] [-n] [-pw <pwfile>] [-compress-type type] [-compress-level level] [-max-dop n] -to <mode> -r <repo>
+    Changes the compression of the repository and recompresses all existing chunks.
+    Chunks already compressed with the given compression type are not changed,
+    so an interrupted recompress can be resumed by running it again. If the
+    compression level changes, all compressed chunks are recompressed and an
+    interrupted recompress starts over. Needs a key that is not write-only.
+      -to           compression mode: auto, slow, yes or no. See init.
+      -compress-type
+                    compression type: zlib or zstd. Default zlib.
+      -compress-level
+                    compression level. Default 0, the default level.
+      -n            dry run, shows how much space would be saved.
+      -v            prints the chunks being recompressed.
+
+  vecbackup rotate-key [-v] [-remove-other-keys] [-lock-file <file>] [-break-stale-lock] [-max-dop n] -pw <pwfile> -new-pw <pwfile> -r <repo>
+    Replaces the encryption keys of the repository with new random keys,
+    for example if a password or a key export may have leaked. All chunks
+    and version files are decrypted and encrypted again with the new keys
+    and the chunks are renamed. This reads and writes the whole repository.
+    If it is interrupted, run it again with the same passwords to resume.
+    No other command can use the repository until it is done. The config
+    with the new keys is encrypted with a new config key and can then only
+    be opened with the new password. Key slots other than the one opened by
+    the password would also open the new keys, so rotate-key fails unless
+    -remove-other-keys is given and lists them.
+      -v            prints the chunks and versions being rotated.
+      -new-pw       file containing the new password
+      -new-key-file file containing a new raw 32-byte key
+      -remove-other-keys
+                    removes the other key slots. Add them again with key add
+                    when rotate-key is done.
+      -lock-file    path to lock file if different from default (<repo>/lock)
+
+  vecbackup copy [-v] [-version <version>] [-pw <pwfile>] [-new-pw <pwfile>] [-lock-file <file>] [-break-stale-lock] [-max-dop n] -r <repo> -to <repo>
+    Copies the backup versions of the repository to another existing repository,
+    for example an off-site copy, without reading the sources again. Only the
+    chunks missing in the destination are copied and versions already in the
+    destination are skipped, so an interrupted copy can be resumed by running
+    it again. If the destination has different keys or compression settings,
+    the chunks are decrypted, recompressed and encrypted again for it.
+      -to           the destination repository.
+      -version      copies only this version. Default is all versions.
+      -new-pw       file containing the password of the destination if it is
+                    different. -new-key-file can also be used.
+      -v            prints the chunks and versions being copied.
+      -lock-file    path to lock file of the destination if different from
+                    default (<destination>/lock)
+
+  vecbackup upgrade-kdf [-kdf kdf] [-pbkdf2-iterations num] [-argon2-memory mib] [-argon2-time num] [-argon2-threads num] -pw <pwfile> -r <repo>
+    Changes the key derivation function used to derive the key from the password,
+    for example from PBKDF2 to Argon2id. The password is not changed.
+    The flags are the same as for init.
+
+  vecbackup change-password [-kdf kdf] [-pbkdf2-iterations num] [-argon2-memory mib] [-argon2-time num] [-argon2-threads num] -pw <pwfile> -new-pw <pwfile> -r <repo>
+    Changes the password of the repository. Only the config file is rewritten
+    with a new salt; the encryption keys and the chunks are not changed.
+    A backup copy of the config file is kept until the new one is written.
+      -new-pw       file containing the new password
+      -new-key-file file containing a new raw 32-byte key
+    The key derivation function is kept unless -kdf or one of its
+    parameters is given. These flags are the same as for init.
+
+  vecbackup key add [-kdf kdf] [-pbkdf2-iterations num] [-argon2-memory mib] [-argon2-time num] [-argon2-threads num] [-write-only] -label <label> -pw <pwfile> -new-pw <pwfile> -r <repo>
+    Adds a key slot so that the repository can also be opened with another
+    password or key file. The repository must be opened with an existing
+    password. A repository without key slots is converted so that its password
+    becomes the key slot "default". Older versions of vecbackup cannot open
+    repositories with key slots.
+      -label        name of the new key slot
+      -new-pw       file containing the new password
+      -new-key-file file containing a new raw 32-byte key
+      -write-only   the new key can only be used for backups. Only for
+                    repositories initialized with -asymmetric.
+    The key derivation flags are the same as for init.
+
+  vecbackup key list -r <repo>
+    Lists the key slots of the repository. No password is needed.
+
+  vecbackup key remove -label <label> -pw <pwfile> -r <repo>
+    Removes a key slot. The repository must be opened with an existing
+    password. The last key slot cannot be removed.
+
+  vecbackup key export -pw <pwfile> -r <repo>
+    Prints the encryption keys and the config of the repository so that
+    it can be recovered with "key import" if the config file is lost or
+    corrupted. Print it or write it down and keep it in a safe place.
+    Anyone with it can read the repository without a password.
+    It is printed twice: as lines of hex with a line number and a checksum
+    at the end of each line, for typing it back in, and as a single line
+    of base32 that can be turned into a QR code. Write-only keys cannot
+    export the keys.
+
+  vecbackup key import [-f] [-in <file>] [-kdf kdf] [-pbkdf2-iterations num] [-argon2-memory mib] [-argon2-time num] [-argon2-threads num] -new-pw <pwfile> -r <repo>
+    Writes a new config file for the repository from the output of
+    "key export". Either form can be used. The repository can then be
+    opened with the new password. All other key slots are lost.
+      -in           file containing the exported keys. Default stdin.
+      -f            replace the existing config file.
+    The key derivation flags are the same as for init.
+
+  vecbackup remove-lock [-f] [-lock-file <file>] [-r repo]
       -lock-file    path to lock file if different from default (<repo>/lock)
-    Removes the lock file left behind due to a failed backup operation.
+      -f            also remove the locks that are not stale.
+    Removes the lock file left behind due to a failed backup operation and
+    prints who held it. With -r, also removes the locks in <repo>/locks.
+    Only stale locks are removed. The holders of the other locks are
+    printed.
     Either -r or -lock-file must be specified.
 
+  vecbackup serve [-v] [-append-only] [-tls-cert <file> -tls-key <file>] -listen <addr> -r <repo>
+    Serves the repository over HTTP so that other computers can use it as
+    "http://host:port/". The server does not need the password of the
+    repository. Clients must use the user and password in the
+    VECBACKUP_HTTP_USER and VECBACKUP_HTTP_PASSWORD environment variables
+    of the server.
+      -listen       address to listen on, for example :8080.
+      -append-only  refuse to overwrite or delete files, except lock files,
+                    so that a client cannot destroy existing backups. Commands
+                    that delete files, like purge-unused, must be run on the
+                    server with the local repository path.
+      -tls-cert     certificate file to serve HTTPS.
+      -tls-key      key file of the certificate.
+      -v            prints every request.
+
 Common flags:
       -r            Path to backup repository.
       -pw           file containing the password
+      -pw-env       environment variable containing the password
+      -pw-command   shell command that prints the password, for example
+                    "pass show backup". A trailing newline is removed.
+      -pw-prompt    prompt for the password on the terminal
+      -key-file     file containing a raw 32-byte key. The key is used
+                    as the master key without key derivation.
+                    Only one of -pw, -pw-env, -pw-command, -pw-prompt and
+                    -key-file can be given. The commands below show -pw
+                    but any of them can be used.
       -rclone-binary  Path to the "rclone" program
+      -no-rclone-daemon
+                    run one rclone command per operation instead of using
+                    one "rclone rcd" process for rclone repositories.
+      -s3-endpoint  URL of the S3 compatible server, for example
+                    http://localhost:9000 for MinIO. Default is AWS S3 in
+                    the region.
+      -s3-region    region of the S3 bucket. Default is $AWS_REGION or us-east-1.
+      -sftp-key     private key file for sftp repositories. Default is the
+                    keys in ssh-agent and ~/.ssh/id_ed25519, id_ecdsa, id_rsa.
+      -sftp-known-hosts
+                    known_hosts file for sftp repositories.
+                    Default is ~/.ssh/known_hosts.
+      -retries      number of retries of a failed storage operation. Default 4.
+                    Errors like a missing file or a denied permission are not
+                    retried.
+      -retry-backoff
+                    delay before the first retry, for example 500ms. It doubles
+                    for each further retry, up to 1m. Default 1s.
+      -retry-jitter random part of the retry delay as a fraction of it.
+                    Default 0.2.
+      -limit-upload maximum upload rate in bytes per second, for example 500K
+                    or 2M. K, M and G are powers of 1024. Default no limit.
+      -limit-download
+                    maximum download rate in bytes per second.
+      -limit-ops    maximum number of storage operations per second.
+      -limit-file   file with limits that can be changed while vecbackup runs.
+                    It is read again within 5 seconds after it changes. Each
+                    line is "upload|download|ops <limit> [HH:MM-HH:MM]". A line
+                    with a time range only applies during that time of the day.
+                    The limits in the file override the flags.
+      -read-only    do not add, overwrite or delete files in the repository
+                    whatever its mode. Lock files are still written.
+      -cache-dir    dir for local caches. Default is the vecbackup dir in the
+                    user cache dir, for example ~/.cache/vecbackup.
+      -no-cache     do not use local caches.
+      -refresh-cache
+                    rebuild the local cache of the chunks in the repository.
+                    The backup command keeps a local list of the chunks in the
+                    repository so that it does not need to check if each chunk
+                    exists. It is rebuilt daily or when chunks are purged.
       -max-dop      maximum degree of parallelism. Default 3. 
                     Minimum 1. Maximum 100. Increasing this number increases
                     memory, cpu, disk and network usage but reduces total time.
-                    Only used for backup, restore and verify-repo commands.
+                    Only used for backup, restore, verify-repo, recompress, rotate-key and copy commands.
 
 Remote repository:
   If the repository path starts with "rclone:", the rest of the path is passed to rclone
   as the location of the repository. For example, if the repo path is "rclone:remote:path/to/dir",
   the rclone path used to store the repo is "remote:path/to/dir".
-  If the repository path does not start with "rclone:", it is assumed to be a local path.
+  If the repository path starts with "s3:", the repository is stored in an S3 compatible
+  object store without rclone. The rest of the path is the bucket followed by the prefix,
+  for example "s3:mybucket/path/to/dir". The credentials are read from the
+  AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY and AWS_SESSION_TOKEN environment variables.
+  If the repository path starts with "sftp:", the repository is stored on an SSH server
+  using SFTP, for example "sftp:user@host:/path/to/dir" or "sftp:user@host:2222:/path/to/dir".
+  The server must be in the known_hosts file.
+  If the repository path starts with "http://" or "https://", the repository is on a
+  server started with "vecbackup serve", for example "http://backup-host:8080/". The user
+  and password are read from the VECBACKUP_HTTP_USER and VECBACKUP_HTTP_PASSWORD
+  environment variables.
+  Otherwise, the repository path is assumed to be a local path.
 
 Exclude Patterns:
 
@@ -148,20 +424,137 @@ var verifyOnly = flag.Bool("verify-only", false, "Verify but don't write.")
 var version = flag.String("version", "", "The version to operate on.")
 var merge = flag.Bool("merge", false, "Merge into existing directory.")
 var pwFile = flag.String("pw", "", "File containing password.")
+var pwEnv = flag.String("pw-env", "", "Environment variable containing password.")
+var pwCommand = flag.String("pw-command", "", "Command that prints the password.")
+var pwPrompt = flag.Bool("pw-prompt", false, "Prompt for the password.")
+var keyFile = flag.String("key-file", "", "File containing a raw 32-byte key.")
+var newPwFile = flag.String("new-pw", "", "File containing new password.")
+var newKeyFile = flag.String("new-key-file", "", "File containing a new raw 32-byte key.")
+var removeOtherKeys = flag.Bool("remove-other-keys", false, "Remove the other key slots during rotate-key.")
+var label = flag.String("label", "", "Key slot label.")
+var in = flag.String("in", "", "File to read from.")
+var writeOnly = flag.Bool("write-only", false, "Add a write-only key.")
+var asymmetric = flag.Bool("asymmetric", false, "Use asymmetric encryption.")
 var chunkSize = flag.Int("chunk-size", 16*1024*1024, "Chunk size.")
+var chunking = flag.String("chunking", "fixed", "Chunking mode.")
+var minChunkSize = flag.Int("min-chunk-size", 0, "Min chunk size for content-defined chunking.")
+var maxChunkSize = flag.Int("max-chunk-size", 0, "Max chunk size for content-defined chunking.")
+var packSize = flag.Int("pack-size", 0, "Pack file size. 0 to store each chunk in its own file.")
+var kdfName = flag.String("kdf", "pbkdf2", "Key derivation function.")
 var iterations = flag.Int("pbkdf2-iterations", 100000, "PBKDF2 iteration count.")
+var argon2Memory = flag.Int("argon2-memory", vecbackup.ARGON2_DEFAULT_MEMORY/1024, "Argon2id memory in MiB.")
+var argon2Time = flag.Int("argon2-time", vecbackup.ARGON2_DEFAULT_TIME, "Argon2id time.")
+var argon2Threads = flag.Int("argon2-threads", vecbackup.ARGON2_DEFAULT_THREADS, "Argon2id threads.")
 var repo = flag.String("r", "", "Path to backup repository.")
 var target = flag.String("target", "", "Path to restore target path.")
 var excludeFrom = flag.String("exclude-from", "", "Reads list of exclude patterns from specified file.")
 var compress = flag.String("compress", "auto", "Compression mode")
+var to = flag.String("to", "", "Target compression mode or destination repository")
+var compressType = flag.String("compress-type", "zlib", "Compression type")
+var compressLevel = flag.Int("compress-level", 0, "Compression level")
+var padding = flag.String("padding", "no", "Padding mode")
 var quick = flag.Bool("quick", false, "Quick mode")
 var rclone = flag.String("rclone-binary", "rclone", "Path to rclone binary")
+var noRcloneDaemon = flag.Bool("no-rclone-daemon", false, "Do not use rclone rcd.")
+var s3Endpoint = flag.String("s3-endpoint", "", "URL of the S3 server.")
+var s3Region = flag.String("s3-region", "", "Region of the S3 bucket.")
+var sftpKey = flag.String("sftp-key", "", "Private key file for sftp.")
+var sftpKnownHosts = flag.String("sftp-known-hosts", "", "known_hosts file for sftp.")
+var retries = flag.Int("retries", 4, "Number of retries of a failed storage operation.")
+var retryBackoff = flag.Duration("retry-backoff", time.Second, "Delay before the first retry.")
+var retryJitter = flag.Float64("retry-jitter", 0.2, "Random part of the retry delay.")
+var limitUpload = flag.String("limit-upload", "", "Maximum upload rate.")
+var limitDownload = flag.String("limit-download", "", "Maximum download rate.")
+var limitOps = flag.String("limit-ops", "", "Maximum storage operations per second.")
+var limitFile = flag.String("limit-file", "", "File with limits.")
+var listen = flag.String("listen", "", "Address to listen on.")
+var appendOnly = flag.Bool("append-only", false, "Refuse to overwrite or delete files.")
+var tlsCert = flag.String("tls-cert", "", "TLS certificate file.")
+var tlsKey = flag.String("tls-key", "", "TLS key file.")
+var readOnly = flag.Bool("read-only", false, "Do not change the repository.")
+var repoMode = flag.String("mode", "", "Repository mode.")
+var mirrors stringList
+var breakStaleLock = flag.Bool("break-stale-lock", false, "Remove a stale lock file.")
 var lockFile = flag.String("lock-file", "", "Lock file path")
+var gracePeriod = flag.Duration("grace-period", vecbackup.DEFAULT_GRACE_PERIOD, "Time unused chunks are pending deletion.")
+var cacheDir = flag.String("cache-dir", "", "Dir for local caches.")
+var noCache = flag.Bool("no-cache", false, "Do not use local caches.")
+var refreshCache = flag.Bool("refresh-cache", false, "Rebuild local caches.")
 var maxDop = flag.Int("max-dop", 3, "Maximum degree of parallelism.")
 
+// stringList is a flag that can be given more than once.
+type stringList []string
+
+func (l *stringList) String() string {
+	return fmt.Sprint([]string(*l))
+}
+
+func (l *stringList) Set(s string) error {
+	*l = append(*l, s)
+	return nil
+}
+
+func parseCompressMode(m, flagName string) vecbackup.CompressionMode {
+	if m == "auto" {
+		return vecbackup.CompressionMode_AUTO
+	} else if m == "slow" {
+		return vecbackup.CompressionMode_SLOW
+	} else if m == "yes" {
+		return vecbackup.CompressionMode_YES
+	} else if m == "no" {
+		return vecbackup.CompressionMode_NO
+	}
+	exitIfError(fmt.Errorf("Invalid %s flag.", flagName))
+	return vecbackup.CompressionMode_AUTO
+}
+
+func parseCompressType() (vecbackup.CompressionType, int32) {
+	var ctype vecbackup.CompressionType
+	if *compressType == "zlib" {
+		ctype = vecbackup.CompressionType_ZLIB
+	} else if *compressType == "zstd" {
+		ctype = vecbackup.CompressionType_ZSTD
+	} else {
+		exitIfError(errors.New("Invalid -compress-type flag."))
+	}
+	if *compressLevel < 0 || *compressLevel > math.MaxInt32 {
+		exitIfError(errors.New("Invalid -compress-level flag."))
+	}
+	return ctype, int32(*compressLevel)
+}
+
+func parseKdf() *vecbackup.KdfParams {
+	if *kdfName == "pbkdf2" {
+		if *iterations < 100000 {
+			exitIfError(errors.New(fmt.Sprintf("Too few PBKDF2 iterations, minimum 100,000: %d", *iterations)))
+		}
+		return &vecbackup.KdfParams{Type: vecbackup.KdfType_PBKDF2_SHA1, Iterations: *iterations}
+	} else if *kdfName == "argon2id" {
+		if *argon2Memory < 1 || *argon2Memory > vecbackup.ARGON2_MAX_MEMORY/1024 {
+			exitIfError(errors.New("Invalid -argon2-memory flag."))
+		}
+		return &vecbackup.KdfParams{Type: vecbackup.KdfType_ARGON2ID, Memory: *argon2Memory * 1024, Time: *argon2Time, Threads: *argon2Threads}
+	}
+	exitIfError(errors.New("Invalid -kdf flag."))
+	return nil
+}
+
+// kdfFlagsSet returns true if any of the key derivation flags is given.
+func kdfFlagsSet() bool {
+	set := false
+	flag.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "kdf", "pbkdf2-iterations", "argon2-memory", "argon2-time", "argon2-threads":
+			set = true
+		}
+	})
+	return set
+}
+
 func exitIfError(err error) {
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "%s\n", err)
+		vecbackup.StopRcloneDaemon()
 		os.Exit(1)
 	}
 }
@@ -172,6 +565,11 @@ func main() {
 	}
 	cmd := os.Args[1]
 	os.Args = append([]string{os.Args[0]}, os.Args[2:]...)
+	if cmd == "key" && len(os.Args) > 1 {
+		cmd = "key " + os.Args[1]
+		os.Args = append([]string{os.Args[0]}, os.Args[2:]...)
+	}
+	flag.Var(&mirrors, "mirror", "Mirror repository.")
 	flag.Parse()
 	vecbackup.SetDebug(*debugF)
 	if *cpuprofile != "" {
@@ -196,6 +594,35 @@ func main() {
 		}()
 	}
 	vecbackup.SetRcloneBinary(*rclone)
+	vecbackup.SetRcloneDaemon(!*noRcloneDaemon)
+	defer vecbackup.StopRcloneDaemon()
+	if *s3Region == "" {
+		*s3Region = os.Getenv("AWS_REGION")
+	}
+	vecbackup.SetS3Config(*s3Endpoint, *s3Region, os.Getenv("AWS_ACCESS_KEY_ID"), os.Getenv("AWS_SECRET_ACCESS_KEY"), os.Getenv("AWS_SESSION_TOKEN"))
+	vecbackup.SetSftpConfig(*sftpKey, *sftpKnownHosts)
+	vecbackup.SetHttpConfig(os.Getenv("VECBACKUP_HTTP_USER"), os.Getenv("VECBACKUP_HTTP_PASSWORD"))
+	if *retries < 0 || *retryBackoff < 0 || *retryJitter < 0 || *retryJitter > 1 {
+		exitIfError(errors.New("Invalid -retries, -retry-backoff or -retry-jitter flag."))
+	}
+	vecbackup.SetRetry(*retries, *retryBackoff, *retryJitter)
+	exitIfError(vecbackup.SetThrottle(*limitUpload, *limitDownload, *limitOps, *limitFile))
+	vecbackup.SetReadOnly(*readOnly)
+	vecbackup.SetBreakStaleLock(*breakStaleLock)
+	pwSrc, err := vecbackup.NewPwSource(*pwFile, *pwEnv, *pwCommand, *pwPrompt, *keyFile)
+	exitIfError(err)
+	if *newPwFile != "" && *newKeyFile != "" {
+		exitIfError(errors.New("Only one of -new-pw and -new-key-file can be given."))
+	}
+	newPwSrc, _ := vecbackup.NewPwSource(*newPwFile, "", "", false, *newKeyFile)
+	if *noCache {
+		vecbackup.SetCacheDir("")
+	} else if *cacheDir != "" {
+		vecbackup.SetCacheDir(*cacheDir)
+	} else if d, err := os.UserCacheDir(); err == nil {
+		vecbackup.SetCacheDir(filepath.Join(d, "vecbackup"))
+	}
+	vecbackup.SetRefreshCache(*refreshCache)
 	if cmd == "help" {
 		help()
 	} else if cmd == "backup" {
@@ -203,7 +630,7 @@ func main() {
 		if *maxDop < 1 || *maxDop > 100 {
 			exitIfError(errors.New("-max-dop must be between 1 and 100.\n"))
 		}
-		exitIfError(vecbackup.Backup(*pwFile, *repo, *excludeFrom, *version, *dryRun, *force, *checkChunks, *verbose, *lockFile, *maxDop, flag.Args(), &stats))
+		exitIfError(vecbackup.Backup(pwSrc, *repo, *excludeFrom, *version, *dryRun, *force, *checkChunks, *verbose, *lockFile, mirrors, *maxDop, flag.Args(), &stats))
 		if *dryRun {
 			fmt.Printf("Backup dry run\n%d dir(s) (%d new %d updated %d removed)\n%d file(s) (%d new %d updated %d removed)\n%d symlink(s) (%d new %d updated %d removed)\ntotal src size %d\n%d error(s).\n", stats.Dirs, stats.DirsNew, stats.DirsUpdated, stats.DirsRemoved, stats.Files, stats.FilesNew, stats.FilesUpdated, stats.FilesRemoved, stats.Symlinks, stats.SymlinksNew, stats.SymlinksUpdated, stats.SymlinksRemoved, stats.Size, stats.Errors)
 		} else {
@@ -213,57 +640,168 @@ func main() {
 			}
 			fmt.Printf("Backup version %s\n%d dir(s) (%d new %d updated %d removed)\n%d file(s) (%d new %d updated %d removed)\n%d symlink(s) (%d new %d updated %d removed)\ntotal src size %d, new src size %d, repo added %d (%0.1f%% of new src size)\n%d error(s).\n", stats.Version, stats.Dirs, stats.DirsNew, stats.DirsUpdated, stats.DirsRemoved, stats.Files, stats.FilesNew, stats.FilesUpdated, stats.FilesRemoved, stats.Symlinks, stats.SymlinksNew, stats.SymlinksUpdated, stats.SymlinksRemoved, stats.Size, stats.SrcAdded, stats.RepoAdded, newRepoPct, stats.Errors)
 		}
+		if len(stats.Retries) > 0 {
+			fmt.Printf("Retried storage operations: %s\n", stats.Retries)
+		}
+		failed := 0
+		for _, m := range stats.Mirrors {
+			if m.Err != nil {
+				fmt.Printf("Mirror %s failed, repo added %d: %s\n", m.Repo, m.RepoAdded, m.Err)
+				failed++
+			} else {
+				fmt.Printf("Mirror %s, repo added %d\n", m.Repo, m.RepoAdded)
+			}
+		}
 		if stats.Errors > 0 {
 			exitIfError(errors.New(fmt.Sprintf("%d errors encountered. Some data were not backed up.", stats.Errors)))
 		}
+		if failed > 0 {
+			exitIfError(errors.New(fmt.Sprintf("%d mirror(s) failed. The next backup with them copies the versions they miss.", failed)))
+		}
 	} else if cmd == "restore" {
 		if *maxDop < 1 || *maxDop > 100 {
 			exitIfError(errors.New("-max-dop must be between 1 and 100.\n"))
 		}
-		exitIfError(vecbackup.Restore(*pwFile, *repo, *target, *version, *merge, *verifyOnly, *dryRun, *verbose, *maxDop, flag.Args()))
+		exitIfError(vecbackup.Restore(pwSrc, *repo, *target, *version, *merge, *verifyOnly, *dryRun, *verbose, *maxDop, flag.Args()))
 	} else if flag.NArg() > 0 {
 		usageAndExit()
 	} else if cmd == "init" {
-		if *chunkSize > math.MaxInt32 {
+		if *chunkSize > math.MaxInt32 || *minChunkSize > math.MaxInt32 || *maxChunkSize > math.MaxInt32 {
 			exitIfError(errors.New("Chunk size is too big."))
 		}
-		if *iterations < 100000 {
-			exitIfError(errors.New(fmt.Sprintf("Too few PBKDF2 iterations, minimum 100,000: %d", *iterations)))
+		if *packSize > math.MaxInt32 {
+			exitIfError(errors.New("Pack size is too big."))
+		}
+		kdf := parseKdf()
+		mode := parseCompressMode(*compress, "-compress")
+		ctype, level := parseCompressType()
+		cfg := &vecbackup.Config{ChunkSize: int32(*chunkSize), Compress: mode, MinChunkSize: int32(*minChunkSize), MaxChunkSize: int32(*maxChunkSize), PackSize: int32(*packSize), CompressionType: ctype, CompressionLevel: level}
+		if *chunking == "fixed" {
+			cfg.Chunking = vecbackup.ChunkingMode_FIXED
+		} else if *chunking == "cdc" {
+			cfg.Chunking = vecbackup.ChunkingMode_CDC
+		} else {
+			exitIfError(errors.New("Invalid -chunking flag."))
 		}
-		var mode vecbackup.CompressionMode = vecbackup.CompressionMode_AUTO
-		if *compress == "auto" {
-			mode = vecbackup.CompressionMode_AUTO
-		} else if *compress == "slow" {
-			mode = vecbackup.CompressionMode_SLOW
-		} else if *compress == "yes" {
-			mode = vecbackup.CompressionMode_YES
-		} else if *compress == "no" {
-			mode = vecbackup.CompressionMode_NO
+		if *padding == "no" {
+			cfg.Padding = vecbackup.PaddingMode_NO_PADDING
+		} else if *padding == "pow2" {
+			cfg.Padding = vecbackup.PaddingMode_POWER_OF_TWO
+		} else if *padding == "padme" {
+			cfg.Padding = vecbackup.PaddingMode_PADME
 		} else {
-			exitIfError(errors.New("Invalid -compress flag."))
+			exitIfError(errors.New("Invalid -padding flag."))
 		}
-		exitIfError(vecbackup.InitRepo(*pwFile, *repo, int32(*chunkSize), *iterations, mode))
+		exitIfError(vecbackup.InitRepo(pwSrc, *repo, kdf, *asymmetric, cfg))
 	} else if cmd == "ls" {
-		exitIfError(vecbackup.Ls(*pwFile, *repo, *version))
+		exitIfError(vecbackup.Ls(pwSrc, *repo, *version))
 	} else if cmd == "versions" {
-		exitIfError(vecbackup.Versions(*pwFile, *repo))
+		exitIfError(vecbackup.Versions(pwSrc, *repo))
 	} else if cmd == "delete-version" {
-		exitIfError(vecbackup.DeleteVersion(*pwFile, *repo, *version))
+		exitIfError(vecbackup.DeleteVersion(pwSrc, *repo, *version))
 	} else if cmd == "delete-old-versions" {
-		exitIfError(vecbackup.DeleteOldVersions(*pwFile, *repo, *dryRun))
+		exitIfError(vecbackup.DeleteOldVersions(pwSrc, *repo, *dryRun))
 	} else if cmd == "verify-repo" {
 		var r vecbackup.VerifyRepoResults
 		if *maxDop < 1 || *maxDop > 100 {
 			exitIfError(errors.New("-max-dop must be between 1 and 100.\n"))
 		}
-		exitIfError(vecbackup.VerifyRepo(*pwFile, *repo, *quick, *maxDop, &r))
+		exitIfError(vecbackup.VerifyRepo(pwSrc, *repo, *quick, *maxDop, &r))
+	} else if cmd == "recompress" {
+		if *maxDop < 1 || *maxDop > 100 {
+			exitIfError(errors.New("-max-dop must be between 1 and 100.\n"))
+		}
+		mode := parseCompressMode(*to, "-to")
+		ctype, level := parseCompressType()
+		var st vecbackup.RecompressStats
+		err := vecbackup.Recompress(pwSrc, *repo, mode, ctype, level, *dryRun, *verbose, *maxDop, &st)
+		if *dryRun {
+			fmt.Printf("Chunks to be recompressed (dryrun): %d out of %d. Size %d -> %d, %d bytes saved.\n", st.Recompressed, st.Chunks, st.OldSize, st.NewSize, st.OldSize-st.NewSize)
+		} else {
+			fmt.Printf("Chunks recompressed: %d out of %d. Size %d -> %d, %d bytes saved.\n", st.Recompressed, st.Chunks, st.OldSize, st.NewSize, st.OldSize-st.NewSize)
+		}
+		exitIfError(err)
+	} else if cmd == "rotate-key" {
+		if *maxDop < 1 || *maxDop > 100 {
+			exitIfError(errors.New("-max-dop must be between 1 and 100.\n"))
+		}
+		var st vecbackup.RotateKeyStats
+		err := vecbackup.RotateKey(pwSrc, newPwSrc, *repo, *lockFile, *removeOtherKeys, *verbose, *maxDop, &st)
+		fmt.Printf("Rotated %d chunk(s) and %d version(s).\n", st.Chunks, st.Versions)
+		exitIfError(err)
+	} else if cmd == "copy" {
+		if *maxDop < 1 || *maxDop > 100 {
+			exitIfError(errors.New("-max-dop must be between 1 and 100.\n"))
+		}
+		toPwSrc := newPwSrc
+		if toPwSrc == nil {
+			toPwSrc = pwSrc
+		}
+		var st vecbackup.CopyStats
+		err := vecbackup.Copy(pwSrc, toPwSrc, *repo, *to, *version, *lockFile, *verbose, *maxDop, &st)
+		fmt.Printf("Copied %d version(s) and %d chunk(s), %d bytes.\n", st.Versions, st.Chunks, st.Size)
+		exitIfError(err)
+	} else if cmd == "upgrade-kdf" {
+		exitIfError(vecbackup.UpgradeKdf(pwSrc, *repo, parseKdf()))
+	} else if cmd == "change-password" {
+		var kdf *vecbackup.KdfParams
+		if kdfFlagsSet() {
+			kdf = parseKdf()
+		}
+		exitIfError(vecbackup.ChangePassword(pwSrc, newPwSrc, *repo, kdf))
+	} else if cmd == "key add" {
+		exitIfError(vecbackup.AddKey(pwSrc, newPwSrc, *repo, *label, parseKdf(), *writeOnly))
+	} else if cmd == "key list" {
+		slots, err := vecbackup.ListKeys(*repo)
+		exitIfError(err)
+		for _, s := range slots {
+			wo := ""
+			if s.WriteOnly {
+				wo = " write-only"
+			}
+			if s.Kdf.Type == vecbackup.KdfType_RAW_KEY {
+				fmt.Printf("%-20s raw key%s\n", s.Label, wo)
+			} else if s.Kdf.Type == vecbackup.KdfType_ARGON2ID {
+				fmt.Printf("%-20s argon2id memory=%dMiB time=%d threads=%d%s\n", s.Label, s.Kdf.Memory/1024, s.Kdf.Time, s.Kdf.Threads, wo)
+			} else {
+				fmt.Printf("%-20s pbkdf2 iterations=%d%s\n", s.Label, s.Kdf.Iterations, wo)
+			}
+		}
+	} else if cmd == "key remove" {
+		exitIfError(vecbackup.RemoveKey(pwSrc, *repo, *label))
+	} else if cmd == "key export" {
+		text, qr, err := vecbackup.ExportKey(pwSrc, *repo)
+		exitIfError(err)
+		fmt.Printf("# vecbackup keys for %s\n# Anyone with these keys can read the repository.\n%s\n# QR form:\n%s\n", *repo, text, qr)
+	} else if cmd == "key import" {
+		exitIfError(vecbackup.ImportKey(newPwSrc, *repo, parseKdf(), *in, *force))
 	} else if cmd == "purge-unused" {
-		exitIfError(vecbackup.PurgeUnused(*pwFile, *repo, *dryRun, *verbose))
+		if *gracePeriod < 0 {
+			exitIfError(errors.New("Invalid -grace-period flag."))
+		}
+		exitIfError(vecbackup.PurgeUnused(pwSrc, *repo, *dryRun, *verbose, *gracePeriod))
+	} else if cmd == "set-mode" {
+		var m vecbackup.RepoMode
+		if *repoMode == "read-write" {
+			m = vecbackup.RepoMode_READ_WRITE
+		} else if *repoMode == "append-only" {
+			m = vecbackup.RepoMode_APPEND_ONLY
+		} else if *repoMode == "read-only" {
+			m = vecbackup.RepoMode_READ_ONLY
+		} else {
+			exitIfError(errors.New("Invalid -mode flag."))
+		}
+		exitIfError(vecbackup.SetMode(pwSrc, *repo, m))
 	} else if cmd == "remove-lock" {
 		if *repo == "" && *lockFile == "" {
 			exitIfError(errors.New("Either -r or -lock-file must be specified."))
 		}
-		exitIfError(vecbackup.RemoveLock(*repo, *lockFile))
+		exitIfError(vecbackup.RemoveLock(*repo, *lockFile, *force))
+	} else if cmd == "serve" {
+		if os.Getenv("VECBACKUP_HTTP_PASSWORD") == "" {
+			exitIfError(errors.New("VECBACKUP_HTTP_PASSWORD must be set to the password of the clients."))
+		}
+		exitIfError(vecbackup.Serve(*repo, *listen, *tlsCert, *tlsKey, *appendOnly, *verbose))
 	} else {
 		usageAndExit()
 	}
@@ -3,6 +3,8 @@ module github.com/ptsim/vecbackup
 go 1.13
 
 require (
+	github.com/klauspost/compress v1.11.4
+	github.com/pkg/sftp v1.11.0
 	golang.org/x/crypto v0.0.0-20200429183012-4b2356b1ed79
 	google.golang.org/protobuf v1.25.0
 )
@@ -0,0 +1,260 @@
+package vecbackup
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"crypto/sha512"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// The chunk cache is a local file listing the chunks known to be in a repo
+// so that a backup does not have to check the existence of every chunk in
+// the repo. It is kept in <cache dir>/<repo id>/chunks. The file starts
+// with a header followed by records of one op byte ('+' or '-') and a FP.
+// New records are appended when chunks are added or deleted.
+//
+// The cache only ever claims that chunks exist. Chunks not in the cache
+// are still looked up in the repo. To notice chunks deleted by other
+// machines, the repo has a stamp file that is rewritten with a random
+// value whenever chunks are deleted. The cache is rebuilt from a listing
+// of the repo if the stamp has changed or the cache is older than
+// CACHE_MAX_AGE.
+
+const (
+	CACHE_MAGIC       = "VBCC"
+	CACHE_VERSION     = 1
+	CACHE_FILE        = "chunks"
+	CACHE_MAX_AGE     = 24 * time.Hour
+	CHUNKS_STAMP_FILE = "chunks-stamp"
+	CACHE_OP_ADD      = '+'
+	CACHE_OP_DELETE   = '-'
+)
+
+const cacheRecordSize = 1 + len(FP{})
+
+var cacheDir string
+var refreshCache bool
+
+// SetCacheDir sets the dir for local caches. The cache is disabled if it is empty.
+func SetCacheDir(d string) {
+	cacheDir = d
+}
+
+// SetRefreshCache forces the chunk cache to be rebuilt when it is loaded.
+func SetRefreshCache(r bool) {
+	refreshCache = r
+}
+
+// repoID returns an ID of the repo that is the same for all the ways to
+// refer to a local repo. It does not show where the repo is without the
+// secret.
+func repoID(repo string, secret []byte) string {
+	sm, p := getStorageMgr(repo)
+	prefix := repo[:len(repo)-len(p)]
+	if _, ok := sm.(localSMgr); ok {
+		if abs, err := filepath.Abs(p); err == nil {
+			p = abs
+		}
+	}
+	h := sha512.New512_256()
+	h.Write([]byte(prefix + p))
+	h.Write([]byte{0})
+	h.Write(secret)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// repoCacheDir returns the dir for the local caches of the repo or "" if
+// caches are disabled.
+func repoCacheDir(repo string, secret []byte) string {
+	if cacheDir == "" {
+		return ""
+	}
+	return filepath.Join(cacheDir, repoID(repo, secret))
+}
+
+// chunkCachePath returns the path of the chunk cache file for the repo
+// or "" if the cache is disabled.
+func chunkCachePath(repo string, secret []byte) string {
+	d := repoCacheDir(repo, secret)
+	if d == "" {
+		return ""
+	}
+	return filepath.Join(d, CACHE_FILE)
+}
+
+func readChunksStamp(sm StorageMgr, repo string) (string, error) {
+	b, err := sm.ReadFile(sm.JoinPath(repo, CHUNKS_STAMP_FILE), &bytes.Buffer{}, &bytes.Buffer{})
+	if os.IsNotExist(err) {
+		return "", nil
+	}
+	return string(b), err
+}
+
+func writeChunksStamp(sm StorageMgr, repo string) error {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return err
+	}
+	return sm.WriteFile(sm.JoinPath(repo, CHUNKS_STAMP_FILE), []byte(hex.EncodeToString(b[:])))
+}
+
+func encodeCacheHeader(stamp string, t time.Time) []byte {
+	var buf bytes.Buffer
+	buf.WriteString(CACHE_MAGIC)
+	buf.WriteByte(CACHE_VERSION)
+	var x [10]byte
+	binary.BigEndian.PutUint64(x[:8], uint64(t.UnixNano()))
+	binary.BigEndian.PutUint16(x[8:], uint16(len(stamp)))
+	buf.Write(x[:])
+	buf.WriteString(stamp)
+	return buf.Bytes()
+}
+
+// readChunkCache reads the cache file. It returns the chunks in the cache,
+// the stamp and time it was built and the length of the valid part of the file.
+func readChunkCache(p string) (map[FP]bool, string, time.Time, int64, error) {
+	b, err := ioutil.ReadFile(p)
+	if err != nil {
+		return nil, "", time.Time{}, 0, err
+	}
+	hl := len(CACHE_MAGIC) + 11
+	if len(b) < hl || string(b[:len(CACHE_MAGIC)]) != CACHE_MAGIC || b[len(CACHE_MAGIC)] != CACHE_VERSION {
+		return nil, "", time.Time{}, 0, errors.New("Invalid chunk cache")
+	}
+	t := time.Unix(0, int64(binary.BigEndian.Uint64(b[len(CACHE_MAGIC)+1:])))
+	sl := int(binary.BigEndian.Uint16(b[hl-2:]))
+	if len(b) < hl+sl {
+		return nil, "", time.Time{}, 0, errors.New("Invalid chunk cache")
+	}
+	stamp := string(b[hl : hl+sl])
+	m := make(map[FP]bool)
+	n := hl + sl
+	// A partial record at the end is left by an interrupted write and is ignored.
+	for ; n+cacheRecordSize <= len(b); n += cacheRecordSize {
+		var fp FP
+		copy(fp[:], b[n+1:n+cacheRecordSize])
+		if b[n] == CACHE_OP_ADD {
+			m[fp] = true
+		} else if b[n] == CACHE_OP_DELETE {
+			delete(m, fp)
+		} else {
+			return nil, "", time.Time{}, 0, errors.New("Invalid chunk cache record")
+		}
+	}
+	return m, stamp, t, int64(n), nil
+}
+
+// writeChunkCache replaces the cache file with the given chunks.
+func writeChunkCache(p, stamp string, t time.Time, chunks map[FP]bool) error {
+	if err := os.MkdirAll(filepath.Dir(p), 0700); err != nil {
+		return err
+	}
+	tp := p + ".tmp"
+	f, err := os.OpenFile(tp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	w.Write(encodeCacheHeader(stamp, t))
+	for fp := range chunks {
+		w.WriteByte(CACHE_OP_ADD)
+		w.Write(fp[:])
+	}
+	err = w.Flush()
+	if err2 := f.Close(); err == nil {
+		err = err2
+	}
+	if err != nil {
+		os.Remove(tp)
+		return err
+	}
+	return os.Rename(tp, p)
+}
+
+// LoadCache loads the chunk cache so that FindChunk does not need to
+// check the repo for the chunks in it. The cache is rebuilt from a listing
+// of the repo if it is missing or out of date. Chunks added or deleted
+// afterwards are recorded in the cache. Errors are not fatal, the cache
+// is just not used.
+func (cm *CMgr) LoadCache() error {
+	if cm.cachePath == "" || cm.packSize > 0 {
+		return nil
+	}
+	stamp, err := readChunksStamp(cm.sm, cm.repo)
+	if err != nil {
+		return err
+	}
+	chunks, cstamp, t, n, err := readChunkCache(cm.cachePath)
+	now := time.Now()
+	if err != nil || refreshCache || cstamp != stamp || now.Sub(t) > CACHE_MAX_AGE || t.After(now) {
+		debugP("Rebuilding chunk cache %s\n", cm.cachePath)
+		if chunks, err = cm.listChunks(); err != nil {
+			return err
+		}
+		if err = writeChunkCache(cm.cachePath, stamp, now, chunks); err != nil {
+			return err
+		}
+	} else {
+		debugP("Loaded %d chunk(s) from chunk cache %s\n", len(chunks), cm.cachePath)
+		if err = os.Truncate(cm.cachePath, n); err != nil {
+			return err
+		}
+	}
+	f, err := os.OpenFile(cm.cachePath, os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+	for fp := range chunks {
+		cm.memoize[fp] = true
+	}
+	cm.cacheFile = f
+	return nil
+}
+
+// CloseCache stops recording added and deleted chunks in the cache.
+func (cm *CMgr) CloseCache() {
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+	if cm.cacheFile != nil {
+		cm.cacheFile.Close()
+		cm.cacheFile = nil
+	}
+}
+
+// InvalidateCache removes the chunk cache so that it is rebuilt next time.
+func (cm *CMgr) InvalidateCache() error {
+	cm.CloseCache()
+	if cm.cachePath == "" {
+		return nil
+	}
+	if err := os.Remove(cm.cachePath); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// cacheRecord must be called with cm.mu held.
+func (cm *CMgr) cacheRecord(op byte, fp FP) {
+	if cm.cacheFile == nil {
+		return
+	}
+	var r [cacheRecordSize]byte
+	r[0] = op
+	copy(r[1:], fp[:])
+	if _, err := cm.cacheFile.Write(r[:]); err != nil {
+		// The cache would no longer be complete. Remove it so that it is rebuilt.
+		debugP("Cannot write chunk cache %s: %s\n", cm.cachePath, err)
+		cm.cacheFile.Close()
+		cm.cacheFile = nil
+		os.Remove(cm.cachePath)
+	}
+}
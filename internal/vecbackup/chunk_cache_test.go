@@ -0,0 +1,135 @@
+package vecbackup
+
+import (
+	"crypto/sha512"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestChunkCache(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "chunk_cache_test-*")
+	if err != nil {
+		t.Fatal("Cannot get tempdir", err)
+	}
+	defer removeAll(t, tmpDir)
+	defer SetCacheDir("")
+	SetCacheDir(filepath.Join(tmpDir, "cache"))
+	repo := filepath.Join(tmpDir, "repo")
+	sm, repo2 := GetStorageMgr(repo)
+	cfg := &Config{Compress: CompressionMode_NO}
+	newCM := func() *CMgr {
+		cm := MakeCMgr(sm, repo2, cfg)
+		cm.cachePath = chunkCachePath(repo, nil)
+		return cm
+	}
+	mem := makeAddChunkMem(100)
+	rand.Seed(7)
+	addChunks := func(cm *CMgr, n int) []FP {
+		var fps []FP
+		for i := 0; i < n; i++ {
+			rand.Read(mem.buf())
+			var fp FP = sha512.Sum512_256(mem.buf())
+			if _, _, err := cm.AddChunk(fp, mem); err != nil {
+				t.Fatalf("AddChunk failed: %s %s", fp, err)
+			}
+			fps = append(fps, fp)
+		}
+		return fps
+	}
+	cm := newCM()
+	fps := addChunks(cm, 10)
+	if err := cm.LoadCache(); err != nil {
+		t.Fatalf("LoadCache failed: %s", err)
+	}
+	fps = append(fps, addChunks(cm, 10)...)
+	if err := cm.DeleteChunk(fps[0]); err != nil {
+		t.Fatalf("DeleteChunk failed: %s", err)
+	}
+	cm.CloseCache()
+	chunks, _, _, _, err := readChunkCache(cm.cachePath)
+	if err != nil {
+		t.Fatalf("Cannot read chunk cache: %s", err)
+	}
+	if len(chunks) != len(fps)-1 || chunks[fps[0]] {
+		t.Fatalf("Expected %d chunks in cache, got %d", len(fps)-1, len(chunks))
+	}
+
+	// A chunk deleted behind the back of the cache is still believed to exist.
+	name := FPtoName(fps[1])
+	if err := os.Remove(filepath.Join(repo, CHUNK_DIR, name[:DIR_PREFIX_SIZE], name)); err != nil {
+		t.Fatal(err)
+	}
+	// Partial records are ignored.
+	f, err := os.OpenFile(cm.cachePath, os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Write([]byte{CACHE_OP_ADD, 1, 2, 3})
+	f.Close()
+	cm = newCM()
+	if err := cm.LoadCache(); err != nil {
+		t.Fatalf("LoadCache failed: %s", err)
+	}
+	cm.mu.Lock()
+	n := len(cm.memoize)
+	cm.mu.Unlock()
+	if n != len(fps)-1 || !cm.FindChunk(fps[1]) || cm.FindChunk(fps[0]) {
+		t.Fatalf("Cache not loaded: %d chunks", n)
+	}
+	addChunks(cm, 1)
+	cm.CloseCache()
+	if chunks, _, _, _, err = readChunkCache(cm.cachePath); err != nil || len(chunks) != len(fps) {
+		t.Fatalf("Cache not appended after partial record: %d chunks, %v", len(chunks), err)
+	}
+
+	// A new stamp causes the cache to be rebuilt.
+	if err := writeChunksStamp(sm, repo2); err != nil {
+		t.Fatal(err)
+	}
+	cm = newCM()
+	if err := cm.LoadCache(); err != nil {
+		t.Fatalf("LoadCache failed: %s", err)
+	}
+	cm.CloseCache()
+	if cm.FindChunk(fps[1]) || !cm.FindChunk(fps[2]) {
+		t.Fatal("Cache not rebuilt after stamp changed")
+	}
+	if chunks, _, _, _, err = readChunkCache(cm.cachePath); err != nil || len(chunks) != len(fps)-1 {
+		t.Fatalf("Rebuilt cache has %d chunks, %v", len(chunks), err)
+	}
+
+	if err := cm.InvalidateCache(); err != nil {
+		t.Fatalf("InvalidateCache failed: %s", err)
+	}
+	if _, err := os.Stat(cm.cachePath); !os.IsNotExist(err) {
+		t.Fatal("Cache not removed")
+	}
+}
+
+func TestChunkCachePath(t *testing.T) {
+	defer SetCacheDir("")
+	SetCacheDir("")
+	if p := chunkCachePath("/a/b", nil); p != "" {
+		t.Errorf("Cache should be disabled: %s", p)
+	}
+	SetCacheDir("/cache")
+	p1 := chunkCachePath("/a/b", nil)
+	p2 := chunkCachePath("/a/b", []byte("secret"))
+	p3 := chunkCachePath("rclone:/a/b", nil)
+	if p1 == p2 || p1 == p3 || p2 == p3 {
+		t.Errorf("Cache paths should be different: %s %s %s", p1, p2, p3)
+	}
+	if filepath.Dir(filepath.Dir(p1)) != filepath.Clean("/cache") {
+		t.Errorf("Cache path not in cache dir: %s", p1)
+	}
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p4, p5 := chunkCachePath("b", nil), chunkCachePath(filepath.Join(wd, "b"), nil); p4 != p5 {
+		t.Errorf("Relative and absolute repo paths should have the same cache: %s %s", p4, p5)
+	}
+}
@@ -6,18 +6,40 @@ import (
 	"encoding/hex"
 	"errors"
 	"fmt"
+	"github.com/klauspost/compress/zstd"
+	"os"
 	"sync"
 )
 
 type CMgr struct {
-	sm       StorageMgr
-	dir      string
-	key      *EncKey
-	compress CompressionMode
-	memoize  map[FP]bool
-	pending  map[FP]bool
-	mu       sync.Mutex
-	cond     *sync.Cond
+	sm        StorageMgr
+	repo      string
+	dir       string
+	packDir   string
+	indexDir  string
+	key       *storageKey
+	indexKey  *EncKey
+	compress  CompressionMode
+	compType  CompressionType
+	compLevel int
+	packSize  int
+	memoize   map[FP]bool
+	pending   map[FP]bool
+	index     map[FP]packLoc
+	packs     map[string][]*PackEntryProto
+	curPack   *packBuf
+	packErr   error
+	indexOnce sync.Once
+	indexErr  error
+	cachePath string
+	cacheFile *os.File
+	mixedKeys bool // Skips pack indexes of the other key during rotate-key.
+	newLevel  bool // Recompresses the chunks of the current type, see Recompress.
+	mirrors   []*mirror
+	deletion  map[FP]int64 // The pending deletion list, see LoadPendingDeletion.
+	kept      map[FP]int64 // The chunks of the list used by the backup.
+	mu        sync.Mutex
+	cond      *sync.Cond
 }
 
 const DIR_PREFIX_SIZE = 2
@@ -36,21 +58,35 @@ func nameToFP(name string) (FP, error) {
 	return fp, nil
 }
 
-func MakeCMgr(sm StorageMgr, repo string, key *EncKey, compress CompressionMode) *CMgr {
-	cm := &CMgr{sm: sm, dir: sm.JoinPath(repo, CHUNK_DIR), key: key, compress: compress}
+func MakeCMgr(sm StorageMgr, repo string, cfg *Config) *CMgr {
+	cm := &CMgr{sm: sm, repo: repo, dir: sm.JoinPath(repo, CHUNK_DIR), key: makeStorageKey(cfg), indexKey: makeIndexKey(cfg), compress: cfg.Compress, compType: cfg.CompressionType, compLevel: int(cfg.CompressionLevel), packSize: int(cfg.PackSize)}
 	cm.cond = sync.NewCond(&cm.mu)
 	cm.pending = make(map[FP]bool)
 	cm.memoize = make(map[FP]bool)
+	if cm.packSize > 0 {
+		cm.packDir = sm.JoinPath(repo, PACK_DIR)
+		cm.indexDir = sm.JoinPath(repo, INDEX_DIR)
+		cm.index = make(map[FP]packLoc)
+		cm.packs = make(map[string][]*PackEntryProto)
+	}
 	return cm
 }
 
 func (cm *CMgr) FindChunk(fp FP) bool {
+	if cm.packSize > 0 {
+		if cm.loadIndex() != nil {
+			return false
+		}
+	}
 	cm.mu.Lock()
 	exist, ok := cm.memoize[fp]
 	cm.mu.Unlock() // race condition. For common case performance. Doesn't affect correctness.
 	if ok {
 		return exist
 	}
+	if cm.packSize > 0 {
+		return false
+	}
 	name := FPtoName(fp)
 	f := cm.sm.JoinPath(cm.sm.JoinPath(cm.dir, name[:DIR_PREFIX_SIZE]), name)
 	if exist, err := cm.sm.FileExists(f); err == nil && exist {
@@ -72,16 +108,24 @@ type readChunkMem struct {
 	encBuf  []byte       // for decryption
 }
 
-func (cm *CMgr) ReadChunk(fp FP, mem *readChunkMem) ([]byte, error) {
+// readStored reads a chunk as it is stored in the repo.
+func (cm *CMgr) readStored(fp FP, mem *readChunkMem) ([]byte, error) {
+	if cm.packSize > 0 {
+		return cm.readPackedChunk(fp, mem)
+	}
 	name := FPtoName(fp)
 	f := cm.sm.JoinPath(cm.sm.JoinPath(cm.dir, name[:DIR_PREFIX_SIZE]), name)
-	ciphertext, err := cm.sm.ReadFile(f, &mem.readBuf, &mem.errBuf)
+	return cm.sm.ReadFile(f, &mem.readBuf, &mem.errBuf)
+}
+
+func (cm *CMgr) ReadChunk(fp FP, mem *readChunkMem) ([]byte, error) {
+	ciphertext, err := cm.readStored(fp, mem)
 	if err != nil {
 		return nil, err
 	}
 	var text []byte
 	if cm.key != nil {
-		text, err = decryptBytes(cm.key, ciphertext, mem.encBuf)
+		text, err = cm.key.decrypt(ciphertext, mem.encBuf)
 		if err != nil {
 			return nil, err
 		}
@@ -119,20 +163,50 @@ func (mem *addChunkMem) bufWithPrefix() []byte {
 	return mem.prefixAndBuf[:1+mem.size]
 }
 
+// discard drops the first n of the avail bytes in the buffer and moves
+// the rest to the front.
+func (mem *addChunkMem) discard(n, avail int) {
+	copy(mem.prefixAndBuf[1:], mem.prefixAndBuf[1+n:1+avail])
+}
+
 func (mem *addChunkMem) setPrefix(p byte) {
 	mem.prefixAndBuf[0] = p
 }
 
+// AddChunk stores the chunk in the repo and its mirrors if they do not
+// have it. It returns whether the repo already had it and the number of
+// bytes written to the repo.
 func (cm *CMgr) AddChunk(fp FP, mem *addChunkMem) (bool, int, error) {
+	exist, ciphertext, err := cm.addChunk(fp, mem, nil)
+	if err != nil {
+		return false, 0, err
+	}
+	if exist {
+		if err := cm.keepChunk(fp); err != nil {
+			return false, 0, err
+		}
+	}
+	n := len(ciphertext)
+	for _, m := range cm.mirrors {
+		ciphertext = m.addChunk(fp, mem, ciphertext)
+	}
+	return exist, n, nil
+}
+
+// addChunk stores the chunk if the repo does not have it. The chunk is
+// encoded from mem unless the encoded chunk is given. It returns whether
+// the repo already had it and the encoded chunk, which is the given one
+// if it already had it.
+func (cm *CMgr) addChunk(fp FP, mem *addChunkMem, ciphertext []byte) (bool, []byte, error) {
 	if cm.FindChunk(fp) { // race condition. For common case performance. Doesn't affect correctness.
-		return true, 0, nil
+		return true, ciphertext, nil
 	}
 	cm.mu.Lock()
 	for {
 		exist, ok := cm.memoize[fp]
 		if ok && exist {
 			cm.mu.Unlock()
-			return true, 0, nil
+			return true, ciphertext, nil
 		}
 		_, isPending := cm.pending[fp]
 		if isPending {
@@ -143,59 +217,177 @@ func (cm *CMgr) AddChunk(fp FP, mem *addChunkMem) (bool, int, error) {
 		}
 	}
 	cm.mu.Unlock()
-	var ciphertext []byte
 	var err error
-	ciphertext, err = compressChunk(mem, cm.compress)
+	if ciphertext == nil {
+		ciphertext, err = cm.encodeAndStore(fp, mem)
+	} else {
+		err = cm.storeChunk(fp, ciphertext)
+	}
+	cm.mu.Lock()
+	if err == nil {
+		cm.memoize[fp] = true
+		if cm.packSize == 0 {
+			cm.cacheRecord(CACHE_OP_ADD, fp)
+		}
+	}
+	delete(cm.pending, fp)
+	cm.cond.Broadcast()
+	cm.mu.Unlock()
 	if err != nil {
-		return false, 0, err
+		return false, nil, err
+	}
+	return false, ciphertext, nil
+}
+
+func (cm *CMgr) encodeAndStore(fp FP, mem *addChunkMem) ([]byte, error) {
+	ciphertext, err := compressChunk(mem, cm.compress, cm.compType, cm.compLevel)
+	if err != nil {
+		return nil, err
 	}
 	if cm.key != nil {
-		ciphertext, err = encryptBytes(cm.key, ciphertext, mem.encBuf)
+		ciphertext, err = cm.key.encrypt(ciphertext, mem.encBuf)
 		if err != nil {
-			return false, 0, err
+			return nil, err
 		}
+		mem.encBuf = ciphertext
+	}
+	return ciphertext, cm.storeChunk(fp, ciphertext)
+}
+
+// storeChunk writes an encoded chunk to the repo.
+func (cm *CMgr) storeChunk(fp FP, ciphertext []byte) error {
+	if cm.packSize > 0 {
+		return cm.addToPack(fp, ciphertext)
 	}
-	mem.encBuf = ciphertext
 	name := FPtoName(fp)
 	dir := cm.sm.JoinPath(cm.dir, name[:DIR_PREFIX_SIZE])
-	f := cm.sm.JoinPath(dir, name)
-	if err = cm.sm.MkdirAll(dir); err != nil {
-		return false, 0, err
-	}
-	err = cm.sm.WriteFile(f, ciphertext)
-	if err != nil {
-		return false, 0, err
+	if err := cm.sm.MkdirAll(dir); err != nil {
+		return err
 	}
-	compressedLen := len(ciphertext)
-	cm.mu.Lock()
-	cm.memoize[fp] = true
-	delete(cm.pending, fp)
-	cm.cond.Broadcast()
-	cm.mu.Unlock()
-	return false, compressedLen, nil
+	return cm.sm.WriteFile(cm.sm.JoinPath(dir, name), ciphertext)
 }
 
 func (cm *CMgr) DeleteChunk(fp FP) error {
+	if cm.packSize > 0 {
+		return errors.New("Cannot delete a chunk from a pack")
+	}
 	name := FPtoName(fp)
 	p := cm.sm.JoinPath(cm.sm.JoinPath(cm.dir, name[:DIR_PREFIX_SIZE]), name)
 	err := cm.sm.DeleteFile(p)
 	if err == nil {
 		cm.mu.Lock()
 		cm.memoize[fp] = false
+		cm.cacheRecord(CACHE_OP_DELETE, fp)
 		cm.mu.Unlock()
 	}
 	return err
 }
 
-func (cm *CMgr) CacheChunkInfo() {
-	if cm.sm.IsDirFast() {
-		cm.GetAllChunks()
+// needsRecode returns whether a chunk stored with the given compression
+// prefix may change when it is compressed with the current settings. The
+// level is not stored, so chunks of the current type only change if the
+// level changes.
+func (cm *CMgr) needsRecode(prefix byte) bool {
+	if cm.compress == CompressionMode_NO {
+		return prefix != byte(CompressionType_NO_COMPRESSION)
+	}
+	t := cm.compType
+	if t != CompressionType_ZSTD {
+		t = CompressionType_ZLIB
 	}
+	return prefix != byte(t) || cm.newLevel
+}
+
+// recodeChunk decodes a stored chunk and encodes it again with the current
+// compression settings. It returns nil if the chunk does not change.
+func (cm *CMgr) recodeChunk(fp FP, stored, secret []byte, rmem *readChunkMem, amem *addChunkMem) ([]byte, error) {
+	text := stored
+	if cm.key != nil {
+		var err error
+		if text, err = cm.key.decrypt(stored, rmem.encBuf); err != nil {
+			return nil, err
+		}
+		rmem.encBuf = text
+	}
+	if len(text) == 0 {
+		return nil, errors.New("Empty chunk")
+	}
+	prefix := text[0]
+	if !cm.needsRecode(prefix) {
+		return nil, nil
+	}
+	plain, err := uncompressChunk(text, &rmem.compBuf)
+	if err != nil {
+		return nil, err
+	}
+	if !matchChunkFP(secret, fp, plain) {
+		return nil, errors.New("Chunk checksum mismatch")
+	}
+	if len(plain) > amem.chunkSize {
+		return nil, errors.New("Chunk is too large")
+	}
+	amem.setSize(len(plain))
+	copy(amem.buf(), plain)
+	out, err := compressChunk(amem, cm.compress, cm.compType, cm.compLevel)
+	if err != nil {
+		return nil, err
+	}
+	if out[0] == prefix && (!cm.newLevel || prefix == byte(CompressionType_NO_COMPRESSION)) {
+		return nil, nil
+	}
+	if cm.key != nil {
+		if out, err = cm.key.encrypt(out, amem.encBuf); err != nil {
+			return nil, err
+		}
+		amem.encBuf = out
+	}
+	return out, nil
+}
+
+// RecompressChunk rewrites a standalone chunk with the current compression
+// settings. It returns the old and new sizes of the stored chunk and whether
+// it was changed.
+func (cm *CMgr) RecompressChunk(fp FP, secret []byte, dryRun bool, rmem *readChunkMem, amem *addChunkMem) (int, int, bool, error) {
+	name := FPtoName(fp)
+	f := cm.sm.JoinPath(cm.sm.JoinPath(cm.dir, name[:DIR_PREFIX_SIZE]), name)
+	stored, err := cm.sm.ReadFile(f, &rmem.readBuf, &rmem.errBuf)
+	if err != nil {
+		return 0, 0, false, err
+	}
+	oldSize := len(stored)
+	out, err := cm.recodeChunk(fp, stored, secret, rmem, amem)
+	if err != nil || out == nil {
+		return oldSize, oldSize, false, err
+	}
+	if !dryRun {
+		if err := cm.sm.WriteFile(f, out); err != nil {
+			return oldSize, oldSize, false, err
+		}
+	}
+	return oldSize, len(out), true, nil
 }
 
 func (cm *CMgr) GetAllChunks() map[FP]bool {
 	m := make(map[FP]bool)
-	cm.sm.LsDir2(cm.dir, func(d, f string) {
+	if cm.packSize > 0 {
+		if cm.loadIndex() == nil {
+			cm.mu.Lock()
+			for fp := range cm.index {
+				m[fp] = true
+			}
+			cm.mu.Unlock()
+		}
+		return m
+	}
+	m, _ = cm.listChunks()
+	return m
+}
+
+// listChunks lists the standalone chunk files. On error, the chunks listed
+// so far are returned.
+func (cm *CMgr) listChunks() (map[FP]bool, error) {
+	m := make(map[FP]bool)
+	err := cm.sm.LsDir2(cm.dir, func(d, f string) {
 		if d == f[:DIR_PREFIX_SIZE] {
 			if fp, err := nameToFP(f); err == nil {
 				cm.mu.Lock()
@@ -205,13 +397,82 @@ func (cm *CMgr) GetAllChunks() map[FP]bool {
 			}
 		}
 	})
-	return m
+	if os.IsNotExist(err) {
+		err = nil
+	}
+	return m, err
 }
 
-func prefixAndCompress(d []byte, zlibBuf *bytes.Buffer) ([]byte, error) {
-	zlibBuf.Reset()
-	zlibBuf.WriteByte(byte(CompressionType_ZLIB))
-	zlw := zlib.NewWriter(zlibBuf)
+var zstdDecoder *zstd.Decoder
+var zstdEncoders = make(map[zstd.EncoderLevel]*zstd.Encoder)
+var zstdMu sync.Mutex
+
+func init() {
+	var err error
+	if zstdDecoder, err = zstd.NewReader(nil); err != nil {
+		panic("Internal error, cannot create zstd decoder.")
+	}
+}
+
+// zstdEncoder returns a shared encoder for the given zstd level (1 to 22).
+// The encoders are only used with EncodeAll which is safe for concurrent use.
+func zstdEncoder(level int) *zstd.Encoder {
+	l := zstdLevel(level)
+	zstdMu.Lock()
+	defer zstdMu.Unlock()
+	enc, ok := zstdEncoders[l]
+	if !ok {
+		var err error
+		if enc, err = zstd.NewWriter(nil, zstd.WithEncoderLevel(l)); err != nil {
+			panic("Internal error, cannot create zstd encoder.")
+		}
+		zstdEncoders[l] = enc
+	}
+	return enc
+}
+
+func zstdLevel(level int) zstd.EncoderLevel {
+	if level == 0 {
+		return zstd.SpeedDefault
+	}
+	return zstd.EncoderLevelFromZstd(level)
+}
+
+func zlibLevel(level int) int {
+	if level == 0 {
+		return zlib.DefaultCompression
+	}
+	return level
+}
+
+// checkCompression checks that the compression type and level are valid.
+func checkCompression(t CompressionType, level int32) error {
+	if t == CompressionType_ZLIB {
+		if level < 0 || level > zlib.BestCompression {
+			return errors.New("Zlib compression level must be between 1 and 9.")
+		}
+	} else if t == CompressionType_ZSTD {
+		if level < 0 || level > 22 {
+			return errors.New("Zstd compression level must be between 1 and 22.")
+		}
+	} else {
+		return errors.New("Unknown compression type.")
+	}
+	return nil
+}
+
+func prefixAndCompress(d []byte, compBuf *bytes.Buffer, t CompressionType, level int) ([]byte, error) {
+	compBuf.Reset()
+	if t == CompressionType_ZSTD {
+		compBuf.WriteByte(byte(CompressionType_ZSTD))
+		compBuf.Grow(len(d))
+		return zstdEncoder(level).EncodeAll(d, compBuf.Bytes()), nil
+	}
+	compBuf.WriteByte(byte(CompressionType_ZLIB))
+	zlw, err := zlib.NewWriterLevel(compBuf, zlibLevel(level))
+	if err != nil {
+		return nil, err
+	}
 	if n, err := zlw.Write(d); err != nil {
 		return nil, err
 	} else if n != len(d) {
@@ -220,18 +481,18 @@ func prefixAndCompress(d []byte, zlibBuf *bytes.Buffer) ([]byte, error) {
 	if zlw.Close() != nil {
 		return nil, errors.New("Zlib close failed")
 	}
-	return zlibBuf.Bytes(), nil
+	return compBuf.Bytes(), nil
 }
 
 const PREFIX_CHECK_SIZE = 4096
 
-func compressChunk(mem *addChunkMem, m CompressionMode) ([]byte, error) {
+func compressChunk(mem *addChunkMem, m CompressionMode, t CompressionType, level int) ([]byte, error) {
 	text := mem.buf()
 	if m == CompressionMode_AUTO {
 		if len(text) < 128 {
 			m = CompressionMode_NO
 		} else if len(text) < PREFIX_CHECK_SIZE {
-			out, err := prefixAndCompress(text, &mem.compBuf)
+			out, err := prefixAndCompress(text, &mem.compBuf, t, level)
 			if err != nil {
 				return nil, err
 			}
@@ -241,7 +502,7 @@ func compressChunk(mem *addChunkMem, m CompressionMode) ([]byte, error) {
 			m = CompressionMode_NO
 		} else {
 			test := text[:PREFIX_CHECK_SIZE]
-			out, err := prefixAndCompress(test, &mem.compBuf)
+			out, err := prefixAndCompress(test, &mem.compBuf, t, level)
 			if err != nil {
 				return nil, err
 			}
@@ -253,7 +514,7 @@ func compressChunk(mem *addChunkMem, m CompressionMode) ([]byte, error) {
 		}
 	}
 	if m == CompressionMode_SLOW {
-		out, err := prefixAndCompress(text, &mem.compBuf)
+		out, err := prefixAndCompress(text, &mem.compBuf, t, level)
 		if err != nil {
 			return nil, err
 		}
@@ -266,12 +527,14 @@ func compressChunk(mem *addChunkMem, m CompressionMode) ([]byte, error) {
 		mem.setPrefix(byte(CompressionType_NO_COMPRESSION))
 		return mem.bufWithPrefix(), nil
 	}
-	return prefixAndCompress(text, &mem.compBuf)
+	return prefixAndCompress(text, &mem.compBuf, t, level)
 }
 
 func uncompressChunk(zlibText []byte, buf *bytes.Buffer) ([]byte, error) {
 	if zlibText[0] == byte(CompressionType_NO_COMPRESSION) {
 		return zlibText[1:], nil
+	} else if zlibText[0] == byte(CompressionType_ZSTD) {
+		return zstdDecoder.DecodeAll(zlibText[1:], buf.Bytes()[:0])
 	} else if zlibText[0] != byte(CompressionType_ZLIB) {
 		return nil, errors.New("Not encrypted")
 	}
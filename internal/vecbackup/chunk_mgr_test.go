@@ -5,19 +5,186 @@ import (
 	"crypto/sha512"
 	"io/ioutil"
 	"math/rand"
+	"path/filepath"
 	"testing"
 )
 
 func TestCMNoEnc(t *testing.T) {
-	testCMhelper(t, nil)
+	testCMhelper(t, &Config{Compress: CompressionMode_YES})
 }
 
 func TestCMEnc(t *testing.T) {
 	var key EncKey = sha512.Sum512_256([]byte("f0839nskjdncw98ehjflsahflas"))
-	testCMhelper(t, &key)
+	testCMhelper(t, &Config{EncryptionKey: &key, Compress: CompressionMode_YES})
 }
 
-func testCMhelper(t *testing.T, key *EncKey) {
+func TestCMZstd(t *testing.T) {
+	var key EncKey = sha512.Sum512_256([]byte("f0839nskjdncw98ehjflsahflas"))
+	testCMhelper(t, &Config{Compress: CompressionMode_YES, CompressionType: CompressionType_ZSTD})
+	testCMhelper(t, &Config{EncryptionKey: &key, Compress: CompressionMode_SLOW, CompressionType: CompressionType_ZSTD, CompressionLevel: 19})
+}
+
+func TestCMAsymmetric(t *testing.T) {
+	pub, priv, err := genKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	secret := make([]byte, 64)
+	testCMhelper(t, &Config{PublicKey: pub, PrivateKey: priv, FPSecret: secret, Compress: CompressionMode_YES})
+	for _, packSize := range []int32{0, 10000} {
+		repo, err := ioutil.TempDir("", "chunk_mgr_test-*")
+		if err != nil {
+			t.Fatal("Cannot get tempdir", err)
+		}
+		defer removeAll(t, repo)
+		sm, repo2 := GetStorageMgr(repo)
+		cfg := &Config{PublicKey: pub, FPSecret: secret, Compress: CompressionMode_YES, PackSize: packSize}
+		cm := MakeCMgr(sm, repo2, cfg)
+		mem := makeAddChunkMem(1000)
+		rand.Read(mem.buf())
+		var fp FP = sha512.Sum512_256(mem.buf())
+		if _, _, err := cm.AddChunk(fp, mem); err != nil {
+			t.Fatalf("AddChunk failed: %s %s", fp, err)
+		}
+		if err := cm.Flush(); err != nil {
+			t.Fatalf("Flush failed: %s", err)
+		}
+		cm = MakeCMgr(sm, repo2, cfg)
+		if !cm.FindChunk(fp) {
+			t.Fatalf("Write-only FindChunk failed: %s", fp)
+		}
+		if _, err := cm.ReadChunk(fp, &readChunkMem{}); err != errNoPrivateKey {
+			t.Fatalf("Write-only ReadChunk should fail: %s", err)
+		}
+		cfg.PrivateKey = priv
+		cm = MakeCMgr(sm, repo2, cfg)
+		b, err := cm.ReadChunk(fp, &readChunkMem{})
+		if err != nil || sha512.Sum512_256(b) != fp {
+			t.Fatalf("ReadChunk failed: %s %s", fp, err)
+		}
+	}
+}
+
+func TestCMMixedCompression(t *testing.T) {
+	repo, err := ioutil.TempDir("", "chunk_mgr_test-*")
+	if err != nil {
+		t.Fatal("Cannot get tempdir", err)
+	}
+	defer removeAll(t, repo)
+	sm, repo2 := GetStorageMgr(repo)
+	zlibCM := MakeCMgr(sm, repo2, &Config{Compress: CompressionMode_YES, CompressionType: CompressionType_ZLIB})
+	zstdCM := MakeCMgr(sm, repo2, &Config{Compress: CompressionMode_YES, CompressionType: CompressionType_ZSTD})
+	mem := makeAddChunkMem(10000)
+	data := makeRepeatedPattern(10000, 100, 3)
+	var names []FP
+	for i, cm := range []*CMgr{zlibCM, zstdCM} {
+		copy(mem.buf(), data)
+		mem.buf()[0] = byte(i)
+		var fp FP = sha512.Sum512_256(mem.buf())
+		if _, _, err := cm.AddChunk(fp, mem); err != nil {
+			t.Fatalf("AddChunk failed: %s %s", fp, err)
+		}
+		names = append(names, fp)
+	}
+	name := FPtoName(names[1])
+	b, err := ioutil.ReadFile(filepath.Join(repo, CHUNK_DIR, name[:DIR_PREFIX_SIZE], name))
+	if err != nil || b[0] != byte(CompressionType_ZSTD) || len(b) > 1000 {
+		t.Fatalf("Chunk not compressed with zstd: %v", err)
+	}
+	mem2 := &readChunkMem{}
+	for _, cm := range []*CMgr{zlibCM, zstdCM} {
+		for _, fp := range names {
+			b, err := cm.ReadChunk(fp, mem2)
+			if err != nil {
+				t.Fatalf("ReadChunk failed: %s %s", fp, err)
+			}
+			if sha512.Sum512_256(b) != fp {
+				t.Fatalf("Chunk %s is wrong\n", fp)
+			}
+		}
+	}
+}
+
+func TestCMPack(t *testing.T) {
+	var key EncKey = sha512.Sum512_256([]byte("f0839nskjdncw98ehjflsahflas"))
+	testCMPackHelper(t, nil)
+	testCMPackHelper(t, &key)
+}
+
+func testCMPackHelper(t *testing.T, key *EncKey) {
+	repo, err := ioutil.TempDir("", "chunk_mgr_test-*")
+	if err != nil {
+		t.Fatal("Cannot get tempdir", err)
+	}
+	defer removeAll(t, repo)
+	sm, repo2 := GetStorageMgr(repo)
+	cfg := &Config{EncryptionKey: key, Compress: CompressionMode_NO, PackSize: 10000}
+	cm := MakeCMgr(sm, repo2, cfg)
+	mem := makeAddChunkMem(1000)
+	rand.Seed(3)
+	var names []FP
+	for i := 0; i < 100; i++ {
+		rand.Read(mem.buf())
+		var fp FP = sha512.Sum512_256(mem.buf())
+		if _, _, err := cm.AddChunk(fp, mem); err != nil {
+			t.Fatalf("AddChunk failed: %s %s", fp, err)
+		}
+		names = append(names, fp)
+	}
+	if err := cm.Flush(); err != nil {
+		t.Fatalf("Flush failed: %s", err)
+	}
+	packs, _ := sm.LsDir(sm.JoinPath(repo2, INDEX_DIR))
+	if len(packs) < 5 || len(packs) > 15 {
+		t.Errorf("Expected about 10 packs, got %d", len(packs))
+	}
+	cm = MakeCMgr(sm, repo2, cfg)
+	if all := cm.GetAllChunks(); len(all) != len(names) {
+		t.Fatalf("GetAllChunks: expected %d, got %d", len(names), len(all))
+	}
+	mem2 := &readChunkMem{}
+	for _, fp := range names {
+		if !cm.FindChunk(fp) {
+			t.Fatalf("FindChunk failed: %s", fp)
+		}
+		b, err := cm.ReadChunk(fp, mem2)
+		if err != nil {
+			t.Fatalf("ReadChunk failed: %s %s", fp, err)
+		}
+		if sha512.Sum512_256(b) != fp {
+			t.Fatalf("Chunk %s is wrong\n", fp)
+		}
+	}
+	unused := make(map[FP]bool)
+	for i, fp := range names {
+		if i%3 != 0 {
+			unused[fp] = true
+		}
+	}
+	var st PackPurgeStats
+	if err := cm.PurgePacks(unused, false, false, &st); err != nil {
+		t.Fatalf("PurgePacks failed: %s", err)
+	}
+	if st.PacksRepacked+st.PacksDeleted != len(packs) || st.UnusedKept != 0 || st.ChunksDeleted != len(unused) {
+		t.Errorf("Unexpected purge stats: %+v", st)
+	}
+	cm = MakeCMgr(sm, repo2, cfg)
+	if all := cm.GetAllChunks(); len(all) != len(names)-len(unused) {
+		t.Fatalf("GetAllChunks after purge: expected %d, got %d", len(names)-len(unused), len(all))
+	}
+	for _, fp := range names {
+		b, err := cm.ReadChunk(fp, mem2)
+		if unused[fp] {
+			if err == nil {
+				t.Fatalf("Chunk should be purged: %s", fp)
+			}
+		} else if err != nil || sha512.Sum512_256(b) != fp {
+			t.Fatalf("ReadChunk after purge failed: %s %s", fp, err)
+		}
+	}
+}
+
+func testCMhelper(t *testing.T, cfg *Config) {
 	repo, err := ioutil.TempDir("", "chunk_mgr_test-*")
 	if err != nil {
 		t.Fatal("Cannot get tempdir", err)
@@ -25,7 +192,7 @@ func testCMhelper(t *testing.T, key *EncKey) {
 	removeAll(t, repo)
 	defer removeAll(t, repo)
 	sm, repo2 := GetStorageMgr(repo)
-	cm := MakeCMgr(sm, repo2, key, CompressionMode_YES)
+	cm := MakeCMgr(sm, repo2, cfg)
 	N := 100000
 	mem := makeAddChunkMem(N)
 	data := mem.buf()
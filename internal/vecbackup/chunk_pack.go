@@ -0,0 +1,544 @@
+package vecbackup
+
+import (
+	"bytes"
+	"crypto/sha512"
+	"errors"
+	"fmt"
+	"google.golang.org/protobuf/proto"
+	"os"
+	"sort"
+	"sync"
+)
+
+// In pack mode, chunks are appended to pack files of about PackSize bytes
+// instead of being stored as one object each. Each chunk in a pack is
+// compressed and encrypted on its own, exactly like a standalone chunk.
+// For every pack "packs/xx/<name>" there is an index file "index/<name>"
+// listing the chunks in the pack with their offsets and lengths.
+// The pack is always written before its index so a pack is never
+// referenced before it is complete.
+
+const (
+	VI_VERSION = 1
+	VI_MAGIC   = "VBKI"
+	// Packs with less than this percentage of bytes in use are repacked by purge-unused.
+	PACK_REPACK_THRESHOLD = 80
+)
+
+type packLoc struct {
+	pack   string
+	offset int64
+	length int32
+}
+
+type packBuf struct {
+	data    []byte
+	entries []*PackEntryProto
+}
+
+func (cm *CMgr) packPath(name string) string {
+	return cm.sm.JoinPath(cm.sm.JoinPath(cm.packDir, name[:DIR_PREFIX_SIZE]), name)
+}
+
+func (cm *CMgr) loadIndex() error {
+	cm.indexOnce.Do(func() {
+		cm.indexErr = cm.readAllIndexes()
+	})
+	return cm.indexErr
+}
+
+func (cm *CMgr) readAllIndexes() error {
+	names, err := cm.sm.LsDir(cm.indexDir)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	sort.Strings(names)
+	var buf, errBuf bytes.Buffer
+	packs := make(map[string][]*PackEntryProto)
+	for _, name := range names {
+		if _, err := nameToFP(name); err != nil {
+			continue
+		}
+		b, err := cm.sm.ReadFile(cm.sm.JoinPath(cm.indexDir, name), &buf, &errBuf)
+		if err != nil {
+			return fmt.Errorf("Cannot read pack index %s: %s", name, err)
+		}
+		entries, err := decodePackIndex(cm.indexKey, b)
+		if err != nil && cm.mixedKeys {
+			continue
+		} else if err != nil {
+			return fmt.Errorf("Invalid pack index %s: %s", name, err)
+		}
+		packs[name] = entries
+	}
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+	for _, name := range names {
+		entries, ok := packs[name]
+		if !ok {
+			continue
+		}
+		for _, e := range entries {
+			var fp FP
+			copy(fp[:], e.FP)
+			if _, ok := cm.index[fp]; !ok {
+				cm.index[fp] = packLoc{pack: name, offset: e.Offset, length: e.Length}
+			}
+			cm.memoize[fp] = true
+		}
+		cm.packs[name] = entries
+	}
+	return nil
+}
+
+func encodePackIndex(key *EncKey, entries []*PackEntryProto) ([]byte, error) {
+	pb, err := proto.Marshal(&PackIndexProto{Version: VI_VERSION, Entries: entries})
+	if err != nil {
+		return nil, err
+	}
+	b := append([]byte(VI_MAGIC), pb...)
+	if key == nil {
+		return b, nil
+	}
+	return encryptBytes(key, b, nil)
+}
+
+func decodePackIndex(key *EncKey, b []byte) ([]*PackEntryProto, error) {
+	if key != nil {
+		var err error
+		if b, err = decryptBytes(key, b, nil); err != nil {
+			return nil, err
+		}
+	}
+	if len(b) < len(VI_MAGIC) || string(b[:len(VI_MAGIC)]) != VI_MAGIC {
+		return nil, errors.New("Bad magic")
+	}
+	pi := &PackIndexProto{}
+	if err := proto.Unmarshal(b[len(VI_MAGIC):], pi); err != nil {
+		return nil, err
+	}
+	if pi.Version != VI_VERSION {
+		return nil, errors.New("Incompatible pack index.")
+	}
+	for _, e := range pi.Entries {
+		if len(e.FP) != len(FP{}) || e.Offset < 0 || e.Length <= 0 {
+			return nil, errors.New("Bad pack entry")
+		}
+	}
+	return pi.Entries, nil
+}
+
+func (cm *CMgr) readPackedChunk(fp FP, mem *readChunkMem) ([]byte, error) {
+	if err := cm.loadIndex(); err != nil {
+		return nil, err
+	}
+	cm.mu.Lock()
+	loc, ok := cm.index[fp]
+	cm.mu.Unlock()
+	if !ok {
+		return nil, os.ErrNotExist
+	}
+	return cm.sm.ReadFileRange(cm.packPath(loc.pack), loc.offset, int(loc.length), &mem.readBuf, &mem.errBuf)
+}
+
+// addToPack appends an encoded chunk to the current pack and writes
+// the pack out when it is full.
+func (cm *CMgr) addToPack(fp FP, data []byte) error {
+	cm.mu.Lock()
+	if cm.packErr != nil {
+		err := cm.packErr
+		cm.mu.Unlock()
+		return err
+	}
+	p := cm.curPack
+	if p == nil {
+		p = &packBuf{data: make([]byte, 0, cm.packSize+len(data))}
+		cm.curPack = p
+	}
+	p.entries = append(p.entries, &PackEntryProto{FP: append([]byte(nil), fp[:]...), Offset: int64(len(p.data)), Length: int32(len(data))})
+	p.data = append(p.data, data...)
+	var full *packBuf
+	if len(p.data) >= cm.packSize {
+		full = p
+		cm.curPack = nil
+	}
+	cm.mu.Unlock()
+	if full != nil {
+		return cm.writePack(full)
+	}
+	return nil
+}
+
+func (cm *CMgr) writePack(p *packBuf) error {
+	name := FPtoName(sha512.Sum512_256(p.data))
+	err := cm.writePackFiles(name, p)
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+	if err != nil {
+		// Other chunks in the pack were already reported as added.
+		// Remember the error so that Flush fails and no version
+		// referring to them is saved.
+		for _, e := range p.entries {
+			var fp FP
+			copy(fp[:], e.FP)
+			cm.memoize[fp] = false
+		}
+		if cm.packErr == nil {
+			cm.packErr = err
+		}
+		return err
+	}
+	for _, e := range p.entries {
+		var fp FP
+		copy(fp[:], e.FP)
+		cm.index[fp] = packLoc{pack: name, offset: e.Offset, length: e.Length}
+	}
+	cm.packs[name] = p.entries
+	return nil
+}
+
+func (cm *CMgr) writePackFiles(name string, p *packBuf) error {
+	dir := cm.sm.JoinPath(cm.packDir, name[:DIR_PREFIX_SIZE])
+	if err := cm.sm.MkdirAll(dir); err != nil {
+		return err
+	}
+	if err := cm.sm.WriteFile(cm.sm.JoinPath(dir, name), p.data); err != nil {
+		return err
+	}
+	b, err := encodePackIndex(cm.indexKey, p.entries)
+	if err != nil {
+		return err
+	}
+	if err := cm.sm.MkdirAll(cm.indexDir); err != nil {
+		return err
+	}
+	return cm.sm.WriteFile(cm.sm.JoinPath(cm.indexDir, name), b)
+}
+
+// Flush writes out the partially filled pack. It must be called after
+// adding chunks and before saving a version that uses them.
+func (cm *CMgr) Flush() error {
+	if cm.packSize == 0 {
+		return nil
+	}
+	cm.mu.Lock()
+	p := cm.curPack
+	cm.curPack = nil
+	err := cm.packErr
+	cm.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	if p != nil {
+		return cm.writePack(p)
+	}
+	return nil
+}
+
+func (cm *CMgr) deletePack(name string) error {
+	if err := cm.sm.DeleteFile(cm.sm.JoinPath(cm.indexDir, name)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err := cm.sm.DeleteFile(cm.packPath(name)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+	for _, e := range cm.packs[name] {
+		var fp FP
+		copy(fp[:], e.FP)
+		if loc, ok := cm.index[fp]; ok && loc.pack == name {
+			delete(cm.index, fp)
+			cm.memoize[fp] = false
+		}
+	}
+	delete(cm.packs, name)
+	return nil
+}
+
+type PackPurgeStats struct {
+	Packs          int
+	PacksDeleted   int
+	PacksRepacked  int
+	ChunksDeleted  int
+	UnusedKept     int
+	OrphansDeleted int
+}
+
+// orphanPacks returns the packs without an index. The index of a pack
+// that a running backup, maybe on another host, has just written may not
+// be visible yet, so they go through the pending deletion list like unused
+// chunks.
+func (cm *CMgr) orphanPacks() (map[FP]bool, error) {
+	if err := cm.loadIndex(); err != nil {
+		return nil, err
+	}
+	orphans := make(map[FP]bool)
+	err := cm.sm.LsDir2(cm.packDir, func(d, f string) {
+		if fp, err := nameToFP(f); err == nil && d == f[:DIR_PREFIX_SIZE] {
+			cm.mu.Lock()
+			_, ok := cm.packs[f]
+			cm.mu.Unlock()
+			if !ok {
+				orphans[fp] = true
+			}
+		}
+	})
+	if err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("Cannot list packs: %s", err)
+	}
+	return orphans, nil
+}
+
+// PurgePacks removes the unused chunks from the packs. Packs without any
+// chunk in use are deleted. Packs with less than PACK_REPACK_THRESHOLD
+// percent of their bytes in use are rewritten with only the chunks in use.
+// Unused chunks in the other packs are kept. Packs without an index are
+// deleted if they are in unused, see orphanPacks.
+func (cm *CMgr) PurgePacks(unused map[FP]bool, dryRun, verbose bool, st *PackPurgeStats) error {
+	if err := cm.loadIndex(); err != nil {
+		return err
+	}
+	cm.mu.Lock()
+	var names []string
+	for name := range cm.packs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	type packUse struct {
+		name   string
+		live   []*PackEntryProto
+		dead   int
+		unused int
+	}
+	var toDelete, toRepack []*packUse
+	for _, name := range names {
+		var liveBytes, totalBytes int64
+		pu := &packUse{name: name}
+		for _, e := range cm.packs[name] {
+			var fp FP
+			copy(fp[:], e.FP)
+			totalBytes += int64(e.Length)
+			// A chunk may be in more than one pack. Only the copy in the index is used.
+			if loc := cm.index[fp]; !unused[fp] && loc.pack == name && loc.offset == e.Offset {
+				liveBytes += int64(e.Length)
+				pu.live = append(pu.live, e)
+			} else {
+				pu.dead++
+				if unused[fp] {
+					pu.unused++
+				}
+			}
+		}
+		if len(pu.live) == 0 {
+			toDelete = append(toDelete, pu)
+		} else if pu.dead > 0 && liveBytes*100 < totalBytes*PACK_REPACK_THRESHOLD {
+			toRepack = append(toRepack, pu)
+		} else {
+			st.UnusedKept += pu.unused
+		}
+	}
+	st.Packs = len(names)
+	cm.mu.Unlock()
+	found, err := cm.orphanPacks()
+	if err != nil {
+		return err
+	}
+	var orphans []string
+	for fp := range found {
+		if unused[fp] {
+			orphans = append(orphans, FPtoName(fp))
+		}
+	}
+	sort.Strings(orphans)
+	if !dryRun && len(toDelete)+len(toRepack)+len(orphans) > 0 {
+		if err := chunksDeleting(cm); err != nil {
+			return err
+		}
+	}
+	for _, pu := range toRepack {
+		if verbose {
+			stdout.Printf("Repack %s: %d chunk(s) kept, %d removed\n", pu.name, len(pu.live), pu.dead)
+		}
+		if dryRun {
+			continue
+		}
+		var buf, errBuf bytes.Buffer
+		data, err := cm.sm.ReadFile(cm.packPath(pu.name), &buf, &errBuf)
+		if err != nil {
+			return fmt.Errorf("Cannot read pack %s: %s", pu.name, err)
+		}
+		for _, e := range pu.live {
+			if e.Offset+int64(e.Length) > int64(len(data)) {
+				return fmt.Errorf("Pack %s is truncated", pu.name)
+			}
+			var fp FP
+			copy(fp[:], e.FP)
+			if err := cm.addToPack(fp, data[e.Offset:e.Offset+int64(e.Length)]); err != nil {
+				return err
+			}
+		}
+	}
+	if err := cm.Flush(); err != nil {
+		return err
+	}
+	// The chunks are now safely in new packs so the old packs can go.
+	for _, pu := range append(toDelete, toRepack...) {
+		if verbose && len(pu.live) == 0 {
+			stdout.Printf("Delete pack %s: %d chunk(s) removed\n", pu.name, pu.dead)
+		}
+		if !dryRun {
+			if err := cm.deletePack(pu.name); err != nil {
+				return fmt.Errorf("Cannot delete pack %s: %s", pu.name, err)
+			}
+		}
+		st.ChunksDeleted += pu.unused
+	}
+	st.PacksDeleted = len(toDelete)
+	st.PacksRepacked = len(toRepack)
+	for _, name := range orphans {
+		if verbose {
+			stdout.Printf("Delete unindexed pack %s\n", name)
+		}
+		if !dryRun {
+			if err := cm.sm.DeleteFile(cm.packPath(name)); err != nil {
+				return fmt.Errorf("Cannot delete pack %s: %s", name, err)
+			}
+		}
+		st.OrphansDeleted++
+	}
+	return nil
+}
+
+type recodedEntry struct {
+	fp   FP
+	data []byte
+}
+
+// RecompressPacks rewrites the packs with chunks that change with the
+// current compression settings. Up to maxDop packs are recompressed at a
+// time. The old packs are deleted after their chunks are in new packs.
+func (cm *CMgr) RecompressPacks(secret []byte, chunkSize int, dryRun, verbose bool, maxDop int, st *RecompressStats) error {
+	if err := cm.loadIndex(); err != nil {
+		return err
+	}
+	cm.mu.Lock()
+	var names []string
+	for name := range cm.packs {
+		names = append(names, name)
+	}
+	cm.mu.Unlock()
+	sort.Strings(names)
+	var mu sync.Mutex // protects st
+	stamped := false
+	for i := 0; i < len(names); i += maxDop {
+		batch := names[i:]
+		if len(batch) > maxDop {
+			batch = batch[:maxDop]
+		}
+		results := make([][]recodedEntry, len(batch))
+		var wg sync.WaitGroup
+		for j, name := range batch {
+			wg.Add(1)
+			go func(j int, name string) {
+				defer wg.Done()
+				entries, err := cm.recodePack(name, secret, chunkSize, &mu, st)
+				mu.Lock()
+				defer mu.Unlock()
+				if err != nil {
+					stderr.Printf("Cannot recompress pack %s: %s\n", name, err)
+					st.Errors++
+				} else if entries != nil && verbose {
+					stdout.Printf("Recompress pack %s\n", name)
+				}
+				results[j] = entries
+			}(j, name)
+		}
+		wg.Wait()
+		if dryRun {
+			continue
+		}
+		var done []string
+		for j, entries := range results {
+			if entries == nil {
+				continue
+			}
+			for _, e := range entries {
+				if err := cm.addToPack(e.fp, e.data); err != nil {
+					return err
+				}
+			}
+			done = append(done, batch[j])
+		}
+		if err := cm.Flush(); err != nil {
+			return err
+		}
+		if len(done) > 0 && !stamped {
+			if err := chunksDeleting(cm); err != nil {
+				return err
+			}
+			stamped = true
+		}
+		for _, name := range done {
+			if err := cm.deletePack(name); err != nil {
+				return fmt.Errorf("Cannot delete pack %s: %s", name, err)
+			}
+		}
+	}
+	return nil
+}
+
+// recodePack returns the chunks in use in the pack with the current
+// compression settings, or nil if none of them change.
+func (cm *CMgr) recodePack(name string, secret []byte, chunkSize int, mu *sync.Mutex, st *RecompressStats) ([]recodedEntry, error) {
+	rmem := &readChunkMem{}
+	data, err := cm.sm.ReadFile(cm.packPath(name), &rmem.readBuf, &rmem.errBuf)
+	if err != nil {
+		return nil, err
+	}
+	amem := makeAddChunkMem(chunkSize)
+	cm.mu.Lock()
+	entries := cm.packs[name]
+	cm.mu.Unlock()
+	var out []recodedEntry
+	var numChunks, numChanged int
+	var oldSize, newSize int64
+	for _, e := range entries {
+		var fp FP
+		copy(fp[:], e.FP)
+		cm.mu.Lock()
+		loc := cm.index[fp]
+		cm.mu.Unlock()
+		if loc.pack != name || loc.offset != e.Offset {
+			continue
+		}
+		if e.Offset+int64(e.Length) > int64(len(data)) {
+			return nil, errors.New("Pack is truncated")
+		}
+		stored := data[e.Offset : e.Offset+int64(e.Length)]
+		numChunks++
+		recoded, err := cm.recodeChunk(fp, stored, secret, rmem, amem)
+		if err != nil {
+			return nil, fmt.Errorf("Chunk %s: %s", fp, err)
+		}
+		if recoded == nil {
+			recoded = stored
+		} else {
+			numChanged++
+			oldSize += int64(len(stored))
+			newSize += int64(len(recoded))
+		}
+		out = append(out, recodedEntry{fp, append([]byte(nil), recoded...)})
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	st.Chunks += numChunks
+	st.Recompressed += numChanged
+	st.OldSize += oldSize
+	st.NewSize += newSize
+	if numChanged == 0 {
+		return nil, nil
+	}
+	return out, nil
+}
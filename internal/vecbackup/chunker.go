@@ -0,0 +1,120 @@
+package vecbackup
+
+import (
+	"crypto/sha512"
+	"encoding/binary"
+	"errors"
+	"math"
+	"math/bits"
+)
+
+// Content-defined chunking using a gear rolling hash with normalized
+// chunking as described in the FastCDC paper. A cut point is placed where
+// the top bits of the hash are zero. A stricter mask is used before the
+// average size and a looser one after it so that chunk sizes cluster around
+// the average.
+
+const (
+	CDC_MIN_CHUNK_SIZE = 64
+	CDC_MIN_SIZE_RATIO = 4
+	CDC_MAX_SIZE_RATIO = 4
+)
+
+var gearTable = makeGearTable()
+
+// The gear table must never change, otherwise chunk boundaries change and
+// previously stored chunks are no longer shared with new backups.
+func makeGearTable() [256]uint64 {
+	var t [256]uint64
+	for i := range t {
+		h := sha512.Sum512_256([]byte{'g', 'e', 'a', 'r', byte(i)})
+		t[i] = binary.BigEndian.Uint64(h[:8])
+	}
+	return t
+}
+
+type chunker struct {
+	minSize int
+	avgSize int
+	maxSize int
+	maskS   uint64
+	maskL   uint64
+}
+
+func topBitsMask(n int) uint64 {
+	return ^uint64(0) << uint(64-n)
+}
+
+func makeChunker(cfg *Config) *chunker {
+	if cfg.Chunking != ChunkingMode_CDC {
+		return nil
+	}
+	b := bits.Len32(uint32(cfg.ChunkSize)) - 1
+	if b < 2 {
+		b = 2
+	}
+	return &chunker{minSize: int(cfg.MinChunkSize), avgSize: int(cfg.ChunkSize), maxSize: int(cfg.MaxChunkSize), maskS: topBitsMask(b + 1), maskL: topBitsMask(b - 1)}
+}
+
+// cut returns the length of the chunk at the start of b.
+// b must hold maxSize bytes unless the end of the file has been reached.
+func (c *chunker) cut(b []byte) int {
+	n := len(b)
+	if n <= c.minSize {
+		return n
+	}
+	if n > c.maxSize {
+		n = c.maxSize
+	}
+	normal := c.avgSize
+	if normal > n {
+		normal = n
+	}
+	var h uint64
+	i := c.minSize
+	for ; i < normal; i++ {
+		h = (h << 1) + gearTable[b[i]]
+		if h&c.maskS == 0 {
+			return i + 1
+		}
+	}
+	for ; i < n; i++ {
+		h = (h << 1) + gearTable[b[i]]
+		if h&c.maskL == 0 {
+			return i + 1
+		}
+	}
+	return n
+}
+
+// setChunkSizes fills in and validates the chunk size limits in cfg.
+func setChunkSizes(cfg *Config) error {
+	if cfg.ChunkSize <= 0 {
+		return errors.New("Chunk size must be positive.")
+	}
+	if cfg.Chunking == ChunkingMode_FIXED {
+		if cfg.MinChunkSize != 0 || cfg.MaxChunkSize != 0 {
+			return errors.New("Min and max chunk sizes are only used for content-defined chunking.")
+		}
+		return nil
+	} else if cfg.Chunking != ChunkingMode_CDC {
+		return errors.New("Unknown chunking mode.")
+	}
+	if cfg.MinChunkSize == 0 {
+		cfg.MinChunkSize = cfg.ChunkSize / CDC_MIN_SIZE_RATIO
+	}
+	if cfg.MaxChunkSize == 0 {
+		max := int64(cfg.ChunkSize) * CDC_MAX_SIZE_RATIO
+		if max > math.MaxInt32 {
+			return errors.New("Chunk size is too big.")
+		}
+		cfg.MaxChunkSize = int32(max)
+	}
+	if cfg.MinChunkSize < CDC_MIN_CHUNK_SIZE {
+		return errors.New("Min chunk size is too small, minimum 64.")
+	}
+	if cfg.MinChunkSize > cfg.ChunkSize || cfg.ChunkSize > cfg.MaxChunkSize {
+		return errors.New("Chunk sizes must satisfy min <= avg <= max.")
+	}
+	return nil
+}
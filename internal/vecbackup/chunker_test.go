@@ -0,0 +1,93 @@
+package vecbackup
+
+import (
+	"crypto/sha512"
+	"math/rand"
+	"testing"
+)
+
+func cdcChunks(ck *chunker, data []byte) []FP {
+	var fps []FP
+	for len(data) > 0 {
+		b := data
+		if len(b) > ck.maxSize {
+			b = b[:ck.maxSize]
+		}
+		n := ck.cut(b)
+		fps = append(fps, sha512.Sum512_256(data[:n]))
+		data = data[n:]
+	}
+	return fps
+}
+
+func TestChunkerSizes(t *testing.T) {
+	cfg := &Config{ChunkSize: 4096, Chunking: ChunkingMode_CDC}
+	if err := setChunkSizes(cfg); err != nil {
+		t.Fatal("setChunkSizes failed", err)
+	}
+	ck := makeChunker(cfg)
+	data := make([]byte, 1000000)
+	rand.Seed(1)
+	rand.Read(data)
+	total := 0
+	n := 0
+	for len(data) > 0 {
+		b := data
+		if len(b) > ck.maxSize {
+			b = b[:ck.maxSize]
+		}
+		size := ck.cut(b)
+		if size <= 0 || size > ck.maxSize || (size < ck.minSize && size != len(data)) {
+			t.Fatalf("Bad chunk size %d", size)
+		}
+		total += size
+		n++
+		data = data[size:]
+	}
+	avg := total / n
+	if avg < int(cfg.MinChunkSize)*2 || avg > int(cfg.MaxChunkSize)/2 {
+		t.Errorf("Average chunk size %d is too far from %d", avg, cfg.ChunkSize)
+	}
+	t.Logf("%d chunks, average size %d", n, avg)
+}
+
+func TestChunkerShift(t *testing.T) {
+	cfg := &Config{ChunkSize: 4096, Chunking: ChunkingMode_CDC}
+	if err := setChunkSizes(cfg); err != nil {
+		t.Fatal("setChunkSizes failed", err)
+	}
+	ck := makeChunker(cfg)
+	data := make([]byte, 1000000)
+	rand.Seed(2)
+	rand.Read(data)
+	data2 := append(append(append([]byte(nil), data[:5000]...), 1, 2, 3), data[5000:]...)
+	fps := make(map[FP]bool)
+	for _, fp := range cdcChunks(ck, data) {
+		fps[fp] = true
+	}
+	fps2 := cdcChunks(ck, data2)
+	same := 0
+	for _, fp := range fps2 {
+		if fps[fp] {
+			same++
+		}
+	}
+	if same < len(fps2)-3 {
+		t.Errorf("Only %d of %d chunks unchanged after insert", same, len(fps2))
+	}
+}
+
+func TestSetChunkSizes(t *testing.T) {
+	for _, cfg := range []*Config{
+		{ChunkSize: 0},
+		{ChunkSize: 4096, MinChunkSize: 1024},
+		{ChunkSize: 4096, Chunking: ChunkingMode_CDC, MinChunkSize: 32},
+		{ChunkSize: 4096, Chunking: ChunkingMode_CDC, MinChunkSize: 8192},
+		{ChunkSize: 4096, Chunking: ChunkingMode_CDC, MaxChunkSize: 1024},
+		{ChunkSize: 1 << 30, Chunking: ChunkingMode_CDC},
+	} {
+		if err := setChunkSizes(cfg); err == nil {
+			t.Errorf("Should fail: %v", cfg)
+		}
+	}
+}
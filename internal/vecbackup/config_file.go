@@ -2,32 +2,45 @@ package vecbackup
 
 import (
 	"bytes"
+	"crypto/rand"
 	"errors"
 	"fmt"
 	"google.golang.org/protobuf/proto"
 	"io"
 	"io/ioutil"
+	"math"
 	"os"
 )
 
 type Config struct {
-	ChunkSize     int32
-	Compress      CompressionMode
-	EncryptionKey *EncKey
-	FPSecret      []byte
+	ChunkSize        int32
+	Compress         CompressionMode
+	Chunking         ChunkingMode
+	MinChunkSize     int32
+	MaxChunkSize     int32
+	PackSize         int32
+	CompressionType  CompressionType
+	CompressionLevel int32
+	Padding          PaddingMode
+	Mode             RepoMode
+	EncryptionKey    *EncKey
+	FPSecret         []byte
+	PublicKey        *EncKey
+	PrivateKey       *EncKey      // Not saved in the config. Nil for write-only keys.
+	Rotation         *KeyRotation // The new keys while rotate-key is in progress.
 }
 
 //---------------------------------------------------------------------------
 func checkConfig(cfg *Config, encrypted bool) {
 	if encrypted {
-		if cfg.EncryptionKey == nil {
+		if (cfg.EncryptionKey == nil) == (cfg.PublicKey == nil) {
 			panic("Internal error, invalid encryption key.")
 		}
 		if cfg.FPSecret == nil || len(cfg.FPSecret) < 64 {
 			panic("Internal error, invalid secret.")
 		}
 	} else {
-		if cfg.EncryptionKey != nil || cfg.FPSecret != nil {
+		if cfg.EncryptionKey != nil || cfg.FPSecret != nil || cfg.PublicKey != nil {
 			panic("Internal error, extra key")
 		}
 	}
@@ -35,10 +48,23 @@ func checkConfig(cfg *Config, encrypted bool) {
 
 func configToBytes(cfg *Config, encrypted bool) ([]byte, error) {
 	checkConfig(cfg, encrypted)
-	cp := ConfigProto{ChunkSize: cfg.ChunkSize, Compress: cfg.Compress}
+	cp := ConfigProto{ChunkSize: cfg.ChunkSize, Compress: cfg.Compress, Chunking: cfg.Chunking, MinChunkSize: cfg.MinChunkSize, MaxChunkSize: cfg.MaxChunkSize, PackSize: cfg.PackSize, CompressionType: cfg.CompressionType, CompressionLevel: cfg.CompressionLevel, Padding: cfg.Padding, Mode: cfg.Mode}
 	if encrypted {
 		cp.FPSecret = cfg.FPSecret
-		cp.EncryptionKey = cfg.EncryptionKey[:]
+		if cfg.PublicKey != nil {
+			cp.PublicKey = cfg.PublicKey[:]
+		} else {
+			cp.EncryptionKey = cfg.EncryptionKey[:]
+		}
+		if r := cfg.Rotation; r != nil {
+			cp.NewFPSecret = r.FPSecret
+			if r.PublicKey != nil {
+				cp.NewPublicKey = r.PublicKey[:]
+				cp.NewPrivateKey = r.PrivateKey[:]
+			} else {
+				cp.NewEncryptionKey = r.EncryptionKey[:]
+			}
+		}
 	}
 	return proto.Marshal(&cp)
 }
@@ -48,23 +74,117 @@ func configFromBytes(b []byte, encrypted bool) (*Config, error) {
 	if err := proto.Unmarshal(b, &cp); err != nil {
 		return nil, err
 	}
-	cfg := &Config{ChunkSize: cp.ChunkSize, Compress: cp.Compress}
+	cfg := &Config{ChunkSize: cp.ChunkSize, Compress: cp.Compress, Chunking: cp.Chunking, MinChunkSize: cp.MinChunkSize, MaxChunkSize: cp.MaxChunkSize, PackSize: cp.PackSize, CompressionType: cp.CompressionType, CompressionLevel: cp.CompressionLevel, Padding: cp.Padding, Mode: cp.Mode}
+	if cfg.Chunking != ChunkingMode_FIXED {
+		if cfg.Chunking != ChunkingMode_CDC || cfg.MinChunkSize <= 0 || cfg.MinChunkSize > cfg.ChunkSize || cfg.ChunkSize > cfg.MaxChunkSize {
+			return nil, errors.New("Invalid chunking in config file.")
+		}
+	}
+	if cfg.PackSize < 0 {
+		return nil, errors.New("Invalid pack size in config file.")
+	}
+	if cfg.CompressionType == CompressionType_NO_COMPRESSION {
+		cfg.CompressionType = CompressionType_ZLIB
+	}
+	if checkCompression(cfg.CompressionType, cfg.CompressionLevel) != nil {
+		return nil, errors.New("Invalid compression in config file.")
+	}
+	if checkPadding(cfg.Padding) != nil || !encrypted && cfg.Padding != PaddingMode_NO_PADDING {
+		return nil, errors.New("Invalid padding in config file.")
+	}
+	if _, ok := RepoMode_name[int32(cfg.Mode)]; !ok {
+		return nil, errors.New("Invalid mode in config file.")
+	}
 	if encrypted {
 		cfg.FPSecret = cp.FPSecret
-		if len(cp.EncryptionKey) != 32 {
-			return nil, errors.New("Invalid encryption key in config file.")
+		if len(cp.PublicKey) > 0 {
+			if len(cp.PublicKey) != 32 || len(cp.EncryptionKey) != 0 {
+				return nil, errors.New("Invalid public key in config file.")
+			}
+			var pub EncKey
+			copy(pub[:], cp.PublicKey)
+			cfg.PublicKey = &pub
+		} else {
+			if len(cp.EncryptionKey) != 32 {
+				return nil, errors.New("Invalid encryption key in config file.")
+			}
+			var mykey EncKey
+			copy(mykey[:], cp.EncryptionKey)
+			cfg.EncryptionKey = &mykey
+		}
+		if len(cp.NewFPSecret) > 0 {
+			r, err := keyRotationFromProto(&cp)
+			if err != nil {
+				return nil, err
+			}
+			cfg.Rotation = r
 		}
-		var mykey EncKey
-		copy(mykey[:], cp.EncryptionKey)
-		cfg.EncryptionKey = &mykey
 	}
 	checkConfig(cfg, encrypted)
 	return cfg, nil
 }
 
-func writeEncConfig(sm StorageMgr, d, p string, t EncType, iterations int64, salt, config []byte) error {
-	ec := EncConfigProto{Version: VC_VERSION, Type: t, Iterations: iterations, Salt: salt, Config: config}
-	pb, err := proto.Marshal(&ec)
+func encodeEncConfig(ec *EncConfigProto) ([]byte, error) {
+	pb, err := proto.Marshal(ec)
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	buf.Write([]byte(VC_MAGIC))
+	buf.Write(pb)
+	return buf.Bytes(), nil
+}
+
+// setEncConfigKdf records the key derivation function in the config file.
+// Config files not using PBKDF2 have a higher version so that older versions
+// of vecbackup refuse them instead of reporting a wrong password.
+func setEncConfigKdf(ec *EncConfigProto, kdf *KdfParams) {
+	ec.Version = VC_VERSION
+	ec.Kdf = kdf.Type
+	ec.Iterations = 0
+	ec.Argon2Memory = 0
+	ec.Argon2Time = 0
+	ec.Argon2Threads = 0
+	if kdf.Type == KdfType_ARGON2ID {
+		ec.Version = VC_VERSION_ARGON2
+		ec.Argon2Memory = int32(kdf.Memory)
+		ec.Argon2Time = int32(kdf.Time)
+		ec.Argon2Threads = int32(kdf.Threads)
+	} else if kdf.Type == KdfType_RAW_KEY {
+		ec.Version = VC_VERSION_ARGON2
+	} else {
+		ec.Iterations = int64(kdf.Iterations)
+	}
+}
+
+func kdfFromEncConfig(ec *EncConfigProto) (*KdfParams, error) {
+	return makeKdfParams(ec.Kdf, ec.Iterations, ec.Argon2Memory, ec.Argon2Time, ec.Argon2Threads)
+}
+
+func makeKdfParams(t KdfType, iterations int64, memory, time, threads int32) (*KdfParams, error) {
+	kdf := &KdfParams{Type: t}
+	if t == KdfType_ARGON2ID {
+		kdf.Memory = int(memory)
+		kdf.Time = int(time)
+		kdf.Threads = int(threads)
+	} else if t == KdfType_PBKDF2_SHA1 {
+		if iterations > math.MaxInt32 {
+			return nil, errors.New("Invalid key derivation parameters in config file.")
+		}
+		kdf.Iterations = int(iterations)
+	}
+	if err := checkKdf(kdf); err != nil {
+		return nil, fmt.Errorf("Invalid key derivation parameters in config file: %s", err)
+	}
+	return kdf, nil
+}
+
+func writeEncConfig(sm StorageMgr, d, p string, t EncType, kdf *KdfParams, salt, config []byte) error {
+	ec := EncConfigProto{Version: VC_VERSION, Type: t, Salt: salt, Config: config}
+	if kdf != nil {
+		setEncConfigKdf(&ec, kdf)
+	}
+	b, err := encodeEncConfig(&ec)
 	if err != nil {
 		return err
 	}
@@ -74,25 +194,62 @@ func writeEncConfig(sm StorageMgr, d, p string, t EncType, iterations int64, sal
 	} else if exists {
 		return fmt.Errorf("Config file already exists in repo: %s", d)
 	}
-	var buf bytes.Buffer
-	buf.Write([]byte(VC_MAGIC))
-	buf.Write(pb)
-	return sm.WriteFile(fp, buf.Bytes())
+	return sm.WriteFile(fp, b)
+}
+
+// replaceEncConfig overwrites the config file of a repo. A copy of the old
+// config file is kept until the new one is written so that the repo is
+// still usable if writing the new config file fails half way.
+func replaceEncConfig(sm StorageMgr, repo string, old []byte, ec *EncConfigProto) error {
+	b, err := encodeEncConfig(ec)
+	if err != nil {
+		return err
+	}
+	bp := sm.JoinPath(repo, CONFIG_BACKUP_FILE)
+	if err := sm.WriteFile(bp, old); err != nil {
+		return fmt.Errorf("Cannot write backup copy of config file: %s", err)
+	}
+	if err := sm.WriteFile(sm.JoinPath(repo, CONFIG_FILE), b); err != nil {
+		return fmt.Errorf("Cannot write config file: %s", err)
+	}
+	return sm.DeleteFile(bp)
 }
 
-func WriteNewConfig(pwFile string, sm StorageMgr, repo string, rounds int, cfg *Config) error {
-	if pwFile == "" {
+// readEncConfig reads the config file of a repo. It falls back to the
+// backup copy left behind by a failed replaceEncConfig.
+func readEncConfig(sm StorageMgr, repo string) ([]byte, *EncConfigProto, error) {
+	b, err := sm.ReadFile(sm.JoinPath(repo, CONFIG_FILE), &bytes.Buffer{}, &bytes.Buffer{})
+	if err == nil {
+		var ec *EncConfigProto
+		if ec, err = decodeConfig(b); err == nil {
+			return b, ec, nil
+		}
+		err = fmt.Errorf("Invalid repository: %s", err)
+	} else if os.IsNotExist(err) {
+		err = fmt.Errorf("Repo config is not found in %s. Is this a repo?", repo)
+	}
+	if b2, err2 := sm.ReadFile(sm.JoinPath(repo, CONFIG_BACKUP_FILE), &bytes.Buffer{}, &bytes.Buffer{}); err2 == nil {
+		if ec, err2 := decodeConfig(b2); err2 == nil {
+			stderr.Printf("Using backup copy of config file: %s\n", err)
+			return b2, ec, nil
+		}
+	}
+	return nil, nil, err
+}
+
+func WriteNewConfig(pwSrc *PwSource, sm StorageMgr, repo string, kdf *KdfParams, cfg *Config) error {
+	if pwSrc == nil {
 		configBytes, err := configToBytes(cfg, false)
 		if err != nil {
 			return err
 		}
-		return writeEncConfig(sm, repo, CONFIG_FILE, EncType_NO_ENCRYPTION, 0, nil, configBytes)
+		return writeEncConfig(sm, repo, CONFIG_FILE, EncType_NO_ENCRYPTION, nil, nil, configBytes)
 	}
-	pw, err := ioutil.ReadFile(pwFile)
+	pw, kdf, err := readNewPw(pwSrc, kdf)
 	if err != nil {
-		return fmt.Errorf("Cannot read password file: %s", pwFile)
+		return err
 	}
-	salt, masterKey, storageKey, fpSecret, err := genKey(pw, rounds)
+	salt, masterKey, storageKey, fpSecret, err := genKey(pw, kdf)
 	if err != nil {
 		return err
 	}
@@ -106,7 +263,72 @@ func WriteNewConfig(pwFile string, sm StorageMgr, repo string, rounds int, cfg *
 	if err != nil {
 		return err
 	}
-	return writeEncConfig(sm, repo, CONFIG_FILE, EncType_SYMMETRIC, int64(rounds), salt, enc)
+	return writeEncConfig(sm, repo, CONFIG_FILE, EncType_SYMMETRIC, kdf, salt, enc)
+}
+
+// WriteNewAsymmetricConfig writes the config of a new ASYMMETRIC repo with
+// a new key pair. The password opens the key slot DEFAULT_KEY_LABEL, which
+// has the private key. Write-only key slots can be added later.
+func WriteNewAsymmetricConfig(pwSrc *PwSource, sm StorageMgr, repo string, kdf *KdfParams, cfg *Config) error {
+	if pwSrc == nil {
+		return errors.New("Asymmetric encryption needs a password.")
+	}
+	pw, kdf, err := readNewPw(pwSrc, kdf)
+	if err != nil {
+		return err
+	}
+	configKey, fpSecret, err := genSecrets()
+	if err != nil {
+		return err
+	}
+	pub, priv, err := genKeyPair()
+	if err != nil {
+		return err
+	}
+	cfg.PublicKey = pub
+	cfg.FPSecret = fpSecret
+	ec, err := asymmetricEncConfig(pw, kdf, configKey, cfg, priv)
+	if err != nil {
+		return err
+	}
+	return writeConfigFile(sm, repo, ec, false)
+}
+
+// asymmetricEncConfig returns the config file of an ASYMMETRIC repo with
+// the config encrypted with the config key and a single key slot
+// DEFAULT_KEY_LABEL for the password that holds the private key.
+func asymmetricEncConfig(pw []byte, kdf *KdfParams, configKey *EncKey, cfg *Config, priv *EncKey) (*EncConfigProto, error) {
+	configBytes, err := configToBytes(cfg, true)
+	if err != nil {
+		return nil, err
+	}
+	enc, err := encryptBytes(configKey, configBytes, nil)
+	if err != nil {
+		return nil, err
+	}
+	slot := &KeySlotProto{Label: DEFAULT_KEY_LABEL}
+	if err := wrapKeySlot(slot, pw, kdf, configKey, priv); err != nil {
+		return nil, err
+	}
+	return &EncConfigProto{Version: VC_VERSION_SLOTS, Type: EncType_ASYMMETRIC, Config: enc, Slots: []*KeySlotProto{slot}}, nil
+}
+
+// writeConfigFile writes the config file of a repo. It fails if the repo
+// already has a config file unless overwrite is true.
+func writeConfigFile(sm StorageMgr, repo string, ec *EncConfigProto, overwrite bool) error {
+	b, err := encodeEncConfig(ec)
+	if err != nil {
+		return err
+	}
+	fp := sm.JoinPath(repo, CONFIG_FILE)
+	if !overwrite {
+		if exists, err := sm.FileExists(fp); err != nil {
+			return err
+		} else if exists {
+			return fmt.Errorf("Config file already exists in repo: %s", repo)
+		}
+	}
+	return sm.WriteFile(fp, b)
 }
 
 func decodeConfig(data []byte) (*EncConfigProto, error) {
@@ -123,43 +345,188 @@ func decodeConfig(data []byte) (*EncConfigProto, error) {
 			return nil, err
 		}
 	}
-	if ec.Version != VC_VERSION {
+	if ec.Version != VC_VERSION && ec.Version != VC_VERSION_ARGON2 && ec.Version != VC_VERSION_SLOTS {
 		return nil, errors.New("Incompatible config file.")
 	}
 	return &ec, nil
 }
 
-func GetConfig(pwFile string, sm StorageMgr, repo string) (*Config, error) {
-	b, err := sm.ReadFile(sm.JoinPath(repo, CONFIG_FILE), &bytes.Buffer{}, &bytes.Buffer{})
+// GetConfig reads the config of the repo. The storage manager then keeps
+// to the mode of the repo.
+func GetConfig(pwSrc *PwSource, sm StorageMgr, repo string) (*Config, error) {
+	_, ec, err := readEncConfig(sm, repo)
 	if err != nil {
-		if os.IsNotExist(err) {
-			return nil, fmt.Errorf("Repo config is not found in %s. Is this a repo?", repo)
-		}
 		return nil, err
 	}
-	ec, err := decodeConfig(b)
+	configBytes, _, priv, err := decryptConfig(pwSrc, ec)
 	if err != nil {
-		return nil, fmt.Errorf("Invalid repository: %s", err)
+		return nil, err
+	}
+	cfg, err := configFromBytes(configBytes, ec.Type != EncType_NO_ENCRYPTION)
+	if err != nil {
+		return nil, err
+	}
+	if (cfg.PublicKey != nil) != (ec.Type == EncType_ASYMMETRIC) {
+		return nil, errors.New("Invalid repository: Wrong encryption type.")
 	}
+	cfg.PrivateKey = priv
+	setGuardMode(sm, cfg.Mode)
+	return cfg, nil
+}
+
+// decryptConfig returns the config bytes and the key used to encrypt the
+// config, which is nil if the repo is not encrypted. The key is the master
+// key derived from the password or the config key of a repo with key slots.
+// The private key of an ASYMMETRIC repo is nil for write-only key slots.
+func decryptConfig(pwSrc *PwSource, ec *EncConfigProto) ([]byte, *EncKey, *EncKey, error) {
 	if ec.Type == EncType_NO_ENCRYPTION {
-		if pwFile != "" {
-			return nil, errors.New("Backup is not encrypted")
+		if pwSrc != nil {
+			return nil, nil, nil, errors.New("Backup is not encrypted")
+		}
+		return ec.Config, nil, nil, nil
+	} else if ec.Type != EncType_SYMMETRIC && (ec.Type != EncType_ASYMMETRIC || ec.Version != VC_VERSION_SLOTS) {
+		return nil, nil, nil, errors.New("Unknown encryption type.")
+	}
+	if pwSrc == nil {
+		return nil, nil, nil, errors.New("Backup is encrypted")
+	}
+	pw, err := readPw(pwSrc)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	var key, priv *EncKey
+	if ec.Version == VC_VERSION_SLOTS {
+		if _, key, priv, err = openKeySlot(ec, pw); err != nil {
+			return nil, nil, nil, err
+		}
+	} else {
+		kdf, err := kdfFromEncConfig(ec)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		if key = getMasterKey(pw, ec.Salt, kdf); key == nil {
+			return nil, nil, nil, errors.New("Wrong password")
 		}
-		return configFromBytes(ec.Config, false)
-	} else if ec.Type != EncType_SYMMETRIC {
-		return nil, errors.New("Unknown encryption type.")
 	}
-	if pwFile == "" {
-		return nil, errors.New("Backup is encrypted")
+	configBytes, err := decryptBytes(key, ec.Config, nil)
+	if err != nil {
+		return nil, nil, nil, errors.New("Wrong password")
+	}
+	return configBytes, key, priv, nil
+}
+
+// UpdateConfig replaces the config of an existing repo. The password and
+// the encryption keys are not changed.
+func UpdateConfig(pwSrc *PwSource, sm StorageMgr, repo string, cfg *Config) error {
+	old, ec, err := readEncConfig(sm, repo)
+	if err != nil {
+		return err
 	}
-	pw, err := ioutil.ReadFile(pwFile)
+	_, masterKey, _, err := decryptConfig(pwSrc, ec)
 	if err != nil {
-		return nil, fmt.Errorf("Cannot read pw file: %s", err)
+		return err
 	}
-	masterKey := getMasterKey(pw, ec.Salt, int(ec.Iterations))
-	configBytes, err := decryptBytes(masterKey, ec.Config, nil)
+	configBytes, err := configToBytes(cfg, masterKey != nil)
 	if err != nil {
-		return nil, errors.New("Wrong password")
+		return err
+	}
+	if masterKey == nil {
+		ec.Config = configBytes
+	} else if ec.Config, err = encryptBytes(masterKey, configBytes, nil); err != nil {
+		return err
+	}
+	return replaceEncConfig(sm, repo, old, ec)
+}
+
+// ChangeKdf encrypts the config of an existing repo again with a master key
+// derived from the same password with the given key derivation function
+// and a new salt. The encryption keys of the repo are not changed.
+func ChangeKdf(pwSrc *PwSource, sm StorageMgr, repo string, kdf *KdfParams) error {
+	if err := checkKdf(kdf); err != nil {
+		return err
+	}
+	return rewrapConfig(pwSrc, pwSrc, sm, repo, kdf)
+}
+
+// ChangeConfigPassword encrypts the config of an existing repo again with a
+// master key derived from the new password and a new salt. The existing
+// key derivation function is kept if kdf is nil. The encryption keys of
+// the repo are not changed so no chunks need to be rewritten.
+func ChangeConfigPassword(pwSrc, newPwSrc *PwSource, sm StorageMgr, repo string, kdf *KdfParams) error {
+	if kdf != nil {
+		if err := checkKdf(kdf); err != nil {
+			return err
+		}
+	}
+	return rewrapConfig(pwSrc, newPwSrc, sm, repo, kdf)
+}
+
+// rewrapConfig wraps the config, or the key slot opened by the password,
+// with the new password. The existing key derivation function is kept if
+// kdf is nil.
+func rewrapConfig(pwSrc, newPwSrc *PwSource, sm StorageMgr, repo string, kdf *KdfParams) error {
+	old, ec, err := readEncConfig(sm, repo)
+	if err != nil {
+		return err
+	}
+	if ec.Type == EncType_NO_ENCRYPTION {
+		return errors.New("Backup is not encrypted")
+	}
+	if ec.Version == VC_VERSION_SLOTS {
+		oldPw, err := readPw(pwSrc)
+		if err != nil {
+			return err
+		}
+		i, key, priv, err := openKeySlot(ec, oldPw)
+		if err != nil {
+			return err
+		}
+		if kdf == nil {
+			if kdf, err = kdfFromKeySlot(ec.Slots[i]); err != nil {
+				return err
+			}
+		}
+		pw, kdf, err := readNewPw(newPwSrc, kdf)
+		if err != nil {
+			return err
+		}
+		if err := wrapKeySlot(ec.Slots[i], pw, kdf, key, priv); err != nil {
+			return err
+		}
+		return replaceEncConfig(sm, repo, old, ec)
+	}
+	configBytes, _, _, err := decryptConfig(pwSrc, ec)
+	if err != nil {
+		return err
+	}
+	if kdf == nil {
+		if kdf, err = kdfFromEncConfig(ec); err != nil {
+			return err
+		}
+	}
+	pw, kdf, err := readNewPw(newPwSrc, kdf)
+	if err != nil {
+		return err
+	}
+	if err := wrapConfig(ec, pw, kdf, configBytes); err != nil {
+		return err
+	}
+	return replaceEncConfig(sm, repo, old, ec)
+}
+
+// wrapConfig encrypts the config bytes with a master key derived from the
+// password with a new salt.
+func wrapConfig(ec *EncConfigProto, pw []byte, kdf *KdfParams, configBytes []byte) error {
+	salt := make([]byte, 32)
+	if _, err := io.ReadFull(rand.Reader, salt); err != nil {
+		return err
+	}
+	enc, err := encryptBytes(getMasterKey(pw, salt, kdf), configBytes, nil)
+	if err != nil {
+		return err
 	}
-	return configFromBytes(configBytes, true)
+	ec.Salt = salt
+	ec.Config = enc
+	setEncConfigKdf(ec, kdf)
+	return nil
 }
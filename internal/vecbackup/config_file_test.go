@@ -3,13 +3,14 @@ package vecbackup
 import (
 	"bytes"
 	"io/ioutil"
+	"log"
 	"os"
 	"path/filepath"
 	"testing"
 )
 
 func equalConfig(cfg1, cfg2 *Config) bool {
-	return cfg1.ChunkSize == cfg2.ChunkSize && equalKey(cfg1.EncryptionKey, cfg2.EncryptionKey) && bytes.Compare(cfg1.FPSecret, cfg2.FPSecret) == 0 && cfg1.Compress == cfg2.Compress
+	return cfg1.ChunkSize == cfg2.ChunkSize && equalKey(cfg1.EncryptionKey, cfg2.EncryptionKey) && bytes.Compare(cfg1.FPSecret, cfg2.FPSecret) == 0 && cfg1.Compress == cfg2.Compress && cfg1.Chunking == cfg2.Chunking && cfg1.MinChunkSize == cfg2.MinChunkSize && cfg1.MaxChunkSize == cfg2.MaxChunkSize && cfg1.PackSize == cfg2.PackSize && cfg1.CompressionType == cfg2.CompressionType && cfg1.CompressionLevel == cfg2.CompressionLevel && cfg1.Padding == cfg2.Padding
 }
 
 func equalKey(k1, k2 *EncKey) bool {
@@ -20,26 +21,29 @@ func equalKey(k1, k2 *EncKey) bool {
 }
 
 func EncConfigTestHelper(t *testing.T, tmpDir, pwFile, badPwFile string, chunk_size int32, compress CompressionMode) {
-	t.Logf("Testing encconfig pwfile <%s> badpwfile <%s> chunksize %d", pwFile, badPwFile, chunk_size)
-	cfg := &Config{ChunkSize: chunk_size, Compress: compress}
+	EncConfigTestHelper2(t, tmpDir, pwFile, badPwFile, &Config{ChunkSize: chunk_size, Compress: compress, CompressionType: CompressionType_ZLIB}, &KdfParams{Iterations: 200000})
+}
+
+func EncConfigTestHelper2(t *testing.T, tmpDir, pwFile, badPwFile string, cfg *Config, kdf *KdfParams) {
+	t.Logf("Testing encconfig pwfile <%s> badpwfile <%s> config %+v", pwFile, badPwFile, cfg)
 	_ = os.Remove(filepath.Join(tmpDir, CONFIG_FILE))
 	defer os.Remove(filepath.Join(tmpDir, CONFIG_FILE))
 	sm, repo2 := GetStorageMgr(tmpDir)
-	err := WriteNewConfig(pwFile, sm, repo2, 200000, cfg)
+	err := WriteNewConfig(PwFile(pwFile), sm, repo2, kdf, cfg)
 	if err != nil {
 		t.Fatal("Cannot save config:", err)
 	}
 	if pwFile != "" {
-		_, err = GetConfig("", sm, repo2)
+		_, err = GetConfig(nil, sm, repo2)
 		if err == nil {
 			t.Fatal("Should not be able to load encrypted config without pw file")
 		}
 	}
-	_, err = GetConfig(badPwFile, sm, repo2)
+	_, err = GetConfig(PwFile(badPwFile), sm, repo2)
 	if err == nil {
 		t.Fatal("Should not be able to load config with bad pw file")
 	}
-	cfg2, err := GetConfig(pwFile, sm, repo2)
+	cfg2, err := GetConfig(PwFile(pwFile), sm, repo2)
 	if err != nil {
 		t.Fatal("Cannot load enc config", err)
 	}
@@ -69,4 +73,158 @@ func TestEncConfig(t *testing.T) {
 	EncConfigTestHelper(t, tmpDir, "", badPwFile, 1, CompressionMode_SLOW)
 	EncConfigTestHelper(t, tmpDir, pwFile, badPwFile, 9229283, CompressionMode_YES)
 	EncConfigTestHelper(t, tmpDir, pwFile, badPwFile, 238493, CompressionMode_NO)
+	EncConfigTestHelper2(t, tmpDir, pwFile, badPwFile, &Config{ChunkSize: 4096, Compress: CompressionMode_AUTO, Chunking: ChunkingMode_CDC, MinChunkSize: 1024, MaxChunkSize: 16384, PackSize: 1 << 20, CompressionType: CompressionType_ZSTD, CompressionLevel: 7, Padding: PaddingMode_PADME}, &KdfParams{Iterations: 200000})
+	EncConfigTestHelper2(t, tmpDir, pwFile, badPwFile, &Config{ChunkSize: 4096, Compress: CompressionMode_AUTO, CompressionType: CompressionType_ZLIB}, &KdfParams{Type: KdfType_ARGON2ID, Memory: 1024, Time: 2, Threads: 2})
+}
+
+func TestUpdateConfig(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "config_file_test-*")
+	if err != nil {
+		t.Fatal("Cannot get tempdir", err)
+	}
+	defer os.RemoveAll(tmpDir)
+	pwFile := filepath.Join(tmpDir, "goodpw")
+	badPwFile := filepath.Join(tmpDir, "badpw")
+	ioutil.WriteFile(pwFile, []byte("oicewoe90390j0w9jf0wejf0weh"), 0444)
+	ioutil.WriteFile(badPwFile, []byte("f00fjsoidfjsodjhfosjd"), 0444)
+	sm, repo2 := GetStorageMgr(tmpDir)
+	cfg := &Config{ChunkSize: 1000, Compress: CompressionMode_NO, CompressionType: CompressionType_ZLIB}
+	if err := WriteNewConfig(PwFile(pwFile), sm, repo2, &KdfParams{Iterations: 100000}, cfg); err != nil {
+		t.Fatal("Cannot save config:", err)
+	}
+	old, err := ioutil.ReadFile(filepath.Join(tmpDir, CONFIG_FILE))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.Compress = CompressionMode_YES
+	cfg.CompressionType = CompressionType_ZSTD
+	if err := UpdateConfig(PwFile(badPwFile), sm, repo2, cfg); err == nil {
+		t.Fatal("Should not be able to update config with bad pw file")
+	}
+	if err := UpdateConfig(PwFile(pwFile), sm, repo2, cfg); err != nil {
+		t.Fatal("Cannot update config:", err)
+	}
+	cfg2, err := GetConfig(PwFile(pwFile), sm, repo2)
+	if err != nil {
+		t.Fatal("Cannot load config", err)
+	}
+	if !equalConfig(cfg, cfg2) {
+		t.Fatal("Configs do not match", cfg, cfg2)
+	}
+	if _, err := os.Stat(filepath.Join(tmpDir, CONFIG_BACKUP_FILE)); !os.IsNotExist(err) {
+		t.Fatal("Backup copy of config file should be removed")
+	}
+	// A broken config file falls back to the backup copy.
+	ioutil.WriteFile(filepath.Join(tmpDir, CONFIG_BACKUP_FILE), old, 0600)
+	ioutil.WriteFile(filepath.Join(tmpDir, CONFIG_FILE), old[:len(old)/2], 0600)
+	save := stderr
+	stderr = log.New(ioutil.Discard, "", 0)
+	defer func() { stderr = save }()
+	if cfg2, err = GetConfig(PwFile(pwFile), sm, repo2); err != nil {
+		t.Fatal("Cannot load config from backup copy", err)
+	}
+	if cfg2.Compress != CompressionMode_NO || !equalKey(cfg.EncryptionKey, cfg2.EncryptionKey) {
+		t.Fatal("Config not loaded from backup copy", cfg2)
+	}
+}
+
+func TestChangeKdf(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "config_file_test-*")
+	if err != nil {
+		t.Fatal("Cannot get tempdir", err)
+	}
+	defer os.RemoveAll(tmpDir)
+	pwFile := filepath.Join(tmpDir, "goodpw")
+	badPwFile := filepath.Join(tmpDir, "badpw")
+	ioutil.WriteFile(pwFile, []byte("oicewoe90390j0w9jf0wejf0weh"), 0444)
+	ioutil.WriteFile(badPwFile, []byte("f00fjsoidfjsodjhfosjd"), 0444)
+	sm, repo2 := GetStorageMgr(tmpDir)
+	cfg := &Config{ChunkSize: 1000, Compress: CompressionMode_NO, CompressionType: CompressionType_ZLIB}
+	if err := WriteNewConfig(PwFile(pwFile), sm, repo2, &KdfParams{Iterations: 100000}, cfg); err != nil {
+		t.Fatal("Cannot save config:", err)
+	}
+	argon2 := &KdfParams{Type: KdfType_ARGON2ID, Memory: 1024, Time: 1, Threads: 1}
+	if err := ChangeKdf(PwFile(badPwFile), sm, repo2, argon2); err == nil {
+		t.Fatal("Should not be able to change kdf with bad pw file")
+	}
+	if err := ChangeKdf(PwFile(pwFile), sm, repo2, &KdfParams{Type: KdfType_ARGON2ID, Memory: 1, Time: 1, Threads: 1}); err == nil {
+		t.Fatal("Should not accept invalid argon2 params")
+	}
+	if err := ChangeKdf(PwFile(pwFile), sm, repo2, argon2); err != nil {
+		t.Fatal("Cannot change kdf:", err)
+	}
+	_, ec, err := readEncConfig(sm, repo2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ec.Kdf != KdfType_ARGON2ID || ec.Version != VC_VERSION_ARGON2 || ec.Iterations != 0 || ec.Argon2Memory != 1024 {
+		t.Fatal("Kdf not changed", ec)
+	}
+	if _, err = GetConfig(PwFile(badPwFile), sm, repo2); err == nil {
+		t.Fatal("Should not be able to load config with bad pw file")
+	}
+	cfg2, err := GetConfig(PwFile(pwFile), sm, repo2)
+	if err != nil {
+		t.Fatal("Cannot load config", err)
+	}
+	if !equalConfig(cfg, cfg2) {
+		t.Fatal("Configs do not match", cfg, cfg2)
+	}
+	if err := ChangeKdf(PwFile(pwFile), sm, repo2, &KdfParams{Iterations: 123456}); err != nil {
+		t.Fatal("Cannot change kdf:", err)
+	}
+	if _, ec, _ = readEncConfig(sm, repo2); ec.Kdf != KdfType_PBKDF2_SHA1 || ec.Version != VC_VERSION || ec.Iterations != 123456 || ec.Argon2Memory != 0 {
+		t.Fatal("Kdf not changed", ec)
+	}
+	if cfg2, err = GetConfig(PwFile(pwFile), sm, repo2); err != nil || !equalConfig(cfg, cfg2) {
+		t.Fatal("Cannot load config", err)
+	}
+}
+
+func TestChangeConfigPassword(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "config_file_test-*")
+	if err != nil {
+		t.Fatal("Cannot get tempdir", err)
+	}
+	defer os.RemoveAll(tmpDir)
+	pwFile := filepath.Join(tmpDir, "goodpw")
+	newPwFile := filepath.Join(tmpDir, "newpw")
+	ioutil.WriteFile(pwFile, []byte("oicewoe90390j0w9jf0wejf0weh"), 0444)
+	ioutil.WriteFile(newPwFile, []byte("f00fjsoidfjsodjhfosjd"), 0444)
+	sm, repo2 := GetStorageMgr(tmpDir)
+	cfg := &Config{ChunkSize: 1000, Compress: CompressionMode_NO, CompressionType: CompressionType_ZLIB}
+	if err := WriteNewConfig(PwFile(pwFile), sm, repo2, &KdfParams{Iterations: 123456}, cfg); err != nil {
+		t.Fatal("Cannot save config:", err)
+	}
+	_, ec, _ := readEncConfig(sm, repo2)
+	oldSalt := ec.Salt
+	if err := ChangeConfigPassword(PwFile(newPwFile), PwFile(pwFile), sm, repo2, nil); err == nil {
+		t.Fatal("Should not be able to change password with bad pw file")
+	}
+	if err := ChangeConfigPassword(PwFile(pwFile), PwFile(newPwFile), sm, repo2, nil); err != nil {
+		t.Fatal("Cannot change password:", err)
+	}
+	if _, ec, _ = readEncConfig(sm, repo2); ec.Iterations != 123456 || bytes.Equal(ec.Salt, oldSalt) {
+		t.Fatal("Kdf should be kept with a new salt", ec)
+	}
+	if exists, _ := sm.FileExists(sm.JoinPath(repo2, CONFIG_BACKUP_FILE)); exists {
+		t.Fatal("Backup copy of config file not removed")
+	}
+	if _, err = GetConfig(PwFile(pwFile), sm, repo2); err == nil {
+		t.Fatal("Should not be able to load config with old pw file")
+	}
+	cfg2, err := GetConfig(PwFile(newPwFile), sm, repo2)
+	if err != nil || !equalConfig(cfg, cfg2) {
+		t.Fatal("Cannot load config with new pw file", err)
+	}
+	argon2 := &KdfParams{Type: KdfType_ARGON2ID, Memory: 1024, Time: 1, Threads: 1}
+	if err := ChangeConfigPassword(PwFile(newPwFile), PwFile(pwFile), sm, repo2, argon2); err != nil {
+		t.Fatal("Cannot change password:", err)
+	}
+	if _, ec, _ = readEncConfig(sm, repo2); ec.Kdf != KdfType_ARGON2ID {
+		t.Fatal("Kdf not changed", ec)
+	}
+	if cfg2, err = GetConfig(PwFile(pwFile), sm, repo2); err != nil || !equalConfig(cfg, cfg2) {
+		t.Fatal("Cannot load config with changed pw file", err)
+	}
 }
@@ -0,0 +1,374 @@
+package vecbackup
+
+import (
+	"bytes"
+	"crypto/sha512"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+)
+
+// copy copies versions from one repo to another without reading the
+// sources again. Only the chunks missing in the destination are copied.
+// If both repos have the same keys, FP secret, padding and compression
+// settings, the stored chunks are copied as they are. Otherwise each chunk
+// is decrypted and checked, compressed again if the compression settings
+// differ, named with the keyed FP of the destination secret and encrypted
+// with the destination key. The version files are rewritten with the
+// destination FPs.
+//
+// A version is saved in the destination after all its chunks, so an
+// interrupted copy leaves no broken version and running it again resumes.
+// Versions already in the destination are skipped. If the FP secrets
+// differ, the destination FPs of chunks copied earlier are found by
+// matching the files of the versions in both repos.
+
+type CopyStats struct {
+	Versions int
+	Chunks   int
+	Size     int64
+	Errors   int
+}
+
+type repoCopier struct {
+	src, dst     *CMgr
+	srcVM, dstVM *VMgr
+	srcSecret    []byte
+	dstSecret    []byte
+	sameSecret   bool
+	raw          bool // Stored chunks are copied as they are.
+	recompress   bool
+	names        map[FP]FP // Destination FPs of source chunks.
+	dstChunks    map[FP]bool
+	verbose      bool
+	maxDop       int
+	locks        []*repoLock // Checked before a version is saved.
+	st           *CopyStats
+	mu           sync.Mutex // protects names, dstChunks and st
+}
+
+func sameEncKey(a, b *EncKey) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return *a == *b
+}
+
+func sameStorageKey(a, b *storageKey) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return a.padding == b.padding && sameEncKey(a.key, b.key) && sameEncKey(a.pub, b.pub)
+}
+
+// sameFileChunks returns whether two file entries have the same chunks.
+func sameFileChunks(a, b *FileData) bool {
+	if !a.IsFile() || !b.IsFile() || a.Size != b.Size || !bytes.Equal(a.FileChecksum, b.FileChecksum) || len(a.Chunks) != len(b.Chunks) || len(a.Sizes) != len(b.Sizes) {
+		return false
+	}
+	for i := range a.Sizes {
+		if a.Sizes[i] != b.Sizes[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// matchVersions finds the destination FPs of source chunks from the
+// versions in both repos.
+func (c *repoCopier) matchVersions(versions []string) {
+	for _, v := range versions {
+		sfds, err, _ := c.srcVM.LoadFiles(v)
+		if err != nil {
+			continue
+		}
+		dfds, err, _ := c.dstVM.LoadFiles(v)
+		if err != nil {
+			continue
+		}
+		dm := make(map[string]*FileData)
+		for _, fd := range dfds {
+			dm[fd.Name] = fd
+		}
+		for _, fd := range sfds {
+			if dfd := dm[fd.Name]; dfd != nil && sameFileChunks(fd, dfd) {
+				for i, fp := range fd.Chunks {
+					c.names[fp] = dfd.Chunks[i]
+				}
+			}
+		}
+	}
+}
+
+// dstFP returns the destination FP of a source chunk if the destination
+// has it.
+func (c *repoCopier) dstFP(fp FP) (FP, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.sameSecret {
+		return fp, c.dstChunks[fp]
+	}
+	newFp, ok := c.names[fp]
+	return newFp, ok && c.dstChunks[newFp]
+}
+
+func (c *repoCopier) added(fp, newFp FP, size int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.names[fp] = newFp
+	c.dstChunks[newFp] = true
+	if size > 0 {
+		c.st.Chunks++
+		c.st.Size += int64(size)
+	}
+}
+
+// copyChunk copies one chunk and returns its destination FP and the
+// number of bytes written.
+func (c *repoCopier) copyChunk(fp FP, rmem *readChunkMem, amem *addChunkMem) (FP, int, error) {
+	stored, err := c.src.readStored(fp, rmem)
+	if err != nil {
+		return FP{}, 0, err
+	}
+	if c.raw {
+		return fp, len(stored), c.dst.storeChunk(fp, stored)
+	}
+	text := stored
+	if c.src.key != nil {
+		if text, err = c.src.key.decrypt(stored, rmem.encBuf); err != nil {
+			return FP{}, 0, err
+		}
+		rmem.encBuf = text
+	}
+	if len(text) == 0 {
+		return FP{}, 0, errors.New("Empty chunk")
+	}
+	plain, err := uncompressChunk(text, &rmem.compBuf)
+	if err != nil {
+		return FP{}, 0, err
+	}
+	origFp := sha512.Sum512_256(plain)
+	if makeChunkFP(c.srcSecret, origFp) != fp {
+		return FP{}, 0, errors.New("Chunk checksum mismatch")
+	}
+	newFp := makeChunkFP(c.dstSecret, origFp)
+	c.mu.Lock()
+	exists := c.dstChunks[newFp]
+	c.mu.Unlock()
+	if exists {
+		return newFp, 0, c.dst.keepChunk(newFp)
+	}
+	out := text
+	if c.recompress {
+		if len(plain) > amem.chunkSize {
+			*amem = *makeAddChunkMem(len(plain))
+		}
+		amem.setSize(len(plain))
+		copy(amem.buf(), plain)
+		if out, err = compressChunk(amem, c.dst.compress, c.dst.compType, c.dst.compLevel); err != nil {
+			return FP{}, 0, err
+		}
+	}
+	if c.dst.key != nil {
+		if out, err = c.dst.key.encrypt(out, amem.encBuf); err != nil {
+			return FP{}, 0, err
+		}
+		amem.encBuf = out
+	}
+	return newFp, len(out), c.dst.storeChunk(newFp, out)
+}
+
+// copyChunks copies the chunks in parallel and returns the number of
+// chunks that failed.
+func (c *repoCopier) copyChunks(chunks []FP) int {
+	var wg sync.WaitGroup
+	errs := 0
+	ch := make(chan FP)
+	for i := 0; i < c.maxDop; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			rmem := &readChunkMem{}
+			amem := makeAddChunkMem(0)
+			for fp := range ch {
+				newFp, size, err := c.copyChunk(fp, rmem, amem)
+				if err != nil {
+					c.mu.Lock()
+					stderr.Printf("Cannot copy chunk %s: %s\n", fp, err)
+					errs++
+					c.mu.Unlock()
+					continue
+				}
+				if c.verbose && size > 0 {
+					stdout.Printf("Copy %s -> %s\n", fp, newFp)
+				}
+				c.added(fp, newFp, size)
+			}
+		}()
+	}
+	for _, fp := range chunks {
+		ch <- fp
+	}
+	close(ch)
+	wg.Wait()
+	return errs
+}
+
+// copyVersionChunks copies the chunks of the version that are missing in
+// the destination. It returns the files of the version with the chunks of
+// the destination.
+func (c *repoCopier) copyVersionChunks(v string) ([]*FileData, error) {
+	fds, err, errs := c.srcVM.LoadFiles(v)
+	if err != nil {
+		return nil, fmt.Errorf("Cannot read version %s: %s", v, err)
+	}
+	if errs > 0 {
+		return nil, fmt.Errorf("Error! Some file info were invalid in version %s", v)
+	}
+	var chunks []FP
+	seen := make(map[FP]bool)
+	for _, fd := range fds {
+		for _, fp := range fd.Chunks {
+			if newFp, ok := c.dstFP(fp); ok {
+				if err := c.dst.keepChunk(newFp); err != nil {
+					return nil, err
+				}
+			} else if !seen[fp] {
+				seen[fp] = true
+				chunks = append(chunks, fp)
+			}
+		}
+	}
+	if n := c.copyChunks(chunks); n > 0 {
+		c.st.Errors += n
+		return nil, fmt.Errorf("Failed to copy %d chunk(s) of version %s.", n, v)
+	}
+	if err := c.dst.Flush(); err != nil {
+		return nil, err
+	}
+	for _, fd := range fds {
+		for i, fp := range fd.Chunks {
+			newFp, ok := c.dstFP(fp)
+			if !ok {
+				return nil, fmt.Errorf("Chunk %s of %s in version %s is missing", fp, fd.Name, v)
+			}
+			fd.Chunks[i] = newFp
+		}
+	}
+	return fds, nil
+}
+
+func (c *repoCopier) copyVersion(v string) error {
+	fds, err := c.copyVersionChunks(v)
+	if err != nil {
+		return err
+	}
+	if err := checkLocks(c.locks...); err != nil {
+		return err
+	}
+	if err := c.dstVM.SaveFiles(v, fds); err != nil {
+		return fmt.Errorf("Cannot write version %s: %s", v, err)
+	}
+	if c.verbose {
+		stdout.Printf("Copy version %s\n", v)
+	}
+	c.st.Versions++
+	return nil
+}
+
+// Copy copies all versions of the repo, or only the given version, to
+// another repo. Versions already in the destination are skipped. It can
+// be run again to resume if it is interrupted.
+func Copy(pwSrc, toPwSrc *PwSource, repo, toRepo, version, lockFile string, verbose bool, maxDop int, st *CopyStats) error {
+	if repo == "" {
+		return errors.New("Backup repository must be specified.")
+	}
+	if toRepo == "" {
+		return errors.New("Destination repository must be specified.")
+	}
+	if repo == toRepo {
+		return errors.New("Source and destination must be different repositories.")
+	}
+	srcVM, srcCM, srcCfg, err := setup(repo, pwSrc)
+	if err != nil {
+		return err
+	}
+	dstVM, dstCM, dstCfg, err := setup(toRepo, toPwSrc)
+	if err != nil {
+		return fmt.Errorf("Cannot open destination: %s", err)
+	}
+	var sml StorageMgr
+	var lockFile2 string
+	if lockFile == "" {
+		var repo2 string
+		sml, repo2 = GetStorageMgr(toRepo)
+		lockFile = sml.JoinPath(toRepo, LOCK_FILENAME)
+		lockFile2 = sml.JoinPath(repo2, LOCK_FILENAME)
+	} else {
+		sml, lockFile2 = GetStorageMgr(lockFile)
+	}
+	lk, err := acquireLock(sml, lockFile2, lockFile)
+	if err != nil {
+		return err
+	}
+	defer lk.release()
+	srl, err := lockRepoForRead(srcCM.sm, repo, srcCM.repo)
+	if err != nil {
+		return err
+	}
+	defer srl.release()
+	drl, err := lockRepo(dstCM.sm, toRepo, dstCM.repo, false)
+	if err != nil {
+		return err
+	}
+	defer drl.release()
+	if err := dstCM.LoadPendingDeletion(); err != nil {
+		return fmt.Errorf("Cannot read pending deletion list of destination: %s", err)
+	}
+	versions, err := srcVM.GetVersions()
+	if err != nil {
+		return fmt.Errorf("Cannot read version files: %s", err)
+	}
+	dstVersions, err := dstVM.GetVersions()
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("Cannot read version files of destination: %s", err)
+	}
+	have := make(map[string]bool)
+	var common []string
+	for _, v := range dstVersions {
+		have[v] = true
+	}
+	for _, v := range versions {
+		if have[v] {
+			common = append(common, v)
+		}
+	}
+	if version != "" {
+		found := false
+		for _, v := range versions {
+			found = found || v == version
+		}
+		if !found {
+			return fmt.Errorf("Version %s not found", version)
+		}
+		versions = []string{version}
+	}
+	c := &repoCopier{src: srcCM, dst: dstCM, srcVM: srcVM, dstVM: dstVM, srcSecret: srcCfg.FPSecret, dstSecret: dstCfg.FPSecret, names: make(map[FP]FP), verbose: verbose, maxDop: maxDop, locks: []*repoLock{lk, srl, drl}, st: st}
+	c.sameSecret = bytes.Equal(c.srcSecret, c.dstSecret)
+	c.recompress = srcCfg.Compress != dstCfg.Compress || srcCfg.CompressionType != dstCfg.CompressionType || srcCfg.CompressionLevel != dstCfg.CompressionLevel
+	c.raw = c.sameSecret && !c.recompress && sameStorageKey(srcCM.key, dstCM.key)
+	if !c.sameSecret {
+		c.matchVersions(common)
+	}
+	c.dstChunks = dstCM.GetAllChunks()
+	for _, v := range versions {
+		if have[v] {
+			continue
+		}
+		if err := c.copyVersion(v); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -3,8 +3,11 @@ package vecbackup
 import (
 	"crypto/rand"
 	"crypto/sha1"
+	"crypto/sha512"
 	"errors"
 	"fmt"
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/nacl/box"
 	"golang.org/x/crypto/nacl/secretbox"
 	"golang.org/x/crypto/pbkdf2"
 	"io"
@@ -42,27 +45,174 @@ func decryptBytes(key *EncKey, encrypted []byte, out []byte) ([]byte, error) {
 	return decrypted, nil
 }
 
-func genKey(pw []byte, rounds int) ([]byte, *EncKey, *EncKey, []byte, error) {
+// In an ASYMMETRIC repo, chunks and version files are sealed with nacl/box
+// to the public key of the repo using a new ephemeral key pair for each
+// item. Only the private key can open them. Backup clients using a
+// write-only key slot get the public key and the FP secret but not the
+// private key, so a compromised client cannot read the data backed up by
+// others or by itself earlier.
+//
+// Dedup still works because chunks are named by the keyed fingerprint,
+// which only needs the FP secret. Pack indexes are encrypted with a
+// symmetric key derived from the FP secret so that write-only clients can
+// find the chunks already in the packs. They contain only the chunk names,
+// offsets and lengths. The storage host still cannot guess contents as it
+// does not have the FP secret. A write-only client can check whether a
+// chunk with a guessed content exists, but it cannot read any chunk.
+// Write-only clients cannot read the previous version either. They keep
+// a local copy of the last version they backed up instead, see
+// manifest_cache.go.
+
+var errNoPrivateKey = errors.New("The private key is needed, this key can only be used for backups.")
+
+// storageKey encrypts the chunks and version files of a repo.
+type storageKey struct {
+	key     *EncKey // SYMMETRIC
+	pub     *EncKey // ASYMMETRIC
+	priv    *EncKey // ASYMMETRIC, nil for write-only keys
+	padding PaddingMode
+}
+
+// makeStorageKey returns nil if the repo is not encrypted.
+func makeStorageKey(cfg *Config) *storageKey {
+	if cfg.EncryptionKey != nil {
+		return &storageKey{key: cfg.EncryptionKey, padding: cfg.Padding}
+	} else if cfg.PublicKey != nil {
+		return &storageKey{pub: cfg.PublicKey, priv: cfg.PrivateKey, padding: cfg.Padding}
+	}
+	return nil
+}
+
+// makeIndexKey returns the key for pack indexes. It is known to write-only
+// clients in ASYMMETRIC repos.
+func makeIndexKey(cfg *Config) *EncKey {
+	if cfg.EncryptionKey != nil {
+		return cfg.EncryptionKey
+	} else if cfg.PublicKey != nil {
+		var key EncKey = sha512.Sum512_256(append([]byte("vecbackup pack index\x00"), cfg.FPSecret...))
+		return &key
+	}
+	return nil
+}
+
+func (k *storageKey) encrypt(text []byte, out []byte) ([]byte, error) {
+	text = padText(k.padding, text)
+	if k.key != nil {
+		return encryptBytes(k.key, text, out)
+	}
+	return box.SealAnonymous(out[:0], text, (*[32]byte)(k.pub), rand.Reader)
+}
+
+func (k *storageKey) decrypt(encrypted []byte, out []byte) ([]byte, error) {
+	if k.key != nil {
+		decrypted, err := decryptBytes(k.key, encrypted, out)
+		if err != nil {
+			return nil, err
+		}
+		return unpadText(k.padding, decrypted)
+	}
+	if k.priv == nil {
+		return nil, errNoPrivateKey
+	}
+	decrypted, ok := box.OpenAnonymous(out[:0], encrypted, (*[32]byte)(k.pub), (*[32]byte)(k.priv))
+	if !ok {
+		return nil, errors.New("Unable to decrypt")
+	}
+	return unpadText(k.padding, decrypted)
+}
+
+// writeOnly returns true if the key can encrypt but not decrypt.
+func (k *storageKey) writeOnly() bool {
+	return k != nil && k.key == nil && k.priv == nil
+}
+
+func genKeyPair() (*EncKey, *EncKey, error) {
+	pub, priv, err := box.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	return (*EncKey)(pub), (*EncKey)(priv), nil
+}
+
+// KdfParams are the parameters of the key derivation function used to
+// turn the password into the master key.
+type KdfParams struct {
+	Type       KdfType
+	Iterations int // PBKDF2
+	Memory     int // Argon2id, in KiB
+	Time       int // Argon2id
+	Threads    int // Argon2id
+}
+
+const (
+	ARGON2_DEFAULT_MEMORY  = 64 * 1024
+	ARGON2_DEFAULT_TIME    = 3
+	ARGON2_DEFAULT_THREADS = 4
+	ARGON2_MAX_MEMORY      = 16 * 1024 * 1024
+	ARGON2_MAX_THREADS     = 255
+)
+
+func checkKdf(kdf *KdfParams) error {
+	if kdf.Type == KdfType_PBKDF2_SHA1 {
+		if kdf.Iterations <= 0 {
+			return errors.New("PBKDF2 iterations must be positive.")
+		}
+	} else if kdf.Type == KdfType_ARGON2ID {
+		if kdf.Time < 1 {
+			return errors.New("Argon2 time must be at least 1.")
+		}
+		if kdf.Threads < 1 || kdf.Threads > ARGON2_MAX_THREADS {
+			return errors.New("Argon2 threads must be between 1 and 255.")
+		}
+		if kdf.Memory < 8*kdf.Threads || kdf.Memory > ARGON2_MAX_MEMORY {
+			return errors.New("Argon2 memory must be between 8 KiB per thread and 16 GiB.")
+		}
+	} else if kdf.Type != KdfType_RAW_KEY {
+		return errors.New("Unknown key derivation function.")
+	}
+	return nil
+}
+
+func genKey(pw []byte, kdf *KdfParams) ([]byte, *EncKey, *EncKey, []byte, error) {
 	salt := make([]byte, 32)
 	if _, err := io.ReadFull(rand.Reader, salt); err != nil {
 		return nil, nil, nil, nil, err
 	}
-	key := pbkdf2.Key(pw, salt, rounds, 32, sha1.New)
-	var masterKey EncKey
-	copy(masterKey[:], key)
-	var storageKey EncKey
-	if _, err := io.ReadFull(rand.Reader, storageKey[:]); err != nil {
+	masterKey := getMasterKey(pw, salt, kdf)
+	storageKey, fpSecret, err := genSecrets()
+	if err != nil {
 		return nil, nil, nil, nil, err
 	}
+	return salt, masterKey, storageKey, fpSecret, nil
+}
+
+// genSecrets returns a random key and a random FP secret.
+func genSecrets() (*EncKey, []byte, error) {
+	var key EncKey
+	if _, err := io.ReadFull(rand.Reader, key[:]); err != nil {
+		return nil, nil, err
+	}
 	fpSecret := make([]byte, 64)
 	if _, err := io.ReadFull(rand.Reader, fpSecret); err != nil {
-		return nil, nil, nil, nil, err
+		return nil, nil, err
 	}
-	return salt, &masterKey, &storageKey, fpSecret, nil
+	return &key, fpSecret, nil
 }
 
-func getMasterKey(pw, salt []byte, rounds int) *EncKey {
-	key := pbkdf2.Key(pw, salt, rounds, 32, sha1.New)
+// getMasterKey derives the master key from the password. kdf must be valid.
+// It returns nil if the password is not a valid raw key for RAW_KEY.
+func getMasterKey(pw, salt []byte, kdf *KdfParams) *EncKey {
+	var key []byte
+	if kdf.Type == KdfType_RAW_KEY {
+		if len(pw) != len(EncKey{}) {
+			return nil
+		}
+		key = pw
+	} else if kdf.Type == KdfType_ARGON2ID {
+		key = argon2.IDKey(pw, salt, uint32(kdf.Time), uint32(kdf.Memory), uint8(kdf.Threads), 32)
+	} else {
+		key = pbkdf2.Key(pw, salt, kdf.Iterations, 32, sha1.New)
+	}
 	var masterKey EncKey
 	copy(masterKey[:], key)
 	return &masterKey
@@ -4,6 +4,8 @@ import (
 	"bytes"
 	"crypto/rand"
 	"crypto/sha512"
+	"golang.org/x/crypto/nacl/box"
+	"golang.org/x/crypto/nacl/secretbox"
 	"io"
 	"testing"
 )
@@ -67,3 +69,57 @@ func testEncrypt(t *testing.T, key, plaintext []byte) {
 	}
 	t.Logf("testEncryptSB succeeded with plaintext len: %d, ciphertext len: %d, overhead: %d", len(plaintext), len(ciphertext), len(ciphertext)-len(plaintext))
 }
+
+func TestPadding(t *testing.T) {
+	for _, c := range []struct {
+		m       PaddingMode
+		n, size int
+	}{
+		{PaddingMode_NO_PADDING, 100, 100},
+		{PaddingMode_POWER_OF_TWO, 0, 4},
+		{PaddingMode_POWER_OF_TWO, 60, 64},
+		{PaddingMode_POWER_OF_TWO, 61, 128},
+		{PaddingMode_POWER_OF_TWO, 1000000, 1 << 20},
+		{PaddingMode_PADME, 0, 4},
+		{PaddingMode_PADME, 60, 64},
+		{PaddingMode_PADME, 61, 72},
+		{PaddingMode_PADME, 1000000, 1015808},
+	} {
+		if size := paddedSize(c.m, c.n); size != c.size {
+			t.Errorf("paddedSize(%s, %d) is %d, should be %d", c.m, c.n, size, c.size)
+		}
+	}
+	pub, priv, err := genKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var key EncKey = sha512.Sum512_256([]byte("sdfsdf09wefjsdlkfjsd"))
+	for _, m := range []PaddingMode{PaddingMode_POWER_OF_TWO, PaddingMode_PADME} {
+		for _, k := range []*storageKey{{key: &key, padding: m}, {pub: pub, priv: priv, padding: m}} {
+			for n := 0; n < 3000; n += 97 {
+				text := make([]byte, n)
+				rand.Read(text)
+				enc, err := k.encrypt(text, nil)
+				if err != nil {
+					t.Fatal(err)
+				}
+				overhead := 24 + secretbox.Overhead
+				if k.key == nil {
+					overhead = box.AnonymousOverhead
+				}
+				if len(enc)-overhead != paddedSize(m, n) {
+					t.Errorf("Wrong padded size %s %d: %d", m, n, len(enc))
+				}
+				dec, err := k.decrypt(enc, nil)
+				if err != nil || !bytes.Equal(text, dec) {
+					t.Fatalf("Padded text mismatch %s %d: %v", m, n, err)
+				}
+			}
+		}
+		bad := padText(m, []byte("abc"))
+		bad[len(bad)-1] = 0xff
+		if _, err := unpadText(m, bad); err == nil {
+			t.Errorf("Invalid padding should fail")
+		}
+	}
+}
@@ -73,11 +73,114 @@ func (FileType) EnumDescriptor() ([]byte, []int) {
 	return file_formats_proto_rawDescGZIP(), []int{0}
 }
 
+type RepoMode int32
+
+const (
+	RepoMode_READ_WRITE RepoMode = 0
+	// Files can be added but not overwritten or deleted.
+	RepoMode_APPEND_ONLY RepoMode = 1
+	// Files cannot be added, overwritten or deleted.
+	RepoMode_READ_ONLY RepoMode = 2
+)
+
+// Enum value maps for RepoMode.
+var (
+	RepoMode_name = map[int32]string{
+		0: "READ_WRITE",
+		1: "APPEND_ONLY",
+		2: "READ_ONLY",
+	}
+	RepoMode_value = map[string]int32{
+		"READ_WRITE":  0,
+		"APPEND_ONLY": 1,
+		"READ_ONLY":   2,
+	}
+)
+
+func (x RepoMode) Enum() *RepoMode {
+	p := new(RepoMode)
+	*p = x
+	return p
+}
+
+func (x RepoMode) String() string {
+	return protoimpl.X.EnumStringOf(x.Descriptor(), protoreflect.EnumNumber(x))
+}
+
+func (RepoMode) Descriptor() protoreflect.EnumDescriptor {
+	return file_formats_proto_enumTypes[1].Descriptor()
+}
+
+func (RepoMode) Type() protoreflect.EnumType {
+	return &file_formats_proto_enumTypes[1]
+}
+
+func (x RepoMode) Number() protoreflect.EnumNumber {
+	return protoreflect.EnumNumber(x)
+}
+
+// Deprecated: Use RepoMode.Descriptor instead.
+func (RepoMode) EnumDescriptor() ([]byte, []int) {
+	return file_formats_proto_rawDescGZIP(), []int{1}
+}
+
+type PaddingMode int32
+
+const (
+	PaddingMode_NO_PADDING PaddingMode = 0
+	// Pads to the next power of two.
+	PaddingMode_POWER_OF_TWO PaddingMode = 1
+	// Padme, at most 12% overhead and leaks O(log log size) bits.
+	PaddingMode_PADME PaddingMode = 2
+)
+
+// Enum value maps for PaddingMode.
+var (
+	PaddingMode_name = map[int32]string{
+		0: "NO_PADDING",
+		1: "POWER_OF_TWO",
+		2: "PADME",
+	}
+	PaddingMode_value = map[string]int32{
+		"NO_PADDING":   0,
+		"POWER_OF_TWO": 1,
+		"PADME":        2,
+	}
+)
+
+func (x PaddingMode) Enum() *PaddingMode {
+	p := new(PaddingMode)
+	*p = x
+	return p
+}
+
+func (x PaddingMode) String() string {
+	return protoimpl.X.EnumStringOf(x.Descriptor(), protoreflect.EnumNumber(x))
+}
+
+func (PaddingMode) Descriptor() protoreflect.EnumDescriptor {
+	return file_formats_proto_enumTypes[2].Descriptor()
+}
+
+func (PaddingMode) Type() protoreflect.EnumType {
+	return &file_formats_proto_enumTypes[2]
+}
+
+func (x PaddingMode) Number() protoreflect.EnumNumber {
+	return protoreflect.EnumNumber(x)
+}
+
+// Deprecated: Use PaddingMode.Descriptor instead.
+func (PaddingMode) EnumDescriptor() ([]byte, []int) {
+	return file_formats_proto_rawDescGZIP(), []int{2}
+}
+
 type EncType int32
 
 const (
 	EncType_NO_ENCRYPTION EncType = 0
 	EncType_SYMMETRIC     EncType = 1
+	EncType_ASYMMETRIC    EncType = 2
 )
 
 // Enum value maps for EncType.
@@ -85,10 +188,12 @@ var (
 	EncType_name = map[int32]string{
 		0: "NO_ENCRYPTION",
 		1: "SYMMETRIC",
+		2: "ASYMMETRIC",
 	}
 	EncType_value = map[string]int32{
 		"NO_ENCRYPTION": 0,
 		"SYMMETRIC":     1,
+		"ASYMMETRIC":    2,
 	}
 )
 
@@ -103,11 +208,11 @@ func (x EncType) String() string {
 }
 
 func (EncType) Descriptor() protoreflect.EnumDescriptor {
-	return file_formats_proto_enumTypes[1].Descriptor()
+	return file_formats_proto_enumTypes[3].Descriptor()
 }
 
 func (EncType) Type() protoreflect.EnumType {
-	return &file_formats_proto_enumTypes[1]
+	return &file_formats_proto_enumTypes[3]
 }
 
 func (x EncType) Number() protoreflect.EnumNumber {
@@ -116,7 +221,57 @@ func (x EncType) Number() protoreflect.EnumNumber {
 
 // Deprecated: Use EncType.Descriptor instead.
 func (EncType) EnumDescriptor() ([]byte, []int) {
-	return file_formats_proto_rawDescGZIP(), []int{1}
+	return file_formats_proto_rawDescGZIP(), []int{3}
+}
+
+type KdfType int32
+
+const (
+	KdfType_PBKDF2_SHA1 KdfType = 0
+	KdfType_ARGON2ID    KdfType = 1
+	// The password is a 32-byte key that is used as the master key.
+	KdfType_RAW_KEY KdfType = 2
+)
+
+// Enum value maps for KdfType.
+var (
+	KdfType_name = map[int32]string{
+		0: "PBKDF2_SHA1",
+		1: "ARGON2ID",
+		2: "RAW_KEY",
+	}
+	KdfType_value = map[string]int32{
+		"PBKDF2_SHA1": 0,
+		"ARGON2ID":    1,
+		"RAW_KEY":     2,
+	}
+)
+
+func (x KdfType) Enum() *KdfType {
+	p := new(KdfType)
+	*p = x
+	return p
+}
+
+func (x KdfType) String() string {
+	return protoimpl.X.EnumStringOf(x.Descriptor(), protoreflect.EnumNumber(x))
+}
+
+func (KdfType) Descriptor() protoreflect.EnumDescriptor {
+	return file_formats_proto_enumTypes[4].Descriptor()
+}
+
+func (KdfType) Type() protoreflect.EnumType {
+	return &file_formats_proto_enumTypes[4]
+}
+
+func (x KdfType) Number() protoreflect.EnumNumber {
+	return protoreflect.EnumNumber(x)
+}
+
+// Deprecated: Use KdfType.Descriptor instead.
+func (KdfType) EnumDescriptor() ([]byte, []int) {
+	return file_formats_proto_rawDescGZIP(), []int{4}
 }
 
 type CompressionType int32
@@ -124,6 +279,7 @@ type CompressionType int32
 const (
 	CompressionType_NO_COMPRESSION CompressionType = 0
 	CompressionType_ZLIB           CompressionType = 1
+	CompressionType_ZSTD           CompressionType = 2
 )
 
 // Enum value maps for CompressionType.
@@ -131,10 +287,12 @@ var (
 	CompressionType_name = map[int32]string{
 		0: "NO_COMPRESSION",
 		1: "ZLIB",
+		2: "ZSTD",
 	}
 	CompressionType_value = map[string]int32{
 		"NO_COMPRESSION": 0,
 		"ZLIB":           1,
+		"ZSTD":           2,
 	}
 )
 
@@ -149,11 +307,11 @@ func (x CompressionType) String() string {
 }
 
 func (CompressionType) Descriptor() protoreflect.EnumDescriptor {
-	return file_formats_proto_enumTypes[2].Descriptor()
+	return file_formats_proto_enumTypes[5].Descriptor()
 }
 
 func (CompressionType) Type() protoreflect.EnumType {
-	return &file_formats_proto_enumTypes[2]
+	return &file_formats_proto_enumTypes[5]
 }
 
 func (x CompressionType) Number() protoreflect.EnumNumber {
@@ -162,7 +320,7 @@ func (x CompressionType) Number() protoreflect.EnumNumber {
 
 // Deprecated: Use CompressionType.Descriptor instead.
 func (CompressionType) EnumDescriptor() ([]byte, []int) {
-	return file_formats_proto_rawDescGZIP(), []int{2}
+	return file_formats_proto_rawDescGZIP(), []int{5}
 }
 
 type CompressionMode int32
@@ -201,11 +359,11 @@ func (x CompressionMode) String() string {
 }
 
 func (CompressionMode) Descriptor() protoreflect.EnumDescriptor {
-	return file_formats_proto_enumTypes[3].Descriptor()
+	return file_formats_proto_enumTypes[6].Descriptor()
 }
 
 func (CompressionMode) Type() protoreflect.EnumType {
-	return &file_formats_proto_enumTypes[3]
+	return &file_formats_proto_enumTypes[6]
 }
 
 func (x CompressionMode) Number() protoreflect.EnumNumber {
@@ -214,7 +372,53 @@ func (x CompressionMode) Number() protoreflect.EnumNumber {
 
 // Deprecated: Use CompressionMode.Descriptor instead.
 func (CompressionMode) EnumDescriptor() ([]byte, []int) {
-	return file_formats_proto_rawDescGZIP(), []int{3}
+	return file_formats_proto_rawDescGZIP(), []int{6}
+}
+
+type ChunkingMode int32
+
+const (
+	ChunkingMode_FIXED ChunkingMode = 0
+	ChunkingMode_CDC   ChunkingMode = 1
+)
+
+// Enum value maps for ChunkingMode.
+var (
+	ChunkingMode_name = map[int32]string{
+		0: "FIXED",
+		1: "CDC",
+	}
+	ChunkingMode_value = map[string]int32{
+		"FIXED": 0,
+		"CDC":   1,
+	}
+)
+
+func (x ChunkingMode) Enum() *ChunkingMode {
+	p := new(ChunkingMode)
+	*p = x
+	return p
+}
+
+func (x ChunkingMode) String() string {
+	return protoimpl.X.EnumStringOf(x.Descriptor(), protoreflect.EnumNumber(x))
+}
+
+func (ChunkingMode) Descriptor() protoreflect.EnumDescriptor {
+	return file_formats_proto_enumTypes[7].Descriptor()
+}
+
+func (ChunkingMode) Type() protoreflect.EnumType {
+	return &file_formats_proto_enumTypes[7]
+}
+
+func (x ChunkingMode) Number() protoreflect.EnumNumber {
+	return protoreflect.EnumNumber(x)
+}
+
+// Deprecated: Use ChunkingMode.Descriptor instead.
+func (ChunkingMode) EnumDescriptor() ([]byte, []int) {
+	return file_formats_proto_rawDescGZIP(), []int{7}
 }
 
 type NodeDataProto struct {
@@ -384,6 +588,26 @@ type ConfigProto struct {
 	EncryptionKey []byte          `protobuf:"bytes,2,opt,name=EncryptionKey,proto3" json:"EncryptionKey,omitempty"`
 	FPSecret      []byte          `protobuf:"bytes,3,opt,name=FPSecret,proto3" json:"FPSecret,omitempty"`
 	Compress      CompressionMode `protobuf:"varint,4,opt,name=Compress,proto3,enum=CompressionMode" json:"Compress,omitempty"`
+	Chunking      ChunkingMode    `protobuf:"varint,5,opt,name=Chunking,proto3,enum=ChunkingMode" json:"Chunking,omitempty"`
+	MinChunkSize  int32           `protobuf:"varint,6,opt,name=MinChunkSize,proto3" json:"MinChunkSize,omitempty"`
+	MaxChunkSize  int32           `protobuf:"varint,7,opt,name=MaxChunkSize,proto3" json:"MaxChunkSize,omitempty"`
+	PackSize      int32           `protobuf:"varint,8,opt,name=PackSize,proto3" json:"PackSize,omitempty"`
+	// Compression used for new chunks and version files. NO_COMPRESSION means ZLIB.
+	CompressionType CompressionType `protobuf:"varint,9,opt,name=CompressionType,proto3,enum=CompressionType" json:"CompressionType,omitempty"`
+	// 0 means the default level of the compression type.
+	CompressionLevel int32 `protobuf:"varint,10,opt,name=CompressionLevel,proto3" json:"CompressionLevel,omitempty"`
+	// Public key of an ASYMMETRIC repo. EncryptionKey is then not used.
+	PublicKey []byte `protobuf:"bytes,11,opt,name=PublicKey,proto3" json:"PublicKey,omitempty"`
+	// The new keys while rotate-key is in progress. They replace the keys
+	// above when it finishes.
+	NewEncryptionKey []byte `protobuf:"bytes,12,opt,name=NewEncryptionKey,proto3" json:"NewEncryptionKey,omitempty"`
+	NewFPSecret      []byte `protobuf:"bytes,13,opt,name=NewFPSecret,proto3" json:"NewFPSecret,omitempty"`
+	NewPublicKey     []byte `protobuf:"bytes,14,opt,name=NewPublicKey,proto3" json:"NewPublicKey,omitempty"`
+	NewPrivateKey    []byte `protobuf:"bytes,15,opt,name=NewPrivateKey,proto3" json:"NewPrivateKey,omitempty"`
+	// Padding of chunks and version files before encryption.
+	Padding PaddingMode `protobuf:"varint,16,opt,name=Padding,proto3,enum=PaddingMode" json:"Padding,omitempty"`
+	// Operations allowed on the repo, see set-mode.
+	Mode RepoMode `protobuf:"varint,17,opt,name=Mode,proto3,enum=RepoMode" json:"Mode,omitempty"`
 }
 
 func (x *ConfigProto) Reset() {
@@ -446,20 +670,109 @@ func (x *ConfigProto) GetCompress() CompressionMode {
 	return CompressionMode_AUTO
 }
 
-type EncConfigProto struct {
+func (x *ConfigProto) GetChunking() ChunkingMode {
+	if x != nil {
+		return x.Chunking
+	}
+	return ChunkingMode_FIXED
+}
+
+func (x *ConfigProto) GetMinChunkSize() int32 {
+	if x != nil {
+		return x.MinChunkSize
+	}
+	return 0
+}
+
+func (x *ConfigProto) GetMaxChunkSize() int32 {
+	if x != nil {
+		return x.MaxChunkSize
+	}
+	return 0
+}
+
+func (x *ConfigProto) GetPackSize() int32 {
+	if x != nil {
+		return x.PackSize
+	}
+	return 0
+}
+
+func (x *ConfigProto) GetCompressionType() CompressionType {
+	if x != nil {
+		return x.CompressionType
+	}
+	return CompressionType_NO_COMPRESSION
+}
+
+func (x *ConfigProto) GetCompressionLevel() int32 {
+	if x != nil {
+		return x.CompressionLevel
+	}
+	return 0
+}
+
+func (x *ConfigProto) GetPublicKey() []byte {
+	if x != nil {
+		return x.PublicKey
+	}
+	return nil
+}
+
+func (x *ConfigProto) GetNewEncryptionKey() []byte {
+	if x != nil {
+		return x.NewEncryptionKey
+	}
+	return nil
+}
+
+func (x *ConfigProto) GetNewFPSecret() []byte {
+	if x != nil {
+		return x.NewFPSecret
+	}
+	return nil
+}
+
+func (x *ConfigProto) GetNewPublicKey() []byte {
+	if x != nil {
+		return x.NewPublicKey
+	}
+	return nil
+}
+
+func (x *ConfigProto) GetNewPrivateKey() []byte {
+	if x != nil {
+		return x.NewPrivateKey
+	}
+	return nil
+}
+
+func (x *ConfigProto) GetPadding() PaddingMode {
+	if x != nil {
+		return x.Padding
+	}
+	return PaddingMode_NO_PADDING
+}
+
+func (x *ConfigProto) GetMode() RepoMode {
+	if x != nil {
+		return x.Mode
+	}
+	return RepoMode_READ_WRITE
+}
+
+type PackEntryProto struct {
 	state         protoimpl.MessageState
 	sizeCache     protoimpl.SizeCache
 	unknownFields protoimpl.UnknownFields
 
-	Version    int32   `protobuf:"varint,1,opt,name=Version,proto3" json:"Version,omitempty"`
-	Type       EncType `protobuf:"varint,2,opt,name=Type,proto3,enum=EncType" json:"Type,omitempty"`
-	Iterations int64   `protobuf:"varint,3,opt,name=Iterations,proto3" json:"Iterations,omitempty"`
-	Salt       []byte  `protobuf:"bytes,4,opt,name=Salt,proto3" json:"Salt,omitempty"`
-	Config     []byte  `protobuf:"bytes,5,opt,name=Config,proto3" json:"Config,omitempty"`
+	FP     []byte `protobuf:"bytes,1,opt,name=FP,proto3" json:"FP,omitempty"`
+	Offset int64  `protobuf:"varint,2,opt,name=Offset,proto3" json:"Offset,omitempty"`
+	Length int32  `protobuf:"varint,3,opt,name=Length,proto3" json:"Length,omitempty"`
 }
 
-func (x *EncConfigProto) Reset() {
-	*x = EncConfigProto{}
+func (x *PackEntryProto) Reset() {
+	*x = PackEntryProto{}
 	if protoimpl.UnsafeEnabled {
 		mi := &file_formats_proto_msgTypes[3]
 		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
@@ -467,13 +780,13 @@ func (x *EncConfigProto) Reset() {
 	}
 }
 
-func (x *EncConfigProto) String() string {
+func (x *PackEntryProto) String() string {
 	return protoimpl.X.MessageStringOf(x)
 }
 
-func (*EncConfigProto) ProtoMessage() {}
+func (*PackEntryProto) ProtoMessage() {}
 
-func (x *EncConfigProto) ProtoReflect() protoreflect.Message {
+func (x *PackEntryProto) ProtoReflect() protoreflect.Message {
 	mi := &file_formats_proto_msgTypes[3]
 	if protoimpl.UnsafeEnabled && x != nil {
 		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
@@ -485,63 +798,590 @@ func (x *EncConfigProto) ProtoReflect() protoreflect.Message {
 	return mi.MessageOf(x)
 }
 
-// Deprecated: Use EncConfigProto.ProtoReflect.Descriptor instead.
-func (*EncConfigProto) Descriptor() ([]byte, []int) {
+// Deprecated: Use PackEntryProto.ProtoReflect.Descriptor instead.
+func (*PackEntryProto) Descriptor() ([]byte, []int) {
 	return file_formats_proto_rawDescGZIP(), []int{3}
 }
 
-func (x *EncConfigProto) GetVersion() int32 {
+func (x *PackEntryProto) GetFP() []byte {
 	if x != nil {
-		return x.Version
+		return x.FP
 	}
-	return 0
+	return nil
 }
 
-func (x *EncConfigProto) GetType() EncType {
+func (x *PackEntryProto) GetOffset() int64 {
 	if x != nil {
-		return x.Type
+		return x.Offset
 	}
-	return EncType_NO_ENCRYPTION
+	return 0
 }
 
-func (x *EncConfigProto) GetIterations() int64 {
+func (x *PackEntryProto) GetLength() int32 {
 	if x != nil {
-		return x.Iterations
+		return x.Length
 	}
 	return 0
 }
 
-func (x *EncConfigProto) GetSalt() []byte {
+type PackIndexProto struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+
+	Version int32             `protobuf:"varint,1,opt,name=Version,proto3" json:"Version,omitempty"`
+	Entries []*PackEntryProto `protobuf:"bytes,2,rep,name=Entries,proto3" json:"Entries,omitempty"`
+}
+
+func (x *PackIndexProto) Reset() {
+	*x = PackIndexProto{}
+	if protoimpl.UnsafeEnabled {
+		mi := &file_formats_proto_msgTypes[4]
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		ms.StoreMessageInfo(mi)
+	}
+}
+
+func (x *PackIndexProto) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*PackIndexProto) ProtoMessage() {}
+
+func (x *PackIndexProto) ProtoReflect() protoreflect.Message {
+	mi := &file_formats_proto_msgTypes[4]
+	if protoimpl.UnsafeEnabled && x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use PackIndexProto.ProtoReflect.Descriptor instead.
+func (*PackIndexProto) Descriptor() ([]byte, []int) {
+	return file_formats_proto_rawDescGZIP(), []int{4}
+}
+
+func (x *PackIndexProto) GetVersion() int32 {
 	if x != nil {
-		return x.Salt
+		return x.Version
 	}
-	return nil
+	return 0
 }
 
-func (x *EncConfigProto) GetConfig() []byte {
+func (x *PackIndexProto) GetEntries() []*PackEntryProto {
 	if x != nil {
-		return x.Config
+		return x.Entries
 	}
 	return nil
 }
 
-var File_formats_proto protoreflect.FileDescriptor
+type PendingChunkProto struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
 
-var file_formats_proto_rawDesc = []byte{
-	0x0a, 0x0d, 0x66, 0x6f, 0x72, 0x6d, 0x61, 0x74, 0x73, 0x2e, 0x70, 0x72, 0x6f, 0x74, 0x6f, 0x1a,
-	0x1f, 0x67, 0x6f, 0x6f, 0x67, 0x6c, 0x65, 0x2f, 0x70, 0x72, 0x6f, 0x74, 0x6f, 0x62, 0x75, 0x66,
-	0x2f, 0x74, 0x69, 0x6d, 0x65, 0x73, 0x74, 0x61, 0x6d, 0x70, 0x2e, 0x70, 0x72, 0x6f, 0x74, 0x6f,
-	0x22, 0x8b, 0x02, 0x0a, 0x0d, 0x4e, 0x6f, 0x64, 0x65, 0x44, 0x61, 0x74, 0x61, 0x50, 0x72, 0x6f,
-	0x74, 0x6f, 0x12, 0x12, 0x0a, 0x04, 0x6e, 0x61, 0x6d, 0x65, 0x18, 0x01, 0x20, 0x01, 0x28, 0x09,
-	0x52, 0x04, 0x6e, 0x61, 0x6d, 0x65, 0x12, 0x1d, 0x0a, 0x04, 0x74, 0x79, 0x70, 0x65, 0x18, 0x02,
-	0x20, 0x01, 0x28, 0x0e, 0x32, 0x09, 0x2e, 0x46, 0x69, 0x6c, 0x65, 0x54, 0x79, 0x70, 0x65, 0x52,
-	0x04, 0x74, 0x79, 0x70, 0x65, 0x12, 0x12, 0x0a, 0x04, 0x73, 0x69, 0x7a, 0x65, 0x18, 0x03, 0x20,
-	0x01, 0x28, 0x03, 0x52, 0x04, 0x73, 0x69, 0x7a, 0x65, 0x12, 0x35, 0x0a, 0x08, 0x6d, 0x6f, 0x64,
-	0x5f, 0x74, 0x69, 0x6d, 0x65, 0x18, 0x04, 0x20, 0x01, 0x28, 0x0b, 0x32, 0x1a, 0x2e, 0x67, 0x6f,
-	0x6f, 0x67, 0x6c, 0x65, 0x2e, 0x70, 0x72, 0x6f, 0x74, 0x6f, 0x62, 0x75, 0x66, 0x2e, 0x54, 0x69,
-	0x6d, 0x65, 0x73, 0x74, 0x61, 0x6d, 0x70, 0x52, 0x07, 0x6d, 0x6f, 0x64, 0x54, 0x69, 0x6d, 0x65,
-	0x12, 0x12, 0x0a, 0x04, 0x70, 0x65, 0x72, 0x6d, 0x18, 0x05, 0x20, 0x01, 0x28, 0x05, 0x52, 0x04,
-	0x70, 0x65, 0x72, 0x6d, 0x12, 0x22, 0x0a, 0x0c, 0x46, 0x69, 0x6c, 0x65, 0x43, 0x68, 0x65, 0x63,
+	FP []byte `protobuf:"bytes,1,opt,name=FP,proto3" json:"FP,omitempty"`
+	// Unix time when purge-unused first found the chunk unused.
+	Time int64 `protobuf:"varint,2,opt,name=Time,proto3" json:"Time,omitempty"`
+}
+
+func (x *PendingChunkProto) Reset() {
+	*x = PendingChunkProto{}
+	if protoimpl.UnsafeEnabled {
+		mi := &file_formats_proto_msgTypes[5]
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		ms.StoreMessageInfo(mi)
+	}
+}
+
+func (x *PendingChunkProto) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*PendingChunkProto) ProtoMessage() {}
+
+func (x *PendingChunkProto) ProtoReflect() protoreflect.Message {
+	mi := &file_formats_proto_msgTypes[5]
+	if protoimpl.UnsafeEnabled && x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use PendingChunkProto.ProtoReflect.Descriptor instead.
+func (*PendingChunkProto) Descriptor() ([]byte, []int) {
+	return file_formats_proto_rawDescGZIP(), []int{5}
+}
+
+func (x *PendingChunkProto) GetFP() []byte {
+	if x != nil {
+		return x.FP
+	}
+	return nil
+}
+
+func (x *PendingChunkProto) GetTime() int64 {
+	if x != nil {
+		return x.Time
+	}
+	return 0
+}
+
+// The pending deletion list, and the chunks a backup kept from it.
+type PendingDeletionProto struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+
+	Version int32                `protobuf:"varint,1,opt,name=Version,proto3" json:"Version,omitempty"`
+	Chunks  []*PendingChunkProto `protobuf:"bytes,2,rep,name=Chunks,proto3" json:"Chunks,omitempty"`
+}
+
+func (x *PendingDeletionProto) Reset() {
+	*x = PendingDeletionProto{}
+	if protoimpl.UnsafeEnabled {
+		mi := &file_formats_proto_msgTypes[6]
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		ms.StoreMessageInfo(mi)
+	}
+}
+
+func (x *PendingDeletionProto) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*PendingDeletionProto) ProtoMessage() {}
+
+func (x *PendingDeletionProto) ProtoReflect() protoreflect.Message {
+	mi := &file_formats_proto_msgTypes[6]
+	if protoimpl.UnsafeEnabled && x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use PendingDeletionProto.ProtoReflect.Descriptor instead.
+func (*PendingDeletionProto) Descriptor() ([]byte, []int) {
+	return file_formats_proto_rawDescGZIP(), []int{6}
+}
+
+func (x *PendingDeletionProto) GetVersion() int32 {
+	if x != nil {
+		return x.Version
+	}
+	return 0
+}
+
+func (x *PendingDeletionProto) GetChunks() []*PendingChunkProto {
+	if x != nil {
+		return x.Chunks
+	}
+	return nil
+}
+
+type EncConfigProto struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+
+	Version int32   `protobuf:"varint,1,opt,name=Version,proto3" json:"Version,omitempty"`
+	Type    EncType `protobuf:"varint,2,opt,name=Type,proto3,enum=EncType" json:"Type,omitempty"`
+	// PBKDF2 iterations.
+	Iterations int64   `protobuf:"varint,3,opt,name=Iterations,proto3" json:"Iterations,omitempty"`
+	Salt       []byte  `protobuf:"bytes,4,opt,name=Salt,proto3" json:"Salt,omitempty"`
+	Config     []byte  `protobuf:"bytes,5,opt,name=Config,proto3" json:"Config,omitempty"`
+	Kdf        KdfType `protobuf:"varint,6,opt,name=Kdf,proto3,enum=KdfType" json:"Kdf,omitempty"`
+	// Argon2id parameters. Memory is in KiB.
+	Argon2Memory  int32 `protobuf:"varint,7,opt,name=Argon2Memory,proto3" json:"Argon2Memory,omitempty"`
+	Argon2Time    int32 `protobuf:"varint,8,opt,name=Argon2Time,proto3" json:"Argon2Time,omitempty"`
+	Argon2Threads int32 `protobuf:"varint,9,opt,name=Argon2Threads,proto3" json:"Argon2Threads,omitempty"`
+	// Key slots, only used in version 3. Config is then encrypted with
+	// a random config key that is wrapped by each of the key slots.
+	Slots []*KeySlotProto `protobuf:"bytes,10,rep,name=Slots,proto3" json:"Slots,omitempty"`
+}
+
+func (x *EncConfigProto) Reset() {
+	*x = EncConfigProto{}
+	if protoimpl.UnsafeEnabled {
+		mi := &file_formats_proto_msgTypes[7]
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		ms.StoreMessageInfo(mi)
+	}
+}
+
+func (x *EncConfigProto) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*EncConfigProto) ProtoMessage() {}
+
+func (x *EncConfigProto) ProtoReflect() protoreflect.Message {
+	mi := &file_formats_proto_msgTypes[7]
+	if protoimpl.UnsafeEnabled && x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use EncConfigProto.ProtoReflect.Descriptor instead.
+func (*EncConfigProto) Descriptor() ([]byte, []int) {
+	return file_formats_proto_rawDescGZIP(), []int{7}
+}
+
+func (x *EncConfigProto) GetVersion() int32 {
+	if x != nil {
+		return x.Version
+	}
+	return 0
+}
+
+func (x *EncConfigProto) GetType() EncType {
+	if x != nil {
+		return x.Type
+	}
+	return EncType_NO_ENCRYPTION
+}
+
+func (x *EncConfigProto) GetIterations() int64 {
+	if x != nil {
+		return x.Iterations
+	}
+	return 0
+}
+
+func (x *EncConfigProto) GetSalt() []byte {
+	if x != nil {
+		return x.Salt
+	}
+	return nil
+}
+
+func (x *EncConfigProto) GetConfig() []byte {
+	if x != nil {
+		return x.Config
+	}
+	return nil
+}
+
+func (x *EncConfigProto) GetKdf() KdfType {
+	if x != nil {
+		return x.Kdf
+	}
+	return KdfType_PBKDF2_SHA1
+}
+
+func (x *EncConfigProto) GetArgon2Memory() int32 {
+	if x != nil {
+		return x.Argon2Memory
+	}
+	return 0
+}
+
+func (x *EncConfigProto) GetArgon2Time() int32 {
+	if x != nil {
+		return x.Argon2Time
+	}
+	return 0
+}
+
+func (x *EncConfigProto) GetArgon2Threads() int32 {
+	if x != nil {
+		return x.Argon2Threads
+	}
+	return 0
+}
+
+func (x *EncConfigProto) GetSlots() []*KeySlotProto {
+	if x != nil {
+		return x.Slots
+	}
+	return nil
+}
+
+type KeySlotProto struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+
+	Label         string  `protobuf:"bytes,1,opt,name=Label,proto3" json:"Label,omitempty"`
+	Kdf           KdfType `protobuf:"varint,2,opt,name=Kdf,proto3,enum=KdfType" json:"Kdf,omitempty"`
+	Iterations    int64   `protobuf:"varint,3,opt,name=Iterations,proto3" json:"Iterations,omitempty"`
+	Argon2Memory  int32   `protobuf:"varint,4,opt,name=Argon2Memory,proto3" json:"Argon2Memory,omitempty"`
+	Argon2Time    int32   `protobuf:"varint,5,opt,name=Argon2Time,proto3" json:"Argon2Time,omitempty"`
+	Argon2Threads int32   `protobuf:"varint,6,opt,name=Argon2Threads,proto3" json:"Argon2Threads,omitempty"`
+	Salt          []byte  `protobuf:"bytes,7,opt,name=Salt,proto3" json:"Salt,omitempty"`
+	// The config key encrypted with the key derived from the password.
+	Key []byte `protobuf:"bytes,8,opt,name=Key,proto3" json:"Key,omitempty"`
+	// The private key of an ASYMMETRIC repo encrypted with the key derived
+	// from the password. Empty for write-only slots.
+	PrivateKey []byte `protobuf:"bytes,9,opt,name=PrivateKey,proto3" json:"PrivateKey,omitempty"`
+}
+
+func (x *KeySlotProto) Reset() {
+	*x = KeySlotProto{}
+	if protoimpl.UnsafeEnabled {
+		mi := &file_formats_proto_msgTypes[8]
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		ms.StoreMessageInfo(mi)
+	}
+}
+
+func (x *KeySlotProto) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*KeySlotProto) ProtoMessage() {}
+
+func (x *KeySlotProto) ProtoReflect() protoreflect.Message {
+	mi := &file_formats_proto_msgTypes[8]
+	if protoimpl.UnsafeEnabled && x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use KeySlotProto.ProtoReflect.Descriptor instead.
+func (*KeySlotProto) Descriptor() ([]byte, []int) {
+	return file_formats_proto_rawDescGZIP(), []int{8}
+}
+
+func (x *KeySlotProto) GetLabel() string {
+	if x != nil {
+		return x.Label
+	}
+	return ""
+}
+
+func (x *KeySlotProto) GetKdf() KdfType {
+	if x != nil {
+		return x.Kdf
+	}
+	return KdfType_PBKDF2_SHA1
+}
+
+func (x *KeySlotProto) GetIterations() int64 {
+	if x != nil {
+		return x.Iterations
+	}
+	return 0
+}
+
+func (x *KeySlotProto) GetArgon2Memory() int32 {
+	if x != nil {
+		return x.Argon2Memory
+	}
+	return 0
+}
+
+func (x *KeySlotProto) GetArgon2Time() int32 {
+	if x != nil {
+		return x.Argon2Time
+	}
+	return 0
+}
+
+func (x *KeySlotProto) GetArgon2Threads() int32 {
+	if x != nil {
+		return x.Argon2Threads
+	}
+	return 0
+}
+
+func (x *KeySlotProto) GetSalt() []byte {
+	if x != nil {
+		return x.Salt
+	}
+	return nil
+}
+
+func (x *KeySlotProto) GetKey() []byte {
+	if x != nil {
+		return x.Key
+	}
+	return nil
+}
+
+func (x *KeySlotProto) GetPrivateKey() []byte {
+	if x != nil {
+		return x.PrivateKey
+	}
+	return nil
+}
+
+// Old and new names of the chunks already rotated by rotate-key.
+type KeyRotationMapProto struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+
+	Version int32    `protobuf:"varint,1,opt,name=Version,proto3" json:"Version,omitempty"`
+	OldFPs  [][]byte `protobuf:"bytes,2,rep,name=OldFPs,proto3" json:"OldFPs,omitempty"`
+	NewFPs  [][]byte `protobuf:"bytes,3,rep,name=NewFPs,proto3" json:"NewFPs,omitempty"`
+}
+
+func (x *KeyRotationMapProto) Reset() {
+	*x = KeyRotationMapProto{}
+	if protoimpl.UnsafeEnabled {
+		mi := &file_formats_proto_msgTypes[9]
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		ms.StoreMessageInfo(mi)
+	}
+}
+
+func (x *KeyRotationMapProto) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*KeyRotationMapProto) ProtoMessage() {}
+
+func (x *KeyRotationMapProto) ProtoReflect() protoreflect.Message {
+	mi := &file_formats_proto_msgTypes[9]
+	if protoimpl.UnsafeEnabled && x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use KeyRotationMapProto.ProtoReflect.Descriptor instead.
+func (*KeyRotationMapProto) Descriptor() ([]byte, []int) {
+	return file_formats_proto_rawDescGZIP(), []int{9}
+}
+
+func (x *KeyRotationMapProto) GetVersion() int32 {
+	if x != nil {
+		return x.Version
+	}
+	return 0
+}
+
+func (x *KeyRotationMapProto) GetOldFPs() [][]byte {
+	if x != nil {
+		return x.OldFPs
+	}
+	return nil
+}
+
+func (x *KeyRotationMapProto) GetNewFPs() [][]byte {
+	if x != nil {
+		return x.NewFPs
+	}
+	return nil
+}
+
+// The secrets of a repo printed by "key export". Config is the unencrypted
+// ConfigProto. PrivateKey is only set for ASYMMETRIC repos.
+type KeyExportProto struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+
+	Version    int32   `protobuf:"varint,1,opt,name=Version,proto3" json:"Version,omitempty"`
+	Type       EncType `protobuf:"varint,2,opt,name=Type,proto3,enum=EncType" json:"Type,omitempty"`
+	Config     []byte  `protobuf:"bytes,3,opt,name=Config,proto3" json:"Config,omitempty"`
+	PrivateKey []byte  `protobuf:"bytes,4,opt,name=PrivateKey,proto3" json:"PrivateKey,omitempty"`
+}
+
+func (x *KeyExportProto) Reset() {
+	*x = KeyExportProto{}
+	if protoimpl.UnsafeEnabled {
+		mi := &file_formats_proto_msgTypes[10]
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		ms.StoreMessageInfo(mi)
+	}
+}
+
+func (x *KeyExportProto) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*KeyExportProto) ProtoMessage() {}
+
+func (x *KeyExportProto) ProtoReflect() protoreflect.Message {
+	mi := &file_formats_proto_msgTypes[10]
+	if protoimpl.UnsafeEnabled && x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use KeyExportProto.ProtoReflect.Descriptor instead.
+func (*KeyExportProto) Descriptor() ([]byte, []int) {
+	return file_formats_proto_rawDescGZIP(), []int{10}
+}
+
+func (x *KeyExportProto) GetVersion() int32 {
+	if x != nil {
+		return x.Version
+	}
+	return 0
+}
+
+func (x *KeyExportProto) GetType() EncType {
+	if x != nil {
+		return x.Type
+	}
+	return EncType_NO_ENCRYPTION
+}
+
+func (x *KeyExportProto) GetConfig() []byte {
+	if x != nil {
+		return x.Config
+	}
+	return nil
+}
+
+func (x *KeyExportProto) GetPrivateKey() []byte {
+	if x != nil {
+		return x.PrivateKey
+	}
+	return nil
+}
+
+var File_formats_proto protoreflect.FileDescriptor
+
+var file_formats_proto_rawDesc = []byte{
+	0x0a, 0x0d, 0x66, 0x6f, 0x72, 0x6d, 0x61, 0x74, 0x73, 0x2e, 0x70, 0x72, 0x6f, 0x74, 0x6f, 0x1a,
+	0x1f, 0x67, 0x6f, 0x6f, 0x67, 0x6c, 0x65, 0x2f, 0x70, 0x72, 0x6f, 0x74, 0x6f, 0x62, 0x75, 0x66,
+	0x2f, 0x74, 0x69, 0x6d, 0x65, 0x73, 0x74, 0x61, 0x6d, 0x70, 0x2e, 0x70, 0x72, 0x6f, 0x74, 0x6f,
+	0x22, 0x8b, 0x02, 0x0a, 0x0d, 0x4e, 0x6f, 0x64, 0x65, 0x44, 0x61, 0x74, 0x61, 0x50, 0x72, 0x6f,
+	0x74, 0x6f, 0x12, 0x12, 0x0a, 0x04, 0x6e, 0x61, 0x6d, 0x65, 0x18, 0x01, 0x20, 0x01, 0x28, 0x09,
+	0x52, 0x04, 0x6e, 0x61, 0x6d, 0x65, 0x12, 0x1d, 0x0a, 0x04, 0x74, 0x79, 0x70, 0x65, 0x18, 0x02,
+	0x20, 0x01, 0x28, 0x0e, 0x32, 0x09, 0x2e, 0x46, 0x69, 0x6c, 0x65, 0x54, 0x79, 0x70, 0x65, 0x52,
+	0x04, 0x74, 0x79, 0x70, 0x65, 0x12, 0x12, 0x0a, 0x04, 0x73, 0x69, 0x7a, 0x65, 0x18, 0x03, 0x20,
+	0x01, 0x28, 0x03, 0x52, 0x04, 0x73, 0x69, 0x7a, 0x65, 0x12, 0x35, 0x0a, 0x08, 0x6d, 0x6f, 0x64,
+	0x5f, 0x74, 0x69, 0x6d, 0x65, 0x18, 0x04, 0x20, 0x01, 0x28, 0x0b, 0x32, 0x1a, 0x2e, 0x67, 0x6f,
+	0x6f, 0x67, 0x6c, 0x65, 0x2e, 0x70, 0x72, 0x6f, 0x74, 0x6f, 0x62, 0x75, 0x66, 0x2e, 0x54, 0x69,
+	0x6d, 0x65, 0x73, 0x74, 0x61, 0x6d, 0x70, 0x52, 0x07, 0x6d, 0x6f, 0x64, 0x54, 0x69, 0x6d, 0x65,
+	0x12, 0x12, 0x0a, 0x04, 0x70, 0x65, 0x72, 0x6d, 0x18, 0x05, 0x20, 0x01, 0x28, 0x05, 0x52, 0x04,
+	0x70, 0x65, 0x72, 0x6d, 0x12, 0x22, 0x0a, 0x0c, 0x46, 0x69, 0x6c, 0x65, 0x43, 0x68, 0x65, 0x63,
 	0x6b, 0x73, 0x75, 0x6d, 0x18, 0x06, 0x20, 0x01, 0x28, 0x0c, 0x52, 0x0c, 0x46, 0x69, 0x6c, 0x65,
 	0x43, 0x68, 0x65, 0x63, 0x6b, 0x73, 0x75, 0x6d, 0x12, 0x16, 0x0a, 0x06, 0x74, 0x61, 0x72, 0x67,
 	0x65, 0x74, 0x18, 0x07, 0x20, 0x01, 0x28, 0x09, 0x52, 0x06, 0x74, 0x61, 0x72, 0x67, 0x65, 0x74,
@@ -550,7 +1390,7 @@ var file_formats_proto_rawDesc = []byte{
 	0x18, 0x09, 0x20, 0x03, 0x28, 0x0c, 0x52, 0x06, 0x43, 0x68, 0x75, 0x6e, 0x6b, 0x73, 0x22, 0x28,
 	0x0a, 0x0c, 0x56, 0x65, 0x72, 0x73, 0x69, 0x6f, 0x6e, 0x50, 0x72, 0x6f, 0x74, 0x6f, 0x12, 0x18,
 	0x0a, 0x07, 0x76, 0x65, 0x72, 0x73, 0x69, 0x6f, 0x6e, 0x18, 0x01, 0x20, 0x01, 0x28, 0x05, 0x52,
-	0x07, 0x76, 0x65, 0x72, 0x73, 0x69, 0x6f, 0x6e, 0x22, 0x9b, 0x01, 0x0a, 0x0b, 0x43, 0x6f, 0x6e,
+	0x07, 0x76, 0x65, 0x72, 0x73, 0x69, 0x6f, 0x6e, 0x22, 0x8f, 0x05, 0x0a, 0x0b, 0x43, 0x6f, 0x6e,
 	0x66, 0x69, 0x67, 0x50, 0x72, 0x6f, 0x74, 0x6f, 0x12, 0x1c, 0x0a, 0x09, 0x43, 0x68, 0x75, 0x6e,
 	0x6b, 0x53, 0x69, 0x7a, 0x65, 0x18, 0x01, 0x20, 0x01, 0x28, 0x05, 0x52, 0x09, 0x43, 0x68, 0x75,
 	0x6e, 0x6b, 0x53, 0x69, 0x7a, 0x65, 0x12, 0x24, 0x0a, 0x0d, 0x45, 0x6e, 0x63, 0x72, 0x79, 0x70,
@@ -560,33 +1400,141 @@ var file_formats_proto_rawDesc = []byte{
 	0x46, 0x50, 0x53, 0x65, 0x63, 0x72, 0x65, 0x74, 0x12, 0x2c, 0x0a, 0x08, 0x43, 0x6f, 0x6d, 0x70,
 	0x72, 0x65, 0x73, 0x73, 0x18, 0x04, 0x20, 0x01, 0x28, 0x0e, 0x32, 0x10, 0x2e, 0x43, 0x6f, 0x6d,
 	0x70, 0x72, 0x65, 0x73, 0x73, 0x69, 0x6f, 0x6e, 0x4d, 0x6f, 0x64, 0x65, 0x52, 0x08, 0x43, 0x6f,
-	0x6d, 0x70, 0x72, 0x65, 0x73, 0x73, 0x22, 0x94, 0x01, 0x0a, 0x0e, 0x45, 0x6e, 0x63, 0x43, 0x6f,
-	0x6e, 0x66, 0x69, 0x67, 0x50, 0x72, 0x6f, 0x74, 0x6f, 0x12, 0x18, 0x0a, 0x07, 0x56, 0x65, 0x72,
-	0x73, 0x69, 0x6f, 0x6e, 0x18, 0x01, 0x20, 0x01, 0x28, 0x05, 0x52, 0x07, 0x56, 0x65, 0x72, 0x73,
-	0x69, 0x6f, 0x6e, 0x12, 0x1c, 0x0a, 0x04, 0x54, 0x79, 0x70, 0x65, 0x18, 0x02, 0x20, 0x01, 0x28,
-	0x0e, 0x32, 0x08, 0x2e, 0x45, 0x6e, 0x63, 0x54, 0x79, 0x70, 0x65, 0x52, 0x04, 0x54, 0x79, 0x70,
-	0x65, 0x12, 0x1e, 0x0a, 0x0a, 0x49, 0x74, 0x65, 0x72, 0x61, 0x74, 0x69, 0x6f, 0x6e, 0x73, 0x18,
-	0x03, 0x20, 0x01, 0x28, 0x03, 0x52, 0x0a, 0x49, 0x74, 0x65, 0x72, 0x61, 0x74, 0x69, 0x6f, 0x6e,
-	0x73, 0x12, 0x12, 0x0a, 0x04, 0x53, 0x61, 0x6c, 0x74, 0x18, 0x04, 0x20, 0x01, 0x28, 0x0c, 0x52,
-	0x04, 0x53, 0x61, 0x6c, 0x74, 0x12, 0x16, 0x0a, 0x06, 0x43, 0x6f, 0x6e, 0x66, 0x69, 0x67, 0x18,
-	0x05, 0x20, 0x01, 0x28, 0x0c, 0x52, 0x06, 0x43, 0x6f, 0x6e, 0x66, 0x69, 0x67, 0x2a, 0x38, 0x0a,
-	0x08, 0x46, 0x69, 0x6c, 0x65, 0x54, 0x79, 0x70, 0x65, 0x12, 0x10, 0x0a, 0x0c, 0x52, 0x45, 0x47,
-	0x55, 0x4c, 0x41, 0x52, 0x5f, 0x46, 0x49, 0x4c, 0x45, 0x10, 0x00, 0x12, 0x0d, 0x0a, 0x09, 0x44,
-	0x49, 0x52, 0x45, 0x43, 0x54, 0x4f, 0x52, 0x59, 0x10, 0x01, 0x12, 0x0b, 0x0a, 0x07, 0x53, 0x59,
-	0x4d, 0x4c, 0x49, 0x4e, 0x4b, 0x10, 0x02, 0x2a, 0x2b, 0x0a, 0x07, 0x45, 0x6e, 0x63, 0x54, 0x79,
-	0x70, 0x65, 0x12, 0x11, 0x0a, 0x0d, 0x4e, 0x4f, 0x5f, 0x45, 0x4e, 0x43, 0x52, 0x59, 0x50, 0x54,
-	0x49, 0x4f, 0x4e, 0x10, 0x00, 0x12, 0x0d, 0x0a, 0x09, 0x53, 0x59, 0x4d, 0x4d, 0x45, 0x54, 0x52,
-	0x49, 0x43, 0x10, 0x01, 0x2a, 0x2f, 0x0a, 0x0f, 0x43, 0x6f, 0x6d, 0x70, 0x72, 0x65, 0x73, 0x73,
-	0x69, 0x6f, 0x6e, 0x54, 0x79, 0x70, 0x65, 0x12, 0x12, 0x0a, 0x0e, 0x4e, 0x4f, 0x5f, 0x43, 0x4f,
-	0x4d, 0x50, 0x52, 0x45, 0x53, 0x53, 0x49, 0x4f, 0x4e, 0x10, 0x00, 0x12, 0x08, 0x0a, 0x04, 0x5a,
-	0x4c, 0x49, 0x42, 0x10, 0x01, 0x2a, 0x36, 0x0a, 0x0f, 0x43, 0x6f, 0x6d, 0x70, 0x72, 0x65, 0x73,
-	0x73, 0x69, 0x6f, 0x6e, 0x4d, 0x6f, 0x64, 0x65, 0x12, 0x08, 0x0a, 0x04, 0x41, 0x55, 0x54, 0x4f,
-	0x10, 0x00, 0x12, 0x08, 0x0a, 0x04, 0x53, 0x4c, 0x4f, 0x57, 0x10, 0x01, 0x12, 0x06, 0x0a, 0x02,
-	0x4e, 0x4f, 0x10, 0x02, 0x12, 0x07, 0x0a, 0x03, 0x59, 0x45, 0x53, 0x10, 0x03, 0x42, 0x2f, 0x5a,
-	0x2d, 0x67, 0x69, 0x74, 0x68, 0x75, 0x62, 0x2e, 0x63, 0x6f, 0x6d, 0x2f, 0x70, 0x74, 0x73, 0x69,
-	0x6d, 0x2f, 0x76, 0x65, 0x63, 0x62, 0x61, 0x63, 0x6b, 0x75, 0x70, 0x2f, 0x69, 0x6e, 0x74, 0x65,
-	0x72, 0x6e, 0x61, 0x6c, 0x2f, 0x76, 0x65, 0x63, 0x62, 0x61, 0x63, 0x6b, 0x75, 0x70, 0x62, 0x06,
-	0x70, 0x72, 0x6f, 0x74, 0x6f, 0x33,
+	0x6d, 0x70, 0x72, 0x65, 0x73, 0x73, 0x12, 0x29, 0x0a, 0x08, 0x43, 0x68, 0x75, 0x6e, 0x6b, 0x69,
+	0x6e, 0x67, 0x18, 0x05, 0x20, 0x01, 0x28, 0x0e, 0x32, 0x0d, 0x2e, 0x43, 0x68, 0x75, 0x6e, 0x6b,
+	0x69, 0x6e, 0x67, 0x4d, 0x6f, 0x64, 0x65, 0x52, 0x08, 0x43, 0x68, 0x75, 0x6e, 0x6b, 0x69, 0x6e,
+	0x67, 0x12, 0x22, 0x0a, 0x0c, 0x4d, 0x69, 0x6e, 0x43, 0x68, 0x75, 0x6e, 0x6b, 0x53, 0x69, 0x7a,
+	0x65, 0x18, 0x06, 0x20, 0x01, 0x28, 0x05, 0x52, 0x0c, 0x4d, 0x69, 0x6e, 0x43, 0x68, 0x75, 0x6e,
+	0x6b, 0x53, 0x69, 0x7a, 0x65, 0x12, 0x22, 0x0a, 0x0c, 0x4d, 0x61, 0x78, 0x43, 0x68, 0x75, 0x6e,
+	0x6b, 0x53, 0x69, 0x7a, 0x65, 0x18, 0x07, 0x20, 0x01, 0x28, 0x05, 0x52, 0x0c, 0x4d, 0x61, 0x78,
+	0x43, 0x68, 0x75, 0x6e, 0x6b, 0x53, 0x69, 0x7a, 0x65, 0x12, 0x1a, 0x0a, 0x08, 0x50, 0x61, 0x63,
+	0x6b, 0x53, 0x69, 0x7a, 0x65, 0x18, 0x08, 0x20, 0x01, 0x28, 0x05, 0x52, 0x08, 0x50, 0x61, 0x63,
+	0x6b, 0x53, 0x69, 0x7a, 0x65, 0x12, 0x3a, 0x0a, 0x0f, 0x43, 0x6f, 0x6d, 0x70, 0x72, 0x65, 0x73,
+	0x73, 0x69, 0x6f, 0x6e, 0x54, 0x79, 0x70, 0x65, 0x18, 0x09, 0x20, 0x01, 0x28, 0x0e, 0x32, 0x10,
+	0x2e, 0x43, 0x6f, 0x6d, 0x70, 0x72, 0x65, 0x73, 0x73, 0x69, 0x6f, 0x6e, 0x54, 0x79, 0x70, 0x65,
+	0x52, 0x0f, 0x43, 0x6f, 0x6d, 0x70, 0x72, 0x65, 0x73, 0x73, 0x69, 0x6f, 0x6e, 0x54, 0x79, 0x70,
+	0x65, 0x12, 0x2a, 0x0a, 0x10, 0x43, 0x6f, 0x6d, 0x70, 0x72, 0x65, 0x73, 0x73, 0x69, 0x6f, 0x6e,
+	0x4c, 0x65, 0x76, 0x65, 0x6c, 0x18, 0x0a, 0x20, 0x01, 0x28, 0x05, 0x52, 0x10, 0x43, 0x6f, 0x6d,
+	0x70, 0x72, 0x65, 0x73, 0x73, 0x69, 0x6f, 0x6e, 0x4c, 0x65, 0x76, 0x65, 0x6c, 0x12, 0x1c, 0x0a,
+	0x09, 0x50, 0x75, 0x62, 0x6c, 0x69, 0x63, 0x4b, 0x65, 0x79, 0x18, 0x0b, 0x20, 0x01, 0x28, 0x0c,
+	0x52, 0x09, 0x50, 0x75, 0x62, 0x6c, 0x69, 0x63, 0x4b, 0x65, 0x79, 0x12, 0x2a, 0x0a, 0x10, 0x4e,
+	0x65, 0x77, 0x45, 0x6e, 0x63, 0x72, 0x79, 0x70, 0x74, 0x69, 0x6f, 0x6e, 0x4b, 0x65, 0x79, 0x18,
+	0x0c, 0x20, 0x01, 0x28, 0x0c, 0x52, 0x10, 0x4e, 0x65, 0x77, 0x45, 0x6e, 0x63, 0x72, 0x79, 0x70,
+	0x74, 0x69, 0x6f, 0x6e, 0x4b, 0x65, 0x79, 0x12, 0x20, 0x0a, 0x0b, 0x4e, 0x65, 0x77, 0x46, 0x50,
+	0x53, 0x65, 0x63, 0x72, 0x65, 0x74, 0x18, 0x0d, 0x20, 0x01, 0x28, 0x0c, 0x52, 0x0b, 0x4e, 0x65,
+	0x77, 0x46, 0x50, 0x53, 0x65, 0x63, 0x72, 0x65, 0x74, 0x12, 0x22, 0x0a, 0x0c, 0x4e, 0x65, 0x77,
+	0x50, 0x75, 0x62, 0x6c, 0x69, 0x63, 0x4b, 0x65, 0x79, 0x18, 0x0e, 0x20, 0x01, 0x28, 0x0c, 0x52,
+	0x0c, 0x4e, 0x65, 0x77, 0x50, 0x75, 0x62, 0x6c, 0x69, 0x63, 0x4b, 0x65, 0x79, 0x12, 0x24, 0x0a,
+	0x0d, 0x4e, 0x65, 0x77, 0x50, 0x72, 0x69, 0x76, 0x61, 0x74, 0x65, 0x4b, 0x65, 0x79, 0x18, 0x0f,
+	0x20, 0x01, 0x28, 0x0c, 0x52, 0x0d, 0x4e, 0x65, 0x77, 0x50, 0x72, 0x69, 0x76, 0x61, 0x74, 0x65,
+	0x4b, 0x65, 0x79, 0x12, 0x26, 0x0a, 0x07, 0x50, 0x61, 0x64, 0x64, 0x69, 0x6e, 0x67, 0x18, 0x10,
+	0x20, 0x01, 0x28, 0x0e, 0x32, 0x0c, 0x2e, 0x50, 0x61, 0x64, 0x64, 0x69, 0x6e, 0x67, 0x4d, 0x6f,
+	0x64, 0x65, 0x52, 0x07, 0x50, 0x61, 0x64, 0x64, 0x69, 0x6e, 0x67, 0x12, 0x1d, 0x0a, 0x04, 0x4d,
+	0x6f, 0x64, 0x65, 0x18, 0x11, 0x20, 0x01, 0x28, 0x0e, 0x32, 0x09, 0x2e, 0x52, 0x65, 0x70, 0x6f,
+	0x4d, 0x6f, 0x64, 0x65, 0x52, 0x04, 0x4d, 0x6f, 0x64, 0x65, 0x22, 0x50, 0x0a, 0x0e, 0x50, 0x61,
+	0x63, 0x6b, 0x45, 0x6e, 0x74, 0x72, 0x79, 0x50, 0x72, 0x6f, 0x74, 0x6f, 0x12, 0x0e, 0x0a, 0x02,
+	0x46, 0x50, 0x18, 0x01, 0x20, 0x01, 0x28, 0x0c, 0x52, 0x02, 0x46, 0x50, 0x12, 0x16, 0x0a, 0x06,
+	0x4f, 0x66, 0x66, 0x73, 0x65, 0x74, 0x18, 0x02, 0x20, 0x01, 0x28, 0x03, 0x52, 0x06, 0x4f, 0x66,
+	0x66, 0x73, 0x65, 0x74, 0x12, 0x16, 0x0a, 0x06, 0x4c, 0x65, 0x6e, 0x67, 0x74, 0x68, 0x18, 0x03,
+	0x20, 0x01, 0x28, 0x05, 0x52, 0x06, 0x4c, 0x65, 0x6e, 0x67, 0x74, 0x68, 0x22, 0x55, 0x0a, 0x0e,
+	0x50, 0x61, 0x63, 0x6b, 0x49, 0x6e, 0x64, 0x65, 0x78, 0x50, 0x72, 0x6f, 0x74, 0x6f, 0x12, 0x18,
+	0x0a, 0x07, 0x56, 0x65, 0x72, 0x73, 0x69, 0x6f, 0x6e, 0x18, 0x01, 0x20, 0x01, 0x28, 0x05, 0x52,
+	0x07, 0x56, 0x65, 0x72, 0x73, 0x69, 0x6f, 0x6e, 0x12, 0x29, 0x0a, 0x07, 0x45, 0x6e, 0x74, 0x72,
+	0x69, 0x65, 0x73, 0x18, 0x02, 0x20, 0x03, 0x28, 0x0b, 0x32, 0x0f, 0x2e, 0x50, 0x61, 0x63, 0x6b,
+	0x45, 0x6e, 0x74, 0x72, 0x79, 0x50, 0x72, 0x6f, 0x74, 0x6f, 0x52, 0x07, 0x45, 0x6e, 0x74, 0x72,
+	0x69, 0x65, 0x73, 0x22, 0x37, 0x0a, 0x11, 0x50, 0x65, 0x6e, 0x64, 0x69, 0x6e, 0x67, 0x43, 0x68,
+	0x75, 0x6e, 0x6b, 0x50, 0x72, 0x6f, 0x74, 0x6f, 0x12, 0x0e, 0x0a, 0x02, 0x46, 0x50, 0x18, 0x01,
+	0x20, 0x01, 0x28, 0x0c, 0x52, 0x02, 0x46, 0x50, 0x12, 0x12, 0x0a, 0x04, 0x54, 0x69, 0x6d, 0x65,
+	0x18, 0x02, 0x20, 0x01, 0x28, 0x03, 0x52, 0x04, 0x54, 0x69, 0x6d, 0x65, 0x22, 0x5c, 0x0a, 0x14,
+	0x50, 0x65, 0x6e, 0x64, 0x69, 0x6e, 0x67, 0x44, 0x65, 0x6c, 0x65, 0x74, 0x69, 0x6f, 0x6e, 0x50,
+	0x72, 0x6f, 0x74, 0x6f, 0x12, 0x18, 0x0a, 0x07, 0x56, 0x65, 0x72, 0x73, 0x69, 0x6f, 0x6e, 0x18,
+	0x01, 0x20, 0x01, 0x28, 0x05, 0x52, 0x07, 0x56, 0x65, 0x72, 0x73, 0x69, 0x6f, 0x6e, 0x12, 0x2a,
+	0x0a, 0x06, 0x43, 0x68, 0x75, 0x6e, 0x6b, 0x73, 0x18, 0x02, 0x20, 0x03, 0x28, 0x0b, 0x32, 0x12,
+	0x2e, 0x50, 0x65, 0x6e, 0x64, 0x69, 0x6e, 0x67, 0x43, 0x68, 0x75, 0x6e, 0x6b, 0x50, 0x72, 0x6f,
+	0x74, 0x6f, 0x52, 0x06, 0x43, 0x68, 0x75, 0x6e, 0x6b, 0x73, 0x22, 0xbf, 0x02, 0x0a, 0x0e, 0x45,
+	0x6e, 0x63, 0x43, 0x6f, 0x6e, 0x66, 0x69, 0x67, 0x50, 0x72, 0x6f, 0x74, 0x6f, 0x12, 0x18, 0x0a,
+	0x07, 0x56, 0x65, 0x72, 0x73, 0x69, 0x6f, 0x6e, 0x18, 0x01, 0x20, 0x01, 0x28, 0x05, 0x52, 0x07,
+	0x56, 0x65, 0x72, 0x73, 0x69, 0x6f, 0x6e, 0x12, 0x1c, 0x0a, 0x04, 0x54, 0x79, 0x70, 0x65, 0x18,
+	0x02, 0x20, 0x01, 0x28, 0x0e, 0x32, 0x08, 0x2e, 0x45, 0x6e, 0x63, 0x54, 0x79, 0x70, 0x65, 0x52,
+	0x04, 0x54, 0x79, 0x70, 0x65, 0x12, 0x1e, 0x0a, 0x0a, 0x49, 0x74, 0x65, 0x72, 0x61, 0x74, 0x69,
+	0x6f, 0x6e, 0x73, 0x18, 0x03, 0x20, 0x01, 0x28, 0x03, 0x52, 0x0a, 0x49, 0x74, 0x65, 0x72, 0x61,
+	0x74, 0x69, 0x6f, 0x6e, 0x73, 0x12, 0x12, 0x0a, 0x04, 0x53, 0x61, 0x6c, 0x74, 0x18, 0x04, 0x20,
+	0x01, 0x28, 0x0c, 0x52, 0x04, 0x53, 0x61, 0x6c, 0x74, 0x12, 0x16, 0x0a, 0x06, 0x43, 0x6f, 0x6e,
+	0x66, 0x69, 0x67, 0x18, 0x05, 0x20, 0x01, 0x28, 0x0c, 0x52, 0x06, 0x43, 0x6f, 0x6e, 0x66, 0x69,
+	0x67, 0x12, 0x1a, 0x0a, 0x03, 0x4b, 0x64, 0x66, 0x18, 0x06, 0x20, 0x01, 0x28, 0x0e, 0x32, 0x08,
+	0x2e, 0x4b, 0x64, 0x66, 0x54, 0x79, 0x70, 0x65, 0x52, 0x03, 0x4b, 0x64, 0x66, 0x12, 0x22, 0x0a,
+	0x0c, 0x41, 0x72, 0x67, 0x6f, 0x6e, 0x32, 0x4d, 0x65, 0x6d, 0x6f, 0x72, 0x79, 0x18, 0x07, 0x20,
+	0x01, 0x28, 0x05, 0x52, 0x0c, 0x41, 0x72, 0x67, 0x6f, 0x6e, 0x32, 0x4d, 0x65, 0x6d, 0x6f, 0x72,
+	0x79, 0x12, 0x1e, 0x0a, 0x0a, 0x41, 0x72, 0x67, 0x6f, 0x6e, 0x32, 0x54, 0x69, 0x6d, 0x65, 0x18,
+	0x08, 0x20, 0x01, 0x28, 0x05, 0x52, 0x0a, 0x41, 0x72, 0x67, 0x6f, 0x6e, 0x32, 0x54, 0x69, 0x6d,
+	0x65, 0x12, 0x24, 0x0a, 0x0d, 0x41, 0x72, 0x67, 0x6f, 0x6e, 0x32, 0x54, 0x68, 0x72, 0x65, 0x61,
+	0x64, 0x73, 0x18, 0x09, 0x20, 0x01, 0x28, 0x05, 0x52, 0x0d, 0x41, 0x72, 0x67, 0x6f, 0x6e, 0x32,
+	0x54, 0x68, 0x72, 0x65, 0x61, 0x64, 0x73, 0x12, 0x23, 0x0a, 0x05, 0x53, 0x6c, 0x6f, 0x74, 0x73,
+	0x18, 0x0a, 0x20, 0x03, 0x28, 0x0b, 0x32, 0x0d, 0x2e, 0x4b, 0x65, 0x79, 0x53, 0x6c, 0x6f, 0x74,
+	0x50, 0x72, 0x6f, 0x74, 0x6f, 0x52, 0x05, 0x53, 0x6c, 0x6f, 0x74, 0x73, 0x22, 0x90, 0x02, 0x0a,
+	0x0c, 0x4b, 0x65, 0x79, 0x53, 0x6c, 0x6f, 0x74, 0x50, 0x72, 0x6f, 0x74, 0x6f, 0x12, 0x14, 0x0a,
+	0x05, 0x4c, 0x61, 0x62, 0x65, 0x6c, 0x18, 0x01, 0x20, 0x01, 0x28, 0x09, 0x52, 0x05, 0x4c, 0x61,
+	0x62, 0x65, 0x6c, 0x12, 0x1a, 0x0a, 0x03, 0x4b, 0x64, 0x66, 0x18, 0x02, 0x20, 0x01, 0x28, 0x0e,
+	0x32, 0x08, 0x2e, 0x4b, 0x64, 0x66, 0x54, 0x79, 0x70, 0x65, 0x52, 0x03, 0x4b, 0x64, 0x66, 0x12,
+	0x1e, 0x0a, 0x0a, 0x49, 0x74, 0x65, 0x72, 0x61, 0x74, 0x69, 0x6f, 0x6e, 0x73, 0x18, 0x03, 0x20,
+	0x01, 0x28, 0x03, 0x52, 0x0a, 0x49, 0x74, 0x65, 0x72, 0x61, 0x74, 0x69, 0x6f, 0x6e, 0x73, 0x12,
+	0x22, 0x0a, 0x0c, 0x41, 0x72, 0x67, 0x6f, 0x6e, 0x32, 0x4d, 0x65, 0x6d, 0x6f, 0x72, 0x79, 0x18,
+	0x04, 0x20, 0x01, 0x28, 0x05, 0x52, 0x0c, 0x41, 0x72, 0x67, 0x6f, 0x6e, 0x32, 0x4d, 0x65, 0x6d,
+	0x6f, 0x72, 0x79, 0x12, 0x1e, 0x0a, 0x0a, 0x41, 0x72, 0x67, 0x6f, 0x6e, 0x32, 0x54, 0x69, 0x6d,
+	0x65, 0x18, 0x05, 0x20, 0x01, 0x28, 0x05, 0x52, 0x0a, 0x41, 0x72, 0x67, 0x6f, 0x6e, 0x32, 0x54,
+	0x69, 0x6d, 0x65, 0x12, 0x24, 0x0a, 0x0d, 0x41, 0x72, 0x67, 0x6f, 0x6e, 0x32, 0x54, 0x68, 0x72,
+	0x65, 0x61, 0x64, 0x73, 0x18, 0x06, 0x20, 0x01, 0x28, 0x05, 0x52, 0x0d, 0x41, 0x72, 0x67, 0x6f,
+	0x6e, 0x32, 0x54, 0x68, 0x72, 0x65, 0x61, 0x64, 0x73, 0x12, 0x12, 0x0a, 0x04, 0x53, 0x61, 0x6c,
+	0x74, 0x18, 0x07, 0x20, 0x01, 0x28, 0x0c, 0x52, 0x04, 0x53, 0x61, 0x6c, 0x74, 0x12, 0x10, 0x0a,
+	0x03, 0x4b, 0x65, 0x79, 0x18, 0x08, 0x20, 0x01, 0x28, 0x0c, 0x52, 0x03, 0x4b, 0x65, 0x79, 0x12,
+	0x1e, 0x0a, 0x0a, 0x50, 0x72, 0x69, 0x76, 0x61, 0x74, 0x65, 0x4b, 0x65, 0x79, 0x18, 0x09, 0x20,
+	0x01, 0x28, 0x0c, 0x52, 0x0a, 0x50, 0x72, 0x69, 0x76, 0x61, 0x74, 0x65, 0x4b, 0x65, 0x79, 0x22,
+	0x5f, 0x0a, 0x13, 0x4b, 0x65, 0x79, 0x52, 0x6f, 0x74, 0x61, 0x74, 0x69, 0x6f, 0x6e, 0x4d, 0x61,
+	0x70, 0x50, 0x72, 0x6f, 0x74, 0x6f, 0x12, 0x18, 0x0a, 0x07, 0x56, 0x65, 0x72, 0x73, 0x69, 0x6f,
+	0x6e, 0x18, 0x01, 0x20, 0x01, 0x28, 0x05, 0x52, 0x07, 0x56, 0x65, 0x72, 0x73, 0x69, 0x6f, 0x6e,
+	0x12, 0x16, 0x0a, 0x06, 0x4f, 0x6c, 0x64, 0x46, 0x50, 0x73, 0x18, 0x02, 0x20, 0x03, 0x28, 0x0c,
+	0x52, 0x06, 0x4f, 0x6c, 0x64, 0x46, 0x50, 0x73, 0x12, 0x16, 0x0a, 0x06, 0x4e, 0x65, 0x77, 0x46,
+	0x50, 0x73, 0x18, 0x03, 0x20, 0x03, 0x28, 0x0c, 0x52, 0x06, 0x4e, 0x65, 0x77, 0x46, 0x50, 0x73,
+	0x22, 0x80, 0x01, 0x0a, 0x0e, 0x4b, 0x65, 0x79, 0x45, 0x78, 0x70, 0x6f, 0x72, 0x74, 0x50, 0x72,
+	0x6f, 0x74, 0x6f, 0x12, 0x18, 0x0a, 0x07, 0x56, 0x65, 0x72, 0x73, 0x69, 0x6f, 0x6e, 0x18, 0x01,
+	0x20, 0x01, 0x28, 0x05, 0x52, 0x07, 0x56, 0x65, 0x72, 0x73, 0x69, 0x6f, 0x6e, 0x12, 0x1c, 0x0a,
+	0x04, 0x54, 0x79, 0x70, 0x65, 0x18, 0x02, 0x20, 0x01, 0x28, 0x0e, 0x32, 0x08, 0x2e, 0x45, 0x6e,
+	0x63, 0x54, 0x79, 0x70, 0x65, 0x52, 0x04, 0x54, 0x79, 0x70, 0x65, 0x12, 0x16, 0x0a, 0x06, 0x43,
+	0x6f, 0x6e, 0x66, 0x69, 0x67, 0x18, 0x03, 0x20, 0x01, 0x28, 0x0c, 0x52, 0x06, 0x43, 0x6f, 0x6e,
+	0x66, 0x69, 0x67, 0x12, 0x1e, 0x0a, 0x0a, 0x50, 0x72, 0x69, 0x76, 0x61, 0x74, 0x65, 0x4b, 0x65,
+	0x79, 0x18, 0x04, 0x20, 0x01, 0x28, 0x0c, 0x52, 0x0a, 0x50, 0x72, 0x69, 0x76, 0x61, 0x74, 0x65,
+	0x4b, 0x65, 0x79, 0x2a, 0x38, 0x0a, 0x08, 0x46, 0x69, 0x6c, 0x65, 0x54, 0x79, 0x70, 0x65, 0x12,
+	0x10, 0x0a, 0x0c, 0x52, 0x45, 0x47, 0x55, 0x4c, 0x41, 0x52, 0x5f, 0x46, 0x49, 0x4c, 0x45, 0x10,
+	0x00, 0x12, 0x0d, 0x0a, 0x09, 0x44, 0x49, 0x52, 0x45, 0x43, 0x54, 0x4f, 0x52, 0x59, 0x10, 0x01,
+	0x12, 0x0b, 0x0a, 0x07, 0x53, 0x59, 0x4d, 0x4c, 0x49, 0x4e, 0x4b, 0x10, 0x02, 0x2a, 0x3a, 0x0a,
+	0x08, 0x52, 0x65, 0x70, 0x6f, 0x4d, 0x6f, 0x64, 0x65, 0x12, 0x0e, 0x0a, 0x0a, 0x52, 0x45, 0x41,
+	0x44, 0x5f, 0x57, 0x52, 0x49, 0x54, 0x45, 0x10, 0x00, 0x12, 0x0f, 0x0a, 0x0b, 0x41, 0x50, 0x50,
+	0x45, 0x4e, 0x44, 0x5f, 0x4f, 0x4e, 0x4c, 0x59, 0x10, 0x01, 0x12, 0x0d, 0x0a, 0x09, 0x52, 0x45,
+	0x41, 0x44, 0x5f, 0x4f, 0x4e, 0x4c, 0x59, 0x10, 0x02, 0x2a, 0x3a, 0x0a, 0x0b, 0x50, 0x61, 0x64,
+	0x64, 0x69, 0x6e, 0x67, 0x4d, 0x6f, 0x64, 0x65, 0x12, 0x0e, 0x0a, 0x0a, 0x4e, 0x4f, 0x5f, 0x50,
+	0x41, 0x44, 0x44, 0x49, 0x4e, 0x47, 0x10, 0x00, 0x12, 0x10, 0x0a, 0x0c, 0x50, 0x4f, 0x57, 0x45,
+	0x52, 0x5f, 0x4f, 0x46, 0x5f, 0x54, 0x57, 0x4f, 0x10, 0x01, 0x12, 0x09, 0x0a, 0x05, 0x50, 0x41,
+	0x44, 0x4d, 0x45, 0x10, 0x02, 0x2a, 0x3b, 0x0a, 0x07, 0x45, 0x6e, 0x63, 0x54, 0x79, 0x70, 0x65,
+	0x12, 0x11, 0x0a, 0x0d, 0x4e, 0x4f, 0x5f, 0x45, 0x4e, 0x43, 0x52, 0x59, 0x50, 0x54, 0x49, 0x4f,
+	0x4e, 0x10, 0x00, 0x12, 0x0d, 0x0a, 0x09, 0x53, 0x59, 0x4d, 0x4d, 0x45, 0x54, 0x52, 0x49, 0x43,
+	0x10, 0x01, 0x12, 0x0e, 0x0a, 0x0a, 0x41, 0x53, 0x59, 0x4d, 0x4d, 0x45, 0x54, 0x52, 0x49, 0x43,
+	0x10, 0x02, 0x2a, 0x35, 0x0a, 0x07, 0x4b, 0x64, 0x66, 0x54, 0x79, 0x70, 0x65, 0x12, 0x0f, 0x0a,
+	0x0b, 0x50, 0x42, 0x4b, 0x44, 0x46, 0x32, 0x5f, 0x53, 0x48, 0x41, 0x31, 0x10, 0x00, 0x12, 0x0c,
+	0x0a, 0x08, 0x41, 0x52, 0x47, 0x4f, 0x4e, 0x32, 0x49, 0x44, 0x10, 0x01, 0x12, 0x0b, 0x0a, 0x07,
+	0x52, 0x41, 0x57, 0x5f, 0x4b, 0x45, 0x59, 0x10, 0x02, 0x2a, 0x39, 0x0a, 0x0f, 0x43, 0x6f, 0x6d,
+	0x70, 0x72, 0x65, 0x73, 0x73, 0x69, 0x6f, 0x6e, 0x54, 0x79, 0x70, 0x65, 0x12, 0x12, 0x0a, 0x0e,
+	0x4e, 0x4f, 0x5f, 0x43, 0x4f, 0x4d, 0x50, 0x52, 0x45, 0x53, 0x53, 0x49, 0x4f, 0x4e, 0x10, 0x00,
+	0x12, 0x08, 0x0a, 0x04, 0x5a, 0x4c, 0x49, 0x42, 0x10, 0x01, 0x12, 0x08, 0x0a, 0x04, 0x5a, 0x53,
+	0x54, 0x44, 0x10, 0x02, 0x2a, 0x36, 0x0a, 0x0f, 0x43, 0x6f, 0x6d, 0x70, 0x72, 0x65, 0x73, 0x73,
+	0x69, 0x6f, 0x6e, 0x4d, 0x6f, 0x64, 0x65, 0x12, 0x08, 0x0a, 0x04, 0x41, 0x55, 0x54, 0x4f, 0x10,
+	0x00, 0x12, 0x08, 0x0a, 0x04, 0x53, 0x4c, 0x4f, 0x57, 0x10, 0x01, 0x12, 0x06, 0x0a, 0x02, 0x4e,
+	0x4f, 0x10, 0x02, 0x12, 0x07, 0x0a, 0x03, 0x59, 0x45, 0x53, 0x10, 0x03, 0x2a, 0x22, 0x0a, 0x0c,
+	0x43, 0x68, 0x75, 0x6e, 0x6b, 0x69, 0x6e, 0x67, 0x4d, 0x6f, 0x64, 0x65, 0x12, 0x09, 0x0a, 0x05,
+	0x46, 0x49, 0x58, 0x45, 0x44, 0x10, 0x00, 0x12, 0x07, 0x0a, 0x03, 0x43, 0x44, 0x43, 0x10, 0x01,
+	0x42, 0x2f, 0x5a, 0x2d, 0x67, 0x69, 0x74, 0x68, 0x75, 0x62, 0x2e, 0x63, 0x6f, 0x6d, 0x2f, 0x70,
+	0x74, 0x73, 0x69, 0x6d, 0x2f, 0x76, 0x65, 0x63, 0x62, 0x61, 0x63, 0x6b, 0x75, 0x70, 0x2f, 0x69,
+	0x6e, 0x74, 0x65, 0x72, 0x6e, 0x61, 0x6c, 0x2f, 0x76, 0x65, 0x63, 0x62, 0x61, 0x63, 0x6b, 0x75,
+	0x70, 0x62, 0x06, 0x70, 0x72, 0x6f, 0x74, 0x6f, 0x33,
 }
 
 var (
@@ -601,29 +1549,50 @@ func file_formats_proto_rawDescGZIP() []byte {
 	return file_formats_proto_rawDescData
 }
 
-var file_formats_proto_enumTypes = make([]protoimpl.EnumInfo, 4)
-var file_formats_proto_msgTypes = make([]protoimpl.MessageInfo, 4)
+var file_formats_proto_enumTypes = make([]protoimpl.EnumInfo, 8)
+var file_formats_proto_msgTypes = make([]protoimpl.MessageInfo, 11)
 var file_formats_proto_goTypes = []interface{}{
 	(FileType)(0),                 // 0: FileType
-	(EncType)(0),                  // 1: EncType
-	(CompressionType)(0),          // 2: CompressionType
-	(CompressionMode)(0),          // 3: CompressionMode
-	(*NodeDataProto)(nil),         // 4: NodeDataProto
-	(*VersionProto)(nil),          // 5: VersionProto
-	(*ConfigProto)(nil),           // 6: ConfigProto
-	(*EncConfigProto)(nil),        // 7: EncConfigProto
-	(*timestamppb.Timestamp)(nil), // 8: google.protobuf.Timestamp
+	(RepoMode)(0),                 // 1: RepoMode
+	(PaddingMode)(0),              // 2: PaddingMode
+	(EncType)(0),                  // 3: EncType
+	(KdfType)(0),                  // 4: KdfType
+	(CompressionType)(0),          // 5: CompressionType
+	(CompressionMode)(0),          // 6: CompressionMode
+	(ChunkingMode)(0),             // 7: ChunkingMode
+	(*NodeDataProto)(nil),         // 8: NodeDataProto
+	(*VersionProto)(nil),          // 9: VersionProto
+	(*ConfigProto)(nil),           // 10: ConfigProto
+	(*PackEntryProto)(nil),        // 11: PackEntryProto
+	(*PackIndexProto)(nil),        // 12: PackIndexProto
+	(*PendingChunkProto)(nil),     // 13: PendingChunkProto
+	(*PendingDeletionProto)(nil),  // 14: PendingDeletionProto
+	(*EncConfigProto)(nil),        // 15: EncConfigProto
+	(*KeySlotProto)(nil),          // 16: KeySlotProto
+	(*KeyRotationMapProto)(nil),   // 17: KeyRotationMapProto
+	(*KeyExportProto)(nil),        // 18: KeyExportProto
+	(*timestamppb.Timestamp)(nil), // 19: google.protobuf.Timestamp
 }
 var file_formats_proto_depIdxs = []int32{
-	0, // 0: NodeDataProto.type:type_name -> FileType
-	8, // 1: NodeDataProto.mod_time:type_name -> google.protobuf.Timestamp
-	3, // 2: ConfigProto.Compress:type_name -> CompressionMode
-	1, // 3: EncConfigProto.Type:type_name -> EncType
-	4, // [4:4] is the sub-list for method output_type
-	4, // [4:4] is the sub-list for method input_type
-	4, // [4:4] is the sub-list for extension type_name
-	4, // [4:4] is the sub-list for extension extendee
-	0, // [0:4] is the sub-list for field type_name
+	0,  // 0: NodeDataProto.type:type_name -> FileType
+	19, // 1: NodeDataProto.mod_time:type_name -> google.protobuf.Timestamp
+	6,  // 2: ConfigProto.Compress:type_name -> CompressionMode
+	7,  // 3: ConfigProto.Chunking:type_name -> ChunkingMode
+	5,  // 4: ConfigProto.CompressionType:type_name -> CompressionType
+	2,  // 5: ConfigProto.Padding:type_name -> PaddingMode
+	1,  // 6: ConfigProto.Mode:type_name -> RepoMode
+	11, // 7: PackIndexProto.Entries:type_name -> PackEntryProto
+	13, // 8: PendingDeletionProto.Chunks:type_name -> PendingChunkProto
+	3,  // 9: EncConfigProto.Type:type_name -> EncType
+	4,  // 10: EncConfigProto.Kdf:type_name -> KdfType
+	16, // 11: EncConfigProto.Slots:type_name -> KeySlotProto
+	4,  // 12: KeySlotProto.Kdf:type_name -> KdfType
+	3,  // 13: KeyExportProto.Type:type_name -> EncType
+	14, // [14:14] is the sub-list for method output_type
+	14, // [14:14] is the sub-list for method input_type
+	14, // [14:14] is the sub-list for extension type_name
+	14, // [14:14] is the sub-list for extension extendee
+	0,  // [0:14] is the sub-list for field type_name
 }
 
 func init() { file_formats_proto_init() }
@@ -669,6 +1638,54 @@ func file_formats_proto_init() {
 			}
 		}
 		file_formats_proto_msgTypes[3].Exporter = func(v interface{}, i int) interface{} {
+			switch v := v.(*PackEntryProto); i {
+			case 0:
+				return &v.state
+			case 1:
+				return &v.sizeCache
+			case 2:
+				return &v.unknownFields
+			default:
+				return nil
+			}
+		}
+		file_formats_proto_msgTypes[4].Exporter = func(v interface{}, i int) interface{} {
+			switch v := v.(*PackIndexProto); i {
+			case 0:
+				return &v.state
+			case 1:
+				return &v.sizeCache
+			case 2:
+				return &v.unknownFields
+			default:
+				return nil
+			}
+		}
+		file_formats_proto_msgTypes[5].Exporter = func(v interface{}, i int) interface{} {
+			switch v := v.(*PendingChunkProto); i {
+			case 0:
+				return &v.state
+			case 1:
+				return &v.sizeCache
+			case 2:
+				return &v.unknownFields
+			default:
+				return nil
+			}
+		}
+		file_formats_proto_msgTypes[6].Exporter = func(v interface{}, i int) interface{} {
+			switch v := v.(*PendingDeletionProto); i {
+			case 0:
+				return &v.state
+			case 1:
+				return &v.sizeCache
+			case 2:
+				return &v.unknownFields
+			default:
+				return nil
+			}
+		}
+		file_formats_proto_msgTypes[7].Exporter = func(v interface{}, i int) interface{} {
 			switch v := v.(*EncConfigProto); i {
 			case 0:
 				return &v.state
@@ -680,14 +1697,50 @@ func file_formats_proto_init() {
 				return nil
 			}
 		}
+		file_formats_proto_msgTypes[8].Exporter = func(v interface{}, i int) interface{} {
+			switch v := v.(*KeySlotProto); i {
+			case 0:
+				return &v.state
+			case 1:
+				return &v.sizeCache
+			case 2:
+				return &v.unknownFields
+			default:
+				return nil
+			}
+		}
+		file_formats_proto_msgTypes[9].Exporter = func(v interface{}, i int) interface{} {
+			switch v := v.(*KeyRotationMapProto); i {
+			case 0:
+				return &v.state
+			case 1:
+				return &v.sizeCache
+			case 2:
+				return &v.unknownFields
+			default:
+				return nil
+			}
+		}
+		file_formats_proto_msgTypes[10].Exporter = func(v interface{}, i int) interface{} {
+			switch v := v.(*KeyExportProto); i {
+			case 0:
+				return &v.state
+			case 1:
+				return &v.sizeCache
+			case 2:
+				return &v.unknownFields
+			default:
+				return nil
+			}
+		}
 	}
 	type x struct{}
 	out := protoimpl.TypeBuilder{
 		File: protoimpl.DescBuilder{
 			GoPackagePath: reflect.TypeOf(x{}).PkgPath(),
 			RawDescriptor: file_formats_proto_rawDesc,
-			NumEnums:      4,
-			NumMessages:   4,
+			NumEnums:      8,
+			NumMessages:   11,
 			NumExtensions: 0,
 			NumServices:   0,
 		},
@@ -0,0 +1,209 @@
+package vecbackup
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base32"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"google.golang.org/protobuf/proto"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// "key export" prints the secrets of a repo so that the repo can be
+// recovered with "key import" if its config file is lost. The export is
+// KEY_EXPORT_MAGIC, a KeyExportProto and the first 4 bytes of the SHA-256
+// of both. It is printed in two forms:
+//
+// The text form has KEY_EXPORT_LINE_SIZE bytes per line in hex, prefixed
+// by the line number and followed by a checksum byte of the line so that
+// typing errors are found on the line they are made.
+//
+// The QR form is a single line in base32, which only uses characters of
+// the alphanumeric mode of QR codes.
+
+const (
+	KEY_EXPORT_MAGIC     = "VBKX"
+	KEY_EXPORT_VERSION   = 1
+	KEY_EXPORT_LINE_SIZE = 16
+)
+
+var keyExportEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+func keyExportChecksum(b []byte) []byte {
+	h := sha256.Sum256(b)
+	return h[:4]
+}
+
+func keyExportLineChecksum(n int, b []byte) byte {
+	h := sha256.Sum256(append([]byte(strconv.Itoa(n)+":"), b...))
+	return h[0]
+}
+
+// ExportKeys returns the secrets of an encrypted repo. The password must
+// not be a write-only key.
+func ExportKeys(pwSrc *PwSource, sm StorageMgr, repo string) ([]byte, error) {
+	_, ec, err := readEncConfig(sm, repo)
+	if err != nil {
+		return nil, err
+	}
+	if ec.Type == EncType_NO_ENCRYPTION {
+		return nil, errors.New("Backup is not encrypted")
+	}
+	configBytes, _, priv, err := decryptConfig(pwSrc, ec)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := configFromBytes(configBytes, true); err != nil {
+		return nil, err
+	}
+	kp := KeyExportProto{Version: KEY_EXPORT_VERSION, Type: ec.Type, Config: configBytes}
+	if ec.Type == EncType_ASYMMETRIC {
+		if priv == nil {
+			return nil, errors.New("A write-only key cannot export the keys.")
+		}
+		kp.PrivateKey = priv[:]
+	}
+	pb, err := proto.Marshal(&kp)
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	buf.WriteString(KEY_EXPORT_MAGIC)
+	buf.Write(pb)
+	buf.Write(keyExportChecksum(buf.Bytes()))
+	return buf.Bytes(), nil
+}
+
+// FormatKeyExport returns the text form of the exported secrets.
+func FormatKeyExport(b []byte) string {
+	var sb strings.Builder
+	for n := 1; len(b) > 0; n++ {
+		l := b
+		if len(l) > KEY_EXPORT_LINE_SIZE {
+			l = l[:KEY_EXPORT_LINE_SIZE]
+		}
+		b = b[len(l):]
+		var groups []string
+		for i := 0; i < len(l); i += 2 {
+			if i+1 < len(l) {
+				groups = append(groups, hex.EncodeToString(l[i:i+2]))
+			} else {
+				groups = append(groups, hex.EncodeToString(l[i:i+1]))
+			}
+		}
+		fmt.Fprintf(&sb, "%3d: %-*s  %02x\n", n, KEY_EXPORT_LINE_SIZE/2*5-1, strings.Join(groups, " "), keyExportLineChecksum(n, l))
+	}
+	return sb.String()
+}
+
+// FormatKeyExportQR returns the QR form of the exported secrets.
+func FormatKeyExportQR(b []byte) string {
+	return keyExportEncoding.EncodeToString(b)
+}
+
+// ParseKeyExport reads the exported secrets. The text form is used if
+// there are numbered lines, otherwise the QR form. Blank lines and lines
+// starting with '#' are ignored so the whole output of "key export" can
+// be used.
+func ParseKeyExport(s string) ([]byte, error) {
+	var lines, numbered []string
+	for _, l := range strings.Split(s, "\n") {
+		l = strings.TrimSpace(l)
+		if l == "" || strings.HasPrefix(l, "#") {
+			continue
+		}
+		lines = append(lines, l)
+		if l[0] >= '0' && l[0] <= '9' && strings.Contains(l, ":") {
+			numbered = append(numbered, l)
+		}
+	}
+	var b []byte
+	if len(numbered) > 0 {
+		for i, l := range numbered {
+			n := i + 1
+			p := strings.SplitN(l, ":", 2)
+			if strings.TrimSpace(p[0]) != strconv.Itoa(n) {
+				return nil, fmt.Errorf("Expected line %d: %s", n, l)
+			}
+			f := strings.Fields(p[1])
+			if len(f) < 2 {
+				return nil, fmt.Errorf("Line %d is too short.", n)
+			}
+			lb, err := hex.DecodeString(strings.Join(f[:len(f)-1], ""))
+			if err != nil {
+				return nil, fmt.Errorf("Invalid hex on line %d: %s", n, err)
+			}
+			cs, err := hex.DecodeString(f[len(f)-1])
+			if err != nil || len(cs) != 1 || cs[0] != keyExportLineChecksum(n, lb) {
+				return nil, fmt.Errorf("Checksum mismatch on line %d, check for typing errors.", n)
+			}
+			b = append(b, lb...)
+		}
+	} else if len(lines) > 0 {
+		var err error
+		if b, err = keyExportEncoding.DecodeString(strings.ToUpper(strings.Join(lines, ""))); err != nil {
+			return nil, fmt.Errorf("Invalid exported keys: %s", err)
+		}
+	} else {
+		return nil, errors.New("No exported keys found.")
+	}
+	if len(b) < len(KEY_EXPORT_MAGIC)+4 || string(b[:len(KEY_EXPORT_MAGIC)]) != KEY_EXPORT_MAGIC {
+		return nil, errors.New("Invalid exported keys.")
+	}
+	if !bytes.Equal(keyExportChecksum(b[:len(b)-4]), b[len(b)-4:]) {
+		return nil, errors.New("Checksum mismatch in exported keys.")
+	}
+	return b, nil
+}
+
+// ImportKeys writes a new config file for the repo with the exported
+// secrets. The repo can then be opened with the new password. An existing
+// config file is only replaced if overwrite is true.
+func ImportKeys(b []byte, newPwSrc *PwSource, sm StorageMgr, repo string, kdf *KdfParams, overwrite bool) error {
+	if len(b) < len(KEY_EXPORT_MAGIC)+4 || string(b[:len(KEY_EXPORT_MAGIC)]) != KEY_EXPORT_MAGIC {
+		return errors.New("Invalid exported keys.")
+	}
+	var kp KeyExportProto
+	if err := proto.Unmarshal(b[len(KEY_EXPORT_MAGIC):len(b)-4], &kp); err != nil {
+		return fmt.Errorf("Invalid exported keys: %s", err)
+	}
+	if kp.Version != KEY_EXPORT_VERSION {
+		return errors.New("Incompatible exported keys.")
+	}
+	cfg, err := configFromBytes(kp.Config, true)
+	if err != nil {
+		return err
+	}
+	if kp.Type != EncType_SYMMETRIC && kp.Type != EncType_ASYMMETRIC {
+		return errors.New("Invalid exported keys: Unknown encryption type.")
+	}
+	if (cfg.PublicKey != nil) != (kp.Type == EncType_ASYMMETRIC) || (kp.Type == EncType_ASYMMETRIC) != (len(kp.PrivateKey) == len(EncKey{})) {
+		return errors.New("Invalid exported keys: Wrong encryption type.")
+	}
+	pw, kdf, err := readNewPw(newPwSrc, kdf)
+	if err != nil {
+		return err
+	}
+	var ec *EncConfigProto
+	if kp.Type == EncType_ASYMMETRIC {
+		var configKey, priv EncKey
+		if _, err := io.ReadFull(rand.Reader, configKey[:]); err != nil {
+			return err
+		}
+		copy(priv[:], kp.PrivateKey)
+		if ec, err = asymmetricEncConfig(pw, kdf, &configKey, cfg, &priv); err != nil {
+			return err
+		}
+	} else {
+		ec = &EncConfigProto{Type: EncType_SYMMETRIC}
+		if err := wrapConfig(ec, pw, kdf, kp.Config); err != nil {
+			return err
+		}
+	}
+	return writeConfigFile(sm, repo, ec, overwrite)
+}
@@ -0,0 +1,80 @@
+package vecbackup
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestKeyExport(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "key_export_test-*")
+	if err != nil {
+		t.Fatal("Cannot get tempdir", err)
+	}
+	defer os.RemoveAll(tmpDir)
+	pwFile := filepath.Join(tmpDir, "pw")
+	newPwFile := filepath.Join(tmpDir, "newpw")
+	ioutil.WriteFile(pwFile, []byte("oicewoe90390j0w9jf0wejf0weh"), 0444)
+	ioutil.WriteFile(newPwFile, []byte("f00fjsoidfjsodjhfosjd"), 0444)
+	kdf := &KdfParams{Iterations: 100000}
+	for _, asymmetric := range []bool{false, true} {
+		repo := filepath.Join(tmpDir, "repo")
+		os.RemoveAll(repo)
+		os.MkdirAll(repo, 0755)
+		sm, repo2 := GetStorageMgr(repo)
+		cfg := &Config{ChunkSize: 1000, Compress: CompressionMode_NO, CompressionType: CompressionType_ZSTD, CompressionLevel: 3, PackSize: 5000}
+		if asymmetric {
+			err = WriteNewAsymmetricConfig(PwFile(pwFile), sm, repo2, kdf, cfg)
+		} else {
+			err = WriteNewConfig(PwFile(pwFile), sm, repo2, kdf, cfg)
+		}
+		if err != nil {
+			t.Fatal("Cannot save config:", err)
+		}
+		orig, err := GetConfig(PwFile(pwFile), sm, repo2)
+		if err != nil {
+			t.Fatal("Cannot load config:", err)
+		}
+		b, err := ExportKeys(PwFile(pwFile), sm, repo2)
+		if err != nil {
+			t.Fatal("Cannot export keys:", err)
+		}
+		text := FormatKeyExport(b)
+		qr := FormatKeyExportQR(b)
+		for _, s := range []string{text, qr, "# comment\n" + text + "\n# QR form:\n" + qr + "\n", strings.ToLower(qr)} {
+			if b2, err := ParseKeyExport(s); err != nil || !bytes.Equal(b, b2) {
+				t.Fatal("Cannot parse exported keys", s, err)
+			}
+		}
+		typo := []byte(text)
+		typo[12] ^= 1
+		if _, err := ParseKeyExport(string(typo)); err == nil || !strings.Contains(err.Error(), "line 1") {
+			t.Fatal("Typing error should be found on line 1", err)
+		}
+		if err := ImportKeys(b, PwFile(newPwFile), sm, repo2, kdf, false); err == nil {
+			t.Fatal("Should not be able to overwrite the config file")
+		}
+		os.Remove(filepath.Join(repo, CONFIG_FILE))
+		if err := ImportKeys(b, PwFile(newPwFile), sm, repo2, kdf, false); err != nil {
+			t.Fatal("Cannot import keys:", err)
+		}
+		if _, err := GetConfig(PwFile(pwFile), sm, repo2); err == nil {
+			t.Fatal("Should not be able to load config with old password")
+		}
+		cfg2, err := GetConfig(PwFile(newPwFile), sm, repo2)
+		if err != nil || !equalConfig(orig, cfg2) || !equalKey(orig.PublicKey, cfg2.PublicKey) || !equalKey(orig.PrivateKey, cfg2.PrivateKey) {
+			t.Fatal("Imported config does not match", orig, cfg2, err)
+		}
+		if asymmetric {
+			if err := AddKeySlot(PwFile(newPwFile), PwFile(pwFile), sm, repo2, "backup", kdf, true); err != nil {
+				t.Fatal("Cannot add write-only key slot:", err)
+			}
+			if _, err := ExportKeys(PwFile(pwFile), sm, repo2); err == nil {
+				t.Fatal("Should not be able to export keys with a write-only key")
+			}
+		}
+	}
+}
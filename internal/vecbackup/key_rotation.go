@@ -0,0 +1,688 @@
+package vecbackup
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha512"
+	"errors"
+	"fmt"
+	"google.golang.org/protobuf/proto"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// rotate-key replaces the storage key and the FP secret of a repo:
+//
+// 1. The new keys are saved in the config next to the old ones. Other
+//    commands refuse to use the repo until rotate-key finishes. Key slots
+//    other than the one used are removed, if allowed, because they could
+//    open the config with the new keys.
+// 2. Every chunk is decrypted with the old key, named with the keyed FP of
+//    the new secret and encrypted again with the new key. The old chunks
+//    are kept. The old and new names are saved in ROTATE_DIR in batches.
+// 3. Every version file is rewritten with the new names and the new key.
+// 4. The pending deletion list and the keep files are rewritten with the
+//    new names and the new key.
+// 5. The old chunks or packs and ROTATE_DIR are deleted.
+// 6. The new keys replace the old ones in the config, which is encrypted
+//    with a new config key and the new password, so that neither the old
+//    password nor the old config key can open it.
+//
+// Chunks, packs and version files are told apart by the key that opens
+// them, so running rotate-key again after a crash resumes where it stopped
+// and at most repeats the last batch.
+
+const (
+	ROTATE_DIR         = "rotate-key"
+	ROTATE_MAP_MAGIC   = "VBKR"
+	ROTATE_MAP_VERSION = 1
+	ROTATE_MAP_BATCH   = 1000
+)
+
+var errKeyRotation = errors.New("Key rotation in progress. Run rotate-key again to finish it.")
+
+// KeyRotation holds the new keys while rotate-key is in progress.
+type KeyRotation struct {
+	EncryptionKey *EncKey
+	FPSecret      []byte
+	PublicKey     *EncKey
+	PrivateKey    *EncKey
+}
+
+type RotateKeyStats struct {
+	Chunks   int
+	Versions int
+	Errors   int
+}
+
+func keyRotationFromProto(cp *ConfigProto) (*KeyRotation, error) {
+	if len(cp.NewFPSecret) < 64 {
+		return nil, errors.New("Invalid new keys in config file.")
+	}
+	r := &KeyRotation{FPSecret: cp.NewFPSecret}
+	if len(cp.PublicKey) > 0 {
+		if len(cp.NewPublicKey) != 32 || len(cp.NewPrivateKey) != 32 || len(cp.NewEncryptionKey) != 0 {
+			return nil, errors.New("Invalid new keys in config file.")
+		}
+		var pub, priv EncKey
+		copy(pub[:], cp.NewPublicKey)
+		copy(priv[:], cp.NewPrivateKey)
+		r.PublicKey = &pub
+		r.PrivateKey = &priv
+	} else {
+		if len(cp.NewEncryptionKey) != 32 || len(cp.NewPublicKey) != 0 || len(cp.NewPrivateKey) != 0 {
+			return nil, errors.New("Invalid new keys in config file.")
+		}
+		var key EncKey
+		copy(key[:], cp.NewEncryptionKey)
+		r.EncryptionKey = &key
+	}
+	return r, nil
+}
+
+// rotatedConfig returns the config with the new keys.
+func rotatedConfig(cfg *Config) *Config {
+	c := *cfg
+	r := cfg.Rotation
+	c.EncryptionKey = r.EncryptionKey
+	c.FPSecret = r.FPSecret
+	c.PublicKey = r.PublicKey
+	c.PrivateKey = r.PrivateKey
+	c.Rotation = nil
+	return &c
+}
+
+// rotatedPw returns the new password for the config with the new keys and
+// its key derivation function, which is that of the config or key slot
+// opened by the old password unless the new password is a key file.
+func rotatedPw(pwSrc, newPwSrc *PwSource, ec *EncConfigProto) ([]byte, *KdfParams, error) {
+	if newPwSrc == nil {
+		return nil, nil, errors.New("New password must be specified.")
+	}
+	pw, err := readPw(pwSrc)
+	if err != nil {
+		return nil, nil, err
+	}
+	var kdf *KdfParams
+	if ec.Version == VC_VERSION_SLOTS {
+		i, _, _, err := openKeySlot(ec, pw)
+		if err != nil {
+			return nil, nil, err
+		}
+		if kdf, err = kdfFromKeySlot(ec.Slots[i]); err != nil {
+			return nil, nil, err
+		}
+	} else if kdf, err = kdfFromEncConfig(ec); err != nil {
+		return nil, nil, err
+	}
+	newPw, kdf, err := readNewPw(newPwSrc, kdf)
+	if err != nil {
+		return nil, nil, err
+	}
+	if bytes.Equal(pw, newPw) {
+		return nil, nil, errors.New("The new password must be different from the old one.")
+	}
+	return newPw, kdf, nil
+}
+
+// StartKeyRotation saves new keys in the config of the repo unless a key
+// rotation is already in progress. It returns the config with both keys.
+// The other key slots are only removed if removeOtherKeys is set.
+func StartKeyRotation(pwSrc, newPwSrc *PwSource, sm StorageMgr, repo string, removeOtherKeys bool) (*Config, error) {
+	old, ec, err := readEncConfig(sm, repo)
+	if err != nil {
+		return nil, err
+	}
+	if ec.Type == EncType_NO_ENCRYPTION {
+		return nil, errors.New("Backup is not encrypted")
+	}
+	configBytes, key, priv, err := decryptConfig(pwSrc, ec)
+	if err != nil {
+		return nil, err
+	}
+	cfg, err := configFromBytes(configBytes, true)
+	if err != nil {
+		return nil, err
+	}
+	if ec.Type == EncType_ASYMMETRIC && priv == nil {
+		return nil, errNoPrivateKey
+	}
+	// Read the new password now rather than after rotating the repo.
+	if _, _, err := rotatedPw(pwSrc, newPwSrc, ec); err != nil {
+		return nil, err
+	}
+	cfg.PrivateKey = priv
+	if cfg.Rotation != nil {
+		return cfg, nil
+	}
+	var others []string
+	if ec.Version == VC_VERSION_SLOTS && len(ec.Slots) > 1 {
+		pw, err := readPw(pwSrc)
+		if err != nil {
+			return nil, err
+		}
+		i, _, _, err := openKeySlot(ec, pw)
+		if err != nil {
+			return nil, err
+		}
+		for j, s := range ec.Slots {
+			if j != i {
+				others = append(others, s.Label)
+			}
+		}
+		if !removeOtherKeys {
+			return nil, fmt.Errorf("Key slot(s) %s would be removed. Use -remove-other-keys to remove them.", strings.Join(others, ", "))
+		}
+		ec.Slots = []*KeySlotProto{ec.Slots[i]}
+	}
+	newKey, fpSecret, err := genSecrets()
+	if err != nil {
+		return nil, err
+	}
+	r := &KeyRotation{FPSecret: fpSecret}
+	if cfg.PublicKey != nil {
+		if r.PublicKey, r.PrivateKey, err = genKeyPair(); err != nil {
+			return nil, err
+		}
+	} else {
+		r.EncryptionKey = newKey
+	}
+	cfg.Rotation = r
+	if configBytes, err = configToBytes(cfg, true); err != nil {
+		return nil, err
+	}
+	if ec.Config, err = encryptBytes(key, configBytes, nil); err != nil {
+		return nil, err
+	}
+	if err := replaceEncConfig(sm, repo, old, ec); err != nil {
+		return nil, err
+	}
+	if len(others) > 0 {
+		stdout.Printf("Removed key slot(s) %s. Add them again with key add when rotate-key is done.\n", strings.Join(others, ", "))
+	}
+	return cfg, nil
+}
+
+// FinishKeyRotation replaces the old keys with the new keys in the config
+// and encrypts it with a new config key and the new password.
+func FinishKeyRotation(pwSrc, newPwSrc *PwSource, sm StorageMgr, repo string, cfg *Config) error {
+	old, ec, err := readEncConfig(sm, repo)
+	if err != nil {
+		return err
+	}
+	if _, _, _, err := decryptConfig(pwSrc, ec); err != nil {
+		return err
+	}
+	pw, kdf, err := rotatedPw(pwSrc, newPwSrc, ec)
+	if err != nil {
+		return err
+	}
+	newCfg := rotatedConfig(cfg)
+	configBytes, err := configToBytes(newCfg, true)
+	if err != nil {
+		return err
+	}
+	if ec.Version != VC_VERSION_SLOTS {
+		if err := wrapConfig(ec, pw, kdf, configBytes); err != nil {
+			return err
+		}
+		return replaceEncConfig(sm, repo, old, ec)
+	}
+	// The new private key, if any, goes into the only key slot.
+	var configKey EncKey
+	if _, err := io.ReadFull(rand.Reader, configKey[:]); err != nil {
+		return err
+	}
+	if err := wrapKeySlot(ec.Slots[0], pw, kdf, &configKey, newCfg.PrivateKey); err != nil {
+		return err
+	}
+	if ec.Config, err = encryptBytes(&configKey, configBytes, nil); err != nil {
+		return err
+	}
+	return replaceEncConfig(sm, repo, old, ec)
+}
+
+// keyRotationMap holds the old and new names of the chunks already rotated.
+type keyRotationMap struct {
+	sm      StorageMgr
+	dir     string
+	key     *EncKey
+	names   map[FP]FP
+	pending []FP // Pairs of old and new names not saved yet.
+	next    int
+	mu      sync.Mutex
+}
+
+func loadKeyRotationMap(sm StorageMgr, repo string, key *EncKey) (*keyRotationMap, error) {
+	m := &keyRotationMap{sm: sm, dir: sm.JoinPath(repo, ROTATE_DIR), key: key, names: make(map[FP]FP)}
+	files, err := sm.LsDir(m.dir)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	sort.Strings(files)
+	for _, f := range files {
+		n, err := strconv.Atoi(f)
+		if err != nil {
+			continue
+		}
+		if n >= m.next {
+			m.next = n + 1
+		}
+		b, err := sm.ReadFile(sm.JoinPath(m.dir, f), &bytes.Buffer{}, &bytes.Buffer{})
+		if err != nil {
+			return nil, fmt.Errorf("Cannot read rotate-key progress %s: %s", f, err)
+		}
+		if b, err = decryptBytes(key, b, nil); err != nil {
+			return nil, fmt.Errorf("Invalid rotate-key progress %s: %s", f, err)
+		}
+		mp := &KeyRotationMapProto{}
+		if len(b) < len(ROTATE_MAP_MAGIC) || string(b[:len(ROTATE_MAP_MAGIC)]) != ROTATE_MAP_MAGIC {
+			return nil, fmt.Errorf("Invalid rotate-key progress %s", f)
+		} else if err := proto.Unmarshal(b[len(ROTATE_MAP_MAGIC):], mp); err != nil {
+			return nil, fmt.Errorf("Invalid rotate-key progress %s: %s", f, err)
+		} else if mp.Version != ROTATE_MAP_VERSION || len(mp.OldFPs) != len(mp.NewFPs) {
+			return nil, fmt.Errorf("Invalid rotate-key progress %s", f)
+		}
+		for i := range mp.OldFPs {
+			var oldFp, newFp FP
+			if len(mp.OldFPs[i]) != len(oldFp) || len(mp.NewFPs[i]) != len(newFp) {
+				return nil, fmt.Errorf("Invalid rotate-key progress %s", f)
+			}
+			copy(oldFp[:], mp.OldFPs[i])
+			copy(newFp[:], mp.NewFPs[i])
+			m.names[oldFp] = newFp
+		}
+	}
+	return m, nil
+}
+
+func (m *keyRotationMap) get(fp FP) (FP, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	newFp, ok := m.names[fp]
+	return newFp, ok
+}
+
+// add records a rotated chunk. The chunk must already be in the repo with
+// its new name. Every ROTATE_MAP_BATCH chunks are saved in the repo.
+func (m *keyRotationMap) add(oldFp, newFp FP) error {
+	m.mu.Lock()
+	m.names[oldFp] = newFp
+	m.pending = append(m.pending, oldFp, newFp)
+	full := len(m.pending) >= 2*ROTATE_MAP_BATCH
+	m.mu.Unlock()
+	if full {
+		return m.flush()
+	}
+	return nil
+}
+
+func (m *keyRotationMap) flush() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if len(m.pending) == 0 {
+		return nil
+	}
+	mp := &KeyRotationMapProto{Version: ROTATE_MAP_VERSION}
+	for i := 0; i < len(m.pending); i += 2 {
+		mp.OldFPs = append(mp.OldFPs, append([]byte(nil), m.pending[i][:]...))
+		mp.NewFPs = append(mp.NewFPs, append([]byte(nil), m.pending[i+1][:]...))
+	}
+	pb, err := proto.Marshal(mp)
+	if err != nil {
+		return err
+	}
+	b, err := encryptBytes(m.key, append([]byte(ROTATE_MAP_MAGIC), pb...), nil)
+	if err != nil {
+		return err
+	}
+	if err := m.sm.MkdirAll(m.dir); err != nil {
+		return err
+	}
+	if err := m.sm.WriteFile(m.sm.JoinPath(m.dir, fmt.Sprintf("%08d", m.next)), b); err != nil {
+		return fmt.Errorf("Cannot save rotate-key progress: %s", err)
+	}
+	m.next++
+	m.pending = nil
+	return nil
+}
+
+func (m *keyRotationMap) remove() error {
+	files, err := m.sm.LsDir(m.dir)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	for _, f := range files {
+		if err := m.sm.DeleteFile(m.sm.JoinPath(m.dir, f)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// keyRotator moves the chunks and version files of a repo from the old
+// keys to the new keys.
+type keyRotator struct {
+	oldCM, newCM *CMgr
+	oldVM, newVM *VMgr
+	oldSecret    []byte
+	newSecret    []byte
+	m            *keyRotationMap
+	verbose      bool
+	maxDop       int
+	st           *RotateKeyStats
+	mu           sync.Mutex // protects st
+}
+
+func newKeyRotator(sm StorageMgr, repo string, cfg *Config, verbose bool, maxDop int, st *RotateKeyStats) (*keyRotator, error) {
+	newCfg := rotatedConfig(cfg)
+	r := &keyRotator{oldCM: MakeCMgr(sm, repo, cfg), newCM: MakeCMgr(sm, repo, newCfg), oldVM: MakeVMgr(sm, repo, cfg), newVM: MakeVMgr(sm, repo, newCfg), oldSecret: cfg.FPSecret, newSecret: newCfg.FPSecret, verbose: verbose, maxDop: maxDop, st: st}
+	r.oldCM.mixedKeys = true
+	r.newCM.mixedKeys = true
+	var err error
+	if r.m, err = loadKeyRotationMap(sm, repo, makeIndexKey(newCfg)); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// rotateChunk returns the new name and the stored data of a chunk with the
+// new keys. The chunk is not compressed again.
+func (r *keyRotator) rotateChunk(fp FP, stored []byte, rmem *readChunkMem) (FP, []byte, error) {
+	text, err := r.oldCM.key.decrypt(stored, rmem.encBuf)
+	if err != nil {
+		return FP{}, nil, err
+	}
+	rmem.encBuf = text
+	if len(text) == 0 {
+		return FP{}, nil, errors.New("Empty chunk")
+	}
+	plain, err := uncompressChunk(text, &rmem.compBuf)
+	if err != nil {
+		return FP{}, nil, err
+	}
+	origFp := sha512.Sum512_256(plain)
+	if makeChunkFP(r.oldSecret, origFp) != fp {
+		return FP{}, nil, errors.New("Chunk checksum mismatch")
+	}
+	out, err := r.newCM.key.encrypt(text, nil)
+	if err != nil {
+		return FP{}, nil, err
+	}
+	return makeChunkFP(r.newSecret, origFp), out, nil
+}
+
+func (r *keyRotator) chunkPath(fp FP) (string, string) {
+	name := FPtoName(fp)
+	dir := r.oldCM.sm.JoinPath(r.oldCM.dir, name[:DIR_PREFIX_SIZE])
+	return dir, r.oldCM.sm.JoinPath(dir, name)
+}
+
+func (r *keyRotator) rotateChunks() error {
+	chunks, err := r.oldCM.listChunks()
+	if err != nil {
+		return fmt.Errorf("Cannot list chunks: %s", err)
+	}
+	var wg sync.WaitGroup
+	ch := make(chan FP)
+	for i := 0; i < r.maxDop; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			rmem := &readChunkMem{}
+			for fp := range ch {
+				err := r.rotateStandaloneChunk(fp, rmem)
+				r.mu.Lock()
+				if err != nil {
+					stderr.Printf("Cannot rotate chunk %s: %s\n", fp, err)
+					r.st.Errors++
+				}
+				r.mu.Unlock()
+			}
+		}()
+	}
+	for fp := range chunks {
+		if _, ok := r.m.get(fp); !ok {
+			ch <- fp
+		}
+	}
+	close(ch)
+	wg.Wait()
+	return r.m.flush()
+}
+
+func (r *keyRotator) rotateStandaloneChunk(fp FP, rmem *readChunkMem) error {
+	sm := r.oldCM.sm
+	_, p := r.chunkPath(fp)
+	stored, err := sm.ReadFile(p, &rmem.readBuf, &rmem.errBuf)
+	if err != nil {
+		return err
+	}
+	newFp, out, err := r.rotateChunk(fp, stored, rmem)
+	if err != nil {
+		if _, err2 := r.newCM.key.decrypt(stored, rmem.encBuf); err2 == nil {
+			// Already rotated but not saved in the progress.
+			return nil
+		}
+		return err
+	}
+	dir, np := r.chunkPath(newFp)
+	if err := sm.MkdirAll(dir); err != nil {
+		return err
+	}
+	if err := sm.WriteFile(np, out); err != nil {
+		return err
+	}
+	if r.verbose {
+		stdout.Printf("Rotate %s -> %s\n", fp, newFp)
+	}
+	r.mu.Lock()
+	r.st.Chunks++
+	r.mu.Unlock()
+	return r.m.add(fp, newFp)
+}
+
+// rotatePacks writes the chunks of each old pack to new packs. Only packs
+// with chunks not rotated yet are read.
+func (r *keyRotator) rotatePacks() error {
+	cm := r.oldCM
+	if err := cm.loadIndex(); err != nil {
+		return err
+	}
+	cm.mu.Lock()
+	var names []string
+	for name := range cm.packs {
+		names = append(names, name)
+	}
+	cm.mu.Unlock()
+	sort.Strings(names)
+	rmem := &readChunkMem{}
+	for _, name := range names {
+		cm.mu.Lock()
+		var live []*PackEntryProto
+		for _, e := range cm.packs[name] {
+			var fp FP
+			copy(fp[:], e.FP)
+			if loc := cm.index[fp]; loc.pack == name && loc.offset == e.Offset {
+				if _, ok := r.m.get(fp); !ok {
+					live = append(live, e)
+				}
+			}
+		}
+		cm.mu.Unlock()
+		if len(live) == 0 {
+			continue
+		}
+		data, err := cm.sm.ReadFile(cm.packPath(name), &rmem.readBuf, &rmem.errBuf)
+		if err != nil {
+			return fmt.Errorf("Cannot read pack %s: %s", name, err)
+		}
+		var pairs []FP
+		for _, e := range live {
+			if e.Offset+int64(e.Length) > int64(len(data)) {
+				return fmt.Errorf("Pack %s is truncated", name)
+			}
+			var fp FP
+			copy(fp[:], e.FP)
+			newFp, out, err := r.rotateChunk(fp, data[e.Offset:e.Offset+int64(e.Length)], rmem)
+			if err != nil {
+				stderr.Printf("Cannot rotate chunk %s: %s\n", fp, err)
+				r.st.Errors++
+				continue
+			}
+			if err := r.newCM.addToPack(newFp, out); err != nil {
+				return err
+			}
+			pairs = append(pairs, fp, newFp)
+		}
+		if err := r.newCM.Flush(); err != nil {
+			return err
+		}
+		for i := 0; i < len(pairs); i += 2 {
+			if r.verbose {
+				stdout.Printf("Rotate %s -> %s\n", pairs[i], pairs[i+1])
+			}
+			r.st.Chunks++
+			if err := r.m.add(pairs[i], pairs[i+1]); err != nil {
+				return err
+			}
+		}
+		if err := r.m.flush(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// rotateVersions rewrites the version files not rotated yet.
+func (r *keyRotator) rotateVersions() error {
+	versions, err := r.oldVM.GetVersions()
+	if err != nil {
+		return fmt.Errorf("Cannot read version files: %s", err)
+	}
+	for _, v := range versions {
+		if _, err, _ := r.newVM.LoadFiles(v); err == nil {
+			continue
+		}
+		fds, err, errs := r.oldVM.LoadFiles(v)
+		if err != nil {
+			return fmt.Errorf("Cannot read version %s: %s", v, err)
+		}
+		if errs > 0 {
+			return fmt.Errorf("Error! Some file info were invalid in version %s", v)
+		}
+		for _, fd := range fds {
+			for i, fp := range fd.Chunks {
+				newFp, ok := r.m.get(fp)
+				if !ok {
+					return fmt.Errorf("Chunk %s of %s in version %s is missing", fp, fd.Name, v)
+				}
+				fd.Chunks[i] = newFp
+			}
+		}
+		if err := r.newVM.SaveFiles(v, fds); err != nil {
+			return fmt.Errorf("Cannot write version %s: %s", v, err)
+		}
+		if r.verbose {
+			stdout.Printf("Rotate version %s\n", v)
+		}
+		r.st.Versions++
+	}
+	return nil
+}
+
+// rotatePending rewrites the pending deletion list and the keep files with
+// the new names and the new index key. Files already rotated are skipped.
+func (r *keyRotator) rotatePending() error {
+	sm := r.oldCM.sm
+	files, err := sm.LsDir(sm.JoinPath(r.oldCM.repo, PENDING_DIR))
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	for _, f := range files {
+		if f != PENDING_DELETION && !strings.HasPrefix(f, PENDING_KEEP_PREFIX) {
+			continue
+		}
+		chunks, err := r.oldCM.readPendingFile(f)
+		if err != nil {
+			if _, err2 := r.newCM.readPendingFile(f); err2 == nil {
+				continue
+			}
+			return err
+		}
+		rotated := make(map[FP]int64)
+		for fp, t := range chunks {
+			if newFp, ok := r.m.get(fp); ok {
+				rotated[newFp] = t
+			}
+		}
+		if err := r.newCM.writePendingFile(f, rotated); err != nil {
+			return fmt.Errorf("Cannot rotate pending deletion file %s: %s", f, err)
+		}
+	}
+	return nil
+}
+
+// removeOld deletes the old chunks or packs and the rotate-key progress.
+func (r *keyRotator) removeOld() error {
+	cm := r.oldCM
+	if cm.packSize > 0 {
+		cm.mu.Lock()
+		var names []string
+		for name := range cm.packs {
+			names = append(names, name)
+		}
+		cm.mu.Unlock()
+		for _, name := range names {
+			if err := cm.deletePack(name); err != nil {
+				return fmt.Errorf("Cannot delete pack %s: %s", name, err)
+			}
+		}
+	} else {
+		for oldFp, newFp := range r.m.names {
+			if oldFp == newFp {
+				continue
+			}
+			_, p := r.chunkPath(oldFp)
+			if err := cm.sm.DeleteFile(p); err != nil && !os.IsNotExist(err) {
+				return fmt.Errorf("Cannot delete chunk %s: %s", oldFp, err)
+			}
+		}
+	}
+	return r.m.remove()
+}
+
+// RotateKeys moves all chunks and version files of the repo to the new
+// keys in the config. The repo must be locked.
+func RotateKeys(sm StorageMgr, repo string, cfg *Config, verbose bool, maxDop int, st *RotateKeyStats) error {
+	r, err := newKeyRotator(sm, repo, cfg, verbose, maxDop, st)
+	if err != nil {
+		return err
+	}
+	if r.oldCM.packSize > 0 {
+		err = r.rotatePacks()
+	} else {
+		err = r.rotateChunks()
+	}
+	if err != nil {
+		return err
+	}
+	if st.Errors > 0 {
+		return fmt.Errorf("Failed to rotate %d chunk(s).", st.Errors)
+	}
+	if err := r.rotateVersions(); err != nil {
+		return err
+	}
+	if err := r.rotatePending(); err != nil {
+		return err
+	}
+	return r.removeOld()
+}
@@ -0,0 +1,283 @@
+package vecbackup
+
+import (
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// A repo with key slots has its config encrypted with a random config key
+// instead of the master key. Each key slot holds a copy of the config key
+// encrypted with a master key derived from a password or key file with the
+// key derivation function and salt of the slot. Any of the slots can open
+// the repo. Repos are converted to key slots when the first key is added.
+// The original password becomes the slot DEFAULT_KEY_LABEL.
+//
+// In an ASYMMETRIC repo, a key slot also holds the private key encrypted
+// with the master key of the slot, except for write-only slots.
+
+const DEFAULT_KEY_LABEL = "default"
+
+type KeySlotInfo struct {
+	Label     string
+	Kdf       KdfParams
+	WriteOnly bool
+}
+
+func kdfFromKeySlot(s *KeySlotProto) (*KdfParams, error) {
+	return makeKdfParams(s.Kdf, s.Iterations, s.Argon2Memory, s.Argon2Time, s.Argon2Threads)
+}
+
+func setKeySlotKdf(s *KeySlotProto, kdf *KdfParams) {
+	s.Kdf = kdf.Type
+	s.Iterations = 0
+	s.Argon2Memory = 0
+	s.Argon2Time = 0
+	s.Argon2Threads = 0
+	if kdf.Type == KdfType_ARGON2ID {
+		s.Argon2Memory = int32(kdf.Memory)
+		s.Argon2Time = int32(kdf.Time)
+		s.Argon2Threads = int32(kdf.Threads)
+	} else if kdf.Type == KdfType_PBKDF2_SHA1 {
+		s.Iterations = int64(kdf.Iterations)
+	}
+}
+
+// wrapKeySlot encrypts the config key and the private key, if any, with
+// a master key derived from the password with a new salt.
+func wrapKeySlot(s *KeySlotProto, pw []byte, kdf *KdfParams, key, priv *EncKey) error {
+	salt := make([]byte, 32)
+	if _, err := io.ReadFull(rand.Reader, salt); err != nil {
+		return err
+	}
+	masterKey := getMasterKey(pw, salt, kdf)
+	enc, err := encryptBytes(masterKey, key[:], nil)
+	if err != nil {
+		return err
+	}
+	var encPriv []byte
+	if priv != nil {
+		if encPriv, err = encryptBytes(masterKey, priv[:], nil); err != nil {
+			return err
+		}
+	}
+	s.Salt = salt
+	s.Key = enc
+	s.PrivateKey = encPriv
+	setKeySlotKdf(s, kdf)
+	return nil
+}
+
+func openKey(masterKey *EncKey, b []byte) (*EncKey, bool) {
+	if len(b) < 24 {
+		return nil, false
+	}
+	d, err := decryptBytes(masterKey, b, nil)
+	if err != nil || len(d) != len(EncKey{}) {
+		return nil, false
+	}
+	var key EncKey
+	copy(key[:], d)
+	return &key, true
+}
+
+// openKeySlot returns the index of the first key slot that can be opened
+// with the password, the config key and the private key, which is nil
+// unless it is a key slot of an ASYMMETRIC repo that is not write-only.
+func openKeySlot(ec *EncConfigProto, pw []byte) (int, *EncKey, *EncKey, error) {
+	for i, s := range ec.Slots {
+		kdf, err := kdfFromKeySlot(s)
+		if err != nil {
+			debugP("Skipping key slot %s: %s\n", s.Label, err)
+			continue
+		}
+		masterKey := getMasterKey(pw, s.Salt, kdf)
+		if masterKey == nil {
+			continue
+		}
+		key, ok := openKey(masterKey, s.Key)
+		if !ok {
+			continue
+		}
+		var priv *EncKey
+		if len(s.PrivateKey) > 0 {
+			if priv, ok = openKey(masterKey, s.PrivateKey); !ok {
+				return -1, nil, nil, fmt.Errorf("Invalid private key in key slot %s", s.Label)
+			}
+		}
+		return i, key, priv, nil
+	}
+	return -1, nil, nil, errors.New("Wrong password")
+}
+
+// openKeySlots opens the config of an encrypted repo with the password and
+// returns the config key and the private key. Repos without key slots are
+// converted so that the password becomes the DEFAULT_KEY_LABEL slot.
+func openKeySlots(pwSrc *PwSource, ec *EncConfigProto) (*EncKey, *EncKey, error) {
+	if ec.Type == EncType_NO_ENCRYPTION {
+		return nil, nil, errors.New("Backup is not encrypted")
+	}
+	configBytes, masterKey, priv, err := decryptConfig(pwSrc, ec)
+	if err != nil || ec.Version == VC_VERSION_SLOTS {
+		return masterKey, priv, err
+	}
+	var key EncKey
+	if _, err := io.ReadFull(rand.Reader, key[:]); err != nil {
+		return nil, nil, err
+	}
+	enc, err := encryptBytes(masterKey, key[:], nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	s := &KeySlotProto{Label: DEFAULT_KEY_LABEL, Salt: ec.Salt, Key: enc}
+	kdf, err := kdfFromEncConfig(ec)
+	if err != nil {
+		return nil, nil, err
+	}
+	setKeySlotKdf(s, kdf)
+	if ec.Config, err = encryptBytes(&key, configBytes, nil); err != nil {
+		return nil, nil, err
+	}
+	ec.Version = VC_VERSION_SLOTS
+	ec.Salt = nil
+	ec.Kdf = KdfType_PBKDF2_SHA1
+	ec.Iterations = 0
+	ec.Argon2Memory = 0
+	ec.Argon2Time = 0
+	ec.Argon2Threads = 0
+	ec.Slots = []*KeySlotProto{s}
+	return &key, nil, nil
+}
+
+// AddKeySlot adds a key slot for the new password or key file to the repo.
+// The repo must be opened with an existing password. A write-only key slot
+// can only be added to an ASYMMETRIC repo.
+func AddKeySlot(pwSrc, newPwSrc *PwSource, sm StorageMgr, repo, label string, kdf *KdfParams, writeOnly bool) error {
+	if label == "" {
+		return errors.New("Key label must be specified.")
+	}
+	old, ec, err := readEncConfig(sm, repo)
+	if err != nil {
+		return err
+	}
+	for _, s := range ec.Slots {
+		if s.Label == label {
+			return fmt.Errorf("Key slot already exists: %s", label)
+		}
+	}
+	if ec.Version != VC_VERSION_SLOTS && label == DEFAULT_KEY_LABEL {
+		return fmt.Errorf("Key slot already exists: %s", label)
+	}
+	if writeOnly && ec.Type != EncType_ASYMMETRIC {
+		return errors.New("Write-only keys need a repository with asymmetric encryption.")
+	}
+	key, priv, err := openKeySlots(pwSrc, ec)
+	if err != nil {
+		return err
+	}
+	// The config holds the new private key during rotate-key.
+	if configBytes, err := decryptBytes(key, ec.Config, nil); err != nil {
+		return err
+	} else if cfg, err := configFromBytes(configBytes, true); err != nil {
+		return err
+	} else if cfg.Rotation != nil {
+		return errKeyRotation
+	}
+	if ec.Type == EncType_ASYMMETRIC && !writeOnly && priv == nil {
+		return errors.New("A write-only key can only add write-only keys.")
+	}
+	if writeOnly {
+		priv = nil
+	}
+	pw, kdf, err := readNewPw(newPwSrc, kdf)
+	if err != nil {
+		return err
+	}
+	s := &KeySlotProto{Label: label}
+	if err := wrapKeySlot(s, pw, kdf, key, priv); err != nil {
+		return err
+	}
+	ec.Slots = append(ec.Slots, s)
+	return replaceEncConfig(sm, repo, old, ec)
+}
+
+// ListKeySlots returns the key slots of the repo. A repo without key slots
+// has the single slot DEFAULT_KEY_LABEL. No password is needed.
+func ListKeySlots(sm StorageMgr, repo string) ([]KeySlotInfo, error) {
+	_, ec, err := readEncConfig(sm, repo)
+	if err != nil {
+		return nil, err
+	}
+	if ec.Type == EncType_NO_ENCRYPTION {
+		return nil, errors.New("Backup is not encrypted")
+	}
+	if ec.Version != VC_VERSION_SLOTS {
+		kdf, err := kdfFromEncConfig(ec)
+		if err != nil {
+			return nil, err
+		}
+		return []KeySlotInfo{{Label: DEFAULT_KEY_LABEL, Kdf: *kdf}}, nil
+	}
+	var r []KeySlotInfo
+	for _, s := range ec.Slots {
+		ks := KeySlotInfo{Label: s.Label, WriteOnly: ec.Type == EncType_ASYMMETRIC && len(s.PrivateKey) == 0}
+		if kdf, err := kdfFromKeySlot(s); err == nil {
+			ks.Kdf = *kdf
+		}
+		r = append(r, ks)
+	}
+	return r, nil
+}
+
+// RemoveKeySlot removes a key slot from the repo. The repo must be opened
+// with an existing password. The last key slot cannot be removed, nor the
+// last key slot with the private key of an ASYMMETRIC repo.
+func RemoveKeySlot(pwSrc *PwSource, sm StorageMgr, repo, label string) error {
+	old, ec, err := readEncConfig(sm, repo)
+	if err != nil {
+		return err
+	}
+	if ec.Type == EncType_NO_ENCRYPTION {
+		return errors.New("Backup is not encrypted")
+	}
+	idx := -1
+	for i, s := range ec.Slots {
+		if s.Label == label {
+			idx = i
+		}
+	}
+	if idx < 0 && !(ec.Version != VC_VERSION_SLOTS && label == DEFAULT_KEY_LABEL) {
+		return fmt.Errorf("Key slot not found: %s", label)
+	}
+	if len(ec.Slots) <= 1 {
+		return errors.New("Cannot remove the last key slot.")
+	}
+	if ec.Type == EncType_ASYMMETRIC && len(ec.Slots[idx].PrivateKey) > 0 {
+		n := 0
+		for _, s := range ec.Slots {
+			if len(s.PrivateKey) > 0 {
+				n++
+			}
+		}
+		if n <= 1 {
+			return errors.New("Cannot remove the last key slot that is not write-only.")
+		}
+	}
+	_, priv, err := openKeySlots(pwSrc, ec)
+	if err != nil {
+		return err
+	}
+	// A write-only key can only remove its own key slot.
+	if ec.Type == EncType_ASYMMETRIC && priv == nil {
+		pw, err := readPw(pwSrc)
+		if err != nil {
+			return err
+		}
+		if _, _, _, err := openKeySlot(&EncConfigProto{Slots: ec.Slots[idx : idx+1]}, pw); err != nil {
+			return errors.New("A write-only key can only remove its own key slot.")
+		}
+	}
+	ec.Slots = append(ec.Slots[:idx], ec.Slots[idx+1:]...)
+	return replaceEncConfig(sm, repo, old, ec)
+}
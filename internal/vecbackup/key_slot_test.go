@@ -0,0 +1,175 @@
+package vecbackup
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestKeySlots(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "key_slot_test-*")
+	if err != nil {
+		t.Fatal("Cannot get tempdir", err)
+	}
+	defer os.RemoveAll(tmpDir)
+	pwFile := filepath.Join(tmpDir, "pw")
+	recoveryFile := filepath.Join(tmpDir, "recovery")
+	badPwFile := filepath.Join(tmpDir, "badpw")
+	ioutil.WriteFile(pwFile, []byte("oicewoe90390j0w9jf0wejf0weh"), 0444)
+	ioutil.WriteFile(recoveryFile, []byte{0, 1, 2, 3, 4, 5, 6, 7, 8, 9}, 0444)
+	ioutil.WriteFile(badPwFile, []byte("f00fjsoidfjsodjhfosjd"), 0444)
+	sm, repo2 := GetStorageMgr(tmpDir)
+	cfg := &Config{ChunkSize: 1000, Compress: CompressionMode_NO, CompressionType: CompressionType_ZLIB}
+	if err := WriteNewConfig(PwFile(pwFile), sm, repo2, &KdfParams{Iterations: 100000}, cfg); err != nil {
+		t.Fatal("Cannot save config:", err)
+	}
+	slots, err := ListKeySlots(sm, repo2)
+	if err != nil || len(slots) != 1 || slots[0].Label != DEFAULT_KEY_LABEL || slots[0].Kdf.Iterations != 100000 {
+		t.Fatal("Unexpected key slots", slots, err)
+	}
+	if err := RemoveKeySlot(PwFile(pwFile), sm, repo2, DEFAULT_KEY_LABEL); err == nil {
+		t.Fatal("Should not be able to remove the last key slot")
+	}
+	argon2 := &KdfParams{Type: KdfType_ARGON2ID, Memory: 1024, Time: 1, Threads: 1}
+	if err := AddKeySlot(PwFile(badPwFile), PwFile(recoveryFile), sm, repo2, "recovery", argon2, false); err == nil {
+		t.Fatal("Should not be able to add key slot with bad pw file")
+	}
+	if err := AddKeySlot(PwFile(pwFile), PwFile(recoveryFile), sm, repo2, DEFAULT_KEY_LABEL, argon2, false); err == nil {
+		t.Fatal("Should not be able to add key slot with existing label")
+	}
+	if err := AddKeySlot(PwFile(pwFile), PwFile(recoveryFile), sm, repo2, "recovery", argon2, false); err != nil {
+		t.Fatal("Cannot add key slot:", err)
+	}
+	if err := AddKeySlot(PwFile(recoveryFile), PwFile(recoveryFile), sm, repo2, "recovery", argon2, false); err == nil {
+		t.Fatal("Should not be able to add key slot with existing label")
+	}
+	slots, err = ListKeySlots(sm, repo2)
+	if err != nil || len(slots) != 2 || slots[1].Label != "recovery" || slots[1].Kdf.Type != KdfType_ARGON2ID {
+		t.Fatal("Unexpected key slots", slots, err)
+	}
+	for _, pf := range []string{pwFile, recoveryFile} {
+		cfg2, err := GetConfig(PwFile(pf), sm, repo2)
+		if err != nil || !equalConfig(cfg, cfg2) {
+			t.Fatal("Cannot load config", pf, err)
+		}
+	}
+	if _, err = GetConfig(PwFile(badPwFile), sm, repo2); err == nil {
+		t.Fatal("Should not be able to load config with bad pw file")
+	}
+
+	// Changing the password only changes the slot that is opened.
+	if err := ChangeConfigPassword(PwFile(recoveryFile), PwFile(badPwFile), sm, repo2, nil); err != nil {
+		t.Fatal("Cannot change password:", err)
+	}
+	if _, err = GetConfig(PwFile(recoveryFile), sm, repo2); err == nil {
+		t.Fatal("Should not be able to load config with old pw file")
+	}
+	for _, pf := range []string{pwFile, badPwFile} {
+		if cfg2, err := GetConfig(PwFile(pf), sm, repo2); err != nil || !equalConfig(cfg, cfg2) {
+			t.Fatal("Cannot load config", pf, err)
+		}
+	}
+	cfg.Compress = CompressionMode_YES
+	if err := UpdateConfig(PwFile(pwFile), sm, repo2, cfg); err != nil {
+		t.Fatal("Cannot update config:", err)
+	}
+	if cfg2, err := GetConfig(PwFile(badPwFile), sm, repo2); err != nil || !equalConfig(cfg, cfg2) {
+		t.Fatal("Cannot load updated config", err)
+	}
+
+	if err := RemoveKeySlot(PwFile(pwFile), sm, repo2, "nosuchslot"); err == nil {
+		t.Fatal("Should not be able to remove missing key slot")
+	}
+	if err := RemoveKeySlot(PwFile(recoveryFile), sm, repo2, DEFAULT_KEY_LABEL); err == nil {
+		t.Fatal("Should not be able to remove key slot with bad pw file")
+	}
+	if err := RemoveKeySlot(PwFile(badPwFile), sm, repo2, DEFAULT_KEY_LABEL); err != nil {
+		t.Fatal("Cannot remove key slot:", err)
+	}
+	if _, err = GetConfig(PwFile(pwFile), sm, repo2); err == nil {
+		t.Fatal("Should not be able to load config with removed key slot")
+	}
+	if err := RemoveKeySlot(PwFile(badPwFile), sm, repo2, "recovery"); err == nil {
+		t.Fatal("Should not be able to remove the last key slot")
+	}
+	if slots, err = ListKeySlots(sm, repo2); err != nil || len(slots) != 1 || slots[0].Label != "recovery" {
+		t.Fatal("Unexpected key slots", slots, err)
+	}
+}
+
+func TestAsymmetricKeySlots(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "key_slot_test-*")
+	if err != nil {
+		t.Fatal("Cannot get tempdir", err)
+	}
+	defer os.RemoveAll(tmpDir)
+	pwFile := filepath.Join(tmpDir, "pw")
+	backupFile := filepath.Join(tmpDir, "backup")
+	ioutil.WriteFile(pwFile, []byte("oicewoe90390j0w9jf0wejf0weh"), 0444)
+	ioutil.WriteFile(backupFile, []byte("f00fjsoidfjsodjhfosjd"), 0444)
+	sm, repo2 := GetStorageMgr(tmpDir)
+	cfg := &Config{ChunkSize: 1000, Compress: CompressionMode_NO, CompressionType: CompressionType_ZLIB}
+	kdf := &KdfParams{Iterations: 100000}
+	if err := WriteNewAsymmetricConfig(PwFile(pwFile), sm, repo2, kdf, cfg); err != nil {
+		t.Fatal("Cannot save config:", err)
+	}
+	full, err := GetConfig(PwFile(pwFile), sm, repo2)
+	if err != nil || !equalConfig(cfg, full) || full.EncryptionKey != nil || full.PublicKey == nil || full.PrivateKey == nil {
+		t.Fatal("Cannot load config", full, err)
+	}
+	if err := AddKeySlot(PwFile(pwFile), PwFile(backupFile), sm, repo2, "backup", kdf, true); err != nil {
+		t.Fatal("Cannot add write-only key slot:", err)
+	}
+	wo, err := GetConfig(PwFile(backupFile), sm, repo2)
+	if err != nil || !equalConfig(cfg, wo) || *wo.PublicKey != *full.PublicKey || wo.PrivateKey != nil {
+		t.Fatal("Write-only config is wrong", wo, err)
+	}
+	if err := AddKeySlot(PwFile(backupFile), PwFile(backupFile), sm, repo2, "other", kdf, false); err == nil {
+		t.Fatal("Should not be able to add a full key slot with a write-only key")
+	}
+	if err := ChangeConfigPassword(PwFile(backupFile), PwFile(backupFile), sm, repo2, nil); err != nil {
+		t.Fatal("Cannot change password:", err)
+	}
+	slots, err := ListKeySlots(sm, repo2)
+	if err != nil || len(slots) != 2 || slots[0].WriteOnly || !slots[1].WriteOnly {
+		t.Fatal("Unexpected key slots", slots, err)
+	}
+	if err := RemoveKeySlot(PwFile(pwFile), sm, repo2, DEFAULT_KEY_LABEL); err == nil {
+		t.Fatal("Should not be able to remove the last key slot with the private key")
+	}
+	otherFile := filepath.Join(tmpDir, "other")
+	ioutil.WriteFile(otherFile, []byte("sdkfjsdlkfjwoeijfowiejfw"), 0444)
+	if err := AddKeySlot(PwFile(pwFile), PwFile(otherFile), sm, repo2, "other", kdf, false); err != nil {
+		t.Fatal("Cannot add key slot:", err)
+	}
+	backup2File := filepath.Join(tmpDir, "backup2")
+	ioutil.WriteFile(backup2File, []byte("oiwejfowiejfoiwjefoijwe"), 0444)
+	if err := AddKeySlot(PwFile(pwFile), PwFile(backup2File), sm, repo2, "backup2", kdf, true); err != nil {
+		t.Fatal("Cannot add write-only key slot:", err)
+	}
+	for _, label := range []string{"other", "backup2"} {
+		if err := RemoveKeySlot(PwFile(backupFile), sm, repo2, label); err == nil {
+			t.Fatalf("Write-only key should not be able to remove key slot %s", label)
+		}
+	}
+	if err := RemoveKeySlot(PwFile(backup2File), sm, repo2, "backup2"); err != nil {
+		t.Fatal("Write-only key should be able to remove its own key slot:", err)
+	}
+	if err := RemoveKeySlot(PwFile(otherFile), sm, repo2, "other"); err != nil {
+		t.Fatal("Cannot remove key slot:", err)
+	}
+	if err := RemoveKeySlot(PwFile(pwFile), sm, repo2, "backup"); err != nil {
+		t.Fatal("Cannot remove key slot:", err)
+	}
+
+	// Write-only key slots need asymmetric encryption.
+	sm2, repo3 := GetStorageMgr(filepath.Join(tmpDir, "sym"))
+	sm2.MkdirAll(repo3)
+	if err := WriteNewConfig(PwFile(pwFile), sm2, repo3, kdf, &Config{ChunkSize: 1000}); err != nil {
+		t.Fatal("Cannot save config:", err)
+	}
+	if err := AddKeySlot(PwFile(pwFile), PwFile(backupFile), sm2, repo3, "backup", kdf, true); err == nil {
+		t.Fatal("Should not be able to add a write-only key slot to a symmetric repo")
+	}
+}
@@ -0,0 +1,359 @@
+package vecbackup
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/user"
+	"runtime"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// The lock file keeps backup, copy and rotate-key from writing to a repo
+// at the same time. It records the host, PID, user and command line of
+// the process holding it as JSON. The holder refreshes the heartbeat in
+// it every lockHeartbeatInterval until it removes the lock.
+//
+// A lock is stale if its heartbeat is older than LOCK_STALE_TIMEOUT or if
+// it was taken on this host by a process that is no longer running. A
+// stale lock is only removed with SetBreakStaleLock. Lock files written by
+// older versions have no owner info and are never stale.
+//
+// Besides, every command that uses the chunks holds a lock of its own in
+// the locks dir of the repo, named shared-<id> or exclusive-<id>. Backup,
+// restore, verify and copy take shared locks. Commands that delete or
+// rewrite chunks or versions take exclusive locks, so that purge-unused
+// cannot delete a chunk that a running backup has found in the repo. A
+// command writes its lock and then lists the dir. A shared lock conflicts
+// with exclusive locks and an exclusive lock with all other locks. On a
+// conflict the command removes its lock and fails, so two commands that
+// start at the same time may both fail but never both run. Each lock has
+// its own file, so it needs no atomic create and works on all storages.
+
+const LOCK_STALE_TIMEOUT = 10 * time.Minute
+
+var lockHeartbeatInterval = time.Minute
+var breakStaleLock bool
+
+// The command line, before main removes the command from os.Args.
+var lockCommand = strings.Join(os.Args, " ")
+
+const (
+	sharedLockPrefix    = "shared-"
+	exclusiveLockPrefix = "exclusive-"
+)
+
+var errLockLost = errors.New("Lock file was removed or taken by another process.")
+
+// SetBreakStaleLock sets whether a stale lock is removed instead of
+// failing.
+func SetBreakStaleLock(b bool) {
+	breakStaleLock = b
+}
+
+type lockInfo struct {
+	Host      string    `json:"host"`
+	PID       int       `json:"pid"`
+	User      string    `json:"user"`
+	Command   string    `json:"command"`
+	Start     time.Time `json:"start"`
+	Heartbeat time.Time `json:"heartbeat"`
+	ID        string    `json:"id"` // Tells the locks of the same process apart.
+}
+
+func newLockInfo() *lockInfo {
+	li := &lockInfo{PID: os.Getpid(), Command: lockCommand, Start: time.Now().UTC()}
+	li.Heartbeat = li.Start
+	li.Host, _ = os.Hostname()
+	if u, err := user.Current(); err == nil {
+		li.User = u.Username
+	} else if li.User = os.Getenv("USER"); li.User == "" {
+		li.User = os.Getenv("USERNAME")
+	}
+	var b [8]byte
+	rand.Read(b[:])
+	li.ID = hex.EncodeToString(b[:])
+	return li
+}
+
+func (li *lockInfo) String() string {
+	return fmt.Sprintf("pid %d of %s on %s since %s, last heartbeat %s, command %q", li.PID, li.User, li.Host, li.Start.Format(time.RFC3339), li.Heartbeat.Format(time.RFC3339), li.Command)
+}
+
+// stale returns why the lock is stale or "" if it is not.
+func (li *lockInfo) stale(now time.Time) string {
+	if d := now.Sub(li.Heartbeat); d > LOCK_STALE_TIMEOUT {
+		return fmt.Sprintf("no heartbeat for %s", d.Round(time.Second))
+	}
+	if host, err := os.Hostname(); err == nil && host == li.Host && !processExists(li.PID) {
+		return fmt.Sprintf("process %d is not running", li.PID)
+	}
+	return ""
+}
+
+// processExists returns whether a process with the PID runs on this host.
+func processExists(pid int) bool {
+	p, err := os.FindProcess(pid)
+	if err != nil {
+		return false
+	}
+	if runtime.GOOS == "windows" {
+		// FindProcess fails on Windows if there is no such process.
+		p.Release()
+		return true
+	}
+	err = p.Signal(syscall.Signal(0))
+	return err == nil || err == syscall.EPERM
+}
+
+// readLockInfo reads the lock file. It returns nil if the lock file has
+// no owner info.
+func readLockInfo(sm StorageMgr, p string) (*lockInfo, error) {
+	b, err := sm.ReadFile(p, &bytes.Buffer{}, &bytes.Buffer{})
+	if err != nil {
+		return nil, err
+	}
+	var li lockInfo
+	if json.Unmarshal(b, &li) != nil || li.ID == "" {
+		return nil, nil
+	}
+	return &li, nil
+}
+
+type repoLock struct {
+	sm   StorageMgr
+	p    string
+	name string // The lock file as given by the user.
+	info *lockInfo
+	stop chan struct{}
+	done chan struct{}
+	err  error      // Set by the heartbeat if the lock is lost.
+	mu   sync.Mutex // protects err
+
+	// For the locks in the locks dir.
+	dir       string
+	dirName   string
+	file      string
+	exclusive bool
+}
+
+// acquireLock creates the lock file p, named name in errors, and starts
+// its heartbeat.
+func acquireLock(sm StorageMgr, p, name string) (*repoLock, error) {
+	l := &repoLock{sm: sm, p: p, name: name, info: newLockInfo(), stop: make(chan struct{}), done: make(chan struct{})}
+	b, err := json.Marshal(l.info)
+	if err != nil {
+		return nil, err
+	}
+	err = sm.WriteLockFile(p, b)
+	if os.IsExist(err) {
+		if err = removeStale(sm, p, name); err != nil {
+			return nil, err
+		}
+		err = sm.WriteLockFile(p, b)
+		if os.IsExist(err) {
+			return nil, fmt.Errorf("Repository is locked. Lock file %s exists.", name)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	go l.heartbeat()
+	return l, nil
+}
+
+// removeStale removes the existing lock file p, named name in errors, if
+// it is stale and SetBreakStaleLock is set. Otherwise it returns why the
+// repo is locked.
+func removeStale(sm StorageMgr, p, name string) error {
+	old, err := readLockInfo(sm, p)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil || old == nil {
+		return fmt.Errorf("Repository is locked. Lock file %s exists.", name)
+	}
+	reason := old.stale(time.Now())
+	if reason == "" {
+		return fmt.Errorf("Repository is locked by %s. Lock file %s exists.", old, name)
+	}
+	if !breakStaleLock {
+		return fmt.Errorf("Repository is locked by %s. The lock is stale, %s. Use -break-stale-lock to remove lock file %s.", old, reason, name)
+	}
+	// Do not remove a lock that another process has just taken.
+	if cur, err := readLockInfo(sm, p); err != nil || cur == nil || cur.ID != old.ID {
+		return fmt.Errorf("Repository is locked. Lock file %s exists.", name)
+	}
+	stderr.Printf("Removing stale lock of %s: %s\n", old, reason)
+	if err := sm.RemoveLockFile(p); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// lockRepo takes a shared or exclusive lock in the locks dir of the repo
+// and starts its heartbeat. repo is the repo as given by the user and
+// repo2 its path in sm.
+func lockRepo(sm StorageMgr, repo, repo2 string, exclusive bool) (*repoLock, error) {
+	l, err := writeRepoLock(sm, repo, repo2, exclusive)
+	if err != nil {
+		return nil, fmt.Errorf("Cannot lock repository: %s", err)
+	}
+	if err := l.start(); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+// lockRepoForRead takes a shared lock for a command that only reads the
+// repo. If the lock cannot be written, for example because the repo is on
+// read-only media, the command runs without it and the lock is nil.
+func lockRepoForRead(sm StorageMgr, repo, repo2 string) (*repoLock, error) {
+	l, err := writeRepoLock(sm, repo, repo2, false)
+	if err != nil {
+		stderr.Printf("Cannot lock repository, continuing without lock: %s\n", err)
+		return nil, nil
+	}
+	if err := l.start(); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+func writeRepoLock(sm StorageMgr, repo, repo2 string, exclusive bool) (*repoLock, error) {
+	prefix := sharedLockPrefix
+	if exclusive {
+		prefix = exclusiveLockPrefix
+	}
+	dir := sm.JoinPath(repo2, LOCKS_DIR)
+	l := &repoLock{sm: sm, dir: dir, dirName: sm.JoinPath(repo, LOCKS_DIR), exclusive: exclusive, info: newLockInfo(), stop: make(chan struct{}), done: make(chan struct{})}
+	l.file = prefix + l.info.ID
+	l.p = sm.JoinPath(dir, l.file)
+	l.name = sm.JoinPath(l.dirName, l.file)
+	b, err := json.Marshal(l.info)
+	if err != nil {
+		return nil, err
+	}
+	// The guard allows the locks dir like the lock files.
+	if err := unguarded(sm).MkdirAll(dir); err != nil {
+		return nil, err
+	}
+	if err := sm.WriteLockFile(l.p, b); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+// start checks the other locks in the locks dir and starts the heartbeat.
+// It removes the lock if it conflicts with another lock.
+func (l *repoLock) start() error {
+	if err := l.checkConflicts(); err != nil {
+		l.sm.RemoveLockFile(l.p)
+		return err
+	}
+	go l.heartbeat()
+	return nil
+}
+
+func (l *repoLock) checkConflicts() error {
+	files, err := l.sm.LsDir(l.dir)
+	if err != nil {
+		return fmt.Errorf("Cannot list locks: %s", err)
+	}
+	for _, f := range files {
+		excl := strings.HasPrefix(f, exclusiveLockPrefix)
+		if f == l.file || !excl && !strings.HasPrefix(f, sharedLockPrefix) {
+			continue
+		}
+		if excl || l.exclusive {
+			if err := removeStale(l.sm, l.sm.JoinPath(l.dir, f), l.sm.JoinPath(l.dirName, f)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (l *repoLock) heartbeat() {
+	defer close(l.done)
+	t := time.NewTicker(lockHeartbeatInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-l.stop:
+			return
+		case <-t.C:
+		}
+		if err := l.refresh(); err != nil {
+			stderr.Printf("Cannot refresh lock file %s: %s\n", l.name, err)
+			if err == errLockLost {
+				l.mu.Lock()
+				l.err = fmt.Errorf("Lost lock %s: %s", l.name, err)
+				l.mu.Unlock()
+				return
+			}
+		}
+	}
+}
+
+// refresh writes the lock file with a new heartbeat if it still has the
+// lock of this process. The guard allows it like other lock operations.
+func (l *repoLock) refresh() error {
+	cur, err := readLockInfo(l.sm, l.p)
+	if os.IsNotExist(err) || err == nil && (cur == nil || cur.ID != l.info.ID) {
+		return errLockLost
+	} else if err != nil {
+		return err
+	}
+	l.info.Heartbeat = time.Now().UTC()
+	b, err := json.Marshal(l.info)
+	if err != nil {
+		return err
+	}
+	return unguarded(l.sm).WriteFile(l.p, b)
+}
+
+// lost returns an error if the heartbeat found that the lock was removed
+// or taken by another process. A nil lock is never lost.
+func (l *repoLock) lost() error {
+	if l == nil {
+		return nil
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.err
+}
+
+// checkLocks returns an error if one of the locks is lost. Commands check
+// it before they write a version or a config that depends on the locks.
+func checkLocks(locks ...*repoLock) error {
+	for _, l := range locks {
+		if err := l.lost(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// release stops the heartbeat and removes the lock file if it still has
+// the lock of this process. A nil lock does nothing.
+func (l *repoLock) release() error {
+	if l == nil {
+		return nil
+	}
+	close(l.stop)
+	<-l.done
+	cur, err := readLockInfo(l.sm, l.p)
+	if os.IsNotExist(err) || err == nil && (cur == nil || cur.ID != l.info.ID) {
+		return errLockLost
+	} else if err != nil {
+		return err
+	}
+	return l.sm.RemoveLockFile(l.p)
+}
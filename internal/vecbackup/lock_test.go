@@ -0,0 +1,299 @@
+package vecbackup
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func writeTestLock(t *testing.T, p string, li *lockInfo) {
+	b, err := json.Marshal(li)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(p, b, 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLockStale(t *testing.T) {
+	now := time.Now()
+	li := newLockInfo()
+	if r := li.stale(now); r != "" {
+		t.Errorf("Lock of this process should not be stale: %s", r)
+	}
+	li.Heartbeat = now.Add(-LOCK_STALE_TIMEOUT - time.Minute)
+	if r := li.stale(now); !strings.Contains(r, "no heartbeat") {
+		t.Errorf("Lock without heartbeat should be stale: %s", r)
+	}
+	cmd := exec.Command(os.Args[0], "-test.run=^$")
+	if err := cmd.Run(); err != nil {
+		t.Fatal(err)
+	}
+	li = newLockInfo()
+	li.PID = cmd.Process.Pid
+	if r := li.stale(now); !strings.Contains(r, "not running") {
+		t.Errorf("Lock of a process that exited should be stale: %s", r)
+	}
+	li.Host = "some-other-host"
+	if r := li.stale(now); r != "" {
+		t.Errorf("Lock of another host with a heartbeat should not be stale: %s", r)
+	}
+}
+
+func TestAcquireLock(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lock_test-*")
+	if err != nil {
+		t.Fatal("Cannot get tempdir", err)
+	}
+	defer removeAll(t, dir)
+	p := filepath.Join(dir, LOCK_FILENAME)
+	l, err := acquireLock(TheLocalSMgr, p, p)
+	if err != nil {
+		t.Fatal("acquireLock failed:", err)
+	}
+	li, err := readLockInfo(TheLocalSMgr, p)
+	if err != nil || li == nil || li.PID != os.Getpid() || li.ID != l.info.ID {
+		t.Fatalf("Lock file should have the owner info: %v %v", li, err)
+	}
+	if _, err := acquireLock(TheLocalSMgr, p, p); err == nil || !strings.Contains(err.Error(), "locked by pid") {
+		t.Errorf("Second lock should fail with the owner: %v", err)
+	}
+	if err := l.release(); err != nil {
+		t.Fatal("release failed:", err)
+	}
+
+	// Stale lock.
+	li.Heartbeat = time.Now().Add(-time.Hour)
+	writeTestLock(t, p, li)
+	if _, err := acquireLock(TheLocalSMgr, p, p); err == nil || !strings.Contains(err.Error(), "-break-stale-lock") {
+		t.Errorf("Stale lock should not be broken without -break-stale-lock: %v", err)
+	}
+	SetBreakStaleLock(true)
+	defer SetBreakStaleLock(false)
+	if l, err = acquireLock(TheLocalSMgr, p, p); err != nil {
+		t.Fatal("Stale lock should be broken:", err)
+	}
+	l.release()
+
+	// Lock without owner info is never stale.
+	if err := ioutil.WriteFile(p, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := acquireLock(TheLocalSMgr, p, p); err == nil || !strings.Contains(err.Error(), "Lock file") {
+		t.Errorf("Lock without owner info should not be broken: %v", err)
+	}
+	os.Remove(p)
+}
+
+func TestLockHeartbeat(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lock_test-*")
+	if err != nil {
+		t.Fatal("Cannot get tempdir", err)
+	}
+	defer removeAll(t, dir)
+	save := lockHeartbeatInterval
+	lockHeartbeatInterval = 10 * time.Millisecond
+	defer func() { lockHeartbeatInterval = save }()
+	p := filepath.Join(dir, LOCK_FILENAME)
+	l, err := acquireLock(withGuard(TheLocalSMgr), p, p)
+	if err != nil {
+		t.Fatal("acquireLock failed:", err)
+	}
+	setGuardMode(l.sm, RepoMode_APPEND_ONLY)
+	start := l.info.Start
+	var li *lockInfo
+	for i := 0; i < 100; i++ {
+		time.Sleep(10 * time.Millisecond)
+		if li, err = readLockInfo(TheLocalSMgr, p); err == nil && li != nil && li.Heartbeat.After(start) {
+			break
+		}
+	}
+	if li == nil || !li.Heartbeat.After(start) || !li.Start.Equal(start) {
+		t.Fatalf("Heartbeat should be refreshed: %v %v", li, err)
+	}
+	if err := l.lost(); err != nil {
+		t.Errorf("Lock should not be lost: %v", err)
+	}
+	// Another process took the lock.
+	li.ID = "other"
+	writeTestLock(t, p, li)
+	select {
+	case <-l.done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Heartbeat should stop when the lock is lost")
+	}
+	if err := checkLocks(nil, l); err == nil || !strings.Contains(err.Error(), "Lost lock") {
+		t.Errorf("Lost lock should be reported: %v", err)
+	}
+	if li, _ := readLockInfo(TheLocalSMgr, p); li == nil || li.ID != "other" {
+		t.Errorf("Lock of the other process should not be overwritten: %v", li)
+	}
+	if err := l.release(); err != errLockLost {
+		t.Errorf("Release of a lost lock should fail: %v", err)
+	}
+	if li, _ := readLockInfo(TheLocalSMgr, p); li == nil || li.ID != "other" {
+		t.Errorf("Lock of the other process should not be removed: %v", li)
+	}
+}
+
+func lsLocks(t testing.TB, dir string) []string {
+	files, err := TheLocalSMgr.LsDir(filepath.Join(dir, LOCKS_DIR))
+	if err != nil && !os.IsNotExist(err) {
+		t.Fatal(err)
+	}
+	return files
+}
+
+func TestRepoLocks(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lock_test-*")
+	if err != nil {
+		t.Fatal("Cannot get tempdir", err)
+	}
+	defer removeAll(t, dir)
+	s1, err := lockRepo(TheLocalSMgr, dir, dir, false)
+	if err != nil {
+		t.Fatal("Shared lock failed:", err)
+	}
+	s2, err := lockRepo(TheLocalSMgr, dir, dir, false)
+	if err != nil {
+		t.Fatal("Second shared lock failed:", err)
+	}
+	if _, err := lockRepo(TheLocalSMgr, dir, dir, true); err == nil || !strings.Contains(err.Error(), "locked by pid") {
+		t.Errorf("Exclusive lock should fail with shared locks: %v", err)
+	}
+	if files := lsLocks(t, dir); len(files) != 2 {
+		t.Errorf("Failed lock should be removed: %v", files)
+	}
+	s1.release()
+	s2.release()
+	x, err := lockRepo(TheLocalSMgr, dir, dir, true)
+	if err != nil {
+		t.Fatal("Exclusive lock failed:", err)
+	}
+	if _, err := lockRepo(TheLocalSMgr, dir, dir, false); err == nil || !strings.Contains(err.Error(), exclusiveLockPrefix) {
+		t.Errorf("Shared lock should fail with an exclusive lock: %v", err)
+	}
+	if _, err := lockRepo(TheLocalSMgr, dir, dir, true); err == nil {
+		t.Error("Second exclusive lock should fail")
+	}
+	x.release()
+	if files := lsLocks(t, dir); len(files) != 0 {
+		t.Errorf("Locks should be removed: %v", files)
+	}
+
+	// Stale exclusive lock.
+	li := newLockInfo()
+	li.Heartbeat = time.Now().Add(-time.Hour)
+	writeTestLock(t, filepath.Join(dir, LOCKS_DIR, exclusiveLockPrefix+li.ID), li)
+	if _, err := lockRepo(TheLocalSMgr, dir, dir, false); err == nil || !strings.Contains(err.Error(), "-break-stale-lock") {
+		t.Errorf("Stale lock should not be broken without -break-stale-lock: %v", err)
+	}
+	SetBreakStaleLock(true)
+	defer SetBreakStaleLock(false)
+	s1, err = lockRepo(TheLocalSMgr, dir, dir, false)
+	if err != nil {
+		t.Fatal("Stale lock should be broken:", err)
+	}
+	if files := lsLocks(t, dir); len(files) != 1 || !strings.HasPrefix(files[0], sharedLockPrefix) {
+		t.Errorf("Only the shared lock should be left: %v", files)
+	}
+	s1.release()
+}
+
+func TestPurgeLocked(t *testing.T) {
+	doTestSeq(t, "purge locked", func(e *TestEnv) {
+		e.setPW([]byte("sdfsdfwerfdsfsdfsd"))
+		e.init()
+		e.addFile("a", 23456, 1)
+		e.backup()
+		l, err := lockRepo(TheLocalSMgr, REPO, REPO, false)
+		if err != nil {
+			e.t.Fatal("Shared lock failed:", err)
+		}
+		if err := PurgeUnused(PwFile(opt.PwFile), REPO, false, false, 0); err == nil || !strings.Contains(err.Error(), "locked") {
+			e.t.Errorf("Purge should fail while a backup holds a shared lock: %v", err)
+		}
+		if err := DeleteVersion(PwFile(opt.PwFile), REPO, e.versions()[0]); err == nil {
+			e.t.Error("Delete version should fail while a backup holds a shared lock")
+		}
+		e.restore()
+		e.checkSame()
+		l.release()
+		e.purgeUnused()
+		if files := lsLocks(e.t, REPO); len(files) != 0 {
+			e.t.Errorf("Locks should be removed: %v", files)
+		}
+	})
+}
+
+func TestRemoveLock(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lock_test-*")
+	if err != nil {
+		t.Fatal("Cannot get tempdir", err)
+	}
+	defer removeAll(t, dir)
+	li := newLockInfo()
+	li.Host, li.PID, li.User = "backup-host", 1234, "alice"
+	writeTestLock(t, filepath.Join(dir, LOCK_FILENAME), li)
+	var b bytes.Buffer
+	save := stdout
+	stdout = log.New(&b, "", 0)
+	defer func() { stdout = save }()
+	if err := RemoveLock(dir, "", false); err == nil || !strings.Contains(err.Error(), "-f") {
+		t.Errorf("RemoveLock should not remove a live lock without -f: %v", err)
+	}
+	if s := b.String(); !strings.Contains(s, "Not removing lock of pid 1234 of alice on backup-host") {
+		t.Errorf("RemoveLock should print the owner of the live lock: %s", s)
+	}
+	b.Reset()
+	if err := RemoveLock(dir, "", true); err != nil {
+		t.Fatal("RemoveLock failed:", err)
+	}
+	if s := b.String(); !strings.Contains(s, "Removed lock of pid 1234 of alice on backup-host") {
+		t.Errorf("RemoveLock should print the owner: %s", s)
+	}
+	if err := RemoveLock(dir, "", false); err == nil {
+		t.Error("RemoveLock without lock should fail")
+	}
+	li.Heartbeat = time.Now().Add(-time.Hour)
+	writeTestLock(t, filepath.Join(dir, LOCK_FILENAME), li)
+	if err := RemoveLock(dir, "", false); err != nil {
+		t.Fatal("RemoveLock should remove a stale lock:", err)
+	}
+	l, err := lockRepo(TheLocalSMgr, dir, dir, true)
+	if err != nil {
+		t.Fatal("Exclusive lock failed:", err)
+	}
+	stale := newLockInfo()
+	stale.Heartbeat = time.Now().Add(-time.Hour)
+	writeTestLock(t, filepath.Join(dir, LOCKS_DIR, sharedLockPrefix+stale.ID), stale)
+	b.Reset()
+	if err := RemoveLock(dir, "", false); err == nil || !strings.Contains(err.Error(), "-f") {
+		t.Errorf("RemoveLock should not remove live locks without -f: %v", err)
+	}
+	if s := b.String(); !strings.Contains(s, "Removed "+sharedLockPrefix) || !strings.Contains(s, "Not removing "+exclusiveLockPrefix) {
+		t.Errorf("RemoveLock should remove only the stale lock: %s", s)
+	}
+	if files := lsLocks(t, dir); len(files) != 1 || files[0] != l.file {
+		t.Errorf("Live lock should be left: %v", files)
+	}
+	b.Reset()
+	if err := RemoveLock(dir, "", true); err != nil {
+		t.Fatal("RemoveLock failed:", err)
+	}
+	if s := b.String(); !strings.Contains(s, "Removed "+exclusiveLockPrefix) {
+		t.Errorf("RemoveLock with -f should remove the live locks: %s", s)
+	}
+	if files := lsLocks(t, dir); len(files) != 0 {
+		t.Errorf("Locks should be removed: %v", files)
+	}
+	l.release()
+}
@@ -0,0 +1,79 @@
+package vecbackup
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// A write-only client of an ASYMMETRIC repo cannot decrypt the version
+// files in the repo. To avoid reading all files again in every backup,
+// it keeps a local copy of the last version it backed up in
+// <cache dir>/<repo id>/manifest. The copy is only used if it is still
+// the latest version in the repo. It contains the version name followed
+// by the unencrypted version file.
+
+const (
+	MANIFEST_MAGIC   = "VBCM"
+	MANIFEST_VERSION = 1
+	MANIFEST_FILE    = "manifest"
+)
+
+var errNoManifest = errors.New("No local copy of the previous version")
+
+func manifestCachePath(repo string, secret []byte) string {
+	d := repoCacheDir(repo, secret)
+	if d == "" {
+		return ""
+	}
+	return filepath.Join(d, MANIFEST_FILE)
+}
+
+// readManifestCache returns the version file in the local copy if it is
+// the given version.
+func readManifestCache(p, version string) ([]byte, error) {
+	if p == "" {
+		return nil, errNoManifest
+	}
+	b, err := ioutil.ReadFile(p)
+	if os.IsNotExist(err) {
+		return nil, errNoManifest
+	} else if err != nil {
+		return nil, err
+	}
+	hl := len(MANIFEST_MAGIC) + 3
+	if len(b) < hl || string(b[:len(MANIFEST_MAGIC)]) != MANIFEST_MAGIC || b[len(MANIFEST_MAGIC)] != MANIFEST_VERSION {
+		return nil, errors.New("Invalid local copy of the previous version")
+	}
+	vl := int(binary.BigEndian.Uint16(b[hl-2:]))
+	if len(b) < hl+vl || string(b[hl:hl+vl]) != version {
+		return nil, errNoManifest
+	}
+	return b[hl+vl:], nil
+}
+
+func writeManifestCache(p, version string, text []byte) error {
+	if p == "" {
+		return nil
+	}
+	if err := os.MkdirAll(filepath.Dir(p), 0700); err != nil {
+		return err
+	}
+	var buf bytes.Buffer
+	buf.WriteString(MANIFEST_MAGIC)
+	buf.WriteByte(MANIFEST_VERSION)
+	var x [2]byte
+	binary.BigEndian.PutUint16(x[:], uint16(len(version)))
+	buf.Write(x[:])
+	buf.WriteString(version)
+	buf.Write(text)
+	tp := p + ".tmp"
+	if err := ioutil.WriteFile(tp, buf.Bytes(), 0600); err != nil {
+		os.Remove(tp)
+		return err
+	}
+	return os.Rename(tp, p)
+}
@@ -0,0 +1,301 @@
+package vecbackup
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+)
+
+// mirror is another repo that backup writes to together with the repo.
+// The sources are read and hashed once and each new chunk is written to
+// the repo and to every mirror that does not have it. A mirror must have
+// the same keys and FP secret as the repo, so the chunks and the version
+// files are the same. A mirror that does not exist is created with a copy
+// of the config file of the repo.
+//
+// A mirror that fails is not written to for the rest of the backup and
+// the version is not saved in it. The version is recorded in the mirrors
+// dir of the repo and copied to the mirror at the start of the next backup
+// that can write to it. Versions missing in a mirror for other reasons,
+// such as being deleted from it, are not copied again. If the mirror does
+// not have the last version of the repo, only its chunks are copied, so
+// that the mirror has the chunks of the files not changed since then.
+
+type mirror struct {
+	repo  string
+	id    string
+	vm    *VMgr
+	cm    *CMgr
+	lock  *repoLock
+	rlock *repoLock
+	added int64
+	err   error
+	mu    sync.Mutex // protects added and err
+}
+
+type MirrorStats struct {
+	Repo      string
+	RepoAdded int64
+	Err       error
+}
+
+// createMirror writes a copy of the config file of the repo to a new
+// mirror. It does nothing if the mirror has a config file.
+func createMirror(cm *CMgr, sm StorageMgr, repo string) (bool, error) {
+	if exists, err := sm.FileExists(sm.JoinPath(repo, CONFIG_FILE)); err != nil {
+		return false, err
+	} else if exists {
+		return false, nil
+	}
+	files, err := sm.LsDir(repo)
+	if !os.IsNotExist(err) && len(files) != 0 {
+		return false, fmt.Errorf("Repo config is not found in %s. Is this a repo?", repo)
+	}
+	b, _, err := readEncConfig(cm.sm, cm.repo)
+	if err != nil {
+		return false, err
+	}
+	if err := sm.MkdirAll(repo); err != nil {
+		return false, fmt.Errorf("Cannot create repo dir: %s", err)
+	}
+	if err := sm.WriteFile(sm.JoinPath(repo, CONFIG_FILE), b); err != nil {
+		return false, err
+	}
+	return true, writeChunksStamp(sm, repo)
+}
+
+// openMirror opens and locks a mirror of the repo. A mirror that cannot
+// be opened is returned as failed.
+func openMirror(pwSrc *PwSource, cm *CMgr, cfg *Config, repo string) *mirror {
+	m := &mirror{repo: repo, id: repoID(repo, cfg.FPSecret)}
+	sm, repo2 := GetStorageMgr(repo)
+	created, err := createMirror(cm, sm, repo2)
+	if err != nil {
+		m.fail(err)
+		return m
+	} else if created {
+		stdout.Printf("Created mirror %s\n", repo)
+	}
+	mcfg, err := GetConfig(pwSrc, sm, repo2)
+	if err != nil {
+		m.fail(err)
+		return m
+	}
+	if !bytes.Equal(mcfg.FPSecret, cfg.FPSecret) || !sameStorageKey(makeStorageKey(mcfg), cm.key) {
+		m.fail(fmt.Errorf("Mirror %s does not have the same keys as the repository. Move it away so that the next backup creates it again, and copy the older versions to it with copy.", repo))
+		return m
+	}
+	if mcfg.Rotation != nil {
+		m.fail(errKeyRotation)
+		return m
+	}
+	if guardMode(sm) == RepoMode_READ_ONLY {
+		m.fail(errReadOnly)
+		return m
+	}
+	if m.lock, err = acquireLock(sm, sm.JoinPath(repo2, LOCK_FILENAME), sm.JoinPath(repo, LOCK_FILENAME)); err != nil {
+		m.fail(err)
+		return m
+	}
+	if m.rlock, err = lockRepo(sm, repo, repo2, false); err != nil {
+		m.fail(err)
+		return m
+	}
+	m.vm = MakeVMgr(sm, repo2, mcfg)
+	m.cm = MakeCMgr(sm, repo2, mcfg)
+	m.cm.cachePath = chunkCachePath(repo, mcfg.FPSecret)
+	if err := m.cm.LoadPendingDeletion(); err != nil {
+		m.fail(err)
+	}
+	return m
+}
+
+// close unlocks the mirror.
+func (m *mirror) close() {
+	if m.cm != nil {
+		m.cm.CloseCache()
+	}
+	m.rlock.release()
+	m.rlock = nil
+	m.lock.release()
+	m.lock = nil
+}
+
+func (m *mirror) fail(err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.err == nil {
+		m.err = err
+		stderr.Printf("Mirror %s failed: %s\n", m.repo, err)
+	}
+}
+
+func (m *mirror) failed() bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.err != nil
+}
+
+func (m *mirror) stats() MirrorStats {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return MirrorStats{Repo: m.repo, RepoAdded: m.added, Err: m.err}
+}
+
+// addChunk stores the chunk in the mirror if it does not have it, see
+// CMgr.addChunk. It returns the encoded chunk for the next mirror.
+func (m *mirror) addChunk(fp FP, mem *addChunkMem, ciphertext []byte) []byte {
+	if m.failed() {
+		return ciphertext
+	}
+	exist, out, err := m.cm.addChunk(fp, mem, ciphertext)
+	if err != nil {
+		m.fail(err)
+		return ciphertext
+	}
+	if exist {
+		if err := m.cm.keepChunk(fp); err != nil {
+			m.fail(err)
+		}
+	} else {
+		m.mu.Lock()
+		m.added += int64(len(out))
+		m.mu.Unlock()
+	}
+	return out
+}
+
+// recordPath returns the path of the file in the repo that records that
+// the version is missing in the mirror.
+func (m *mirror) recordPath(cm *CMgr, version string) string {
+	return cm.sm.JoinPath(cm.sm.JoinPath(cm.repo, MIRRORS_DIR), m.id+"-"+version)
+}
+
+// record records in the repo that the version is missing in the mirror.
+func (m *mirror) record(cm *CMgr, version string) {
+	err := cm.sm.MkdirAll(cm.sm.JoinPath(cm.repo, MIRRORS_DIR))
+	if err == nil {
+		err = cm.sm.WriteFile(m.recordPath(cm, version), []byte(version))
+	}
+	if err != nil {
+		stderr.Printf("Cannot record that version %s is missing in mirror %s: %s\n", version, m.repo, err)
+	}
+}
+
+// unrecord deletes the record that the version is missing in the mirror.
+func (m *mirror) unrecord(cm *CMgr, version string) {
+	if err := cm.sm.DeleteFile(m.recordPath(cm, version)); err != nil && !os.IsNotExist(err) {
+		stderr.Printf("Cannot delete the record that version %s is missing in mirror %s: %s\n", version, m.repo, err)
+	}
+}
+
+// recorded returns the versions recorded as missing in the mirror.
+func (m *mirror) recorded(cm *CMgr) ([]string, error) {
+	files, err := cm.sm.LsDir(cm.sm.JoinPath(cm.repo, MIRRORS_DIR))
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	prefix := m.id + "-"
+	var versions []string
+	for _, f := range files {
+		if strings.HasPrefix(f, prefix) {
+			versions = append(versions, f[len(prefix):])
+		}
+	}
+	return versions, nil
+}
+
+// catchUp copies the versions recorded as missing in the mirror, and the
+// chunks of the last version of the repo if the mirror does not have it.
+func (m *mirror) catchUp(vm *VMgr, cm *CMgr, secret []byte, versions []string, verbose bool, maxDop int) {
+	if m.failed() {
+		return
+	}
+	recorded, err := m.recorded(cm)
+	if err != nil {
+		m.fail(fmt.Errorf("Cannot read the versions missing in the mirror: %s", err))
+		return
+	}
+	have, err := m.vm.GetVersions()
+	if err != nil {
+		m.fail(fmt.Errorf("Cannot read version files: %s", err))
+		return
+	}
+	haveMap := make(map[string]bool)
+	for _, v := range have {
+		haveMap[v] = true
+	}
+	inRepo := make(map[string]bool)
+	for _, v := range versions {
+		inRepo[v] = true
+	}
+	recordedMap := make(map[string]bool)
+	for _, v := range recorded {
+		if haveMap[v] || !inRepo[v] {
+			m.unrecord(cm, v)
+		} else {
+			recordedMap[v] = true
+		}
+	}
+	var missing []string
+	for _, v := range versions {
+		if recordedMap[v] {
+			missing = append(missing, v)
+		}
+	}
+	var last string
+	if len(versions) > 0 && !haveMap[versions[len(versions)-1]] && !recordedMap[versions[len(versions)-1]] {
+		last = versions[len(versions)-1]
+	}
+	if len(missing) == 0 && last == "" {
+		return
+	}
+	if verbose {
+		stdout.Printf("Copying %d version(s) to mirror %s\n", len(missing), m.repo)
+	}
+	var st CopyStats
+	c := &repoCopier{src: cm, dst: m.cm, srcVM: vm, dstVM: m.vm, srcSecret: secret, dstSecret: secret, sameSecret: true, raw: true, names: make(map[FP]FP), verbose: verbose, maxDop: maxDop, locks: []*repoLock{m.lock, m.rlock}, st: &st}
+	c.dstChunks = m.cm.GetAllChunks()
+	if last != "" {
+		if _, err := c.copyVersionChunks(last); err != nil {
+			m.fail(err)
+			missing = nil
+		}
+	}
+	for _, v := range missing {
+		if err := c.copyVersion(v); err != nil {
+			m.fail(err)
+			break
+		}
+		m.unrecord(cm, v)
+	}
+	m.mu.Lock()
+	m.added += st.Size
+	m.mu.Unlock()
+	m.cm.mu.Lock()
+	for fp := range c.dstChunks {
+		m.cm.memoize[fp] = true
+	}
+	m.cm.mu.Unlock()
+}
+
+// save saves the version in the mirror if it did not fail. Otherwise it
+// records in the repo that the version is missing in the mirror.
+func (m *mirror) save(cm *CMgr, version string, fds []*FileData) {
+	if !m.failed() {
+		if err := m.cm.Flush(); err != nil {
+			m.fail(err)
+		} else if err := checkLocks(m.lock, m.rlock); err != nil {
+			m.fail(err)
+		} else if err := m.vm.SaveFiles(version, fds); err != nil {
+			m.fail(err)
+		}
+	}
+	if m.failed() {
+		m.record(cm, version)
+	}
+}
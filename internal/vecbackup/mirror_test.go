@@ -0,0 +1,214 @@
+package vecbackup
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func checkMirror(e *TestEnv, repo, mirror string, versions []string) {
+	opt.Repo = mirror
+	defer func() { opt.Repo = repo }()
+	if v := e.versions(); strings.Join(v, " ") != strings.Join(versions, " ") {
+		e.t.Fatalf("Mirror %s should have versions %v: %v", mirror, versions, v)
+	}
+	e.clean("res")
+	e.restore()
+	e.checkSame()
+	r := e.verifyRepo()
+	if r.Errors != 0 || r.Missing != 0 {
+		e.t.Errorf("Should be 0, 0: numErrors=%d numMissing=%d", r.Errors, r.Missing)
+	}
+}
+
+func TestMirror(t *testing.T) {
+	for _, packSize := range []int{0, 20000} {
+		doTestSeq(t, fmt.Sprintf("mirror packs=%d", packSize), func(e *TestEnv) {
+			_, restore := setTestRetry(0, 0, 0)
+			defer restore()
+			saveUser, savePassword := httpUser, httpPassword
+			SetHttpConfig("backup", "secret")
+			defer SetHttpConfig(saveUser, savePassword)
+			var failPuts int32
+			s := &repoServer{sm: TheLocalSMgr, root: filepath.Join(TEMPDIR, "test_http"), user: httpUser, password: httpPassword}
+			defer removeAll(e.t, s.root)
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if atomic.LoadInt32(&failPuts) != 0 && r.Method == "PUT" && r.Header.Get("If-None-Match") == "" {
+					http.Error(w, "Disk broken", http.StatusInternalServerError)
+					return
+				}
+				s.ServeHTTP(w, r)
+			}))
+			defer srv.Close()
+			m1 := filepath.Join(TEMPDIR, "test_mirror")
+			defer removeAll(e.t, m1)
+			m2 := srv.URL + "/m2"
+			e.setPW([]byte("sdfsdfwerfdsfsdfsd"))
+			opt.ChunkSize = 5000
+			opt.PackSize = packSize
+			e.init()
+			e.addFile("a", 23456, 1)
+			e.addFile("b/c", 7890, 2)
+			opt.Mirrors = []string{m1, m2}
+			stats := e.backup()
+			if len(stats.Mirrors) != 2 {
+				e.t.Fatalf("Should have stats of 2 mirrors: %v", stats.Mirrors)
+			}
+			for _, m := range stats.Mirrors {
+				if m.Err != nil || m.RepoAdded == 0 {
+					e.t.Errorf("Mirror %s should have added chunks: %d %v", m.Repo, m.RepoAdded, m.Err)
+				}
+			}
+			v1 := e.versions()
+			checkMirror(e, REPO, m1, v1)
+			checkMirror(e, REPO, m2, v1)
+
+			// A failed mirror does not fail the backup.
+			atomic.StoreInt32(&failPuts, 1)
+			e.addFile("d", 12345, 3)
+			stats = e.backup()
+			if stats.Mirrors[0].Err != nil || stats.Mirrors[1].Err == nil {
+				e.t.Fatalf("Only the second mirror should fail: %v", stats.Mirrors)
+			}
+			v2 := e.versions()
+			opt.Repo = m2
+			if v := e.versions(); len(v) != 1 {
+				e.t.Fatalf("Failed mirror should not have the new version: %v", v)
+			}
+			opt.Repo = REPO
+
+			// The next backup copies the missing version.
+			atomic.StoreInt32(&failPuts, 0)
+			e.rm("a")
+			e.addFile("e", 3456, 4)
+			stats = e.backup()
+			for _, m := range stats.Mirrors {
+				if m.Err != nil {
+					e.t.Errorf("Mirror %s should not fail: %v", m.Repo, m.Err)
+				}
+			}
+			v3 := e.versions()
+			if len(v2) != 2 || len(v3) != 3 {
+				e.t.Fatalf("Should have 2 and 3 versions: %v %v", v2, v3)
+			}
+			checkMirror(e, REPO, m1, v3)
+			checkMirror(e, REPO, m2, v3)
+			opt.Repo = m2
+			opt.Version = v2[1]
+			e.clean("res")
+			e.restore()
+			e.checkExistFile("a")
+			e.checkExistFile("d")
+			opt.Repo = REPO
+			opt.Version = ""
+
+			opt.Mirrors = []string{REPO}
+			if err := Backup(PwFile(opt.PwFile), REPO, "", "", false, false, false, false, "", opt.Mirrors, opt.MaxDop, []string{SRCDIR}, &BackupStats{}); err == nil {
+				e.t.Error("Backup with the repo as mirror should fail")
+			}
+			other := filepath.Join(TEMPDIR, "test_other")
+			defer removeAll(e.t, other)
+			opt.Repo = other
+			e.init()
+			opt.Repo = REPO
+			opt.Mirrors = []string{other}
+			stats = e.backup()
+			if err := stats.Mirrors[0].Err; err == nil || !strings.Contains(err.Error(), "same keys") {
+				e.t.Errorf("Mirror with other keys should fail: %v", err)
+			}
+
+			// The mirror is created again with the version it missed.
+			removeAll(e.t, other)
+			e.addFile("f", 4567, 5)
+			stats = e.backup()
+			if err := stats.Mirrors[0].Err; err != nil {
+				e.t.Errorf("Mirror %s should not fail: %v", other, err)
+			}
+			v5 := e.versions()
+			checkMirror(e, REPO, other, v5[3:])
+			if files, err := TheLocalSMgr.LsDir(filepath.Join(REPO, MIRRORS_DIR)); len(files) != 0 {
+				e.t.Errorf("Missing versions should not be recorded: %v %v", files, err)
+			}
+		})
+	}
+}
+
+func TestMirrorKeepsPending(t *testing.T) {
+	doTestSeq(t, "mirror keeps pending", func(e *TestEnv) {
+		m := filepath.Join(TEMPDIR, "test_mirror")
+		defer removeAll(e.t, m)
+		e.setPW([]byte("sdfsdfwerfdsfsdfsd"))
+		opt.ChunkSize = 5000
+		opt.GracePeriod = time.Hour
+		e.init()
+		e.addFile("a", 23456, 1)
+		e.addFile("b", 7890, 2)
+		opt.Mirrors = []string{m}
+		e.backup()
+
+		// The chunks of the version go on the pending deletion list of
+		// the mirror.
+		opt.Repo = m
+		e.deleteVersion(e.versions()[0])
+		opt.Version = ""
+		e.purgeUnused()
+		list, err := pendingCMgr(e).readPendingFile(PENDING_DELETION)
+		if err != nil || len(list) == 0 {
+			e.t.Fatalf("Unused chunks should be on the list: %v %v", list, err)
+		}
+		opt.Repo = REPO
+
+		// The next backup copies the chunks of the deleted version back,
+		// but not the version, without reading a and b.
+		e.rm("a")
+		e.rm("b")
+		e.addFile("c", 3456, 3)
+		e.backup()
+		if n := keepFiles(m); n != len(list) {
+			e.t.Errorf("Copying a version to the mirror should keep its chunks: %d %d", n, len(list))
+		}
+		checkMirror(e, REPO, m, e.versions()[1:])
+	})
+}
+
+func TestCopyKeepsPending(t *testing.T) {
+	doTestSeq(t, "copy keeps pending", func(e *TestEnv) {
+		dst := filepath.Join(TEMPDIR, "test_copy")
+		defer removeAll(e.t, dst)
+		e.setPW([]byte("sdfsdfwerfdsfsdfsd"))
+		opt.ChunkSize = 5000
+		opt.GracePeriod = time.Hour
+		e.init()
+		e.addFile("a", 23456, 1)
+		e.addFile("b", 7890, 2)
+		e.backup()
+		opt.Repo = dst
+		e.init()
+		opt.Repo = REPO
+		var st CopyStats
+		e.failIfError("Copy", Copy(PwFile(opt.PwFile), PwFile(opt.PwFile), REPO, dst, "", "", false, opt.MaxDop, &st))
+
+		// The chunks of the version go on the pending deletion list of
+		// the destination.
+		opt.Repo = dst
+		e.deleteVersion(e.versions()[0])
+		opt.Version = ""
+		e.purgeUnused()
+		list, err := pendingCMgr(e).readPendingFile(PENDING_DELETION)
+		if err != nil || len(list) == 0 {
+			e.t.Fatalf("Unused chunks should be on the list: %v %v", list, err)
+		}
+		opt.Repo = REPO
+
+		e.failIfError("Copy", Copy(PwFile(opt.PwFile), PwFile(opt.PwFile), REPO, dst, "", "", false, opt.MaxDop, &st))
+		if n := keepFiles(dst); n != len(list) {
+			e.t.Errorf("Copying a version should keep its chunks in the destination: %d %d", n, len(list))
+		}
+		checkMirror(e, REPO, dst, e.versions())
+	})
+}
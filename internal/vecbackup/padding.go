@@ -0,0 +1,69 @@
+package vecbackup
+
+import (
+	"encoding/binary"
+	"errors"
+	"math/bits"
+)
+
+// Without padding, the size of an encrypted chunk is the size of the
+// compressed chunk plus a fixed overhead. The last chunk of a file gives
+// away the file size modulo the chunk size, so a known file can be
+// recognized in the repo. With a padding mode, chunks and version files
+// are padded before encryption to one of a few sizes:
+//
+//   text | zero bytes | 4 bytes big-endian number of padding bytes
+//
+// The padding is stripped right after decryption, so everything above
+// the storage key only sees the real data. Pack indexes and the config
+// file are not padded.
+
+const PAD_TRAILER_SIZE = 4
+
+// paddedSize returns the size of a text of n bytes after padding.
+func paddedSize(m PaddingMode, n int) int {
+	l := n + PAD_TRAILER_SIZE
+	switch m {
+	case PaddingMode_POWER_OF_TWO:
+		return 1 << bits.Len(uint(l-1))
+	case PaddingMode_PADME:
+		// https://lbarman.ch/blog/padme/
+		e := bits.Len(uint(l)) - 1
+		s := bits.Len(uint(e))
+		mask := 1<<uint(e-s) - 1
+		return (l + mask) &^ mask
+	}
+	return n
+}
+
+func padText(m PaddingMode, text []byte) []byte {
+	if m == PaddingMode_NO_PADDING {
+		return text
+	}
+	size := paddedSize(m, len(text))
+	out := make([]byte, size)
+	copy(out, text)
+	binary.BigEndian.PutUint32(out[size-PAD_TRAILER_SIZE:], uint32(size-len(text)))
+	return out
+}
+
+func unpadText(m PaddingMode, text []byte) ([]byte, error) {
+	if m == PaddingMode_NO_PADDING {
+		return text, nil
+	}
+	if len(text) < PAD_TRAILER_SIZE {
+		return nil, errors.New("Invalid padding")
+	}
+	n := int64(binary.BigEndian.Uint32(text[len(text)-PAD_TRAILER_SIZE:]))
+	if n < PAD_TRAILER_SIZE || n > int64(len(text)) {
+		return nil, errors.New("Invalid padding")
+	}
+	return text[:int64(len(text))-n], nil
+}
+
+func checkPadding(m PaddingMode) error {
+	if m != PaddingMode_NO_PADDING && m != PaddingMode_POWER_OF_TWO && m != PaddingMode_PADME {
+		return errors.New("Invalid padding mode.")
+	}
+	return nil
+}
@@ -0,0 +1,174 @@
+package vecbackup
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"golang.org/x/crypto/ssh/terminal"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"runtime"
+	"strings"
+)
+
+// PwSource is where the password of a repo comes from. Exactly one of
+// the fields is set. A nil *PwSource means the repo is not encrypted.
+type PwSource struct {
+	File    string // File containing the password.
+	Env     string // Environment variable containing the password.
+	Command string // Shell command that prints the password.
+	Prompt  bool   // Reads the password from the terminal.
+	KeyFile string // File containing a raw 32-byte key. No key derivation is done.
+
+	pw    []byte
+	isKey bool
+	done  bool
+}
+
+// NewPwSource returns the password source given by the flags, nil if
+// none is given or an error if more than one is given.
+func NewPwSource(file, env, command string, prompt bool, keyFile string) (*PwSource, error) {
+	src := &PwSource{File: file, Env: env, Command: command, Prompt: prompt, KeyFile: keyFile}
+	n := 0
+	for _, set := range []bool{file != "", env != "", command != "", prompt, keyFile != ""} {
+		if set {
+			n++
+		}
+	}
+	if n == 0 {
+		return nil, nil
+	} else if n > 1 {
+		return nil, errors.New("Only one of -pw, -pw-env, -pw-command, -pw-prompt and -key-file can be given.")
+	}
+	return src, nil
+}
+
+// PwFile returns a password source for the password file or nil if the
+// name is empty.
+func PwFile(file string) *PwSource {
+	if file == "" {
+		return nil
+	}
+	return &PwSource{File: file}
+}
+
+// read returns the password and whether it is a raw key. The password is
+// only read once. New passwords read from the terminal must be confirmed.
+func (src *PwSource) read(prompt string, confirm bool) ([]byte, bool, error) {
+	if src.done {
+		return src.pw, src.isKey, nil
+	}
+	var pw []byte
+	var err error
+	if src.File != "" {
+		if pw, err = ioutil.ReadFile(src.File); err != nil {
+			return nil, false, fmt.Errorf("Cannot read pw file: %s", err)
+		}
+	} else if src.Env != "" {
+		v, ok := os.LookupEnv(src.Env)
+		if !ok {
+			return nil, false, fmt.Errorf("Environment variable %s is not set", src.Env)
+		}
+		if v == "" {
+			return nil, false, fmt.Errorf("Environment variable %s is empty", src.Env)
+		}
+		pw = []byte(v)
+	} else if src.Command != "" {
+		if pw, err = runPwCommand(src.Command); err != nil {
+			return nil, false, err
+		}
+		if len(pw) == 0 {
+			return nil, false, errors.New("Password command printed no password")
+		}
+	} else if src.Prompt {
+		if pw, err = promptPassword(prompt + ": "); err != nil {
+			return nil, false, err
+		}
+		if len(pw) == 0 {
+			return nil, false, errors.New("Empty password")
+		}
+		if confirm {
+			pw2, err := promptPassword("Confirm " + strings.ToLower(prompt) + ": ")
+			if err != nil {
+				return nil, false, err
+			}
+			if !bytes.Equal(pw, pw2) {
+				return nil, false, errors.New("Passwords do not match")
+			}
+		}
+	} else if src.KeyFile != "" {
+		if pw, err = ioutil.ReadFile(src.KeyFile); err != nil {
+			return nil, false, fmt.Errorf("Cannot read key file: %s", err)
+		}
+		if len(pw) != len(EncKey{}) {
+			return nil, false, fmt.Errorf("Key file must contain exactly %d bytes: %s", len(EncKey{}), src.KeyFile)
+		}
+		src.isKey = true
+	} else {
+		return nil, false, errors.New("No password given")
+	}
+	src.pw = pw
+	src.done = true
+	return src.pw, src.isKey, nil
+}
+
+// readPw reads the password from the source.
+func readPw(src *PwSource) ([]byte, error) {
+	pw, _, err := src.read("Password", false)
+	return pw, err
+}
+
+// readNewPw reads a new password from the source and returns the key
+// derivation function to use with it, which is RAW_KEY for key files
+// and kdf otherwise.
+func readNewPw(src *PwSource, kdf *KdfParams) ([]byte, *KdfParams, error) {
+	pw, isKey, err := src.read("New password", true)
+	if err != nil {
+		return nil, nil, err
+	}
+	if isKey {
+		return pw, &KdfParams{Type: KdfType_RAW_KEY}, nil
+	}
+	if kdf.Type == KdfType_RAW_KEY {
+		return nil, nil, errors.New("Only key files can be used without key derivation.")
+	}
+	if err := checkKdf(kdf); err != nil {
+		return nil, nil, err
+	}
+	return pw, kdf, nil
+}
+
+// runPwCommand runs the command with the shell and returns its output
+// without the trailing newline.
+func runPwCommand(command string) ([]byte, error) {
+	var cmd *exec.Cmd
+	if runtime.GOOS == "windows" {
+		cmd = exec.Command("cmd", "/C", command)
+	} else {
+		cmd = exec.Command("/bin/sh", "-c", command)
+	}
+	cmd.Stdin = os.Stdin
+	cmd.Stderr = os.Stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("Password command failed: %s", err)
+	}
+	out = bytes.TrimSuffix(out, []byte("\n"))
+	out = bytes.TrimSuffix(out, []byte("\r"))
+	return out, nil
+}
+
+func promptPassword(prompt string) ([]byte, error) {
+	fd := int(os.Stdin.Fd())
+	if !terminal.IsTerminal(fd) {
+		return nil, errors.New("Cannot prompt for password, stdin is not a terminal")
+	}
+	fmt.Fprint(os.Stderr, prompt)
+	pw, err := terminal.ReadPassword(fd)
+	fmt.Fprintln(os.Stderr)
+	if err != nil {
+		return nil, fmt.Errorf("Cannot read password: %s", err)
+	}
+	return pw, nil
+}
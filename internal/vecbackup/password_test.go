@@ -0,0 +1,101 @@
+package vecbackup
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+)
+
+func TestPwSource(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "password_test-*")
+	if err != nil {
+		t.Fatal("Cannot get tempdir", err)
+	}
+	defer os.RemoveAll(tmpDir)
+	if src, err := NewPwSource("", "", "", false, ""); src != nil || err != nil {
+		t.Fatal("No password source should be nil", src, err)
+	}
+	if _, err := NewPwSource("pw", "PW", "", false, ""); err == nil {
+		t.Fatal("Should not be able to give two password sources")
+	}
+	if _, err := NewPwSource("", "", "", true, "key"); err == nil {
+		t.Fatal("Should not be able to give two password sources")
+	}
+
+	os.Setenv("VECBACKUP_TEST_PW", "envpw")
+	defer os.Unsetenv("VECBACKUP_TEST_PW")
+	src, _ := NewPwSource("", "VECBACKUP_TEST_PW", "", false, "")
+	if pw, err := readPw(src); err != nil || string(pw) != "envpw" {
+		t.Fatal("Cannot read pw from env", string(pw), err)
+	}
+	src, _ = NewPwSource("", "VECBACKUP_TEST_NO_SUCH_PW", "", false, "")
+	if _, err := readPw(src); err == nil {
+		t.Fatal("Should not be able to read pw from unset env")
+	}
+
+	if runtime.GOOS != "windows" {
+		src, _ = NewPwSource("", "", "echo cmdpw", false, "")
+		if pw, err := readPw(src); err != nil || string(pw) != "cmdpw" {
+			t.Fatal("Cannot read pw from command", string(pw), err)
+		}
+		src, _ = NewPwSource("", "", "exit 1", false, "")
+		if _, err := readPw(src); err == nil {
+			t.Fatal("Should fail if the pw command fails")
+		}
+		src, _ = NewPwSource("", "", "true", false, "")
+		if _, err := readPw(src); err == nil {
+			t.Fatal("Should fail if the pw command prints nothing")
+		}
+	}
+
+	keyFile := filepath.Join(tmpDir, "key")
+	key := bytes.Repeat([]byte{7}, 32)
+	ioutil.WriteFile(keyFile, key, 0444)
+	src, _ = NewPwSource("", "", "", false, keyFile)
+	if pw, kdf, err := readNewPw(src, &KdfParams{Iterations: 100000}); err != nil || !bytes.Equal(pw, key) || kdf.Type != KdfType_RAW_KEY {
+		t.Fatal("Cannot read key file", kdf, err)
+	}
+	shortKeyFile := filepath.Join(tmpDir, "shortkey")
+	ioutil.WriteFile(shortKeyFile, key[:31], 0444)
+	src, _ = NewPwSource("", "", "", false, shortKeyFile)
+	if _, err := readPw(src); err == nil {
+		t.Fatal("Should not be able to read key file with wrong size")
+	}
+	if _, _, err := readNewPw(PwFile(keyFile), &KdfParams{Type: KdfType_RAW_KEY}); err == nil {
+		t.Fatal("Should not be able to use a password without key derivation")
+	}
+}
+
+func TestKeyFileConfig(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "password_test-*")
+	if err != nil {
+		t.Fatal("Cannot get tempdir", err)
+	}
+	defer os.RemoveAll(tmpDir)
+	keyFile := filepath.Join(tmpDir, "key")
+	badKeyFile := filepath.Join(tmpDir, "badkey")
+	ioutil.WriteFile(keyFile, bytes.Repeat([]byte{1}, 32), 0444)
+	ioutil.WriteFile(badKeyFile, bytes.Repeat([]byte{2}, 32), 0444)
+	keySrc := func(p string) *PwSource {
+		src, _ := NewPwSource("", "", "", false, p)
+		return src
+	}
+	sm, repo2 := GetStorageMgr(tmpDir)
+	cfg := &Config{ChunkSize: 1000, Compress: CompressionMode_NO, CompressionType: CompressionType_ZLIB}
+	if err := WriteNewConfig(keySrc(keyFile), sm, repo2, &KdfParams{Iterations: 100000}, cfg); err != nil {
+		t.Fatal("Cannot save config:", err)
+	}
+	if cfg2, err := GetConfig(keySrc(keyFile), sm, repo2); err != nil || !equalConfig(cfg, cfg2) {
+		t.Fatal("Cannot load config with key file", err)
+	}
+	if _, err := GetConfig(keySrc(badKeyFile), sm, repo2); err == nil {
+		t.Fatal("Should not be able to load config with bad key file")
+	}
+	slots, err := ListKeySlots(sm, repo2)
+	if err != nil || len(slots) != 1 || slots[0].Kdf.Type != KdfType_RAW_KEY {
+		t.Fatal("Unexpected key slots", slots, err)
+	}
+}
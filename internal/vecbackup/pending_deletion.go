@@ -0,0 +1,234 @@
+package vecbackup
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"google.golang.org/protobuf/proto"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// purge-unused deletes unused chunks in two phases so that a backup that
+// is still running, maybe on another host and not yet visible on eventually
+// consistent storage, does not lose the chunks it has found in the repo.
+// A purge first puts the unused chunks on the pending deletion list
+// "pending/deletion" with the time it found them. A later purge deletes
+// the chunks that are still unused and have been on the list for the grace
+// period. Chunks that are used again are dropped from the list. Packs
+// without an index go on the list too, by the name of the pack.
+//
+// A backup that finds a chunk of the list in the repo keeps it by writing
+// the chunk name to a new file "pending/keep-<id>" right away, before the
+// version that uses it is saved. Adding a file works in append-only repos,
+// where the list cannot be rewritten. The next purge
+// removes the kept chunks from the list, so they wait another grace period
+// if they are still unused, and then deletes the keep files.
+//
+// The list and the keep files contain only chunk names and times. They are
+// encrypted with the key of the pack indexes so that write-only clients can
+// read the list.
+
+const (
+	VD_VERSION           = 1
+	VD_MAGIC             = "VBKD"
+	PENDING_DELETION     = "deletion"
+	PENDING_KEEP_PREFIX  = "keep-"
+	DEFAULT_GRACE_PERIOD = 24 * time.Hour
+)
+
+type PendingStats struct {
+	Pending int // Chunks on the list after the purge.
+	New     int // Chunks put on the list by the purge.
+	Kept    int // Chunks kept by backups, put on the list again.
+	Expired int // Chunks to be deleted.
+}
+
+func encodePendingList(key *EncKey, chunks map[FP]int64) ([]byte, error) {
+	var fps []FP
+	for fp := range chunks {
+		fps = append(fps, fp)
+	}
+	sort.Slice(fps, func(i, j int) bool { return bytes.Compare(fps[i][:], fps[j][:]) < 0 })
+	pd := &PendingDeletionProto{Version: VD_VERSION}
+	for _, fp := range fps {
+		pd.Chunks = append(pd.Chunks, &PendingChunkProto{FP: append([]byte(nil), fp[:]...), Time: chunks[fp]})
+	}
+	pb, err := proto.Marshal(pd)
+	if err != nil {
+		return nil, err
+	}
+	b := append([]byte(VD_MAGIC), pb...)
+	if key == nil {
+		return b, nil
+	}
+	return encryptBytes(key, b, nil)
+}
+
+func decodePendingList(key *EncKey, b []byte) (map[FP]int64, error) {
+	if key != nil {
+		var err error
+		if b, err = decryptBytes(key, b, nil); err != nil {
+			return nil, err
+		}
+	}
+	if len(b) < len(VD_MAGIC) || string(b[:len(VD_MAGIC)]) != VD_MAGIC {
+		return nil, errors.New("Bad magic")
+	}
+	pd := &PendingDeletionProto{}
+	if err := proto.Unmarshal(b[len(VD_MAGIC):], pd); err != nil {
+		return nil, err
+	}
+	if pd.Version != VD_VERSION {
+		return nil, errors.New("Incompatible pending deletion list.")
+	}
+	chunks := make(map[FP]int64)
+	for _, c := range pd.Chunks {
+		var fp FP
+		if len(c.FP) != len(fp) {
+			return nil, errors.New("Bad pending chunk")
+		}
+		copy(fp[:], c.FP)
+		chunks[fp] = c.Time
+	}
+	return chunks, nil
+}
+
+func (cm *CMgr) pendingPath(name string) string {
+	return cm.sm.JoinPath(cm.sm.JoinPath(cm.repo, PENDING_DIR), name)
+}
+
+// readPendingFile reads the list or a keep file. It returns nil if the
+// file does not exist.
+func (cm *CMgr) readPendingFile(name string) (map[FP]int64, error) {
+	var buf, errBuf bytes.Buffer
+	b, err := cm.sm.ReadFile(cm.pendingPath(name), &buf, &errBuf)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	chunks, err := decodePendingList(cm.indexKey, b)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid pending deletion file %s: %s", name, err)
+	}
+	return chunks, nil
+}
+
+func (cm *CMgr) writePendingFile(name string, chunks map[FP]int64) error {
+	b, err := encodePendingList(cm.indexKey, chunks)
+	if err != nil {
+		return err
+	}
+	if err := cm.sm.MkdirAll(cm.sm.JoinPath(cm.repo, PENDING_DIR)); err != nil {
+		return err
+	}
+	return cm.sm.WriteFile(cm.pendingPath(name), b)
+}
+
+// LoadPendingDeletion reads the pending deletion list for the backup, so
+// that the chunks of the list that it uses are kept, see keepChunk.
+func (cm *CMgr) LoadPendingDeletion() error {
+	chunks, err := cm.readPendingFile(PENDING_DELETION)
+	if err != nil {
+		return err
+	}
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+	cm.deletion = chunks
+	cm.kept = make(map[FP]int64)
+	return nil
+}
+
+// keepChunk writes a keep file for a chunk of the pending deletion list
+// the first time the backup uses it, so that a purge that runs before the
+// version is saved does not delete it.
+func (cm *CMgr) keepChunk(fp FP) error {
+	cm.mu.Lock()
+	t, ok := cm.deletion[fp]
+	_, done := cm.kept[fp]
+	if ok && !done {
+		cm.kept[fp] = t
+	}
+	cm.mu.Unlock()
+	if !ok || done {
+		return nil
+	}
+	var b [8]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return err
+	}
+	if err := cm.writePendingFile(PENDING_KEEP_PREFIX+hex.EncodeToString(b[:]), map[FP]int64{fp: t}); err != nil {
+		return fmt.Errorf("Cannot keep chunk pending deletion: %s", err)
+	}
+	return nil
+}
+
+// UpdatePendingDeletion puts the unused chunks on the pending deletion list
+// and returns the chunks to be deleted, those that have been on it for the
+// grace period and were not kept by a backup since. They are removed from
+// the list before they are deleted. A chunk that is not deleted is put on
+// the list again by the next purge. With a grace period of 0, all unused
+// chunks are deleted.
+func (cm *CMgr) UpdatePendingDeletion(unused map[FP]bool, grace time.Duration, now time.Time, dryRun bool, st *PendingStats) (map[FP]bool, error) {
+	old, err := cm.readPendingFile(PENDING_DELETION)
+	if err != nil {
+		return nil, err
+	}
+	files, err := cm.sm.LsDir(cm.sm.JoinPath(cm.repo, PENDING_DIR))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	var keepFiles []string
+	kept := make(map[FP]bool)
+	for _, f := range files {
+		if !strings.HasPrefix(f, PENDING_KEEP_PREFIX) {
+			continue
+		}
+		chunks, err := cm.readPendingFile(f)
+		if err != nil {
+			return nil, err
+		}
+		for fp := range chunks {
+			kept[fp] = true
+		}
+		keepFiles = append(keepFiles, f)
+	}
+	list := make(map[FP]int64)
+	expired := make(map[FP]bool)
+	for fp := range unused {
+		t, ok := old[fp]
+		switch {
+		case grace == 0:
+			expired[fp] = true
+		case ok && kept[fp]:
+			list[fp] = now.Unix()
+			st.Kept++
+		case ok && now.Sub(time.Unix(t, 0)) >= grace:
+			expired[fp] = true
+		case ok:
+			list[fp] = t
+		default:
+			list[fp] = now.Unix()
+			st.New++
+		}
+	}
+	st.Pending = len(list)
+	st.Expired = len(expired)
+	if dryRun || old == nil && len(list) == 0 && len(keepFiles) == 0 {
+		return expired, nil
+	}
+	if err := cm.writePendingFile(PENDING_DELETION, list); err != nil {
+		return nil, fmt.Errorf("Cannot write pending deletion list: %s", err)
+	}
+	for _, f := range keepFiles {
+		if err := cm.sm.DeleteFile(cm.pendingPath(f)); err != nil {
+			return nil, err
+		}
+	}
+	return expired, nil
+}
@@ -0,0 +1,251 @@
+package vecbackup
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPendingListEncoding(t *testing.T) {
+	var key EncKey
+	key[0] = 1
+	chunks := map[FP]int64{FP{1}: 100, FP{2}: 200}
+	for _, k := range []*EncKey{nil, &key} {
+		b, err := encodePendingList(k, chunks)
+		if err != nil {
+			t.Fatal("encodePendingList failed:", err)
+		}
+		got, err := decodePendingList(k, b)
+		if err != nil || len(got) != 2 || got[FP{1}] != 100 || got[FP{2}] != 200 {
+			t.Fatalf("Decoded list should match: %v %v", got, err)
+		}
+	}
+	b, _ := encodePendingList(&key, chunks)
+	var other EncKey
+	if _, err := decodePendingList(&other, b); err == nil {
+		t.Error("Decoding with another key should fail")
+	}
+}
+
+func pendingCMgr(e *TestEnv) *CMgr {
+	_, cm, _, err := setup(opt.Repo, PwFile(opt.PwFile))
+	e.failIfError("setup", err)
+	return cm
+}
+
+// agePendingList moves the times on the pending deletion list back by d.
+func agePendingList(e *TestEnv, d time.Duration) {
+	cm := pendingCMgr(e)
+	list, err := cm.readPendingFile(PENDING_DELETION)
+	e.failIfError("readPendingFile", err)
+	for fp := range list {
+		list[fp] -= int64(d / time.Second)
+	}
+	e.failIfError("writePendingFile", cm.writePendingFile(PENDING_DELETION, list))
+}
+
+func keepFiles(repo string) int {
+	files, _ := TheLocalSMgr.LsDir(TheLocalSMgr.JoinPath(repo, PENDING_DIR))
+	n := 0
+	for _, f := range files {
+		if strings.HasPrefix(f, PENDING_KEEP_PREFIX) {
+			n++
+		}
+	}
+	return n
+}
+
+func TestPendingDeletion(t *testing.T) {
+	doTestSeq(t, "pending deletion", func(e *TestEnv) {
+		e.setPW([]byte("sdfsdfwerfdsfsdfsd"))
+		opt.ChunkSize = 5000
+		opt.GracePeriod = time.Hour
+		e.init()
+		e.addFile("a", 23456, 1)
+		e.addFile("b", 7890, 2)
+		e.backup()
+		e.rm("a")
+		e.backup()
+		e.deleteVersion(e.versions()[0])
+		opt.Version = ""
+
+		// The first purge only puts the chunks of a on the list.
+		e.purgeUnused()
+		r := e.verifyRepo()
+		if r.Unused == 0 {
+			e.t.Fatal("Unused chunks should not be deleted by the first purge")
+		}
+		list, err := pendingCMgr(e).readPendingFile(PENDING_DELETION)
+		if err != nil || len(list) != r.Unused {
+			e.t.Fatalf("Unused chunks should be on the list: %d %d %v", len(list), r.Unused, err)
+		}
+		e.purgeUnused()
+		if r2 := e.verifyRepo(); r2.Unused != r.Unused {
+			e.t.Errorf("Chunks should not be deleted before the grace period: %d %d", r2.Unused, r.Unused)
+		}
+
+		// A backup that uses the chunks keeps them for another grace period.
+		e.addFile("a", 23456, 1)
+		e.backup()
+		if n := keepFiles(REPO); n != len(list) {
+			e.t.Fatalf("Backup should write a keep file for each chunk of the list: %d %d", n, len(list))
+		}
+		e.deleteVersion(e.versions()[1])
+		opt.Version = ""
+		agePendingList(e, 2*time.Hour)
+		e.purgeUnused()
+		if r2 := e.verifyRepo(); r2.Unused != r.Unused {
+			e.t.Errorf("Kept chunks should not be deleted: %d %d", r2.Unused, r.Unused)
+		}
+		if keepFiles(REPO) != 0 {
+			e.t.Error("Purge should delete the keep files")
+		}
+
+		// After the grace period, the chunks are deleted.
+		agePendingList(e, 2*time.Hour)
+		e.purgeUnused()
+		if r2 := e.verifyRepo(); r2.Unused != 0 || r2.Errors != 0 || r2.Missing != 0 {
+			e.t.Errorf("Should be 0, 0, 0: numErrors=%d numMissing=%d numUnused=%d", r2.Errors, r2.Missing, r2.Unused)
+		}
+		if list, err := pendingCMgr(e).readPendingFile(PENDING_DELETION); err != nil || len(list) != 0 {
+			e.t.Errorf("List should be empty: %v %v", list, err)
+		}
+		e.rm("a")
+		e.restore()
+		e.checkSame()
+
+		// A grace period of 0 deletes at once.
+		e.rm("b")
+		e.backup()
+		e.deleteVersion(e.versions()[0])
+		opt.Version = ""
+		opt.GracePeriod = 0
+		e.purgeUnused()
+		if r2 := e.verifyRepo(); r2.Unused != 0 {
+			e.t.Errorf("Unused chunks should be deleted at once: %d", r2.Unused)
+		}
+	})
+}
+
+func TestPendingDeletionKeepBeforeSave(t *testing.T) {
+	doTestSeq(t, "pending deletion keep before save", func(e *TestEnv) {
+		e.setPW([]byte("sdfsdfwerfdsfsdfsd"))
+		opt.ChunkSize = 5000
+		opt.GracePeriod = time.Hour
+		e.init()
+		e.addFile("a", 23456, 1)
+		e.addFile("b", 7890, 2)
+		e.backup()
+		e.rm("a")
+		e.backup()
+		e.deleteVersion(e.versions()[0])
+		opt.Version = ""
+		e.purgeUnused()
+		r := e.verifyRepo()
+		list, err := pendingCMgr(e).readPendingFile(PENDING_DELETION)
+		if err != nil || len(list) == 0 {
+			e.t.Fatalf("Unused chunks should be on the list: %v %v", list, err)
+		}
+
+		// A backup finds the chunks of the list, then a purge runs after
+		// the grace period before the backup saves its version.
+		cm := pendingCMgr(e)
+		e.failIfError("LoadPendingDeletion", cm.LoadPendingDeletion())
+		for fp := range list {
+			e.failIfError("keepChunk", cm.keepChunk(fp))
+		}
+		agePendingList(e, 2*time.Hour)
+		e.purgeUnused()
+		if r2 := e.verifyRepo(); r2.Unused != r.Unused {
+			e.t.Errorf("Chunks found by a running backup should not be deleted: %d %d", r2.Unused, r.Unused)
+		}
+	})
+}
+
+func TestPendingDeletionRotateKey(t *testing.T) {
+	for _, packSize := range []int{0, 20000} {
+		doTestSeq(t, fmt.Sprintf("pending deletion rotate-key packs=%d", packSize), func(e *TestEnv) {
+			e.setPW([]byte("sdfsdfwerfdsfsdfsd"))
+			opt.ChunkSize = 5000
+			opt.PackSize = packSize
+			opt.GracePeriod = time.Hour
+			e.init()
+			e.addFile("a", 23456, 1)
+			e.addFile("b", 7890, 2)
+			e.backup()
+			e.rm("a")
+			e.backup()
+			e.deleteVersion(e.versions()[0])
+			opt.Version = ""
+			e.purgeUnused()
+			list, err := pendingCMgr(e).readPendingFile(PENDING_DELETION)
+			if err != nil || len(list) == 0 {
+				e.t.Fatalf("Unused chunks should be on the list: %v %v", list, err)
+			}
+			e.addFile("a", 23456, 1)
+			e.backup()
+			if n := keepFiles(REPO); n != len(list) {
+				e.t.Fatalf("Backup should write keep files: %d %d", n, len(list))
+			}
+
+			e.rotateKey([]byte("rotated key"), false)
+			cm := pendingCMgr(e)
+			list2, err := cm.readPendingFile(PENDING_DELETION)
+			if err != nil || len(list2) != len(list) {
+				e.t.Fatalf("List should be rotated: %d %d %v", len(list2), len(list), err)
+			}
+			for fp := range list2 {
+				if list[fp] != 0 {
+					e.t.Errorf("List should have the new names: %s", fp)
+				}
+			}
+			if n := keepFiles(REPO); n != len(list) {
+				e.t.Errorf("Keep files should be rotated: %d %d", n, len(list))
+			}
+			e.backup()
+			e.purgeUnused()
+			if r := e.verifyRepo(); r.Errors != 0 || r.Missing != 0 || r.Unused != 0 {
+				e.t.Errorf("Should be 0, 0, 0: numErrors=%d numMissing=%d numUnused=%d", r.Errors, r.Missing, r.Unused)
+			}
+			e.clean("res")
+			e.restore()
+			e.checkSame()
+		})
+	}
+}
+
+func TestPendingDeletionOrphanPack(t *testing.T) {
+	doTestSeq(t, "pending deletion orphan pack", func(e *TestEnv) {
+		e.setPW([]byte("sdfsdfwerfdsfsdfsd"))
+		opt.ChunkSize = 5000
+		opt.PackSize = 20000
+		opt.GracePeriod = time.Hour
+		e.init()
+		e.addFile("a", 23456, 1)
+		e.backup()
+
+		// A pack of a running backup whose index is not visible yet.
+		name := FPtoName(FP{1, 2, 3})
+		p := filepath.Join(REPO, PACK_DIR, name[:DIR_PREFIX_SIZE], name)
+		e.failIfError("MkdirAll", os.MkdirAll(filepath.Dir(p), 0755))
+		e.failIfError("WriteFile", ioutil.WriteFile(p, []byte("pack"), 0644))
+		e.purgeUnused()
+		if _, err := os.Stat(p); err != nil {
+			e.t.Fatal("Pack without index should not be deleted by the first purge:", err)
+		}
+		if list, err := pendingCMgr(e).readPendingFile(PENDING_DELETION); err != nil || len(list) != 1 {
+			e.t.Fatalf("Pack without index should be on the list: %v %v", list, err)
+		}
+		agePendingList(e, 2*time.Hour)
+		e.purgeUnused()
+		if _, err := os.Stat(p); !os.IsNotExist(err) {
+			e.t.Error("Pack without index should be deleted after the grace period:", err)
+		}
+		e.restore()
+		e.checkSame()
+	})
+}
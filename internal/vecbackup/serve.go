@@ -0,0 +1,208 @@
+package vecbackup
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"strconv"
+)
+
+// serve exports the storage operations of a repo over HTTP for the http
+// backend, see httpSMgr for the requests. Every request must have the
+// user and password given to SetHttpConfig.
+//
+// In append-only mode the server refuses to overwrite or delete files, so
+// a client cannot destroy existing backups. Writing a file again with the
+// same content succeeds, so that a retried write does not fail. Only the
+// lock files, named "lock" or in the "locks" dir, can be overwritten by
+// the lock heartbeat and removed. Commands that delete or rewrite files, like purge-unused
+// and delete-version, must be run on the server with the local repo path.
+
+type repoServer struct {
+	sm         StorageMgr
+	root       string
+	user       string
+	password   string
+	appendOnly bool
+	verbose    bool
+}
+
+// path returns the path in the repo of a request path. Cleaning the path
+// as an absolute path removes any "..".
+func (s *repoServer) path(p string) string {
+	p = path.Clean("/" + p)
+	if p == "/" {
+		return s.root
+	}
+	return s.sm.JoinPath(s.root, p[1:])
+}
+
+// isLockPath returns whether the request path is a lock file.
+func isLockPath(p string) bool {
+	p = path.Clean("/" + p)
+	return path.Base(p) == LOCK_FILENAME || path.Base(path.Dir(p)) == LOCKS_DIR
+}
+
+func (s *repoServer) authorized(r *http.Request) bool {
+	u, p, ok := r.BasicAuth()
+	return ok && subtle.ConstantTimeCompare([]byte(u), []byte(s.user)) == 1 && subtle.ConstantTimeCompare([]byte(p), []byte(s.password)) == 1
+}
+
+func (s *repoServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !s.authorized(r) {
+		w.Header().Set("WWW-Authenticate", `Basic realm="vecbackup"`)
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	status, err := s.serve(w, r)
+	if err != nil {
+		switch {
+		case os.IsNotExist(err):
+			status = http.StatusNotFound
+		case os.IsExist(err):
+			status = http.StatusPreconditionFailed
+		case err == io.ErrUnexpectedEOF:
+			status = http.StatusRequestedRangeNotSatisfiable
+		case err == errAppendOnly || err == errReadOnly:
+			status = http.StatusForbidden
+		case status == 0:
+			status = http.StatusInternalServerError
+		}
+		http.Error(w, err.Error(), status)
+		if status == http.StatusInternalServerError || status == http.StatusForbidden {
+			stderr.Printf("%s %s: %s\n", r.Method, r.URL.Path, err)
+		}
+	}
+	if s.verbose {
+		if status == 0 {
+			status = http.StatusOK
+		}
+		stdout.Printf("%s %s %s %d\n", r.RemoteAddr, r.Method, r.URL.RequestURI(), status)
+	}
+}
+
+// serve handles an authorized request. It returns the error status if it
+// is not derived from the error.
+func (s *repoServer) serve(w http.ResponseWriter, r *http.Request) (int, error) {
+	p := s.path(r.URL.Path)
+	op := r.URL.Query().Get("op")
+	switch {
+	case r.Method == "GET" && op == "ls":
+		files, err := s.sm.LsDir(p)
+		if err != nil {
+			return 0, err
+		}
+		if files == nil {
+			files = []string{}
+		}
+		return 0, json.NewEncoder(w).Encode(files)
+	case r.Method == "GET" && op == "ls2":
+		files := [][2]string{}
+		if err := s.sm.LsDir2(p, func(d, f string) { files = append(files, [2]string{d, f}) }); err != nil {
+			return 0, err
+		}
+		return 0, json.NewEncoder(w).Encode(files)
+	case r.Method == "GET" && op == "":
+		return s.read(w, r, p)
+	case r.Method == "HEAD" && op == "":
+		exists, err := s.sm.FileExists(p)
+		if err == nil && !exists {
+			err = os.ErrNotExist
+		}
+		return 0, err
+	case r.Method == "POST" && op == "mkdir":
+		return 0, s.sm.MkdirAll(p)
+	case r.Method == "PUT" && op == "":
+		d, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			return http.StatusBadRequest, err
+		}
+		if r.Header.Get("If-None-Match") == "*" {
+			return 0, s.sm.WriteLockFile(p, d)
+		}
+		if s.appendOnly && !isLockPath(r.URL.Path) {
+			// A retried write whose first attempt succeeded writes the
+			// same content again.
+			var buf, errBuf bytes.Buffer
+			if old, err := s.sm.ReadFile(p, &buf, &errBuf); err == nil {
+				if bytes.Equal(old, d) {
+					return 0, nil
+				}
+				return 0, errAppendOnly
+			} else if !os.IsNotExist(err) {
+				return 0, err
+			}
+		}
+		return 0, s.sm.WriteFile(p, d)
+	case r.Method == "DELETE" && op == "unlock":
+		if s.appendOnly && !isLockPath(r.URL.Path) {
+			return 0, errAppendOnly
+		}
+		return 0, s.sm.RemoveLockFile(p)
+	case r.Method == "DELETE" && op == "":
+		if s.appendOnly {
+			return 0, errAppendOnly
+		}
+		return 0, s.sm.DeleteFile(p)
+	}
+	return http.StatusBadRequest, fmt.Errorf("Invalid request %s %s", r.Method, r.URL.RequestURI())
+}
+
+func (s *repoServer) read(w http.ResponseWriter, r *http.Request, p string) (int, error) {
+	var buf, errBuf bytes.Buffer
+	rg := r.Header.Get("Range")
+	if rg == "" {
+		b, err := s.sm.ReadFile(p, &buf, &errBuf)
+		if err != nil {
+			return 0, err
+		}
+		w.Header().Set("Content-Length", strconv.Itoa(len(b)))
+		w.Write(b)
+		return 0, nil
+	}
+	var start, end int64
+	if _, err := fmt.Sscanf(rg, "bytes=%d-%d", &start, &end); err != nil || start < 0 || start > end {
+		return http.StatusBadRequest, fmt.Errorf("Invalid range %s", rg)
+	}
+	b, err := s.sm.ReadFileRange(p, start, int(end-start+1), &buf, &errBuf)
+	if err != nil {
+		return 0, err
+	}
+	w.Header().Set("Content-Length", strconv.Itoa(len(b)))
+	w.WriteHeader(http.StatusPartialContent)
+	w.Write(b)
+	return http.StatusPartialContent, nil
+}
+
+// Serve serves the repo over HTTP, or HTTPS if a certificate and key file
+// are given, until it fails.
+func Serve(repo, listen, certFile, keyFile string, appendOnly, verbose bool) error {
+	if repo == "" {
+		return errors.New("Backup repository must be specified.")
+	}
+	if listen == "" {
+		return errors.New("Listen address must be specified.")
+	}
+	if httpPassword == "" {
+		return errors.New("A password is required to serve a repository.")
+	}
+	if (certFile == "") != (keyFile == "") {
+		return errors.New("Both the TLS certificate and key files must be specified.")
+	}
+	sm, p := GetStorageMgr(repo)
+	srv := &http.Server{Addr: listen, Handler: &repoServer{sm: sm, root: p, user: httpUser, password: httpPassword, appendOnly: appendOnly, verbose: verbose}}
+	if verbose {
+		stdout.Printf("Serving %s on %s\n", repo, listen)
+	}
+	if certFile != "" {
+		return srv.ListenAndServeTLS(certFile, keyFile)
+	}
+	return srv.ListenAndServe()
+}
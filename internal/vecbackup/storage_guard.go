@@ -0,0 +1,139 @@
+package vecbackup
+
+import (
+	"bytes"
+	"errors"
+	"sync"
+)
+
+// guardSMgr refuses the storage operations not allowed by the mode of the
+// repo, so that a repo can be protected from delete-version, purge-unused
+// and the like. It starts with the mode given by SetReadOnly and GetConfig
+// makes it stricter if the config of the repo has a stricter mode. In
+// APPEND_ONLY mode, existing files cannot be overwritten or deleted. In
+// READ_ONLY mode, no files can be written. Lock files can always be
+// written and removed.
+//
+// The mode is only kept by this client. Use "serve -append-only" to keep a
+// client that is not trusted from deleting backups.
+
+type guardSMgr struct {
+	sm   StorageMgr
+	mu   sync.Mutex
+	mode RepoMode
+}
+
+var readOnly bool
+
+var errAppendOnly = errors.New("Refused by append-only repository.")
+var errReadOnly = errors.New("Refused by read-only repository.")
+
+// SetReadOnly sets whether repos are opened read-only whatever their mode.
+func SetReadOnly(b bool) {
+	readOnly = b
+}
+
+func withGuard(sm StorageMgr) *guardSMgr {
+	g := &guardSMgr{sm: sm}
+	if readOnly {
+		g.mode = RepoMode_READ_ONLY
+	}
+	return g
+}
+
+// setGuardMode makes the mode of the storage manager mode if it is
+// stricter.
+func setGuardMode(sm StorageMgr, mode RepoMode) {
+	if g, ok := sm.(*guardSMgr); ok {
+		g.mu.Lock()
+		if mode > g.mode {
+			g.mode = mode
+		}
+		g.mu.Unlock()
+	}
+}
+
+// guardMode returns the mode kept by the storage manager.
+func guardMode(sm StorageMgr) RepoMode {
+	if g, ok := sm.(*guardSMgr); ok {
+		g.mu.Lock()
+		defer g.mu.Unlock()
+		return g.mode
+	}
+	return RepoMode_READ_WRITE
+}
+
+// unguarded returns the storage manager without the guard.
+func unguarded(sm StorageMgr) StorageMgr {
+	if g, ok := sm.(*guardSMgr); ok {
+		return g.sm
+	}
+	return sm
+}
+
+func (g *guardSMgr) JoinPath(d, f string) string {
+	return g.sm.JoinPath(d, f)
+}
+
+func (g *guardSMgr) IsDirFast() bool {
+	return g.sm.IsDirFast()
+}
+
+func (g *guardSMgr) LsDir(p string) ([]string, error) {
+	return g.sm.LsDir(p)
+}
+
+func (g *guardSMgr) LsDir2(p string, f StorageMgrLsDir2Func) error {
+	return g.sm.LsDir2(p, f)
+}
+
+func (g *guardSMgr) FileExists(p string) (bool, error) {
+	return g.sm.FileExists(p)
+}
+
+func (g *guardSMgr) MkdirAll(p string) error {
+	if guardMode(g) == RepoMode_READ_ONLY {
+		return errReadOnly
+	}
+	return g.sm.MkdirAll(p)
+}
+
+func (g *guardSMgr) ReadFile(p string, out, errOut *bytes.Buffer) ([]byte, error) {
+	return g.sm.ReadFile(p, out, errOut)
+}
+
+func (g *guardSMgr) ReadFileRange(p string, offset int64, length int, out, errOut *bytes.Buffer) ([]byte, error) {
+	return g.sm.ReadFileRange(p, offset, length, out, errOut)
+}
+
+func (g *guardSMgr) WriteFile(p string, d []byte) error {
+	switch guardMode(g) {
+	case RepoMode_READ_ONLY:
+		return errReadOnly
+	case RepoMode_APPEND_ONLY:
+		if exists, err := g.sm.FileExists(p); err != nil {
+			return err
+		} else if exists {
+			return errAppendOnly
+		}
+	}
+	return g.sm.WriteFile(p, d)
+}
+
+func (g *guardSMgr) DeleteFile(p string) error {
+	switch guardMode(g) {
+	case RepoMode_READ_ONLY:
+		return errReadOnly
+	case RepoMode_APPEND_ONLY:
+		return errAppendOnly
+	}
+	return g.sm.DeleteFile(p)
+}
+
+func (g *guardSMgr) WriteLockFile(p string, d []byte) error {
+	return g.sm.WriteLockFile(p, d)
+}
+
+func (g *guardSMgr) RemoveLockFile(p string) error {
+	return g.sm.RemoveLockFile(p)
+}
@@ -0,0 +1,117 @@
+package vecbackup
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+func TestGuardSMgr(t *testing.T) {
+	dir, err := ioutil.TempDir("", "storage_guard_test-*")
+	if err != nil {
+		t.Fatal("Cannot get tempdir", err)
+	}
+	defer removeAll(t, dir)
+	sm := withGuard(TheLocalSMgr)
+	f := filepath.Join(dir, "f")
+	if err := sm.WriteFile(f, []byte("old")); err != nil {
+		t.Fatal("WriteFile failed:", err)
+	}
+	setGuardMode(sm, RepoMode_APPEND_ONLY)
+	if err := sm.WriteFile(f, []byte("new")); err != errAppendOnly {
+		t.Fatalf("Overwrite should be refused: %v", err)
+	}
+	if err := sm.DeleteFile(f); err != errAppendOnly {
+		t.Fatalf("DeleteFile should be refused: %v", err)
+	}
+	if err := sm.WriteFile(filepath.Join(dir, "g"), []byte("new")); err != nil {
+		t.Fatal("New file should be written:", err)
+	}
+	setGuardMode(sm, RepoMode_READ_WRITE)
+	if guardMode(sm) != RepoMode_APPEND_ONLY {
+		t.Fatal("Mode should not become less strict")
+	}
+	setGuardMode(sm, RepoMode_READ_ONLY)
+	if err := sm.WriteFile(filepath.Join(dir, "h"), []byte("new")); err != errReadOnly {
+		t.Fatalf("WriteFile should be refused: %v", err)
+	}
+	if err := sm.MkdirAll(filepath.Join(dir, "d")); err != errReadOnly {
+		t.Fatalf("MkdirAll should be refused: %v", err)
+	}
+	lock := filepath.Join(dir, LOCK_FILENAME)
+	if err := sm.WriteLockFile(lock, nil); err != nil {
+		t.Fatal("WriteLockFile failed:", err)
+	}
+	if err := sm.RemoveLockFile(lock); err != nil {
+		t.Fatal("RemoveLockFile failed:", err)
+	}
+	var buf bytes.Buffer
+	if b, err := sm.ReadFile(f, &buf, nil); err != nil || string(b) != "old" {
+		t.Fatalf("File should not change: %s %v", b, err)
+	}
+	if err := unguarded(sm).DeleteFile(f); err != nil {
+		t.Fatal("Unguarded DeleteFile failed:", err)
+	}
+	SetReadOnly(true)
+	defer SetReadOnly(false)
+	if guardMode(withGuard(TheLocalSMgr)) != RepoMode_READ_ONLY {
+		t.Fatal("Read-only flag should make the mode read-only")
+	}
+}
+
+func TestRepoMode(t *testing.T) {
+	for _, packSize := range []int{0, 20000} {
+		doTestSeq(t, fmt.Sprintf("repo mode packs=%d", packSize), func(e *TestEnv) {
+			e.setPW([]byte("sdfsdfwerfdsfsdfsd"))
+			opt.ChunkSize = 5000
+			opt.PackSize = packSize
+			e.init()
+			e.addFile("a", 23456, 1)
+			e.backup()
+			pwSrc := PwFile(opt.PwFile)
+			e.failIfError("SetMode", SetMode(pwSrc, opt.Repo, RepoMode_APPEND_ONLY))
+			e.addFile("b/c", 7890, 2)
+			e.rm("a")
+			e.backup()
+			e.restore()
+			e.checkSame()
+			versions := e.versions()
+			if len(versions) != 2 {
+				e.t.Fatalf("Should have 2 versions: %v", versions)
+			}
+			if err := DeleteVersion(pwSrc, opt.Repo, versions[0]); err == nil {
+				e.t.Error("Delete version should be refused by append-only repo")
+			}
+			e.setPW([]byte("wrong password"))
+			if err := SetMode(PwFile(opt.PwFile), opt.Repo, RepoMode_READ_WRITE); err == nil {
+				e.t.Error("Set mode with the wrong password should fail")
+			}
+			e.setPW([]byte("sdfsdfwerfdsfsdfsd"))
+			e.failIfError("SetMode", SetMode(pwSrc, opt.Repo, RepoMode_READ_ONLY))
+			stats := &BackupStats{}
+			if err := Backup(pwSrc, opt.Repo, "", "", false, false, false, false, "", nil, 1, []string{SRCDIR}, stats); err != errReadOnly {
+				e.t.Errorf("Backup should be refused by read-only repo: %v", err)
+			}
+			e.failIfError("SetMode", SetMode(pwSrc, opt.Repo, RepoMode_READ_WRITE))
+			SetReadOnly(true)
+			if err := DeleteVersion(pwSrc, opt.Repo, versions[0]); err == nil {
+				e.t.Error("Delete version should be refused with -read-only")
+			}
+			if err := SetMode(pwSrc, opt.Repo, RepoMode_APPEND_ONLY); err != errReadOnly {
+				e.t.Errorf("Set mode should be refused with -read-only")
+			}
+			SetReadOnly(false)
+			e.deleteVersion(versions[0])
+			e.purgeUnused()
+			if len(e.versions()) != 1 {
+				e.t.Error("Delete version should work after set-mode read-write")
+			}
+			r := e.verifyRepo()
+			if r.Errors != 0 || r.Missing != 0 || r.Unused != 0 {
+				e.t.Errorf("Should be 0, 0, 0: numErrors=%d numMissing=%d numUnused=%d", r.Errors, r.Missing, r.Unused)
+			}
+		})
+	}
+}
@@ -0,0 +1,230 @@
+package vecbackup
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+)
+
+// httpSMgr stores the repo on a vecbackup server started with the serve
+// command. The repo path is "http://host:port/path" or "https://...".
+// Each storage operation is one request:
+//
+//	GET    path            read, with a Range header for part of a file
+//	GET    path?op=ls      list the files in a dir as a JSON array
+//	GET    path?op=ls2     list the files in the subdirs of a dir
+//	HEAD   path            check if the file exists
+//	PUT    path            write, "If-None-Match: *" to create a lock file
+//	POST   path?op=mkdir   create the dir
+//	DELETE path            delete, ?op=unlock to remove a lock file
+//
+// Requests use basic authentication with the user and password given to
+// SetHttpConfig.
+
+type httpSMgr struct {
+	base   string // scheme://host:port
+	client *http.Client
+}
+
+var httpUser string
+var httpPassword string
+var httpClient = &http.Client{Transport: &http.Transport{Proxy: http.ProxyFromEnvironment, MaxIdleConnsPerHost: 100, IdleConnTimeout: 90 * time.Second}}
+var httpMgrs = make(map[string]*httpSMgr)
+var httpMgrsMu sync.Mutex
+
+// SetHttpConfig sets the user and password of the http backend and of the
+// serve command.
+func SetHttpConfig(user, password string) {
+	httpUser = user
+	httpPassword = password
+}
+
+// getHttpSMgr returns the storage manager for "http://host:port/path" and
+// the path.
+func getHttpSMgr(p string) (*httpSMgr, string) {
+	i := strings.Index(p, "://") + 3
+	j := strings.Index(p[i:], "/")
+	base, rest := p, "/"
+	if j >= 0 {
+		base, rest = p[:i+j], p[i+j:]
+	}
+	httpMgrsMu.Lock()
+	defer httpMgrsMu.Unlock()
+	sm := httpMgrs[base]
+	if sm == nil {
+		sm = &httpSMgr{base: base, client: httpClient}
+		httpMgrs[base] = sm
+	}
+	return sm, rest
+}
+
+func (sm *httpSMgr) do(method, p, op string, header http.Header, body []byte, ok ...int) (*http.Response, error) {
+	u := sm.base + (&url.URL{Path: path.Clean("/" + p)}).EscapedPath()
+	if op != "" {
+		u += "?op=" + op
+	}
+	req, err := http.NewRequest(method, u, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	req.SetBasicAuth(httpUser, httpPassword)
+	resp, err := sm.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	for _, s := range ok {
+		if resp.StatusCode == s {
+			return resp, nil
+		}
+	}
+	defer resp.Body.Close()
+	b, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+	msg := strings.TrimSpace(string(b))
+	switch resp.StatusCode {
+	case http.StatusNotFound:
+		return nil, os.ErrNotExist
+	case http.StatusPreconditionFailed:
+		return nil, os.ErrExist
+	case http.StatusRequestedRangeNotSatisfiable:
+		return nil, io.ErrUnexpectedEOF
+	case http.StatusUnauthorized:
+		return nil, fatalError{fmt.Errorf("Authentication failed for %s. Check VECBACKUP_HTTP_USER and VECBACKUP_HTTP_PASSWORD.", sm.base)}
+	}
+	if msg == "" {
+		msg = resp.Status
+	}
+	return nil, &httpStatusError{resp.StatusCode, fmt.Sprintf("%s %s failed: %s", method, p, msg)}
+}
+
+func (sm *httpSMgr) JoinPath(d, f string) string {
+	return path.Join(d, f)
+}
+
+func (sm *httpSMgr) IsDirFast() bool {
+	return true
+}
+
+func (sm *httpSMgr) list(p, op string, out interface{}) error {
+	resp, err := sm.do("GET", p, op, nil, nil, http.StatusOK)
+	if err != nil {
+		return err
+	}
+	defer drain(resp)
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+func (sm *httpSMgr) LsDir(p string) ([]string, error) {
+	var files []string
+	err := sm.list(p, "ls", &files)
+	return files, err
+}
+
+func (sm *httpSMgr) LsDir2(p string, f StorageMgrLsDir2Func) error {
+	var files [][2]string
+	if err := sm.list(p, "ls2", &files); err != nil {
+		return err
+	}
+	for _, x := range files {
+		f(x[0], x[1])
+	}
+	return nil
+}
+
+func (sm *httpSMgr) FileExists(p string) (bool, error) {
+	resp, err := sm.do("HEAD", p, "", nil, nil, http.StatusOK)
+	if os.IsNotExist(err) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	drain(resp)
+	return true, nil
+}
+
+func (sm *httpSMgr) MkdirAll(p string) error {
+	resp, err := sm.do("POST", p, "mkdir", nil, nil, http.StatusOK)
+	if err != nil {
+		return err
+	}
+	drain(resp)
+	return nil
+}
+
+func (sm *httpSMgr) ReadFile(p string, out, _ *bytes.Buffer) ([]byte, error) {
+	resp, err := sm.do("GET", p, "", nil, nil, http.StatusOK)
+	if err != nil {
+		return nil, err
+	}
+	defer drain(resp)
+	out.Reset()
+	if _, err = out.ReadFrom(resp.Body); err != nil {
+		return nil, err
+	}
+	return out.Bytes(), nil
+}
+
+func (sm *httpSMgr) ReadFileRange(p string, offset int64, length int, out, _ *bytes.Buffer) ([]byte, error) {
+	header := http.Header{"Range": {fmt.Sprintf("bytes=%d-%d", offset, offset+int64(length)-1)}}
+	resp, err := sm.do("GET", p, "", header, nil, http.StatusPartialContent)
+	if err != nil {
+		return nil, err
+	}
+	defer drain(resp)
+	out.Reset()
+	out.Grow(length)
+	if _, err = out.ReadFrom(resp.Body); err != nil {
+		return nil, err
+	}
+	if out.Len() != length {
+		return nil, io.ErrUnexpectedEOF
+	}
+	return out.Bytes(), nil
+}
+
+func (sm *httpSMgr) WriteFile(p string, d []byte) error {
+	resp, err := sm.do("PUT", p, "", nil, d, http.StatusOK)
+	if err != nil {
+		return err
+	}
+	drain(resp)
+	return nil
+}
+
+func (sm *httpSMgr) DeleteFile(p string) error {
+	resp, err := sm.do("DELETE", p, "", nil, nil, http.StatusOK)
+	if err != nil {
+		return err
+	}
+	drain(resp)
+	return nil
+}
+
+func (sm *httpSMgr) WriteLockFile(p string, d []byte) error {
+	resp, err := sm.do("PUT", p, "", http.Header{"If-None-Match": {"*"}}, d, http.StatusOK)
+	if err != nil {
+		return err
+	}
+	drain(resp)
+	return nil
+}
+
+func (sm *httpSMgr) RemoveLockFile(p string) error {
+	resp, err := sm.do("DELETE", p, "unlock", nil, nil, http.StatusOK)
+	if err != nil {
+		return err
+	}
+	drain(resp)
+	return nil
+}
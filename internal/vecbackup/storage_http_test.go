@@ -0,0 +1,150 @@
+package vecbackup
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// startRepoServer serves dir like the serve command and sets the user
+// and password of the clients. It returns the server and a func that
+// stops it.
+func startRepoServer(dir string, appendOnly bool) (*httptest.Server, func()) {
+	saveUser, savePassword := httpUser, httpPassword
+	SetHttpConfig("backup", "secret")
+	srv := httptest.NewServer(&repoServer{sm: TheLocalSMgr, root: dir, user: httpUser, password: httpPassword, appendOnly: appendOnly})
+	return srv, func() {
+		srv.Close()
+		SetHttpConfig(saveUser, savePassword)
+	}
+}
+
+func TestHttpStorageMgr(t *testing.T) {
+	dir, err := ioutil.TempDir("", "storage_http_test-*")
+	if err != nil {
+		t.Fatal("Cannot get tempdir", err)
+	}
+	defer removeAll(t, dir)
+	srv, stop := startRepoServer(dir, false)
+	defer stop()
+	sm, p := getHttpSMgr(srv.URL + "/some dir+x")
+	if p != "/some dir+x" {
+		t.Fatalf("Wrong path %s", p)
+	}
+	testStorageMgr(t, sm, p)
+	if _, err := os.Stat(filepath.Join(dir, "some dir+x", "top0")); err != nil {
+		t.Fatalf("File should be in the served dir: %s", err)
+	}
+	if sm2, p := getHttpSMgr(srv.URL); sm2 != sm || p != "/" {
+		t.Fatalf("Same server should have the same storage manager: %s", p)
+	}
+	SetHttpConfig("backup", "wrong")
+	if _, err := sm.LsDir(p); err == nil || !permanentError(err) {
+		t.Fatalf("Wrong password should fail: %v", err)
+	}
+	s := &repoServer{sm: TheLocalSMgr, root: dir}
+	if p := s.path("/../../etc/passwd"); p != filepath.Join(dir, "etc", "passwd") {
+		t.Fatalf("Path should stay in the repo: %s", p)
+	}
+}
+
+func TestHttpAppendOnly(t *testing.T) {
+	dir, err := ioutil.TempDir("", "storage_http_test-*")
+	if err != nil {
+		t.Fatal("Cannot get tempdir", err)
+	}
+	defer removeAll(t, dir)
+	srv, stop := startRepoServer(dir, true)
+	defer stop()
+	sm, p := getHttpSMgr(srv.URL)
+	f := sm.JoinPath(p, "f")
+	if err := sm.WriteFile(f, []byte("old")); err != nil {
+		t.Fatal("WriteFile failed:", err)
+	}
+	if err := sm.WriteFile(f, []byte("old")); err != nil {
+		t.Fatal("Writing the same content again should succeed:", err)
+	}
+	if err := sm.WriteFile(f, []byte("new")); err == nil || !permanentError(err) {
+		t.Fatalf("Overwrite should be refused: %v", err)
+	}
+	if err := sm.DeleteFile(f); err == nil {
+		t.Fatal("DeleteFile should be refused")
+	}
+	if err := sm.RemoveLockFile(f); err == nil {
+		t.Fatal("RemoveLockFile of a file not named lock should be refused")
+	}
+	var buf bytes.Buffer
+	if b, err := sm.ReadFile(f, &buf, nil); err != nil || string(b) != "old" {
+		t.Fatalf("File should not change: %s %v", b, err)
+	}
+	lock := sm.JoinPath(p, LOCK_FILENAME)
+	if err := sm.WriteLockFile(lock, []byte("first")); err != nil {
+		t.Fatal("WriteLockFile failed:", err)
+	}
+	if err := sm.WriteLockFile(lock, nil); !os.IsExist(err) {
+		t.Fatalf("Second WriteLockFile should fail with exist: %v", err)
+	}
+	if err := sm.WriteFile(lock, []byte("heartbeat")); err != nil {
+		t.Fatal("Lock file should be overwritten:", err)
+	}
+	if err := sm.RemoveLockFile(lock); err != nil {
+		t.Fatal("RemoveLockFile failed:", err)
+	}
+	if err := sm.MkdirAll(sm.JoinPath(p, LOCKS_DIR)); err != nil {
+		t.Fatal("MkdirAll failed:", err)
+	}
+	lock = sm.JoinPath(sm.JoinPath(p, LOCKS_DIR), sharedLockPrefix+"1")
+	if err := sm.WriteLockFile(lock, []byte("first")); err != nil {
+		t.Fatal("WriteLockFile failed:", err)
+	}
+	if err := sm.WriteFile(lock, []byte("heartbeat")); err != nil {
+		t.Fatal("Lock file in locks dir should be overwritten:", err)
+	}
+	if err := sm.RemoveLockFile(lock); err != nil {
+		t.Fatal("RemoveLockFile failed:", err)
+	}
+	req, _ := http.NewRequest("GET", srv.URL+"/f", nil)
+	if resp, err := http.DefaultClient.Do(req); err != nil || resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("Request without password should be unauthorized: %v %v", resp, err)
+	}
+}
+
+func TestHttpBackup(t *testing.T) {
+	for _, packSize := range []int{0, 20000} {
+		doTestSeq(t, fmt.Sprintf("http backup packs=%d", packSize), func(e *TestEnv) {
+			srv, stop := startRepoServer(REPO, true)
+			defer stop()
+			e.setPW([]byte("sdfsdfwerfdsfsdfsd"))
+			opt.Repo = srv.URL + "/"
+			opt.ChunkSize = 5000
+			opt.PackSize = packSize
+			e.init()
+			e.addFile("a", 23456, 1)
+			e.addFile("b/c", 7890, 2)
+			e.backup()
+			e.addFile("d", 12345, 3)
+			e.rm("a")
+			e.backup()
+			r := e.verifyRepo()
+			if r.Errors != 0 || r.Missing != 0 || r.Unused != 0 {
+				e.t.Errorf("Should be 0, 0, 0: numErrors=%d numMissing=%d numUnused=%d", r.Errors, r.Missing, r.Unused)
+			}
+			e.restore()
+			e.checkSame()
+			versions := e.versions()
+			if err := DeleteVersion(PwFile(opt.PwFile), opt.Repo, versions[0]); err == nil {
+				e.t.Error("Delete version should be refused by append-only server")
+			}
+			opt.Repo = REPO
+			e.deleteVersion(versions[0])
+			if len(e.versions()) != 1 {
+				e.t.Error("Delete version on the server should work")
+			}
+		})
+	}
+}
@@ -4,14 +4,14 @@ import (
 	"bytes"
 	"encoding/json"
 	"fmt"
+	"io"
 	"io/ioutil"
-	"math/rand"
 	"os"
 	"os/exec"
 	"path"
 	"path/filepath"
+	"strconv"
 	"strings"
-	"time"
 )
 
 var rcloneBinary string = "rclone"
@@ -30,9 +30,12 @@ type StorageMgr interface {
 	FileExists(f string) (bool, error)
 	MkdirAll(p string) error
 	ReadFile(p string, out, errOut *bytes.Buffer) ([]byte, error)
+	ReadFileRange(p string, offset int64, length int, out, errOut *bytes.Buffer) ([]byte, error)
 	WriteFile(p string, d []byte) error
 	DeleteFile(p string) error
-	WriteLockFile(p string) error
+	// WriteLockFile creates the lock file with the content d. It fails
+	// with os.ErrExist if the lock file exists.
+	WriteLockFile(p string, d []byte) error
 	RemoveLockFile(p string) error
 }
 
@@ -42,10 +45,27 @@ type localSMgr struct{}
 var TheRcloneSMgr = rcloneSMgr{}
 var TheLocalSMgr = localSMgr{}
 
+// GetStorageMgr returns the storage manager of the repo path, which retries
+// failed operations, keeps to the limits and refuses the operations not
+// allowed by the mode, and the path used by the storage manager.
 func GetStorageMgr(p string) (StorageMgr, string) {
+	sm, p := getStorageMgr(p)
+	return withGuard(withRetry(withThrottle(sm))), p
+}
+
+func getStorageMgr(p string) (StorageMgr, string) {
 	if len(p) > 7 && p[:7] == "rclone:" {
 		return TheRcloneSMgr, p[7:]
 	}
+	if len(p) > 3 && p[:3] == "s3:" {
+		return TheS3SMgr, p[3:]
+	}
+	if len(p) > 5 && p[:5] == "sftp:" {
+		return getSftpSMgr(p[5:])
+	}
+	if strings.HasPrefix(p, "http://") || strings.HasPrefix(p, "https://") {
+		return getHttpSMgr(p)
+	}
 	return TheLocalSMgr, p
 }
 
@@ -74,6 +94,9 @@ func (sm localSMgr) IsDirFast() bool {
 }
 
 func (sm rcloneSMgr) LsDir(p string) ([]string, error) {
+	if rc := getRcloneRc(); rc != nil {
+		return rc.lsDir(p)
+	}
 	catCmd := exec.Command(rcloneBinary, "lsjson", "--no-modtime", "--no-mimetype", "--fast-list", "--max-depth", "1", "--files-only", p)
 	catOut, err := catCmd.Output()
 	if err != nil {
@@ -114,6 +137,9 @@ type rcloneLsRecord struct {
 }
 
 func (sm rcloneSMgr) LsDir2(p string, f StorageMgrLsDir2Func) error {
+	if rc := getRcloneRc(); rc != nil {
+		return rc.lsDir2(p, f)
+	}
 	catCmd := exec.Command(rcloneBinary, "lsjson", "--no-modtime", "--no-mimetype", "--fast-list", "--max-depth", "2", "--files-only", p)
 	catOut, err := catCmd.Output()
 	if err != nil {
@@ -157,6 +183,9 @@ func (sm rcloneSMgr) FileExists(f string) (bool, error) {
 	if filename == "/" || filename == "." {
 		return false, fmt.Errorf("Invalid path: %s", f)
 	}
+	if rc := getRcloneRc(); rc != nil {
+		return rc.fileExists(f)
+	}
 	catCmd := exec.Command(rcloneBinary, "lsjson", "--no-modtime", "--no-mimetype", "--fast-list", "--max-depth", "1", "--files-only", f)
 	catOut, err := catCmd.Output()
 	if err != nil {
@@ -193,6 +222,9 @@ func (sm localSMgr) MkdirAll(p string) error {
 }
 
 func (sm rcloneSMgr) ReadFile(p string, out, errOut *bytes.Buffer) ([]byte, error) {
+	if rc := getRcloneRc(); rc != nil {
+		return rc.readFile(p, out)
+	}
 	catCmd := exec.Command(rcloneBinary, "cat", p)
 	err := runCmd(catCmd, out, errOut)
 	if err != nil {
@@ -215,7 +247,45 @@ func (sm localSMgr) ReadFile(p string, out, _ *bytes.Buffer) ([]byte, error) {
 	return out.Bytes(), err
 }
 
+func (sm rcloneSMgr) ReadFileRange(p string, offset int64, length int, out, errOut *bytes.Buffer) ([]byte, error) {
+	if rc := getRcloneRc(); rc != nil {
+		return rc.readFileRange(p, offset, length, out)
+	}
+	catCmd := exec.Command(rcloneBinary, "cat", "--offset", strconv.FormatInt(offset, 10), "--count", strconv.Itoa(length), p)
+	err := runCmd(catCmd, out, errOut)
+	if err != nil {
+		return nil, err
+	}
+	if len(out.Bytes()) == 0 {
+		return nil, os.ErrNotExist
+	}
+	if len(out.Bytes()) != length {
+		return nil, io.ErrUnexpectedEOF
+	}
+	return out.Bytes(), nil
+}
+
+func (sm localSMgr) ReadFileRange(p string, offset int64, length int, out, _ *bytes.Buffer) ([]byte, error) {
+	f, err := os.Open(p)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	out.Reset()
+	out.Grow(length)
+	b := out.Bytes()[:length]
+	if _, err = f.ReadAt(b, offset); err == io.EOF {
+		return nil, io.ErrUnexpectedEOF
+	} else if err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
 func (sm rcloneSMgr) WriteFile(p string, d []byte) error {
+	if rc := getRcloneRc(); rc != nil {
+		return rc.writeFile(p, d)
+	}
 	cmd := exec.Command(rcloneBinary, "rcat", p)
 	cmdIn, _ := cmd.StdinPipe()
 	if err := cmd.Start(); err != nil {
@@ -259,6 +329,9 @@ func (sm localSMgr) WriteFile(p string, d []byte) error {
 }
 
 func (sm rcloneSMgr) DeleteFile(p string) error {
+	if rc := getRcloneRc(); rc != nil {
+		return rc.deleteFile(p)
+	}
 	cmd := exec.Command(rcloneBinary, "deletefile", p)
 	return cmd.Run()
 }
@@ -267,7 +340,10 @@ func (sm localSMgr) DeleteFile(p string) error {
 	return os.Remove(p)
 }
 
-func (sm rcloneSMgr) WriteLockFile(p string) error {
+// WriteLockFile writes the lock file and reads it back. The content of
+// each lock is different, so if another client wrote the lock file at the
+// same time, only one of them reads back its own content.
+func (sm rcloneSMgr) WriteLockFile(p string, d []byte) error {
 	exists, err := TheRcloneSMgr.FileExists(p)
 	if err != nil {
 		return err
@@ -275,8 +351,7 @@ func (sm rcloneSMgr) WriteLockFile(p string) error {
 	if exists {
 		return os.ErrExist
 	}
-	d := []byte(fmt.Sprintf("%s\n%d\n", time.Now().UTC().Format(time.RFC3339Nano), rand.Int63()))
-	err = TheRcloneSMgr.WriteFile(p, []byte(d))
+	err = TheRcloneSMgr.WriteFile(p, d)
 	if err != nil {
 		return err
 	}
@@ -291,7 +366,7 @@ func (sm rcloneSMgr) WriteLockFile(p string) error {
 	return nil
 }
 
-func (sm localSMgr) WriteLockFile(p string) error {
+func (sm localSMgr) WriteLockFile(p string, d []byte) error {
 	exists, err := TheLocalSMgr.FileExists(p)
 	if err != nil {
 		return err
@@ -303,8 +378,11 @@ func (sm localSMgr) WriteLockFile(p string) error {
 	if err != nil {
 		return err
 	}
-	lockFile.Close()
-	return nil
+	_, err = lockFile.Write(d)
+	if err2 := lockFile.Close(); err == nil {
+		err = err2
+	}
+	return err
 }
 
 func (sm rcloneSMgr) RemoveLockFile(p string) error {
@@ -0,0 +1,342 @@
+package vecbackup
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime/multipart"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Running an rclone command for every file costs tens of milliseconds
+// per chunk. Instead, one "rclone rcd" process is started on first use
+// and the rclone storage manager sends operations/* calls to its remote
+// control API over HTTP on localhost. The user and password of the API
+// are random and passed in the environment. Files are read with
+// --rc-serve, which serves "/[remote:path]/file" and supports ranges.
+//
+// If the daemon cannot be started, for example because rclone is too
+// old, the rclone storage manager runs one rclone command per operation
+// as before.
+
+const RCLONE_RC_START_TIMEOUT = 10 * time.Second
+
+type rcloneRc struct {
+	url    string
+	user   string
+	pass   string
+	client *http.Client
+	cmd    *exec.Cmd
+}
+
+var rcloneDaemon = true
+var rcloneRcTried bool
+var theRcloneRc *rcloneRc
+var rcloneRcMu sync.Mutex
+
+// SetRcloneDaemon sets whether rclone repos use an "rclone rcd" process.
+func SetRcloneDaemon(b bool) {
+	rcloneDaemon = b
+}
+
+// StopRcloneDaemon stops the "rclone rcd" process if it was started.
+func StopRcloneDaemon() {
+	rcloneRcMu.Lock()
+	defer rcloneRcMu.Unlock()
+	if theRcloneRc != nil && theRcloneRc.cmd != nil {
+		theRcloneRc.cmd.Process.Kill()
+		theRcloneRc.cmd.Wait()
+	}
+	theRcloneRc = nil
+	rcloneRcTried = false
+}
+
+// getRcloneRc returns the rc client, starting the daemon on first use,
+// or nil if the rclone commands should be used.
+func getRcloneRc() *rcloneRc {
+	rcloneRcMu.Lock()
+	defer rcloneRcMu.Unlock()
+	if !rcloneDaemon {
+		return nil
+	}
+	if !rcloneRcTried {
+		rcloneRcTried = true
+		rc, err := startRcloneRc()
+		if err != nil {
+			debugP("Cannot start rclone rcd, running rclone commands instead: %s\n", err)
+		} else {
+			theRcloneRc = rc
+		}
+	}
+	return theRcloneRc
+}
+
+func randomHex(n int) string {
+	b := make([]byte, n)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+func startRcloneRc() (*rcloneRc, error) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	addr := l.Addr().String()
+	l.Close()
+	rc := &rcloneRc{url: "http://" + addr, user: randomHex(16), pass: randomHex(16), client: &http.Client{Transport: &http.Transport{MaxIdleConnsPerHost: 100}}}
+	rc.cmd = exec.Command(rcloneBinary, "rcd", "--rc-addr", addr, "--rc-serve")
+	rc.cmd.Env = append(os.Environ(), "RCLONE_RC_USER="+rc.user, "RCLONE_RC_PASS="+rc.pass)
+	if err := rc.cmd.Start(); err != nil {
+		return nil, err
+	}
+	exited := make(chan error, 1)
+	go func() {
+		exited <- rc.cmd.Wait()
+	}()
+	deadline := time.Now().Add(RCLONE_RC_START_TIMEOUT)
+	for {
+		err := rc.call("rc/noop", struct{}{}, nil)
+		if err == nil {
+			return rc, nil
+		}
+		select {
+		case err := <-exited:
+			return nil, fmt.Errorf("rclone rcd exited: %v", err)
+		case <-time.After(50 * time.Millisecond):
+		}
+		if time.Now().After(deadline) {
+			rc.cmd.Process.Kill()
+			return nil, fmt.Errorf("rclone rcd did not start: %s", err)
+		}
+	}
+}
+
+type rcloneRcError struct {
+	Error  string `json:"error"`
+	Status int    `json:"status"`
+}
+
+// rcError returns the error for a failed response.
+func rcError(method string, resp *http.Response) error {
+	b, _ := ioutil.ReadAll(resp.Body)
+	var e rcloneRcError
+	if json.Unmarshal(b, &e) != nil || e.Status == 0 {
+		e.Status = resp.StatusCode
+		e.Error = resp.Status
+	}
+	if e.Status == http.StatusNotFound {
+		return os.ErrNotExist
+	}
+	return &httpStatusError{e.Status, fmt.Sprintf("rclone %s failed: %s", method, e.Error)}
+}
+
+func (rc *rcloneRc) do(req *http.Request) (*http.Response, error) {
+	req.SetBasicAuth(rc.user, rc.pass)
+	return rc.client.Do(req)
+}
+
+// call calls the rc method with the JSON input and decodes the result
+// into out if it is not nil.
+func (rc *rcloneRc) call(method string, in, out interface{}) error {
+	b, err := json.Marshal(in)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("POST", rc.url+"/"+method, bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := rc.do(req)
+	if err != nil {
+		return err
+	}
+	defer drain(resp)
+	if resp.StatusCode != http.StatusOK {
+		return rcError(method, resp)
+	}
+	if out == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// rcSplit splits an rclone path into the parent and the file name.
+func rcSplit(p string) (string, string) {
+	i := strings.LastIndex(p, "/")
+	if i < 0 {
+		i = strings.LastIndex(p, ":")
+		return p[:i+1], p[i+1:]
+	} else if i == 0 {
+		return "/", p[1:]
+	}
+	return p[:i], p[i+1:]
+}
+
+type rcloneRcListOpt struct {
+	Recurse    bool `json:"recurse"`
+	FilesOnly  bool `json:"filesOnly"`
+	NoModTime  bool `json:"noModTime"`
+	NoMimeType bool `json:"noMimeType"`
+}
+
+type rcloneRcListIn struct {
+	Fs     string          `json:"fs"`
+	Remote string          `json:"remote"`
+	Opt    rcloneRcListOpt `json:"opt"`
+}
+
+type rcloneRcFileIn struct {
+	Fs     string `json:"fs"`
+	Remote string `json:"remote"`
+}
+
+func (rc *rcloneRc) list(p string, recurse bool) ([]rcloneLsRecord, error) {
+	var out struct {
+		List []rcloneLsRecord `json:"list"`
+	}
+	in := rcloneRcListIn{Fs: p, Opt: rcloneRcListOpt{Recurse: recurse, FilesOnly: true, NoModTime: true, NoMimeType: true}}
+	if err := rc.call("operations/list", in, &out); err != nil {
+		return nil, err
+	}
+	return out.List, nil
+}
+
+func (rc *rcloneRc) lsDir(p string) ([]string, error) {
+	recs, err := rc.list(p, false)
+	if err != nil {
+		return nil, err
+	}
+	var files []string
+	for _, r := range recs {
+		files = append(files, r.Path)
+	}
+	return files, nil
+}
+
+func (rc *rcloneRc) lsDir2(p string, f StorageMgrLsDir2Func) error {
+	recs, err := rc.list(p, true)
+	if err != nil {
+		return err
+	}
+	for _, r := range recs {
+		ss := strings.Split(r.Path, "/")
+		if len(ss) == 2 {
+			f(ss[0], ss[1])
+		}
+	}
+	return nil
+}
+
+func (rc *rcloneRc) fileExists(p string) (bool, error) {
+	fs, remote := rcSplit(p)
+	var out struct {
+		Item *rcloneLsRecord `json:"item"`
+	}
+	if err := rc.call("operations/stat", rcloneRcFileIn{Fs: fs, Remote: remote}, &out); err != nil {
+		return false, err
+	}
+	return out.Item != nil, nil
+}
+
+// get reads the file with --rc-serve.
+func (rc *rcloneRc) get(p string, header http.Header) (*http.Response, error) {
+	fs, remote := rcSplit(p)
+	u := url.URL{Path: "/[" + fs + "]/" + remote}
+	req, err := http.NewRequest("GET", rc.url+u.EscapedPath(), nil)
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	return rc.do(req)
+}
+
+func (rc *rcloneRc) readFile(p string, out *bytes.Buffer) ([]byte, error) {
+	resp, err := rc.get(p, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer drain(resp)
+	if resp.StatusCode != http.StatusOK {
+		return nil, rcError("cat", resp)
+	}
+	out.Reset()
+	if _, err = out.ReadFrom(resp.Body); err != nil {
+		return nil, err
+	}
+	return out.Bytes(), nil
+}
+
+func (rc *rcloneRc) readFileRange(p string, offset int64, length int, out *bytes.Buffer) ([]byte, error) {
+	resp, err := rc.get(p, http.Header{"Range": {fmt.Sprintf("bytes=%d-%d", offset, offset+int64(length)-1)}})
+	if err != nil {
+		return nil, err
+	}
+	defer drain(resp)
+	if resp.StatusCode == http.StatusRequestedRangeNotSatisfiable {
+		return nil, io.ErrUnexpectedEOF
+	} else if resp.StatusCode != http.StatusPartialContent {
+		return nil, rcError("cat", resp)
+	}
+	out.Reset()
+	out.Grow(length)
+	if _, err = out.ReadFrom(resp.Body); err != nil {
+		return nil, err
+	}
+	if out.Len() != length {
+		return nil, io.ErrUnexpectedEOF
+	}
+	return out.Bytes(), nil
+}
+
+func (rc *rcloneRc) writeFile(p string, d []byte) error {
+	fs, remote := rcSplit(p)
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	w, err := mw.CreateFormFile("file", remote)
+	if err != nil {
+		return err
+	}
+	w.Write(d)
+	if err = mw.Close(); err != nil {
+		return err
+	}
+	q := url.Values{"fs": {fs}, "remote": {""}}
+	req, err := http.NewRequest("POST", rc.url+"/operations/uploadfile?"+q.Encode(), &body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+	resp, err := rc.do(req)
+	if err != nil {
+		return err
+	}
+	defer drain(resp)
+	if resp.StatusCode != http.StatusOK {
+		return rcError("operations/uploadfile", resp)
+	}
+	return nil
+}
+
+func (rc *rcloneRc) deleteFile(p string) error {
+	fs, remote := rcSplit(p)
+	if remote == "" {
+		return errors.New("Invalid path: " + p)
+	}
+	return rc.call("operations/deletefile", rcloneRcFileIn{Fs: fs, Remote: remote}, nil)
+}
@@ -0,0 +1,195 @@
+package vecbackup
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeRcloneRc serves the rclone rc calls used by rcloneRc from a local
+// dir, where the fs is a local path as with rclone.
+type fakeRcloneRc struct {
+	calls int
+}
+
+func rcReply(w http.ResponseWriter, err error, out interface{}) {
+	if os.IsNotExist(err) {
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(rcloneRcError{Error: "object not found", Status: http.StatusNotFound})
+	} else if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(rcloneRcError{Error: err.Error(), Status: http.StatusInternalServerError})
+	} else {
+		json.NewEncoder(w).Encode(out)
+	}
+}
+
+func (f *fakeRcloneRc) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if user, pass, ok := r.BasicAuth(); !ok || user != "user" || pass != "pass" {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	f.calls++
+	if r.Method == "GET" {
+		i := strings.Index(r.URL.Path, "]/")
+		if !strings.HasPrefix(r.URL.Path, "/[") || i < 0 {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		file, err := os.Open(filepath.Join(r.URL.Path[2:i], r.URL.Path[i+2:]))
+		if err != nil {
+			rcReply(w, err, nil)
+			return
+		}
+		defer file.Close()
+		http.ServeContent(w, r, "", time.Time{}, file)
+		return
+	}
+	switch r.URL.Path {
+	case "/rc/noop":
+		rcReply(w, nil, struct{}{})
+	case "/operations/list":
+		var in rcloneRcListIn
+		json.NewDecoder(r.Body).Decode(&in)
+		dir := filepath.Join(in.Fs, in.Remote)
+		if _, err := os.Stat(dir); err != nil {
+			rcReply(w, err, nil)
+			return
+		}
+		var out struct {
+			List []rcloneLsRecord `json:"list"`
+		}
+		err := filepath.Walk(dir, func(p string, fi os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			if fi.IsDir() && p != dir && !in.Opt.Recurse {
+				return filepath.SkipDir
+			}
+			if fi.Mode().IsRegular() {
+				rel, _ := filepath.Rel(dir, p)
+				out.List = append(out.List, rcloneLsRecord{Path: filepath.ToSlash(rel)})
+			}
+			return nil
+		})
+		rcReply(w, err, out)
+	case "/operations/stat":
+		var in rcloneRcFileIn
+		json.NewDecoder(r.Body).Decode(&in)
+		var out struct {
+			Item *rcloneLsRecord `json:"item"`
+		}
+		if _, err := os.Stat(filepath.Join(in.Fs, in.Remote)); err == nil {
+			out.Item = &rcloneLsRecord{Path: in.Remote}
+		}
+		rcReply(w, nil, out)
+	case "/operations/deletefile":
+		var in rcloneRcFileIn
+		json.NewDecoder(r.Body).Decode(&in)
+		rcReply(w, os.Remove(filepath.Join(in.Fs, in.Remote)), struct{}{})
+	case "/operations/uploadfile":
+		mr, err := r.MultipartReader()
+		if err != nil {
+			rcReply(w, err, nil)
+			return
+		}
+		dir := filepath.Join(r.URL.Query().Get("fs"), r.URL.Query().Get("remote"))
+		for {
+			part, err := mr.NextPart()
+			if err != nil {
+				break
+			}
+			d, _ := ioutil.ReadAll(part)
+			os.MkdirAll(dir, DEFAULT_DIR_PERM)
+			if err := ioutil.WriteFile(filepath.Join(dir, part.FileName()), d, DEFAULT_FILE_PERM); err != nil {
+				rcReply(w, err, nil)
+				return
+			}
+		}
+		rcReply(w, nil, struct{}{})
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+// useFakeRcloneRc makes the rclone storage manager use a fake rc server.
+func useFakeRcloneRc(t *testing.T) (*fakeRcloneRc, func()) {
+	fake := &fakeRcloneRc{}
+	srv := httptest.NewServer(fake)
+	StopRcloneDaemon()
+	rcloneRcMu.Lock()
+	theRcloneRc = &rcloneRc{url: srv.URL, user: "user", pass: "pass", client: srv.Client()}
+	rcloneRcTried = true
+	rcloneRcMu.Unlock()
+	return fake, func() {
+		StopRcloneDaemon()
+		srv.Close()
+	}
+}
+
+func TestRcloneRcStorageMgr(t *testing.T) {
+	dir, err := ioutil.TempDir("", "storage_mgr_test-*")
+	if err != nil {
+		t.Fatal("Cannot get tempdir", err)
+	}
+	defer removeAll(t, dir)
+	fake, stop := useFakeRcloneRc(t)
+	defer stop()
+	sm, p := GetStorageMgr("rclone:" + dir)
+	testStorageMgr(t, sm, p)
+	if fake.calls == 0 {
+		t.Fatal("rc server not used")
+	}
+}
+
+func TestRcSplit(t *testing.T) {
+	for _, x := range [][3]string{
+		{"remote:dir/file", "remote:dir", "file"},
+		{"remote:file", "remote:", "file"},
+		{"remote:a/b/c", "remote:a/b", "c"},
+		{"/tmp/file", "/tmp", "file"},
+		{"/file", "/", "file"},
+		{"file", "", "file"},
+	} {
+		if fs, remote := rcSplit(x[0]); fs != x[1] || remote != x[2] {
+			t.Errorf("rcSplit(%q) = %q %q", x[0], fs, remote)
+		}
+	}
+}
+
+func TestRcloneRcFallback(t *testing.T) {
+	defer SetRcloneBinary(rcloneBinary)
+	defer StopRcloneDaemon()
+	StopRcloneDaemon()
+	SetRcloneBinary("/nonexistent/rclone")
+	if rc := getRcloneRc(); rc != nil {
+		t.Fatal("Daemon should not start")
+	}
+	StopRcloneDaemon()
+	SetRcloneDaemon(false)
+	defer SetRcloneDaemon(true)
+	fake, stop := useFakeRcloneRc(t)
+	defer stop()
+	if _, err := TheRcloneSMgr.LsDir("/tmp"); err == nil || fake.calls != 0 {
+		t.Fatalf("Disabled daemon should run rclone: %v %d", err, fake.calls)
+	}
+}
+
+func TestRcloneRcBackup(t *testing.T) {
+	dir, err := ioutil.TempDir("", "storage_mgr_test-*")
+	if err != nil {
+		t.Fatal("Cannot get tempdir", err)
+	}
+	defer removeAll(t, dir)
+	_, stop := useFakeRcloneRc(t)
+	defer stop()
+	doTestSeq(t, "rclone rc backup", func(e *TestEnv) {
+		testRepoBackup(e, "rclone:"+filepath.Join(dir, "repo"))
+	})
+}
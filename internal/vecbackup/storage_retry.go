@@ -0,0 +1,247 @@
+package vecbackup
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"github.com/pkg/sftp"
+	"io"
+	"math/rand"
+	"net/http"
+	"os"
+	"os/exec"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// retrySMgr wraps the storage manager of every repo and retries failed
+// operations with exponential backoff, so that a network blip or a rate
+// limit does not fail a whole file. Errors that cannot go away by trying
+// again, like a missing file or a denied permission, are returned at once.
+//
+// WriteLockFile is not retried: if the lock file was created by an attempt
+// that reported an error, a retry would find the lock taken.
+
+const RETRY_MAX_BACKOFF = time.Minute
+
+var retries = 4
+var retryBackoff = time.Second
+var retryJitter = 0.2
+var retrySleep = time.Sleep
+
+// SetRetry sets the number of retries of a failed storage operation, the
+// delay before the first retry, which doubles for each further retry, and
+// the random part of the delay as a fraction of it.
+func SetRetry(n int, backoff time.Duration, jitter float64) {
+	retries = n
+	retryBackoff = backoff
+	retryJitter = jitter
+}
+
+// RetryCounts has the number of retries of each storage operation.
+type RetryCounts map[string]int
+
+func (rc RetryCounts) String() string {
+	var ops []string
+	for op := range rc {
+		ops = append(ops, op)
+	}
+	sort.Strings(ops)
+	var s []string
+	for _, op := range ops {
+		s = append(s, fmt.Sprintf("%s %d", op, rc[op]))
+	}
+	return strings.Join(s, ", ")
+}
+
+// httpStatusError is returned by HTTP based storage managers when the
+// server returns an error status.
+type httpStatusError struct {
+	status int
+	msg    string
+}
+
+func (e *httpStatusError) Error() string {
+	return e.msg
+}
+
+// fatalError is an error that retrying cannot fix, like a wrong setting.
+type fatalError struct {
+	error
+}
+
+// permanentError returns whether retrying an operation that failed with
+// the error cannot help.
+func permanentError(err error) bool {
+	if os.IsNotExist(err) || os.IsExist(err) || os.IsPermission(err) || err == io.ErrUnexpectedEOF || errors.Is(err, exec.ErrNotFound) {
+		return true
+	}
+	var fe fatalError
+	if errors.As(err, &fe) {
+		return true
+	}
+	var ee *exec.ExitError
+	if errors.As(err, &ee) {
+		// rclone exit codes: directory not found, file not found and
+		// fatal error.
+		c := ee.ExitCode()
+		return c == 3 || c == 4 || c == 7
+	}
+	var he *httpStatusError
+	if errors.As(err, &he) {
+		return he.status >= 400 && he.status < 500 && he.status != http.StatusRequestTimeout && he.status != http.StatusTooManyRequests
+	}
+	var se *sftp.StatusError
+	if errors.As(err, &se) {
+		// SSH_FX_NO_CONNECTION and SSH_FX_CONNECTION_LOST
+		return se.Code != 6 && se.Code != 7
+	}
+	return false
+}
+
+type retrySMgr struct {
+	sm     StorageMgr
+	mu     sync.Mutex
+	counts RetryCounts
+}
+
+func withRetry(sm StorageMgr) *retrySMgr {
+	return &retrySMgr{sm: sm, counts: make(RetryCounts)}
+}
+
+// retryCounts returns the retries done by the storage manager so far.
+func retryCounts(sm StorageMgr) RetryCounts {
+	rc := make(RetryCounts)
+	if r, ok := unguarded(sm).(*retrySMgr); ok {
+		r.mu.Lock()
+		for op, n := range r.counts {
+			rc[op] = n
+		}
+		r.mu.Unlock()
+	}
+	return rc
+}
+
+// retryDelay returns the delay before the given retry, starting from 1.
+func retryDelay(retry int) time.Duration {
+	d := retryBackoff
+	for i := 1; i < retry && d < RETRY_MAX_BACKOFF; i++ {
+		d *= 2
+	}
+	if d > RETRY_MAX_BACKOFF {
+		d = RETRY_MAX_BACKOFF
+	}
+	return d + time.Duration(float64(d)*retryJitter*(2*rand.Float64()-1))
+}
+
+// do runs f until it succeeds, fails with a permanent error or runs out
+// of retries.
+func (r *retrySMgr) do(op, p string, f func() error) error {
+	for i := 1; ; i++ {
+		err := f()
+		if err == nil || i > retries || permanentError(err) {
+			return err
+		}
+		d := retryDelay(i)
+		debugP("%s %s failed, retrying in %s: %s\n", op, p, d, err)
+		r.mu.Lock()
+		r.counts[op]++
+		r.mu.Unlock()
+		retrySleep(d)
+	}
+}
+
+func (r *retrySMgr) JoinPath(d, f string) string {
+	return r.sm.JoinPath(d, f)
+}
+
+func (r *retrySMgr) IsDirFast() bool {
+	return r.sm.IsDirFast()
+}
+
+func (r *retrySMgr) LsDir(p string) ([]string, error) {
+	var files []string
+	err := r.do("LsDir", p, func() error {
+		var err error
+		files, err = r.sm.LsDir(p)
+		return err
+	})
+	return files, err
+}
+
+// LsDir2 may call f again for the same files if it is retried.
+func (r *retrySMgr) LsDir2(p string, f StorageMgrLsDir2Func) error {
+	return r.do("LsDir2", p, func() error {
+		return r.sm.LsDir2(p, f)
+	})
+}
+
+func (r *retrySMgr) FileExists(p string) (bool, error) {
+	var exists bool
+	err := r.do("FileExists", p, func() error {
+		var err error
+		exists, err = r.sm.FileExists(p)
+		return err
+	})
+	return exists, err
+}
+
+func (r *retrySMgr) MkdirAll(p string) error {
+	return r.do("MkdirAll", p, func() error {
+		return r.sm.MkdirAll(p)
+	})
+}
+
+func (r *retrySMgr) ReadFile(p string, out, errOut *bytes.Buffer) ([]byte, error) {
+	var b []byte
+	err := r.do("ReadFile", p, func() error {
+		var err error
+		b, err = r.sm.ReadFile(p, out, errOut)
+		return err
+	})
+	return b, err
+}
+
+func (r *retrySMgr) ReadFileRange(p string, offset int64, length int, out, errOut *bytes.Buffer) ([]byte, error) {
+	var b []byte
+	err := r.do("ReadFileRange", p, func() error {
+		var err error
+		b, err = r.sm.ReadFileRange(p, offset, length, out, errOut)
+		return err
+	})
+	return b, err
+}
+
+func (r *retrySMgr) WriteFile(p string, d []byte) error {
+	return r.do("WriteFile", p, func() error {
+		return r.sm.WriteFile(p, d)
+	})
+}
+
+// deleteRetried deletes with del and treats a missing file as deleted if
+// an earlier attempt failed, since that attempt may have deleted it.
+func (r *retrySMgr) deleteRetried(op, p string, del func(string) error) error {
+	failed := false
+	return r.do(op, p, func() error {
+		err := del(p)
+		if failed && os.IsNotExist(err) {
+			return nil
+		}
+		failed = err != nil
+		return err
+	})
+}
+
+func (r *retrySMgr) DeleteFile(p string) error {
+	return r.deleteRetried("DeleteFile", p, r.sm.DeleteFile)
+}
+
+func (r *retrySMgr) WriteLockFile(p string, d []byte) error {
+	return r.sm.WriteLockFile(p, d)
+}
+
+func (r *retrySMgr) RemoveLockFile(p string) error {
+	return r.deleteRetried("RemoveLockFile", p, r.sm.RemoveLockFile)
+}
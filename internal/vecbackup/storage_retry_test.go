@@ -0,0 +1,199 @@
+package vecbackup
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// flakySMgr fails the next n operations with err. DeleteFile deletes the
+// file before it fails, like a request whose response was lost.
+type flakySMgr struct {
+	StorageMgr
+	err   error
+	n     int
+	calls int
+}
+
+func (f *flakySMgr) fail() error {
+	f.calls++
+	if f.n > 0 {
+		f.n--
+		return f.err
+	}
+	return nil
+}
+
+func (f *flakySMgr) ReadFile(p string, out, errOut *bytes.Buffer) ([]byte, error) {
+	if err := f.fail(); err != nil {
+		return nil, err
+	}
+	return f.StorageMgr.ReadFile(p, out, errOut)
+}
+
+func (f *flakySMgr) WriteFile(p string, d []byte) error {
+	if err := f.fail(); err != nil {
+		return err
+	}
+	return f.StorageMgr.WriteFile(p, d)
+}
+
+func (f *flakySMgr) DeleteFile(p string) error {
+	err := f.StorageMgr.DeleteFile(p)
+	if err2 := f.fail(); err2 != nil {
+		return err2
+	}
+	return err
+}
+
+func (f *flakySMgr) WriteLockFile(p string, d []byte) error {
+	if err := f.fail(); err != nil {
+		return err
+	}
+	return f.StorageMgr.WriteLockFile(p, d)
+}
+
+// setTestRetry sets the retry settings and records the delays instead of
+// sleeping. It returns the delays and a func that restores the settings.
+func setTestRetry(n int, backoff time.Duration, jitter float64) (*[]time.Duration, func()) {
+	saveRetries, saveBackoff, saveJitter, saveSleep := retries, retryBackoff, retryJitter, retrySleep
+	SetRetry(n, backoff, jitter)
+	var delays []time.Duration
+	var mu sync.Mutex
+	retrySleep = func(d time.Duration) {
+		mu.Lock()
+		delays = append(delays, d)
+		mu.Unlock()
+	}
+	return &delays, func() {
+		SetRetry(saveRetries, saveBackoff, saveJitter)
+		retrySleep = saveSleep
+	}
+}
+
+func TestRetrySMgr(t *testing.T) {
+	dir, err := ioutil.TempDir("", "storage_retry_test-*")
+	if err != nil {
+		t.Fatal("Cannot get tempdir", err)
+	}
+	defer removeAll(t, dir)
+	delays, restore := setTestRetry(3, time.Second, 0)
+	defer restore()
+	f := &flakySMgr{StorageMgr: TheLocalSMgr, err: errors.New("connection reset by peer"), n: 2}
+	sm := withRetry(f)
+	p := filepath.Join(dir, "a")
+	if err := sm.WriteFile(p, []byte("hello")); err != nil {
+		t.Fatalf("WriteFile failed: %s", err)
+	}
+	if f.calls != 3 || fmt.Sprint(*delays) != "[1s 2s]" {
+		t.Errorf("Want 3 calls and delays [1s 2s], got %d calls and delays %v", f.calls, *delays)
+	}
+	f.n, f.calls = 5, 0
+	var buf bytes.Buffer
+	if _, err := sm.ReadFile(p, &buf, nil); err != f.err {
+		t.Errorf("ReadFile should fail with %v, got %v", f.err, err)
+	}
+	if f.calls != 4 {
+		t.Errorf("ReadFile should be tried 4 times, tried %d times", f.calls)
+	}
+	f.n, f.calls = 1, 0
+	if err := sm.DeleteFile(p); err != nil {
+		t.Errorf("DeleteFile of a file deleted by a failed attempt should succeed: %s", err)
+	}
+	if err := sm.DeleteFile(p); !os.IsNotExist(err) {
+		t.Errorf("DeleteFile of a missing file should fail with not exist, got %v", err)
+	}
+	f.n, f.calls = 1, 0
+	if err := sm.WriteLockFile(filepath.Join(dir, "lock"), nil); err != f.err || f.calls != 1 {
+		t.Errorf("WriteLockFile should not be retried: %v, %d calls", err, f.calls)
+	}
+	if s := retryCounts(sm).String(); s != "DeleteFile 1, ReadFile 3, WriteFile 2" {
+		t.Errorf("Wrong retry counts: %s", s)
+	}
+	if len(retryCounts(TheLocalSMgr)) != 0 {
+		t.Error("Storage manager without retry should have no retry counts")
+	}
+}
+
+func TestPermanentError(t *testing.T) {
+	for _, c := range []struct {
+		err       error
+		permanent bool
+	}{
+		{os.ErrNotExist, true},
+		{&os.PathError{Op: "open", Path: "x", Err: os.ErrPermission}, true},
+		{os.ErrExist, true},
+		{fatalError{errors.New("Unknown host")}, true},
+		{&httpStatusError{http.StatusForbidden, "forbidden"}, true},
+		{&httpStatusError{http.StatusTooManyRequests, "slow down"}, false},
+		{&httpStatusError{http.StatusRequestTimeout, "timeout"}, false},
+		{&httpStatusError{http.StatusServiceUnavailable, "unavailable"}, false},
+		{fmt.Errorf("Cannot connect: %w", errors.New("connection refused")), false},
+	} {
+		if permanentError(c.err) != c.permanent {
+			t.Errorf("permanentError(%v) should be %v", c.err, c.permanent)
+		}
+	}
+	_, restore := setTestRetry(3, time.Second, 0)
+	defer restore()
+	f := &flakySMgr{StorageMgr: TheLocalSMgr, err: &httpStatusError{http.StatusForbidden, "forbidden"}, n: 1}
+	if err := withRetry(f).WriteFile("x", nil); err != f.err || f.calls != 1 {
+		t.Errorf("Permanent error should not be retried: %v, %d calls", err, f.calls)
+	}
+}
+
+func TestRetryDelay(t *testing.T) {
+	_, restore := setTestRetry(10, time.Second, 0.2)
+	defer restore()
+	base := time.Second
+	for i := 1; i <= 10; i++ {
+		for j := 0; j < 20; j++ {
+			d := retryDelay(i)
+			if d < base*8/10 || d > base*12/10 {
+				t.Fatalf("Delay of retry %d should be within 20%% of %s, got %s", i, base, d)
+			}
+		}
+		if base *= 2; base > RETRY_MAX_BACKOFF {
+			base = RETRY_MAX_BACKOFF
+		}
+	}
+}
+
+func TestRetryS3Backup(t *testing.T) {
+	f, srv := newFakeS3(t)
+	defer srv.Close()
+	f.pageSize = 100
+	save := *TheS3SMgr
+	defer func() { *TheS3SMgr = save }()
+	SetS3Config(srv.URL, f.sm.region, f.sm.accessKey, f.sm.secretKey, "")
+	_, restore := setTestRetry(4, time.Second, 0.2)
+	defer restore()
+	doTestSeq(t, "retry s3 backup", func(e *TestEnv) {
+		e.setPW([]byte("sdfsdfwerfdsfsdfsd"))
+		opt.Repo = "s3:bucket/repo"
+		opt.ChunkSize = 5000
+		e.init()
+		f.mu.Lock()
+		f.failEvery = 5
+		f.mu.Unlock()
+		e.addFile("a", 23456, 1)
+		e.addFile("b/c", 7890, 2)
+		stats := e.backup()
+		if stats.Errors != 0 || stats.Retries["WriteFile"] == 0 {
+			e.t.Errorf("Backup should succeed with retried writes: errors=%d retries=%s", stats.Errors, stats.Retries)
+		}
+		r := e.restore()
+		if len(r) == 0 || !strings.HasPrefix(r[len(r)-1], "Retried storage operations: ") {
+			e.t.Errorf("Restore should report retries: %v", r)
+		}
+		e.checkSame()
+	})
+}
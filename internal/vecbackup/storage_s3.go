@@ -0,0 +1,347 @@
+package vecbackup
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// s3SMgr stores the repo in an S3 compatible object store. The repo path
+// is "bucket/prefix". Requests use path-style URLs so that MinIO and other
+// S3 compatible servers work without DNS setup, and are signed with AWS
+// signature version 4. All requests share one http.Client so connections
+// are reused.
+
+const S3_LIST_MAX_KEYS = 1000
+
+type s3SMgr struct {
+	client       *http.Client
+	endpoint     string
+	region       string
+	accessKey    string
+	secretKey    string
+	sessionToken string
+}
+
+var TheS3SMgr = &s3SMgr{client: &http.Client{Transport: &http.Transport{Proxy: http.ProxyFromEnvironment, MaxIdleConnsPerHost: 100, IdleConnTimeout: 90 * time.Second}}, endpoint: "https://s3.us-east-1.amazonaws.com", region: "us-east-1"}
+
+// SetS3Config sets the endpoint and credentials of the S3 backend. The
+// endpoint defaults to AWS S3 in the region.
+func SetS3Config(endpoint, region, accessKey, secretKey, sessionToken string) {
+	if region == "" {
+		region = "us-east-1"
+	}
+	if endpoint == "" {
+		endpoint = "https://s3." + region + ".amazonaws.com"
+	}
+	TheS3SMgr.endpoint = strings.TrimSuffix(endpoint, "/")
+	TheS3SMgr.region = region
+	TheS3SMgr.accessKey = accessKey
+	TheS3SMgr.secretKey = secretKey
+	TheS3SMgr.sessionToken = sessionToken
+}
+
+// s3Escape escapes a path the way signature version 4 expects.
+func s3Escape(s string, keepSlash bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if 'A' <= c && c <= 'Z' || 'a' <= c && c <= 'z' || '0' <= c && c <= '9' || c == '-' || c == '_' || c == '.' || c == '~' || keepSlash && c == '/' {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+// s3Query returns the query string in the canonical form of signature
+// version 4.
+func s3Query(q url.Values) string {
+	var keys []string
+	for k := range q {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var params []string
+	for _, k := range keys {
+		for _, v := range q[k] {
+			params = append(params, s3Escape(k, false)+"="+s3Escape(v, false))
+		}
+	}
+	return strings.Join(params, "&")
+}
+
+func hmacSHA256(key []byte, s string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(s))
+	return h.Sum(nil)
+}
+
+// sign adds the signature version 4 headers to the request.
+func (sm *s3SMgr) sign(req *http.Request, payloadHash string, t time.Time) {
+	amzDate := t.UTC().Format("20060102T150405Z")
+	day := amzDate[:8]
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+	if sm.sessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", sm.sessionToken)
+	}
+	headers := map[string]string{"host": req.URL.Host}
+	for k, v := range req.Header {
+		lk := strings.ToLower(k)
+		if strings.HasPrefix(lk, "x-amz-") || lk == "if-none-match" || lk == "range" {
+			headers[lk] = strings.TrimSpace(strings.Join(v, ","))
+		}
+	}
+	var names []string
+	for k := range headers {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	var canonHeaders strings.Builder
+	for _, k := range names {
+		canonHeaders.WriteString(k + ":" + headers[k] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+	canonReq := strings.Join([]string{req.Method, s3Escape(req.URL.Path, true), s3Query(req.URL.Query()), canonHeaders.String(), signedHeaders, payloadHash}, "\n")
+	scope := day + "/" + sm.region + "/s3/aws4_request"
+	h := sha256.Sum256([]byte(canonReq))
+	toSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(h[:])
+	key := hmacSHA256([]byte("AWS4"+sm.secretKey), day)
+	key = hmacSHA256(key, sm.region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	sig := hex.EncodeToString(hmacSHA256(key, toSign))
+	req.Header.Set("Authorization", "AWS4-HMAC-SHA256 Credential="+sm.accessKey+"/"+scope+", SignedHeaders="+signedHeaders+", Signature="+sig)
+}
+
+type s3Error struct {
+	Code    string
+	Message string
+}
+
+// do sends a signed request for the object p, which is "bucket/key", and
+// returns the response if the status is one of ok.
+func (sm *s3SMgr) do(method, p string, query url.Values, header http.Header, body []byte, ok ...int) (*http.Response, error) {
+	u, err := url.Parse(sm.endpoint + "/" + s3Escape(strings.TrimPrefix(p, "/"), true))
+	if err != nil {
+		return nil, err
+	}
+	u.RawQuery = s3Query(query)
+	req, err := http.NewRequest(method, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.ContentLength = int64(len(body))
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	h := sha256.Sum256(body)
+	sm.sign(req, hex.EncodeToString(h[:]), time.Now())
+	resp, err := sm.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	for _, s := range ok {
+		if resp.StatusCode == s {
+			return resp, nil
+		}
+	}
+	defer resp.Body.Close()
+	b, _ := ioutil.ReadAll(resp.Body)
+	switch resp.StatusCode {
+	case http.StatusNotFound:
+		return nil, os.ErrNotExist
+	case http.StatusPreconditionFailed, http.StatusConflict:
+		if header.Get("If-None-Match") != "" {
+			return nil, os.ErrExist
+		}
+	}
+	var e s3Error
+	if xml.Unmarshal(b, &e) == nil && e.Code != "" {
+		return nil, &httpStatusError{resp.StatusCode, fmt.Sprintf("S3 %s %s failed: %s: %s", method, p, e.Code, e.Message)}
+	}
+	return nil, &httpStatusError{resp.StatusCode, fmt.Sprintf("S3 %s %s failed: %s", method, p, resp.Status)}
+}
+
+// drain reads the rest of the body so that the connection can be reused.
+func drain(resp *http.Response) {
+	io.Copy(ioutil.Discard, resp.Body)
+	resp.Body.Close()
+}
+
+type s3ListResult struct {
+	Contents []struct {
+		Key string
+	}
+	IsTruncated           bool
+	NextContinuationToken string
+}
+
+// list calls f with the keys under the prefix p/ relative to p.
+func (sm *s3SMgr) list(p, delimiter string, f func(string)) error {
+	p = strings.Trim(p, "/")
+	bucket, prefix := p, ""
+	if i := strings.Index(p, "/"); i >= 0 {
+		bucket, prefix = p[:i], p[i+1:]+"/"
+	}
+	q := url.Values{"list-type": {"2"}, "prefix": {prefix}, "max-keys": {strconv.Itoa(S3_LIST_MAX_KEYS)}}
+	if delimiter != "" {
+		q.Set("delimiter", delimiter)
+	}
+	for {
+		resp, err := sm.do("GET", bucket, q, nil, nil, http.StatusOK)
+		if err != nil {
+			return err
+		}
+		var r s3ListResult
+		err = xml.NewDecoder(resp.Body).Decode(&r)
+		drain(resp)
+		if err != nil {
+			return fmt.Errorf("Invalid S3 list response: %s", err)
+		}
+		for _, c := range r.Contents {
+			if strings.HasPrefix(c.Key, prefix) {
+				f(c.Key[len(prefix):])
+			}
+		}
+		if !r.IsTruncated || r.NextContinuationToken == "" {
+			return nil
+		}
+		q.Set("continuation-token", r.NextContinuationToken)
+	}
+}
+
+func (sm *s3SMgr) JoinPath(d, f string) string {
+	return d + "/" + f
+}
+
+func (sm *s3SMgr) IsDirFast() bool {
+	return true
+}
+
+func (sm *s3SMgr) LsDir(p string) ([]string, error) {
+	var files []string
+	err := sm.list(p, "/", func(f string) {
+		if f != "" && !strings.Contains(f, "/") {
+			files = append(files, f)
+		}
+	})
+	return files, err
+}
+
+func (sm *s3SMgr) LsDir2(p string, f StorageMgrLsDir2Func) error {
+	return sm.list(p, "", func(k string) {
+		ss := strings.Split(k, "/")
+		if len(ss) == 2 && ss[0] != "" && ss[1] != "" {
+			f(ss[0], ss[1])
+		}
+	})
+}
+
+func (sm *s3SMgr) FileExists(f string) (bool, error) {
+	filename := path.Base(f)
+	if filename == "/" || filename == "." {
+		return false, fmt.Errorf("Invalid path: %s", f)
+	}
+	resp, err := sm.do("HEAD", f, nil, nil, nil, http.StatusOK)
+	if os.IsNotExist(err) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	drain(resp)
+	return true, nil
+}
+
+func (sm *s3SMgr) MkdirAll(p string) error {
+	return nil
+}
+
+func (sm *s3SMgr) ReadFile(p string, out, _ *bytes.Buffer) ([]byte, error) {
+	resp, err := sm.do("GET", p, nil, nil, nil, http.StatusOK)
+	if err != nil {
+		return nil, err
+	}
+	defer drain(resp)
+	out.Reset()
+	if resp.ContentLength > 0 {
+		out.Grow(int(resp.ContentLength))
+	}
+	_, err = out.ReadFrom(resp.Body)
+	return out.Bytes(), err
+}
+
+func (sm *s3SMgr) ReadFileRange(p string, offset int64, length int, out, _ *bytes.Buffer) ([]byte, error) {
+	header := http.Header{"Range": {fmt.Sprintf("bytes=%d-%d", offset, offset+int64(length)-1)}}
+	resp, err := sm.do("GET", p, nil, header, nil, http.StatusPartialContent, http.StatusRequestedRangeNotSatisfiable)
+	if err != nil {
+		return nil, err
+	}
+	defer drain(resp)
+	if resp.StatusCode == http.StatusRequestedRangeNotSatisfiable {
+		return nil, io.ErrUnexpectedEOF
+	}
+	out.Reset()
+	out.Grow(length)
+	if _, err = out.ReadFrom(resp.Body); err != nil {
+		return nil, err
+	}
+	if out.Len() != length {
+		return nil, io.ErrUnexpectedEOF
+	}
+	return out.Bytes(), nil
+}
+
+func (sm *s3SMgr) WriteFile(p string, d []byte) error {
+	resp, err := sm.do("PUT", p, nil, nil, d, http.StatusOK)
+	if err != nil {
+		return err
+	}
+	drain(resp)
+	return nil
+}
+
+func (sm *s3SMgr) DeleteFile(p string) error {
+	resp, err := sm.do("DELETE", p, nil, nil, nil, http.StatusNoContent, http.StatusOK)
+	if err != nil {
+		return err
+	}
+	drain(resp)
+	return nil
+}
+
+// WriteLockFile uses a conditional PUT so that only one of several
+// clients creating the lock file at the same time succeeds.
+func (sm *s3SMgr) WriteLockFile(p string, d []byte) error {
+	resp, err := sm.do("PUT", p, nil, http.Header{"If-None-Match": {"*"}}, d, http.StatusOK)
+	if err != nil {
+		return err
+	}
+	drain(resp)
+	return nil
+}
+
+func (sm *s3SMgr) RemoveLockFile(p string) error {
+	exists, err := sm.FileExists(p)
+	if err != nil {
+		return err
+	} else if !exists {
+		return os.ErrNotExist
+	}
+	return sm.DeleteFile(p)
+}
@@ -0,0 +1,366 @@
+package vecbackup
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+	"golang.org/x/crypto/ssh/knownhosts"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/user"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// sftpSMgr stores the repo on an SSH server. The repo path is
+// "[user@]host[:port]:path". One SSH connection is opened per server on
+// first use and shared by all requests. Files are written to a temp file
+// and renamed so that a file is either complete or missing.
+//
+// The server is checked against the known_hosts file and the user is
+// authenticated with the keys in ssh-agent and the key file, which
+// defaults to the usual files in ~/.ssh.
+
+const SFTP_OP_UNSUPPORTED = 8 // SSH_FX_OP_UNSUPPORTED
+
+type sftpSMgr struct {
+	addr   string // host:port
+	user   string
+	mu     sync.Mutex
+	client *sftp.Client
+}
+
+var sftpKeyFile string
+var sftpKnownHostsFile string
+var sftpMgrs = make(map[string]*sftpSMgr)
+var sftpMgrsMu sync.Mutex
+
+// SetSftpConfig sets the private key file and the known_hosts file used
+// for SFTP repos. Empty means the default files in ~/.ssh.
+func SetSftpConfig(keyFile, knownHostsFile string) {
+	sftpKeyFile = keyFile
+	sftpKnownHostsFile = knownHostsFile
+}
+
+// getSftpSMgr returns the storage manager for "[user@]host[:port]:path"
+// and the path.
+func getSftpSMgr(p string) (*sftpSMgr, string) {
+	u := ""
+	if i := strings.Index(p, "@"); i >= 0 && i < strings.Index(p, ":") {
+		u, p = p[:i], p[i+1:]
+	}
+	host, port, rest := p, "22", ""
+	if i := strings.Index(p, ":"); i >= 0 {
+		host, rest = p[:i], p[i+1:]
+		if j := strings.Index(rest, ":"); j > 0 && strings.Trim(rest[:j], "0123456789") == "" {
+			port, rest = rest[:j], rest[j+1:]
+		}
+	}
+	if rest == "" {
+		rest = "."
+	}
+	addr := net.JoinHostPort(host, port)
+	sftpMgrsMu.Lock()
+	defer sftpMgrsMu.Unlock()
+	key := u + "@" + addr
+	sm := sftpMgrs[key]
+	if sm == nil {
+		sm = &sftpSMgr{addr: addr, user: u}
+		sftpMgrs[key] = sm
+	}
+	return sm, rest
+}
+
+func sshDir() string {
+	if h, err := os.UserHomeDir(); err == nil {
+		return filepath.Join(h, ".ssh")
+	}
+	return ".ssh"
+}
+
+func sshSigners() ([]ssh.Signer, error) {
+	var signers []ssh.Signer
+	if sock := os.Getenv("SSH_AUTH_SOCK"); sock != "" {
+		if conn, err := net.Dial("unix", sock); err == nil {
+			if s, err := agent.NewClient(conn).Signers(); err == nil {
+				signers = append(signers, s...)
+			}
+		}
+	}
+	files := []string{sftpKeyFile}
+	if sftpKeyFile == "" {
+		files = []string{filepath.Join(sshDir(), "id_ed25519"), filepath.Join(sshDir(), "id_ecdsa"), filepath.Join(sshDir(), "id_rsa")}
+	}
+	for _, f := range files {
+		b, err := ioutil.ReadFile(f)
+		if os.IsNotExist(err) && sftpKeyFile == "" {
+			continue
+		} else if err != nil {
+			return nil, fmt.Errorf("Cannot read SSH key: %s", err)
+		}
+		s, err := ssh.ParsePrivateKey(b)
+		if _, ok := err.(*ssh.PassphraseMissingError); ok {
+			if sftpKeyFile != "" {
+				return nil, fmt.Errorf("SSH key %s is encrypted, add it to ssh-agent instead.", f)
+			}
+			continue
+		} else if err != nil {
+			return nil, fmt.Errorf("Invalid SSH key %s: %s", f, err)
+		}
+		signers = append(signers, s)
+	}
+	if len(signers) == 0 {
+		return nil, errors.New("No SSH keys found. Start ssh-agent or use -sftp-key.")
+	}
+	return signers, nil
+}
+
+// connect returns the SFTP client, connecting to the server if needed.
+func (sm *sftpSMgr) connect() (*sftp.Client, error) {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+	if sm.client != nil {
+		return sm.client, nil
+	}
+	khFile := sftpKnownHostsFile
+	if khFile == "" {
+		khFile = filepath.Join(sshDir(), "known_hosts")
+	}
+	hostKeyCallback, err := knownhosts.New(khFile)
+	if err != nil {
+		return nil, fatalError{fmt.Errorf("Cannot read known_hosts file: %s", err)}
+	}
+	signers, err := sshSigners()
+	if err != nil {
+		return nil, fatalError{err}
+	}
+	u := sm.user
+	if u == "" {
+		if cu, err := user.Current(); err == nil {
+			u = cu.Username
+		}
+	}
+	cfg := &ssh.ClientConfig{User: u, Auth: []ssh.AuthMethod{ssh.PublicKeys(signers...)}, HostKeyCallback: hostKeyCallback, Timeout: 30 * time.Second}
+	conn, err := ssh.Dial("tcp", sm.addr, cfg)
+	if err != nil {
+		if strings.Contains(err.Error(), "knownhosts: key is unknown") {
+			return nil, fatalError{fmt.Errorf("Unknown host %s. Connect with ssh once to add it to %s.", sm.addr, khFile)}
+		} else if strings.Contains(err.Error(), "knownhosts: key mismatch") || strings.Contains(err.Error(), "unable to authenticate") {
+			return nil, fatalError{fmt.Errorf("Cannot connect to %s: %s", sm.addr, err)}
+		}
+		return nil, fmt.Errorf("Cannot connect to %s: %s", sm.addr, err)
+	}
+	client, err := sftp.NewClient(conn)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("Cannot start SFTP on %s: %s", sm.addr, err)
+	}
+	sm.client = client
+	go func() {
+		// Reconnect on next use if the connection is lost.
+		conn.Wait()
+		sm.mu.Lock()
+		if sm.client == client {
+			sm.client = nil
+		}
+		sm.mu.Unlock()
+	}()
+	return client, nil
+}
+
+func (sm *sftpSMgr) JoinPath(d, f string) string {
+	return path.Join(d, f)
+}
+
+func (sm *sftpSMgr) IsDirFast() bool {
+	return true
+}
+
+func (sm *sftpSMgr) LsDir(p string) ([]string, error) {
+	c, err := sm.connect()
+	if err != nil {
+		return nil, err
+	}
+	files, err := c.ReadDir(p)
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, f := range files {
+		if f.Mode().IsRegular() {
+			names = append(names, f.Name())
+		}
+	}
+	return names, nil
+}
+
+func (sm *sftpSMgr) LsDir2(p string, f StorageMgrLsDir2Func) error {
+	c, err := sm.connect()
+	if err != nil {
+		return err
+	}
+	l1, err := c.ReadDir(p)
+	if err != nil {
+		return err
+	}
+	for _, d := range l1 {
+		if d.IsDir() {
+			l2, err := c.ReadDir(path.Join(p, d.Name()))
+			if err != nil {
+				return err
+			}
+			for _, x := range l2 {
+				if x.Mode().IsRegular() {
+					f(d.Name(), x.Name())
+				}
+			}
+		}
+	}
+	return nil
+}
+
+func (sm *sftpSMgr) FileExists(f string) (bool, error) {
+	c, err := sm.connect()
+	if err != nil {
+		return false, err
+	}
+	_, err = c.Lstat(f)
+	if err == nil {
+		return true, nil
+	} else if os.IsNotExist(err) {
+		return false, nil
+	}
+	return false, err
+}
+
+func (sm *sftpSMgr) MkdirAll(p string) error {
+	c, err := sm.connect()
+	if err != nil {
+		return err
+	}
+	return c.MkdirAll(p)
+}
+
+func (sm *sftpSMgr) ReadFile(p string, out, _ *bytes.Buffer) ([]byte, error) {
+	c, err := sm.connect()
+	if err != nil {
+		return nil, err
+	}
+	f, err := c.Open(p)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	out.Reset()
+	_, err = f.WriteTo(out)
+	return out.Bytes(), err
+}
+
+func (sm *sftpSMgr) ReadFileRange(p string, offset int64, length int, out, _ *bytes.Buffer) ([]byte, error) {
+	c, err := sm.connect()
+	if err != nil {
+		return nil, err
+	}
+	f, err := c.Open(p)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	out.Reset()
+	out.Grow(length)
+	b := out.Bytes()[:length]
+	if _, err = f.Seek(offset, io.SeekStart); err != nil {
+		return nil, err
+	}
+	if _, err = io.ReadFull(f, b); err == io.EOF {
+		return nil, io.ErrUnexpectedEOF
+	} else if err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+func (sm *sftpSMgr) WriteFile(p string, d []byte) error {
+	c, err := sm.connect()
+	if err != nil {
+		return err
+	}
+	tp := p + "-temp"
+	f, err := c.Create(tp)
+	if err != nil {
+		return err
+	}
+	if _, err = f.Write(d); err != nil {
+		f.Close()
+		c.Remove(tp)
+		return err
+	}
+	if err = f.Close(); err != nil {
+		c.Remove(tp)
+		return err
+	}
+	err = c.PosixRename(tp, p)
+	if se, ok := err.(*sftp.StatusError); ok && se.Code == SFTP_OP_UNSUPPORTED {
+		// Without posix-rename, a plain rename fails if the file exists.
+		if err = c.Rename(tp, p); err != nil {
+			if exists, _ := sm.FileExists(p); exists && c.Remove(p) == nil {
+				err = c.Rename(tp, p)
+			}
+		}
+	}
+	if err != nil {
+		c.Remove(tp)
+		return err
+	}
+	return nil
+}
+
+func (sm *sftpSMgr) DeleteFile(p string) error {
+	c, err := sm.connect()
+	if err != nil {
+		return err
+	}
+	return c.Remove(p)
+}
+
+func (sm *sftpSMgr) WriteLockFile(p string, d []byte) error {
+	exists, err := sm.FileExists(p)
+	if err != nil {
+		return err
+	}
+	if exists {
+		return os.ErrExist
+	}
+	c, err := sm.connect()
+	if err != nil {
+		return err
+	}
+	f, err := c.OpenFile(p, os.O_WRONLY|os.O_CREATE|os.O_EXCL)
+	if err != nil {
+		if exists, _ := sm.FileExists(p); exists {
+			return os.ErrExist
+		}
+		return err
+	}
+	_, err = f.Write(d)
+	if err2 := f.Close(); err == nil {
+		err = err2
+	}
+	return err
+}
+
+func (sm *sftpSMgr) RemoveLockFile(p string) error {
+	c, err := sm.connect()
+	if err != nil {
+		return err
+	}
+	return c.Remove(p)
+}
@@ -0,0 +1,345 @@
+package vecbackup
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// throttleSMgr limits the upload rate, the download rate and the number
+// of storage operations per second. It is below the retry wrapper so that
+// retries count too. The limiters are shared by all repos, so the limits
+// hold for the whole process.
+//
+// The limits given by SetThrottle can be changed by a limit file, which is
+// read again when it changes, so the limits of a running backup can be
+// changed by editing it. Each line of the limit file is
+//
+//	upload|download|ops <limit> [HH:MM-HH:MM]
+//
+// A line with a time range only applies during that time of the day and
+// wins over a line without one. Lines starting with # are ignored.
+
+const THROTTLE_CHECK_INTERVAL = 5 * time.Second
+
+var throttleNow = time.Now
+var throttleSleep = time.Sleep
+
+// rateLimiter lets through rate units per second on average with bursts
+// of up to one second. 0 means no limit.
+type rateLimiter struct {
+	mu   sync.Mutex
+	rate float64
+	next time.Time // When all units let through so far are paid for.
+}
+
+func (l *rateLimiter) setRate(rate float64) {
+	l.mu.Lock()
+	l.rate = rate
+	l.mu.Unlock()
+}
+
+func (l *rateLimiter) wait(n int) {
+	l.mu.Lock()
+	if l.rate <= 0 || n <= 0 {
+		l.mu.Unlock()
+		return
+	}
+	now := throttleNow()
+	if burst := now.Add(-time.Second); l.next.Before(burst) {
+		l.next = burst
+	}
+	l.next = l.next.Add(time.Duration(float64(n) / l.rate * float64(time.Second)))
+	d := l.next.Sub(now)
+	l.mu.Unlock()
+	if d > 0 {
+		throttleSleep(d)
+	}
+}
+
+type throttleRule struct {
+	kind     string // upload, download or ops
+	rate     float64
+	from, to int // Minutes after midnight. Equal if the rule applies all day.
+}
+
+func (r *throttleRule) active(t time.Time) bool {
+	if r.from == r.to {
+		return true
+	}
+	m := t.Hour()*60 + t.Minute()
+	if r.from < r.to {
+		return m >= r.from && m < r.to
+	}
+	return m >= r.from || m < r.to
+}
+
+type throttler struct {
+	mu       sync.Mutex
+	upload   rateLimiter
+	download rateLimiter
+	ops      rateLimiter
+	flags    []throttleRule
+	rules    []throttleRule // From the limit file.
+	file     string
+	fileMod  time.Time
+	fileSize int64
+	fileErr  string
+	checked  time.Time
+}
+
+var theThrottler = &throttler{}
+
+// parseRate parses a rate like 500K or 10M. K, M and G are powers of 1024.
+// 0 or off means no limit.
+func parseRate(s string) (float64, error) {
+	if s == "" || s == "off" {
+		return 0, nil
+	}
+	m, n := 1.0, s
+	switch s[len(s)-1] {
+	case 'k', 'K':
+		m = 1 << 10
+	case 'm', 'M':
+		m = 1 << 20
+	case 'g', 'G':
+		m = 1 << 30
+	}
+	if m > 1 {
+		n = s[:len(s)-1]
+	}
+	f, err := strconv.ParseFloat(n, 64)
+	if err != nil || f < 0 {
+		return 0, fmt.Errorf("Invalid rate %s", s)
+	}
+	return f * m, nil
+}
+
+func parseTimeOfDay(s string) (int, error) {
+	t, err := time.Parse("15:04", s)
+	if err != nil {
+		return 0, fmt.Errorf("Invalid time %s", s)
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+func parseThrottleRule(l string) (throttleRule, error) {
+	var r throttleRule
+	fs := strings.Fields(l)
+	if len(fs) < 2 || len(fs) > 3 {
+		return r, fmt.Errorf("Invalid limit: %s", l)
+	}
+	r.kind = fs[0]
+	if r.kind != "upload" && r.kind != "download" && r.kind != "ops" {
+		return r, fmt.Errorf("Invalid limit: %s", l)
+	}
+	var err error
+	if r.rate, err = parseRate(fs[1]); err != nil {
+		return r, err
+	}
+	if len(fs) == 3 {
+		ft := strings.Split(fs[2], "-")
+		if len(ft) != 2 {
+			return r, fmt.Errorf("Invalid time range %s", fs[2])
+		}
+		if r.from, err = parseTimeOfDay(ft[0]); err != nil {
+			return r, err
+		}
+		if r.to, err = parseTimeOfDay(ft[1]); err != nil {
+			return r, err
+		}
+	}
+	return r, nil
+}
+
+func readLimitFile(fn string) ([]throttleRule, error) {
+	in, err := os.Open(fn)
+	if err != nil {
+		return nil, err
+	}
+	defer in.Close()
+	var rules []throttleRule
+	scanner := bufio.NewScanner(in)
+	for scanner.Scan() {
+		l := strings.TrimSpace(scanner.Text())
+		if l == "" || l[0] == '#' {
+			continue
+		}
+		r, err := parseThrottleRule(l)
+		if err != nil {
+			return nil, err
+		}
+		rules = append(rules, r)
+	}
+	return rules, scanner.Err()
+}
+
+// SetThrottle sets the upload and download limits in bytes per second,
+// the limit of storage operations per second and the limit file. Empty
+// means no limit.
+func SetThrottle(upload, download, ops, limitFile string) error {
+	return theThrottler.set(upload, download, ops, limitFile)
+}
+
+func (t *throttler) set(upload, download, ops, limitFile string) error {
+	var flags []throttleRule
+	for _, l := range []struct{ kind, s string }{{"upload", upload}, {"download", download}, {"ops", ops}} {
+		rate, err := parseRate(l.s)
+		if err != nil {
+			return err
+		}
+		flags = append(flags, throttleRule{kind: l.kind, rate: rate})
+	}
+	var rules []throttleRule
+	var fi os.FileInfo
+	if limitFile != "" {
+		var err error
+		if fi, err = os.Stat(limitFile); err != nil {
+			return fmt.Errorf("Cannot read limit file: %s", err)
+		}
+		if rules, err = readLimitFile(limitFile); err != nil {
+			return fmt.Errorf("Cannot read limit file: %s", err)
+		}
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.flags = flags
+	t.rules = rules
+	t.file = limitFile
+	t.fileErr = ""
+	if fi != nil {
+		t.fileMod, t.fileSize = fi.ModTime(), fi.Size()
+	}
+	t.apply(throttleNow())
+	return nil
+}
+
+// apply sets the rates of the limiters from the rules active at now.
+func (t *throttler) apply(now time.Time) {
+	rates := make(map[string]float64)
+	rules := append(append([]throttleRule(nil), t.flags...), t.rules...)
+	for _, ranged := range []bool{false, true} {
+		for i := range rules {
+			r := &rules[i]
+			if (r.from != r.to) == ranged && r.active(now) {
+				rates[r.kind] = r.rate
+			}
+		}
+	}
+	t.upload.setRate(rates["upload"])
+	t.download.setRate(rates["download"])
+	t.ops.setRate(rates["ops"])
+	t.checked = now
+}
+
+// check reads the limit file again if it changed and applies the rules
+// of the time of day, at most once every THROTTLE_CHECK_INTERVAL.
+func (t *throttler) check() {
+	now := throttleNow()
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if now.Sub(t.checked) < THROTTLE_CHECK_INTERVAL {
+		return
+	}
+	if t.file != "" {
+		if fi, err := os.Stat(t.file); err == nil && (!fi.ModTime().Equal(t.fileMod) || fi.Size() != t.fileSize) {
+			t.fileMod, t.fileSize = fi.ModTime(), fi.Size()
+			if rules, err := readLimitFile(t.file); err != nil {
+				if err.Error() != t.fileErr {
+					t.fileErr = err.Error()
+					stderr.Printf("Ignoring limit file %s: %s\n", t.file, err)
+				}
+			} else {
+				t.rules = rules
+				t.fileErr = ""
+				debugP("Limits read from %s\n", t.file)
+			}
+		}
+	}
+	t.apply(now)
+}
+
+// op waits until one more storage operation is allowed.
+func (t *throttler) op() {
+	t.check()
+	t.ops.wait(1)
+}
+
+type throttleSMgr struct {
+	sm StorageMgr
+	t  *throttler
+}
+
+func withThrottle(sm StorageMgr) *throttleSMgr {
+	return &throttleSMgr{sm: sm, t: theThrottler}
+}
+
+func (s *throttleSMgr) JoinPath(d, f string) string {
+	return s.sm.JoinPath(d, f)
+}
+
+func (s *throttleSMgr) IsDirFast() bool {
+	return s.sm.IsDirFast()
+}
+
+func (s *throttleSMgr) LsDir(p string) ([]string, error) {
+	s.t.op()
+	return s.sm.LsDir(p)
+}
+
+func (s *throttleSMgr) LsDir2(p string, f StorageMgrLsDir2Func) error {
+	s.t.op()
+	return s.sm.LsDir2(p, f)
+}
+
+func (s *throttleSMgr) FileExists(p string) (bool, error) {
+	s.t.op()
+	return s.sm.FileExists(p)
+}
+
+func (s *throttleSMgr) MkdirAll(p string) error {
+	s.t.op()
+	return s.sm.MkdirAll(p)
+}
+
+// ReadFile pays for the download after it, since the size is not known
+// before.
+func (s *throttleSMgr) ReadFile(p string, out, errOut *bytes.Buffer) ([]byte, error) {
+	s.t.op()
+	b, err := s.sm.ReadFile(p, out, errOut)
+	s.t.download.wait(len(b))
+	return b, err
+}
+
+func (s *throttleSMgr) ReadFileRange(p string, offset int64, length int, out, errOut *bytes.Buffer) ([]byte, error) {
+	s.t.op()
+	s.t.download.wait(length)
+	return s.sm.ReadFileRange(p, offset, length, out, errOut)
+}
+
+func (s *throttleSMgr) WriteFile(p string, d []byte) error {
+	s.t.op()
+	s.t.upload.wait(len(d))
+	return s.sm.WriteFile(p, d)
+}
+
+func (s *throttleSMgr) DeleteFile(p string) error {
+	s.t.op()
+	return s.sm.DeleteFile(p)
+}
+
+func (s *throttleSMgr) WriteLockFile(p string, d []byte) error {
+	s.t.op()
+	s.t.upload.wait(len(d))
+	return s.sm.WriteLockFile(p, d)
+}
+
+func (s *throttleSMgr) RemoveLockFile(p string) error {
+	s.t.op()
+	return s.sm.RemoveLockFile(p)
+}
@@ -0,0 +1,153 @@
+package vecbackup
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// fakeThrottleClock makes the throttle use a clock that only moves when
+// it sleeps. It returns the clock and a func that restores the real one.
+func fakeThrottleClock() (*time.Time, func()) {
+	saveNow, saveSleep := throttleNow, throttleSleep
+	now := time.Date(2020, 1, 1, 12, 0, 0, 0, time.Local)
+	throttleNow = func() time.Time { return now }
+	throttleSleep = func(d time.Duration) { now = now.Add(d) }
+	return &now, func() {
+		throttleNow, throttleSleep = saveNow, saveSleep
+	}
+}
+
+func TestParseRate(t *testing.T) {
+	for s, want := range map[string]float64{"": 0, "off": 0, "0": 0, "100": 100, "1.5K": 1536, "2m": 2 << 20, "1G": 1 << 30} {
+		if r, err := parseRate(s); err != nil || r != want {
+			t.Errorf("parseRate(%q) = %v, %v, want %v", s, r, err, want)
+		}
+	}
+	for _, s := range []string{"K", "-1", "10X", "fast"} {
+		if _, err := parseRate(s); err == nil {
+			t.Errorf("parseRate(%q) should fail", s)
+		}
+	}
+}
+
+func TestRateLimiter(t *testing.T) {
+	now, restore := fakeThrottleClock()
+	defer restore()
+	start := *now
+	var l rateLimiter
+	l.wait(1000000)
+	if !now.Equal(start) {
+		t.Error("No limit should not wait")
+	}
+	l.setRate(1000)
+	l.wait(1000)
+	if !now.Equal(start) {
+		t.Error("Burst of one second should not wait")
+	}
+	for i := 0; i < 10; i++ {
+		l.wait(500)
+	}
+	if d := now.Sub(start); d != 5*time.Second {
+		t.Errorf("Should take 5s, took %s", d)
+	}
+}
+
+func TestThrottleSchedule(t *testing.T) {
+	dir, err := ioutil.TempDir("", "storage_throttle_test-*")
+	if err != nil {
+		t.Fatal("Cannot get tempdir", err)
+	}
+	defer removeAll(t, dir)
+	fn := filepath.Join(dir, "limits")
+	if err := ioutil.WriteFile(fn, []byte("# office hours\nupload 1M 09:00-18:00\n\nops 10 22:00-06:00\ndownload 2M\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	var th throttler
+	if err := th.set("100K", "", "50", fn); err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range []struct {
+		at                    string
+		upload, download, ops float64
+	}{
+		{"08:59", 100 << 10, 2 << 20, 50},
+		{"09:00", 1 << 20, 2 << 20, 50},
+		{"17:59", 1 << 20, 2 << 20, 50},
+		{"23:00", 100 << 10, 2 << 20, 10},
+		{"05:59", 100 << 10, 2 << 20, 10},
+		{"06:00", 100 << 10, 2 << 20, 50},
+	} {
+		at, _ := time.Parse("15:04", c.at)
+		th.apply(at)
+		if th.upload.rate != c.upload || th.download.rate != c.download || th.ops.rate != c.ops {
+			t.Errorf("At %s: upload %v download %v ops %v, want %v %v %v", c.at, th.upload.rate, th.download.rate, th.ops.rate, c.upload, c.download, c.ops)
+		}
+	}
+	for _, l := range []string{"upload", "upload 1M 9-18", "upload 1M 09:00", "cpu 10", "ops 10 09:00-25:00"} {
+		if _, err := parseThrottleRule(l); err == nil {
+			t.Errorf("parseThrottleRule(%q) should fail", l)
+		}
+	}
+	if err := th.set("", "", "", filepath.Join(dir, "missing")); err == nil {
+		t.Error("Missing limit file should fail")
+	}
+}
+
+func TestThrottleSMgr(t *testing.T) {
+	dir, err := ioutil.TempDir("", "storage_throttle_test-*")
+	if err != nil {
+		t.Fatal("Cannot get tempdir", err)
+	}
+	defer removeAll(t, dir)
+	now, restore := fakeThrottleClock()
+	defer restore()
+	fn := filepath.Join(dir, "limits")
+	if err := ioutil.WriteFile(fn, []byte("upload 1000\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	th := &throttler{}
+	if err := th.set("", "", "", fn); err != nil {
+		t.Fatal(err)
+	}
+	sm := &throttleSMgr{sm: TheLocalSMgr, t: th}
+	start := *now
+	d := make([]byte, 500)
+	for i := 0; i < 6; i++ {
+		if err := sm.WriteFile(filepath.Join(dir, "a"), d); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if el := now.Sub(start); el != 2*time.Second {
+		t.Errorf("Upload should take 2s, took %s", el)
+	}
+	// A changed limit file is read again at the next check.
+	if err := ioutil.WriteFile(fn, []byte("upload 100\nops 1\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	os.Chtimes(fn, start.Add(time.Hour), start.Add(time.Hour))
+	*now = now.Add(THROTTLE_CHECK_INTERVAL)
+	if _, err := sm.FileExists(filepath.Join(dir, "a")); err != nil {
+		t.Fatal(err)
+	}
+	if th.upload.rate != 100 || th.ops.rate != 1 {
+		t.Errorf("Limits should be read again: upload %v ops %v", th.upload.rate, th.ops.rate)
+	}
+	// An invalid limit file is ignored.
+	if err := ioutil.WriteFile(fn, []byte("upload lots\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	os.Chtimes(fn, start.Add(2*time.Hour), start.Add(2*time.Hour))
+	*now = now.Add(THROTTLE_CHECK_INTERVAL)
+	sm.FileExists(filepath.Join(dir, "a"))
+	if th.upload.rate != 100 {
+		t.Errorf("Invalid limit file should be ignored: upload %v", th.upload.rate)
+	}
+	var buf bytes.Buffer
+	if b, err := sm.ReadFile(filepath.Join(dir, "a"), &buf, nil); err != nil || len(b) != 500 {
+		t.Fatalf("ReadFile failed: %v", err)
+	}
+}
@@ -18,14 +18,22 @@ import (
 
 const (
 	VC_VERSION              = 1
+	VC_VERSION_ARGON2       = 2
+	VC_VERSION_SLOTS        = 3
 	VC_MAGIC                = "VBKC"
 	VV_VERSION              = 1
 	VV_MAGIC                = "VBKV"
 	CONFIG_FILE             = "vecbackup-config"
+	CONFIG_BACKUP_FILE      = "vecbackup-config-old"
 	VERSION_DIR             = "versions"
 	CHUNK_DIR               = "chunks"
+	PACK_DIR                = "packs"
+	INDEX_DIR               = "index"
 	VERSION_FILENAME_PREFIX = "version-"
 	LOCK_FILENAME           = "lock"
+	LOCKS_DIR               = "locks"
+	PENDING_DIR             = "pending"
+	MIRRORS_DIR             = "mirrors"
 	RESTORE_TEMP_SUFFIX     = ".vbk.restore.temp"
 	DEFAULT_DIR_PERM        = 0700
 	DEFAULT_FILE_PERM       = 0600
@@ -187,7 +195,7 @@ func statsRemoveFile(fd *FileData, stats *BackupStats) {
 	}
 }
 
-func backupOneNode(cm *CMgr, mem *addChunkMem, dryRun, force, checkChunks, verbose bool, old *FileData, new *FileData, secret []byte, mu *sync.Mutex, stats *BackupStats) (*FileData, error) {
+func backupOneNode(cm *CMgr, ck *chunker, mem *addChunkMem, dryRun, force, checkChunks, verbose bool, old *FileData, new *FileData, secret []byte, mu *sync.Mutex, stats *BackupStats) (*FileData, error) {
 	mu.Lock()
 	defer mu.Unlock()
 	if old != nil && new == nil {
@@ -217,7 +225,7 @@ func backupOneNode(cm *CMgr, mem *addChunkMem, dryRun, force, checkChunks, verbo
 		if new.IsFile() {
 			if !dryRun {
 				mu.Unlock()
-				srcAdded, repoAdded, err := addChunks(new, cm, mem, dryRun, secret)
+				srcAdded, repoAdded, err := addChunks(new, cm, ck, mem, dryRun, secret)
 				mu.Lock()
 				if err != nil {
 					stderr.Printf("F %s: %s\n", to_add.PrettyPrint(), err)
@@ -270,7 +278,7 @@ func backupOneNode(cm *CMgr, mem *addChunkMem, dryRun, force, checkChunks, verbo
 	return to_add, nil
 }
 
-func addChunks(fd *FileData, cm *CMgr, mem *addChunkMem, dryRun bool, secret []byte) (int64, int64, error) {
+func addChunks(fd *FileData, cm *CMgr, ck *chunker, mem *addChunkMem, dryRun bool, secret []byte) (int64, int64, error) {
 	h := sha512.New512_256()
 	var chunks []FP = nil
 	var sizes []int32
@@ -282,38 +290,77 @@ func addChunks(fd *FileData, cm *CMgr, mem *addChunkMem, dryRun bool, secret []b
 	var n int64 = 0
 	var srcAdded int64 = 0
 	var repoAdded int64 = 0
-	blockSize := mem.chunkSize
-	for {
-		mem.setSize(blockSize)
+	addChunk := func(count int) error {
+		mem.setSize(count)
 		buf := mem.buf()
-		count, err := io.ReadFull(file, buf)
-		if count > 0 {
-			mem.setSize(count)
+		h.Write(buf)
+		var chunk FP = makeChunkFP(secret, sha512.Sum512_256(buf))
+		dup, compressedLen, err := cm.AddChunk(chunk, mem)
+		if err != nil {
+			return err
+		}
+		srcAdded = srcAdded + int64(count)
+		if !dup {
+			repoAdded = repoAdded + int64(compressedLen)
+		}
+		chunks = append(chunks, chunk)
+		sizes = append(sizes, int32(count))
+		return nil
+	}
+	blockSize := mem.chunkSize
+	if ck == nil {
+		for {
+			mem.setSize(blockSize)
 			buf := mem.buf()
-			n += int64(count)
-			h.Write(buf)
-			var chunk FP = makeChunkFP(secret, sha512.Sum512_256(buf))
-			dup, compressedLen, err := cm.AddChunk(chunk, mem)
-			if err != nil {
-				return 0, 0, err
+			count, err := io.ReadFull(file, buf)
+			if count > 0 {
+				n += int64(count)
+				if err := addChunk(count); err != nil {
+					return 0, 0, err
+				}
 			}
-			srcAdded = srcAdded + int64(count)
-			if !dup {
-				repoAdded = repoAdded + int64(compressedLen)
+			if n > fd.Size {
+				return 0, 0, fmt.Errorf("File size changed %s", fd.Name)
+			}
+			if err == io.EOF || count < blockSize {
+				break
 			}
-			chunks = append(chunks, chunk)
-			sizes = append(sizes, int32(count))
-		}
-		if n > fd.Size {
-			return 0, 0, fmt.Errorf("File size changed %s", fd.Name)
 		}
-		if err == io.EOF || count < blockSize {
-			if n < fd.Size {
+	} else {
+		// The buffer holds up to the max chunk size. Bytes after each cut
+		// point are moved to the front and the buffer is topped up again.
+		avail := 0
+		eof := false
+		for {
+			if !eof && avail < blockSize {
+				mem.setSize(blockSize)
+				count, err := io.ReadFull(file, mem.buf()[avail:])
+				n += int64(count)
+				avail += count
+				if err == io.EOF || err == io.ErrUnexpectedEOF {
+					eof = true
+				} else if err != nil {
+					return 0, 0, err
+				}
+			}
+			if n > fd.Size {
 				return 0, 0, fmt.Errorf("File size changed %s", fd.Name)
 			}
-			break
+			if avail == 0 {
+				break
+			}
+			mem.setSize(avail)
+			count := ck.cut(mem.buf())
+			if err := addChunk(count); err != nil {
+				return 0, 0, err
+			}
+			mem.discard(count, avail)
+			avail -= count
 		}
 	}
+	if n < fd.Size {
+		return 0, 0, fmt.Errorf("File size changed %s", fd.Name)
+	}
 	fd.Chunks = chunks
 	fd.Sizes = sizes
 	fd.FileChecksum = h.Sum(nil)
@@ -464,23 +511,52 @@ func restoreFile(fd *FileData, cm *CMgr, mem *readChunkMem, resDir string, merge
 	return false, err
 }
 
-func setup(repo string, pwFile string) (*VMgr, *CMgr, *Config, error) {
+func setup(repo string, pwSrc *PwSource) (*VMgr, *CMgr, *Config, error) {
 	sm, repo2 := GetStorageMgr(repo)
-	cfg, err := GetConfig(pwFile, sm, repo2)
+	cfg, err := GetConfig(pwSrc, sm, repo2)
 	if err != nil {
 		return nil, nil, nil, err
 	}
-	vm := MakeVMgr(sm, repo2, cfg.EncryptionKey)
-	cm := MakeCMgr(sm, repo2, cfg.EncryptionKey, cfg.Compress)
+	if cfg.Rotation != nil {
+		return nil, nil, nil, errKeyRotation
+	}
+	vm := MakeVMgr(sm, repo2, cfg)
+	cm := MakeCMgr(sm, repo2, cfg)
+	cm.cachePath = chunkCachePath(repo, cfg.FPSecret)
+	vm.manifestPath = manifestCachePath(repo, cfg.FPSecret)
 	return vm, cm, cfg, nil
 }
 
 //---------------------------------------------------------------------------
 
-func InitRepo(pwFile, repo string, chunkSize int32, iterations int, compress CompressionMode) error {
+func InitRepo(pwSrc *PwSource, repo string, kdf *KdfParams, asymmetric bool, cfg *Config) error {
 	if repo == "" {
 		return errors.New("Backup repository must be specified.")
 	}
+	if err := setChunkSizes(cfg); err != nil {
+		return err
+	}
+	if cfg.PackSize < 0 {
+		return errors.New("Pack size must not be negative.")
+	}
+	if pwSrc != nil && pwSrc.KeyFile == "" {
+		if err := checkKdf(kdf); err != nil {
+			return err
+		}
+	} else if pwSrc == nil && asymmetric {
+		return errors.New("Asymmetric encryption needs a password.")
+	}
+	if cfg.CompressionType == CompressionType_NO_COMPRESSION {
+		cfg.CompressionType = CompressionType_ZLIB
+	}
+	if err := checkCompression(cfg.CompressionType, cfg.CompressionLevel); err != nil {
+		return err
+	}
+	if err := checkPadding(cfg.Padding); err != nil {
+		return err
+	} else if pwSrc == nil && cfg.Padding != PaddingMode_NO_PADDING {
+		return errors.New("Padding needs encryption.")
+	}
 	sm, repo2 := GetStorageMgr(repo)
 	files, err := sm.LsDir(repo2)
 	if !os.IsNotExist(err) && len(files) != 0 {
@@ -490,12 +566,17 @@ func InitRepo(pwFile, repo string, chunkSize int32, iterations int, compress Com
 	if err != nil {
 		return fmt.Errorf("Cannot create repo dir: %s", err)
 	}
-	cfg := &Config{ChunkSize: chunkSize, Compress: compress}
-	err = WriteNewConfig(pwFile, sm, repo2, iterations, cfg)
+	if asymmetric {
+		err = WriteNewAsymmetricConfig(pwSrc, sm, repo2, kdf, cfg)
+	} else {
+		err = WriteNewConfig(pwSrc, sm, repo2, kdf, cfg)
+	}
 	if err != nil {
 		return fmt.Errorf("Cannot write encypted config file: %s", err)
 	}
-	return err
+	// A new stamp makes sure that a chunk cache of a previous repo
+	// at the same location is not used.
+	return writeChunksStamp(sm, repo2)
 }
 
 type BackupStats struct {
@@ -516,19 +597,27 @@ type BackupStats struct {
 	Size            int64
 	SrcAdded        int64
 	RepoAdded       int64
+	Retries         RetryCounts
+	Mirrors         []MirrorStats
 }
 
-func Backup(pwFile, repo, excludeFrom, setVersion string, dryRun, force, checkChunks, verbose bool, lockFile string, maxDop int, srcs []string, stats *BackupStats) error {
+// Backup backs up the srcs to a new version in the repo and in the
+// mirrors, see mirror.
+func Backup(pwSrc *PwSource, repo, excludeFrom, setVersion string, dryRun, force, checkChunks, verbose bool, lockFile string, mirrors []string, maxDop int, srcs []string, stats *BackupStats) error {
 	if repo == "" {
 		return errors.New("Backup repository must be specified.")
 	}
 	if len(srcs) == 0 {
 		return errors.New("At least one backup src must be specified")
 	}
-	vm, cm, cfg, err := setup(repo, pwFile)
+	vm, cm, cfg, err := setup(repo, pwSrc)
 	if err != nil {
 		return err
 	}
+	defer func() { stats.Retries = retryCounts(cm.sm) }()
+	if !dryRun && guardMode(cm.sm) == RepoMode_READ_ONLY {
+		return errReadOnly
+	}
 	var sml StorageMgr
 	var lockFile2 string
 	if lockFile == "" {
@@ -543,12 +632,34 @@ func Backup(pwFile, repo, excludeFrom, setVersion string, dryRun, force, checkCh
 	if err != nil {
 		return fmt.Errorf("Cannot read exclude-from file: %s", err)
 	}
-	if err = sml.WriteLockFile(lockFile2); os.IsExist(err) {
-		return fmt.Errorf("Repository is locked. Lock file %s exists.", lockFile)
-	} else if err != nil {
+	lk, err := acquireLock(sml, lockFile2, lockFile)
+	if err != nil {
 		return err
 	}
-	defer sml.RemoveLockFile(lockFile2)
+	defer lk.release()
+	rl, err := lockRepo(cm.sm, repo, cm.repo, false)
+	if err != nil {
+		return err
+	}
+	defer rl.release()
+	if !dryRun {
+		if err := cm.LoadPendingDeletion(); err != nil {
+			return err
+		}
+		for _, r := range mirrors {
+			if r == repo {
+				return errors.New("A mirror must be different from the repository.")
+			}
+			m := openMirror(pwSrc, cm, cfg, r)
+			defer m.close()
+			cm.mirrors = append(cm.mirrors, m)
+		}
+		defer func() {
+			for _, m := range cm.mirrors {
+				stats.Mirrors = append(stats.Mirrors, m.stats())
+			}
+		}()
+	}
 	var new_version string
 	if setVersion != "" {
 		if _, ok := DecodeVersionTime(setVersion); ok {
@@ -564,6 +675,15 @@ func Backup(pwFile, repo, excludeFrom, setVersion string, dryRun, force, checkCh
 	if new_version == "" {
 		new_version = CreateNewVersion(last_version)
 	}
+	if len(cm.mirrors) > 0 {
+		versions, err := vm.GetVersions()
+		if err != nil {
+			return fmt.Errorf("Cannot read version files: %s", err)
+		}
+		for _, m := range cm.mirrors {
+			m.catchUp(vm, cm, cfg.FPSecret, versions, verbose, maxDop)
+		}
+	}
 	if verbose {
 		stdout.Println("Scanning sources...")
 	}
@@ -576,7 +696,9 @@ func Backup(pwFile, repo, excludeFrom, setVersion string, dryRun, force, checkCh
 	vfdm.Init()
 	if last_version != "" {
 		fds, err, errs := vm.LoadFiles(last_version)
-		if err != nil {
+		if err == errNoManifest {
+			stderr.Printf("No local copy of version %s, all files will be read.\n", last_version)
+		} else if err != nil {
 			return fmt.Errorf("Failed reading previous version: %s", err)
 		}
 		stats.Errors += errs
@@ -595,14 +717,31 @@ func Backup(pwFile, repo, excludeFrom, setVersion string, dryRun, force, checkCh
 			stdout.Printf("Starting backup from last version %s ...", last_version)
 		}
 	}
-	//cm.CacheChunkInfo()
+	if !dryRun && !checkChunks {
+		if err := cm.LoadCache(); err != nil {
+			debugP("Not using chunk cache: %s\n", err)
+		}
+		defer cm.CloseCache()
+		for _, m := range cm.mirrors {
+			if !m.failed() {
+				if err := m.cm.LoadCache(); err != nil {
+					debugP("Not using chunk cache: %s\n", err)
+				}
+			}
+		}
+	}
 	var last string
 	var fds []*FileData
 	var wg sync.WaitGroup
 	var mu sync.Mutex // protect fds and stats
+	ck := makeChunker(cfg)
+	bufSize := int(cfg.ChunkSize)
+	if ck != nil {
+		bufSize = ck.maxSize
+	}
 	ch := make(chan *addChunkMem, maxDop)
 	for i := 0; i < maxDop; i++ {
-		ch <- makeAddChunkMem(int(cfg.ChunkSize))
+		ch <- makeAddChunkMem(bufSize)
 	}
 	for _, n := range comb {
 		if n == last {
@@ -614,7 +753,7 @@ func Backup(pwFile, repo, excludeFrom, setVersion string, dryRun, force, checkCh
 			defer wg.Done()
 			mem := <-ch
 			defer func() { ch <- mem }()
-			new_fd, err := backupOneNode(cm, mem, dryRun, force, checkChunks, verbose, vfdm.files[name], sfdm.files[name], cfg.FPSecret, &mu, stats)
+			new_fd, err := backupOneNode(cm, ck, mem, dryRun, force, checkChunks, verbose, vfdm.files[name], sfdm.files[name], cfg.FPSecret, &mu, stats)
 			if err == nil && new_fd != nil {
 				mu.Lock()
 				fds = append(fds, new_fd)
@@ -628,25 +767,39 @@ func Backup(pwFile, repo, excludeFrom, setVersion string, dryRun, force, checkCh
 	}
 	ch = nil
 	if !dryRun {
+		if err = cm.Flush(); err != nil {
+			return err
+		}
+		if err = checkLocks(lk, rl); err != nil {
+			return err
+		}
 		if err = vm.SaveFiles(new_version, fds); err != nil {
 			return err
 		}
 		stats.Version = new_version
+		for _, m := range cm.mirrors {
+			m.save(cm, new_version, fds)
+		}
 	}
 	return nil
 }
 
-func Restore(pwFile, repo, resDir, version string, merge, verifyOnly, dryRun, verbose bool, maxDop int, patterns []string) error {
+func Restore(pwSrc *PwSource, repo, resDir, version string, merge, verifyOnly, dryRun, verbose bool, maxDop int, patterns []string) error {
 	if repo == "" {
 		return errors.New("Backup repository must be specified.")
 	}
 	if resDir == "" && !verifyOnly {
 		return errors.New("Target must be specified.")
 	}
-	vm, cm, cfg, err := setup(repo, pwFile)
+	vm, cm, cfg, err := setup(repo, pwSrc)
+	if err != nil {
+		return err
+	}
+	rl, err := lockRepoForRead(cm.sm, repo, cm.repo)
 	if err != nil {
 		return err
 	}
+	defer rl.release()
 	if !merge {
 		if _, err := os.Lstat(resDir); !os.IsNotExist(err) {
 			return fmt.Errorf("Restore dir %s already exists", resDir)
@@ -743,17 +896,20 @@ func Restore(pwFile, repo, resDir, version string, merge, verifyOnly, dryRun, ve
 			}
 		}
 	}
+	if rc := retryCounts(cm.sm); len(rc) > 0 {
+		stdout.Printf("Retried storage operations: %s\n", rc)
+	}
 	if errs > 0 {
 		return errors.New("Errors occured during restore. Some files were not restored.")
 	}
 	return nil
 }
 
-func Ls(pwFile, repo, version string) error {
+func Ls(pwSrc *PwSource, repo, version string) error {
 	if repo == "" {
 		return errors.New("Backup repository must be specified.")
 	}
-	vm, _, _, err := setup(repo, pwFile)
+	vm, _, _, err := setup(repo, pwSrc)
 	if err != nil {
 		return err
 	}
@@ -786,11 +942,11 @@ func Ls(pwFile, repo, version string) error {
 	return nil
 }
 
-func Versions(pwFile, repo string) error {
+func Versions(pwSrc *PwSource, repo string) error {
 	if repo == "" {
 		return errors.New("Backup repository must be specified.")
 	}
-	vm, _, _, err := setup(repo, pwFile)
+	vm, _, _, err := setup(repo, pwSrc)
 	if err != nil {
 		return err
 	}
@@ -804,17 +960,22 @@ func Versions(pwFile, repo string) error {
 	return nil
 }
 
-func DeleteVersion(pwFile, repo, version string) error {
+func DeleteVersion(pwSrc *PwSource, repo, version string) error {
 	if repo == "" {
 		return errors.New("Backup repository must be specified.")
 	}
 	if version == "" {
 		return errors.New("Version must be specified.")
 	}
-	vm, _, _, err := setup(repo, pwFile)
+	vm, cm, _, err := setup(repo, pwSrc)
+	if err != nil {
+		return err
+	}
+	rl, err := lockRepo(cm.sm, repo, cm.repo, true)
 	if err != nil {
 		return err
 	}
+	defer rl.release()
 	err = vm.DeleteVersion(version)
 	if err != nil {
 		return fmt.Errorf("Cannot delete version %s: %s", version, err)
@@ -822,14 +983,24 @@ func DeleteVersion(pwFile, repo, version string) error {
 	return nil
 }
 
-func DeleteOldVersions(pwFile, repo string, dryRun bool) error {
+func DeleteOldVersions(pwSrc *PwSource, repo string, dryRun bool) error {
 	if repo == "" {
 		return errors.New("Backup repository must be specified.")
 	}
-	vm, _, _, err := setup(repo, pwFile)
+	vm, cm, _, err := setup(repo, pwSrc)
 	if err != nil {
 		return err
 	}
+	var rl *repoLock
+	if dryRun {
+		rl, err = lockRepoForRead(cm.sm, repo, cm.repo)
+	} else {
+		rl, err = lockRepo(cm.sm, repo, cm.repo, true)
+	}
+	if err != nil {
+		return err
+	}
+	defer rl.release()
 	versions, err := vm.GetVersions()
 	if err != nil {
 		return fmt.Errorf("Cannot read version files: %s", err)
@@ -852,14 +1023,19 @@ type VerifyRepoResults struct {
 	Chunks, Ok, Errors, Missing, Unused int
 }
 
-func VerifyRepo(pwFile, repo string, quick bool, maxDop int, r *VerifyRepoResults) error {
+func VerifyRepo(pwSrc *PwSource, repo string, quick bool, maxDop int, r *VerifyRepoResults) error {
 	if repo == "" {
 		return errors.New("Backup repository must be specified.")
 	}
-	vm, cm, cfg, err := setup(repo, pwFile)
+	vm, cm, cfg, err := setup(repo, pwSrc)
+	if err != nil {
+		return err
+	}
+	rl, err := lockRepoForRead(cm.sm, repo, cm.repo)
 	if err != nil {
 		return err
 	}
+	defer rl.release()
 	versions, err := vm.GetVersions()
 	if err != nil {
 		return fmt.Errorf("Cannot read version files: %s", err)
@@ -1009,14 +1185,26 @@ func VerifyRepo(pwFile, repo string, quick bool, maxDop int, r *VerifyRepoResult
 	return nil
 }
 
-func PurgeUnused(pwFile, repo string, dryRun, verbose bool) error {
+// PurgeUnused deletes the chunks that are not used by any version and have
+// been pending deletion for the grace period, see UpdatePendingDeletion.
+func PurgeUnused(pwSrc *PwSource, repo string, dryRun, verbose bool, grace time.Duration) error {
 	if repo == "" {
 		return errors.New("Backup repository must be specified.")
 	}
-	vm, cm, _, err := setup(repo, pwFile)
+	vm, cm, _, err := setup(repo, pwSrc)
 	if err != nil {
 		return err
 	}
+	var rl *repoLock
+	if dryRun {
+		rl, err = lockRepoForRead(cm.sm, repo, cm.repo)
+	} else {
+		rl, err = lockRepo(cm.sm, repo, cm.repo, true)
+	}
+	if err != nil {
+		return err
+	}
+	defer rl.release()
 	versions, err := vm.GetVersions()
 	if err != nil {
 		return fmt.Errorf("Cannot read version files: %s", err)
@@ -1037,6 +1225,46 @@ func PurgeUnused(pwFile, repo string, dryRun, verbose bool) error {
 			}
 		}
 	}
+	if cm.packSize > 0 {
+		orphans, err := cm.orphanPacks()
+		if err != nil {
+			return err
+		}
+		for fp := range orphans {
+			counts[fp] = true
+		}
+	}
+	var pst PendingStats
+	counts, err = cm.UpdatePendingDeletion(counts, grace, time.Now(), dryRun, &pst)
+	if err != nil {
+		return err
+	}
+	if grace > 0 {
+		stdout.Printf("Unused chunks pending deletion: %d, %d new, %d kept by backups. Pending for more than %s: %d.\n", pst.Pending, pst.New, pst.Kept, grace, pst.Expired)
+	}
+	if cm.packSize > 0 {
+		var st PackPurgeStats
+		if err := cm.PurgePacks(counts, dryRun, verbose, &st); err != nil {
+			return err
+		}
+		if dryRun {
+			stdout.Printf("Chunks to be purged (dryrun): %d out of %d. Packs to be deleted: %d, repacked: %d out of %d.\n", st.ChunksDeleted, total_chunks, st.PacksDeleted+st.OrphansDeleted, st.PacksRepacked, st.Packs)
+		} else {
+			stdout.Printf("Chunks purged: %d out of %d. Packs deleted: %d, repacked: %d out of %d.\n", st.ChunksDeleted, total_chunks, st.PacksDeleted+st.OrphansDeleted, st.PacksRepacked, st.Packs)
+		}
+		if st.UnusedKept > 0 {
+			stdout.Printf("%d unused chunk(s) kept in mostly used packs.\n", st.UnusedKept)
+		}
+		if !dryRun && st.PacksDeleted+st.PacksRepacked+st.OrphansDeleted > 0 {
+			return chunksDeleted(cm)
+		}
+		return nil
+	}
+	if !dryRun && len(counts) > 0 {
+		if err := chunksDeleting(cm); err != nil {
+			return err
+		}
+	}
 	numDeleted := 0
 	numFailed := 0
 	for chunk, _ := range counts {
@@ -1064,13 +1292,333 @@ func PurgeUnused(pwFile, repo string, dryRun, verbose bool) error {
 	} else {
 		stdout.Printf("Chunks purged: %d out of %d.\n", numDeleted, total_chunks)
 	}
+	if !dryRun && numDeleted > 0 {
+		if err := chunksDeleted(cm); err != nil {
+			return err
+		}
+	}
 	if numFailed > 0 {
 		return fmt.Errorf("Failed to purge %d chunk(s).", numFailed)
 	}
 	return nil
 }
 
-func RemoveLock(repo, lockFile string) error {
+// chunksDeleting must be called before deleting chunks from the repo so
+// that the chunk caches of other machines are rebuilt even if the delete
+// is interrupted.
+func chunksDeleting(cm *CMgr) error {
+	if err := writeChunksStamp(cm.sm, cm.repo); err != nil {
+		return fmt.Errorf("Cannot write chunks stamp file: %s", err)
+	}
+	return nil
+}
+
+// chunksDeleted must be called after deleting chunks from the repo
+// so that the chunk caches of all machines are rebuilt.
+func chunksDeleted(cm *CMgr) error {
+	if err := writeChunksStamp(cm.sm, cm.repo); err != nil {
+		return fmt.Errorf("Cannot write chunks stamp file: %s", err)
+	}
+	return cm.InvalidateCache()
+}
+
+// UpgradeKdf changes the key derivation function used to derive the master
+// key from the password of the repo.
+func UpgradeKdf(pwSrc *PwSource, repo string, kdf *KdfParams) error {
+	if repo == "" {
+		return errors.New("Backup repository must be specified.")
+	}
+	if pwSrc == nil {
+		return errors.New("Password must be specified.")
+	}
+	sm, repo2 := GetStorageMgr(repo)
+	return ChangeKdf(pwSrc, sm, repo2, kdf)
+}
+
+func ChangePassword(pwSrc, newPwSrc *PwSource, repo string, kdf *KdfParams) error {
+	if repo == "" {
+		return errors.New("Backup repository must be specified.")
+	}
+	if pwSrc == nil {
+		return errors.New("Password must be specified.")
+	}
+	if newPwSrc == nil {
+		return errors.New("New password must be specified.")
+	}
+	sm, repo2 := GetStorageMgr(repo)
+	return ChangeConfigPassword(pwSrc, newPwSrc, sm, repo2, kdf)
+}
+
+func AddKey(pwSrc, newPwSrc *PwSource, repo, label string, kdf *KdfParams, writeOnly bool) error {
+	if repo == "" {
+		return errors.New("Backup repository must be specified.")
+	}
+	if pwSrc == nil {
+		return errors.New("Password must be specified.")
+	}
+	if newPwSrc == nil {
+		return errors.New("New password must be specified.")
+	}
+	sm, repo2 := GetStorageMgr(repo)
+	return AddKeySlot(pwSrc, newPwSrc, sm, repo2, label, kdf, writeOnly)
+}
+
+func ListKeys(repo string) ([]KeySlotInfo, error) {
+	if repo == "" {
+		return nil, errors.New("Backup repository must be specified.")
+	}
+	sm, repo2 := GetStorageMgr(repo)
+	return ListKeySlots(sm, repo2)
+}
+
+func RemoveKey(pwSrc *PwSource, repo, label string) error {
+	if repo == "" {
+		return errors.New("Backup repository must be specified.")
+	}
+	if pwSrc == nil {
+		return errors.New("Password must be specified.")
+	}
+	sm, repo2 := GetStorageMgr(repo)
+	return RemoveKeySlot(pwSrc, sm, repo2, label)
+}
+
+// ExportKey returns the text form and the QR form of the secrets of the
+// repo. Anyone with them can read the repo.
+func ExportKey(pwSrc *PwSource, repo string) (string, string, error) {
+	if repo == "" {
+		return "", "", errors.New("Backup repository must be specified.")
+	}
+	if pwSrc == nil {
+		return "", "", errors.New("Password must be specified.")
+	}
+	sm, repo2 := GetStorageMgr(repo)
+	b, err := ExportKeys(pwSrc, sm, repo2)
+	if err != nil {
+		return "", "", err
+	}
+	return FormatKeyExport(b), FormatKeyExportQR(b), nil
+}
+
+// ImportKey rebuilds the config file of the repo from the secrets printed
+// by ExportKey, read from the file in or stdin if in is empty.
+func ImportKey(newPwSrc *PwSource, repo string, kdf *KdfParams, in string, force bool) error {
+	if repo == "" {
+		return errors.New("Backup repository must be specified.")
+	}
+	if newPwSrc == nil {
+		return errors.New("New password must be specified.")
+	}
+	var text []byte
+	var err error
+	if in == "" {
+		text, err = ioutil.ReadAll(os.Stdin)
+	} else {
+		text, err = ioutil.ReadFile(in)
+	}
+	if err != nil {
+		return fmt.Errorf("Cannot read exported keys: %s", err)
+	}
+	b, err := ParseKeyExport(string(text))
+	if err != nil {
+		return err
+	}
+	sm, repo2 := GetStorageMgr(repo)
+	if err := sm.MkdirAll(repo2); err != nil {
+		return fmt.Errorf("Cannot create repo dir: %s", err)
+	}
+	return ImportKeys(b, newPwSrc, sm, repo2, kdf, force)
+}
+
+// SetMode sets the mode of the repo, which limits the operations allowed
+// on it. A repo can only be made less strict with the password, so it
+// cannot be done with a write-only key.
+func SetMode(pwSrc *PwSource, repo string, mode RepoMode) error {
+	if repo == "" {
+		return errors.New("Backup repository must be specified.")
+	}
+	if readOnly {
+		return errReadOnly
+	}
+	sm, repo2 := GetStorageMgr(repo)
+	cfg, err := GetConfig(pwSrc, sm, repo2)
+	if err != nil {
+		return err
+	}
+	if cfg.PublicKey != nil && cfg.PrivateKey == nil {
+		return errors.New("Cannot set the mode with a write-only key.")
+	}
+	cfg.Mode = mode
+	return UpdateConfig(pwSrc, unguarded(sm), repo2, cfg)
+}
+
+type RecompressStats struct {
+	Chunks       int
+	Recompressed int
+	Errors       int
+	OldSize      int64
+	NewSize      int64
+}
+
+// Recompress changes the compression settings of the repo and recompresses
+// the existing chunks with the new settings. Chunks already compressed with
+// the target compression type are skipped so an interrupted recompress can
+// be resumed by running it again. If the compression level changes, all
+// compressed chunks are recompressed. The config is updated at the end, so
+// an interrupted recompress to a new level starts over when run again.
+func Recompress(pwSrc *PwSource, repo string, mode CompressionMode, ctype CompressionType, level int32, dryRun, verbose bool, maxDop int, st *RecompressStats) error {
+	if repo == "" {
+		return errors.New("Backup repository must be specified.")
+	}
+	if err := checkCompression(ctype, level); err != nil {
+		return err
+	}
+	sm, repo2 := GetStorageMgr(repo)
+	cfg, err := GetConfig(pwSrc, sm, repo2)
+	if err != nil {
+		return err
+	}
+	if cfg.Rotation != nil {
+		return errKeyRotation
+	}
+	if cfg.PublicKey != nil && cfg.PrivateKey == nil {
+		return errors.New("Cannot recompress with a write-only key.")
+	}
+	var rl *repoLock
+	if dryRun {
+		rl, err = lockRepoForRead(sm, repo, repo2)
+	} else {
+		rl, err = lockRepo(sm, repo, repo2, true)
+	}
+	if err != nil {
+		return err
+	}
+	defer rl.release()
+	newLevel := cfg.CompressionLevel != level
+	cfg.Compress = mode
+	cfg.CompressionType = ctype
+	cfg.CompressionLevel = level
+	cm := MakeCMgr(sm, repo2, cfg)
+	cm.newLevel = newLevel
+	chunkSize := int(cfg.ChunkSize)
+	if cfg.Chunking == ChunkingMode_CDC {
+		chunkSize = int(cfg.MaxChunkSize)
+	}
+	if cm.packSize > 0 {
+		if err := cm.RecompressPacks(cfg.FPSecret, chunkSize, dryRun, verbose, maxDop, st); err != nil {
+			return err
+		}
+		if !dryRun && st.Recompressed > 0 {
+			if err := chunksDeleted(cm); err != nil {
+				return err
+			}
+		}
+	} else {
+		var chunks []FP
+		for fp := range cm.GetAllChunks() {
+			chunks = append(chunks, fp)
+		}
+		st.Chunks = len(chunks)
+		var wg sync.WaitGroup
+		var mu sync.Mutex // protects st
+		ch := make(chan FP)
+		for i := 0; i < maxDop; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				rmem := &readChunkMem{}
+				amem := makeAddChunkMem(chunkSize)
+				for fp := range ch {
+					oldSize, newSize, changed, err := cm.RecompressChunk(fp, cfg.FPSecret, dryRun, rmem, amem)
+					mu.Lock()
+					if err != nil {
+						stderr.Printf("Cannot recompress chunk %s: %s\n", fp, err)
+						st.Errors++
+					} else if changed {
+						if verbose {
+							stdout.Printf("Recompress %s: %d -> %d\n", fp, oldSize, newSize)
+						}
+						st.Recompressed++
+						st.OldSize += int64(oldSize)
+						st.NewSize += int64(newSize)
+					}
+					mu.Unlock()
+				}
+			}()
+		}
+		for _, fp := range chunks {
+			ch <- fp
+		}
+		close(ch)
+		wg.Wait()
+	}
+	if st.Errors > 0 {
+		return fmt.Errorf("Failed to recompress %d chunk(s).", st.Errors)
+	}
+	if !dryRun {
+		if err := UpdateConfig(pwSrc, sm, repo2, cfg); err != nil {
+			return fmt.Errorf("Cannot update config: %s", err)
+		}
+	}
+	return nil
+}
+
+// RotateKey replaces the storage key and the FP secret of the repo and
+// rewrites all chunks and version files with the new keys. The repo is
+// then opened with the new password. It can be run again with the old
+// password to resume if it is interrupted.
+func RotateKey(pwSrc, newPwSrc *PwSource, repo, lockFile string, removeOtherKeys, verbose bool, maxDop int, st *RotateKeyStats) error {
+	if repo == "" {
+		return errors.New("Backup repository must be specified.")
+	}
+	if pwSrc == nil {
+		return errors.New("Password must be specified.")
+	}
+	if newPwSrc == nil {
+		return errors.New("New password must be specified.")
+	}
+	sm, repo2 := GetStorageMgr(repo)
+	var sml StorageMgr
+	var lockFile2 string
+	if lockFile == "" {
+		sml = sm
+		lockFile = sm.JoinPath(repo, LOCK_FILENAME)
+		lockFile2 = sm.JoinPath(repo2, LOCK_FILENAME)
+	} else {
+		sml, lockFile2 = GetStorageMgr(lockFile)
+	}
+	lk, err := acquireLock(sml, lockFile2, lockFile)
+	if err != nil {
+		return err
+	}
+	defer lk.release()
+	rl, err := lockRepo(sm, repo, repo2, true)
+	if err != nil {
+		return err
+	}
+	defer rl.release()
+	cfg, err := StartKeyRotation(pwSrc, newPwSrc, sm, repo2, removeOtherKeys)
+	if err != nil {
+		return err
+	}
+	if err := RotateKeys(sm, repo2, cfg, verbose, maxDop, st); err != nil {
+		return err
+	}
+	if err := checkLocks(lk, rl); err != nil {
+		return err
+	}
+	if err := FinishKeyRotation(pwSrc, newPwSrc, sm, repo2, cfg); err != nil {
+		return err
+	}
+	if d := repoCacheDir(repo, cfg.FPSecret); d != "" {
+		os.RemoveAll(d)
+	}
+	return nil
+}
+
+// RemoveLock removes the lock file and, if the repo is given, the locks in
+// the locks dir of the repo if they are stale. The other locks are held by
+// running commands and are only removed if force is set.
+func RemoveLock(repo, lockFile string, force bool) error {
 	var sml StorageMgr
 	var lockFile2 string
 	if lockFile == "" {
@@ -1080,8 +1628,57 @@ func RemoveLock(repo, lockFile string) error {
 	} else {
 		sml, lockFile2 = GetStorageMgr(lockFile)
 	}
-	err := sml.RemoveLockFile(lockFile2)
-	if os.IsNotExist(err) {
+	removed := false
+	live := 0
+	// removeLock removes the lock file p, described as what, unless it is
+	// held by a running command.
+	removeLock := func(sm StorageMgr, p, what string) error {
+		li, err := readLockInfo(sm, p)
+		if os.IsNotExist(err) {
+			return nil
+		}
+		if !force && (li == nil || li.stale(time.Now()) == "") {
+			live++
+			if li != nil {
+				stdout.Printf("Not removing %s of %s\n", what, li)
+			} else {
+				stdout.Printf("Not removing lock file %s without owner info\n", p)
+			}
+			return nil
+		}
+		if err := sm.RemoveLockFile(p); os.IsNotExist(err) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		removed = true
+		if li != nil {
+			stdout.Printf("Removed %s of %s\n", what, li)
+		} else {
+			stdout.Printf("Removed lock file %s without owner info\n", p)
+		}
+		return nil
+	}
+	if err := removeLock(sml, lockFile2, "lock"); err != nil {
+		return err
+	}
+	if repo != "" {
+		sm, repo2 := GetStorageMgr(repo)
+		dir := sm.JoinPath(repo2, LOCKS_DIR)
+		files, err := sm.LsDir(dir)
+		if err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("Cannot list locks: %s", err)
+		}
+		for _, f := range files {
+			if err := removeLock(sm, sm.JoinPath(dir, f), f); err != nil {
+				return err
+			}
+		}
+	}
+	if live > 0 {
+		return fmt.Errorf("%d lock(s) are not stale. Use -f to remove them.", live)
+	}
+	if !removed {
 		return fmt.Errorf("Repo is not locked. Lock file %s does not exist", lockFile2)
 	}
 	return nil
@@ -4,6 +4,8 @@ import (
 	"bytes"
 	"flag"
 	"fmt"
+	"golang.org/x/crypto/nacl/box"
+	"golang.org/x/crypto/nacl/secretbox"
 	"hash/fnv"
 	"io/ioutil"
 	"log"
@@ -37,11 +39,19 @@ var opt struct {
 	PwFile      string
 	ChunkSize   int
 	Iterations  int
+	Kdf         KdfType
+	Asymmetric  bool
 	Repo        string
 	Target      string
 	ExcludeFrom string
 	Compress    CompressionMode
+	CompType    CompressionType
+	Chunking    ChunkingMode
+	PackSize    int
+	Padding     PaddingMode
 	LockFile    string
+	Mirrors     []string
+	GracePeriod time.Duration
 	MaxDop      int
 }
 
@@ -65,11 +75,19 @@ func setupTest(t testing.TB, name string) func() {
 	opt.PwFile = ""
 	opt.ChunkSize = 16 * 1024 * 1024
 	opt.Iterations = 9999
+	opt.Kdf = KdfType_PBKDF2_SHA1
+	opt.Asymmetric = false
 	opt.Repo = REPO
 	opt.Target = RESDIR
 	opt.ExcludeFrom = ""
 	opt.Compress = CompressionMode_AUTO
+	opt.CompType = CompressionType_ZLIB
+	opt.Chunking = ChunkingMode_FIXED
+	opt.PackSize = 0
+	opt.Padding = PaddingMode_NO_PADDING
 	opt.LockFile = ""
+	opt.Mirrors = nil
+	opt.GracePeriod = 0
 	opt.MaxDop = 10
 	stdout.SetOutput(ioutil.Discard)
 	debug = *debugFlag
@@ -158,16 +176,19 @@ func (e *TestEnv) setPW(pw []byte) {
 }
 
 func (e *TestEnv) init() {
-	e.failIfError("init", InitRepo(opt.PwFile, opt.Repo, int32(opt.ChunkSize), opt.Iterations, opt.Compress))
+	cfg := &Config{ChunkSize: int32(opt.ChunkSize), Compress: opt.Compress, CompressionType: opt.CompType, Chunking: opt.Chunking, PackSize: int32(opt.PackSize), Padding: opt.Padding}
+	kdf := &KdfParams{Type: opt.Kdf, Iterations: opt.Iterations, Memory: 1024, Time: 1, Threads: 2}
+	e.failIfError("init", InitRepo(PwFile(opt.PwFile), opt.Repo, kdf, opt.Asymmetric, cfg))
 }
 
-func (e *TestEnv) backup() {
+func (e *TestEnv) backup() *BackupStats {
 	wk, err := os.Getwd()
 	e.failIfError("Getwd", err)
 	e.failIfError("Chdir to srcdir", os.Chdir(SRCDIR))
 	stats := &BackupStats{}
-	e.failIfError("backup", Backup(opt.PwFile, opt.Repo, opt.ExcludeFrom, opt.Version, opt.DryRun, opt.Force, opt.CheckChunks, opt.Verbose, opt.LockFile, opt.MaxDop, []string{"."}, stats))
+	e.failIfError("backup", Backup(PwFile(opt.PwFile), opt.Repo, opt.ExcludeFrom, opt.Version, opt.DryRun, opt.Force, opt.CheckChunks, opt.Verbose, opt.LockFile, opt.Mirrors, opt.MaxDop, []string{"."}, stats))
 	e.failIfError("Chdir to test dir", os.Chdir(wk))
+	return stats
 }
 
 func (e *TestEnv) backupSrcs(srcs []string) {
@@ -175,7 +196,7 @@ func (e *TestEnv) backupSrcs(srcs []string) {
 	e.failIfError("Getwd", err)
 	e.failIfError("Chdir to srcdir", os.Chdir(SRCDIR))
 	stats := &BackupStats{}
-	e.failIfError("backup", Backup(opt.PwFile, opt.Repo, opt.ExcludeFrom, opt.Version, opt.DryRun, opt.Force, opt.CheckChunks, opt.Verbose, opt.LockFile, opt.MaxDop, srcs, stats))
+	e.failIfError("backup", Backup(PwFile(opt.PwFile), opt.Repo, opt.ExcludeFrom, opt.Version, opt.DryRun, opt.Force, opt.CheckChunks, opt.Verbose, opt.LockFile, opt.Mirrors, opt.MaxDop, srcs, stats))
 	e.failIfError("Chdir to test dir", os.Chdir(wk))
 }
 
@@ -184,7 +205,7 @@ func (e *TestEnv) restore() []string {
 	save := stdout
 	stdout = log.New(&b, "", 0)
 	defer func() { stdout = save }()
-	e.failIfError("restore", Restore(opt.PwFile, opt.Repo, opt.Target, opt.Version, opt.Merge, opt.VerifyOnly, opt.DryRun, opt.Verbose, opt.MaxDop, nil))
+	e.failIfError("restore", Restore(PwFile(opt.PwFile), opt.Repo, opt.Target, opt.Version, opt.Merge, opt.VerifyOnly, opt.DryRun, opt.Verbose, opt.MaxDop, nil))
 	r := strings.Split(b.String(), "\n")
 	return r[:len(r)-1]
 }
@@ -194,14 +215,14 @@ func (e *TestEnv) restoreFiles(patterns []string) []string {
 	save := stdout
 	stdout = log.New(&b, "", 0)
 	defer func() { stdout = save }()
-	e.failIfError("restore", Restore(opt.PwFile, opt.Repo, opt.Target, opt.Version, opt.Merge, opt.VerifyOnly, opt.DryRun, opt.Verbose, opt.MaxDop, patterns))
+	e.failIfError("restore", Restore(PwFile(opt.PwFile), opt.Repo, opt.Target, opt.Version, opt.Merge, opt.VerifyOnly, opt.DryRun, opt.Verbose, opt.MaxDop, patterns))
 	r := strings.Split(b.String(), "\n")
 	return r[:len(r)-1]
 }
 
 func (e *TestEnv) verifyRepo() *VerifyRepoResults {
 	var r VerifyRepoResults
-	e.failIfError("verifyRepo", VerifyRepo(opt.PwFile, opt.Repo, false, opt.MaxDop, &r))
+	e.failIfError("verifyRepo", VerifyRepo(PwFile(opt.PwFile), opt.Repo, false, opt.MaxDop, &r))
 	return &r
 }
 
@@ -210,10 +231,28 @@ func (e *TestEnv) purgeUnused() string {
 	save := stdout
 	stdout = log.New(&b, "", 0)
 	defer func() { stdout = save }()
-	e.failIfError("purgeUnused", PurgeUnused(opt.PwFile, opt.Repo, opt.DryRun, opt.Verbose))
+	e.failIfError("purgeUnused", PurgeUnused(PwFile(opt.PwFile), opt.Repo, opt.DryRun, opt.Verbose, opt.GracePeriod))
 	return b.String()
 }
 
+// rotateKey runs rotate-key with a new password and uses the new password
+// from then on.
+func (e *TestEnv) rotateKey(pw []byte, removeOtherKeys bool) *RotateKeyStats {
+	newPwFile := filepath.Join(TEMPDIR, "rotated_pw")
+	os.Remove(newPwFile)
+	e.failIfError("write pw", ioutil.WriteFile(newPwFile, pw, 0444))
+	var st RotateKeyStats
+	e.failIfError("RotateKey", RotateKey(PwFile(opt.PwFile), PwFile(newPwFile), opt.Repo, "", removeOtherKeys, false, opt.MaxDop, &st))
+	opt.PwFile = newPwFile
+	return &st
+}
+
+func (e *TestEnv) recompress(mode CompressionMode, ctype CompressionType) *RecompressStats {
+	var st RecompressStats
+	e.failIfError("recompress", Recompress(PwFile(opt.PwFile), opt.Repo, mode, ctype, 0, opt.DryRun, opt.Verbose, opt.MaxDop, &st))
+	return &st
+}
+
 func (e *TestEnv) add(f string) {
 	h := fnv.New32()
 	h.Write([]byte(f))
@@ -293,14 +332,14 @@ func (e *TestEnv) versions() []string {
 	save := stdout
 	stdout = log.New(&b, "", 0)
 	defer func() { stdout = save }()
-	e.failIfError("versions", Versions(opt.PwFile, opt.Repo))
+	e.failIfError("versions", Versions(PwFile(opt.PwFile), opt.Repo))
 	r := strings.Split(b.String(), "\n")
 	return r[:len(r)-1]
 }
 
 func (e *TestEnv) deleteVersion(version string) {
 	opt.Version = version
-	e.failIfError("deleteVersion", DeleteVersion(opt.PwFile, opt.Repo, opt.Version))
+	e.failIfError("deleteVersion", DeleteVersion(PwFile(opt.PwFile), opt.Repo, opt.Version))
 }
 
 func (e *TestEnv) ls(version string) []string {
@@ -309,7 +348,7 @@ func (e *TestEnv) ls(version string) []string {
 	save := stdout
 	stdout = log.New(&b, "", 0)
 	defer func() { stdout = save }()
-	e.failIfError("ls", Ls(opt.PwFile, opt.Repo, opt.Version))
+	e.failIfError("ls", Ls(PwFile(opt.PwFile), opt.Repo, opt.Version))
 	r := strings.Split(b.String(), "\n")
 	return r[:len(r)-1]
 }
@@ -1410,6 +1449,547 @@ func TestT24(t *testing.T) {
 	})
 }
 
+func TestT25(t *testing.T) {
+	doTestSeq(t, "T25 content-defined chunking", func(e *TestEnv) {
+		data := make([]byte, 300000)
+		rand.Read(data)
+		e.setPW([]byte("fsdfsdfadfsdfasdd2349fhcif"))
+		opt.ChunkSize = 8192
+		opt.Chunking = ChunkingMode_CDC
+		opt.Compress = CompressionMode_NO
+		e.init()
+		e.addFileWithData("f1", data)
+		e.add("f2")
+		e.addFileWithData("f3", nil)
+		e.backup()
+		e.restore()
+		e.checkSame()
+		data2 := append(append(append([]byte(nil), data[:1000]...), 'x'), data[1000:]...)
+		e.rm("f1")
+		e.addFileWithData("f1", data2)
+		stats := e.backup()
+		if stats.RepoAdded > 4*8192*4 {
+			e.t.Errorf("Too much data added after one byte insert: %d", stats.RepoAdded)
+		}
+		e.clean("res")
+		e.restore()
+		e.checkSame()
+		r := e.verifyRepo()
+		if r.Errors != 0 || r.Missing != 0 || r.Unused != 0 {
+			e.t.Errorf("Should be 0, 0, 0: numErrors=%d numMissing=%d numUnused=%d", r.Errors, r.Missing, r.Unused)
+		}
+	})
+}
+
+func TestT26(t *testing.T) {
+	doTestSeq(t, "T26 pack files", func(e *TestEnv) {
+		e.setPW([]byte("fsdfsdfadfsdfasdd2349fhcif"))
+		opt.ChunkSize = 1000
+		opt.PackSize = 20000
+		e.init()
+		for i := 0; i < 100; i++ {
+			e.addFileRepeatedPattern(fmt.Sprintf("d%d/f%d", i/10, i), 3000+i*17, 7, i)
+		}
+		e.backup()
+		e.clean("res")
+		e.restore()
+		e.checkSame()
+		versions := e.versions()
+		for i := 0; i < 100; i += 2 {
+			e.rm(fmt.Sprintf("d%d/f%d", i/10, i))
+		}
+		e.backup()
+		e.deleteVersion(versions[0])
+		e.purgeUnused()
+		r := e.verifyRepo()
+		if r.Errors != 0 || r.Missing != 0 || r.Unused != 0 {
+			e.t.Errorf("Should be 0, 0, 0: numErrors=%d numMissing=%d numUnused=%d", r.Errors, r.Missing, r.Unused)
+		}
+		opt.Version = ""
+		e.clean("res")
+		e.restore()
+		e.checkSame()
+		if _, err := os.Stat(filepath.Join(REPO, CHUNK_DIR)); !os.IsNotExist(err) {
+			e.t.Errorf("No standalone chunks should be written in pack mode")
+		}
+	})
+}
+
+func TestT27(t *testing.T) {
+	doTestSeq(t, "T27 chunk cache", func(e *TestEnv) {
+		cache := filepath.Join(TEMPDIR, "test_cache")
+		defer removeAll(e.t, cache)
+		defer SetCacheDir("")
+		SetCacheDir(cache)
+		opt.CheckChunks = false
+		opt.ChunkSize = 1000
+		e.init()
+		e.addFile("a", 5000, 1)
+		e.addFile("b", 5000, 2)
+		e.backup()
+		versions := e.versions()
+		e.rm("a")
+		e.backup()
+		// Copy the cache to simulate a cache on another machine.
+		cm := MakeCMgr(TheLocalSMgr, REPO, &Config{})
+		cm.cachePath = chunkCachePath(REPO, nil)
+		saved, err := ioutil.ReadFile(cm.cachePath)
+		e.failIfError("read cache", err)
+		e.deleteVersion(versions[0])
+		e.purgeUnused()
+		if _, err := os.Stat(cm.cachePath); !os.IsNotExist(err) {
+			e.t.Errorf("Cache should be invalidated by purge")
+		}
+		e.failIfError("write cache", ioutil.WriteFile(cm.cachePath, saved, 0600))
+		e.addFile("a", 5000, 1)
+		if st := e.backup(); st.RepoAdded == 0 {
+			e.t.Errorf("Chunks of a should be added again")
+		}
+		r := e.verifyRepo()
+		if r.Errors != 0 || r.Missing != 0 {
+			e.t.Errorf("Should be 0, 0: numErrors=%d numMissing=%d", r.Errors, r.Missing)
+		}
+		e.clean("res")
+		e.restore()
+		e.checkSame()
+	})
+}
+
+func TestT28(t *testing.T) {
+	doTestSeq(t, "T28 zstd compression", func(e *TestEnv) {
+		opt.CompType = CompressionType_ZSTD
+		opt.Compress = CompressionMode_YES
+		e.init()
+		for i := 0; i < 20; i++ {
+			e.addFileRepeatedPattern(fmt.Sprintf("d/f%d", i), 100000+i, 1000, i)
+		}
+		e.addSymlink("s", "d/f1")
+		st := e.backup()
+		if st.RepoAdded*10 > st.SrcAdded {
+			e.t.Errorf("Should be compressed: src added %d repo added %d", st.SrcAdded, st.RepoAdded)
+		}
+		vs := e.versions()
+		b, err := ioutil.ReadFile(filepath.Join(REPO, VERSION_DIR, VERSION_FILENAME_PREFIX+vs[0]))
+		e.failIfError("read version file", err)
+		if !bytes.HasPrefix(b, zstdMagic) {
+			e.t.Errorf("Version file is not compressed with zstd")
+		}
+		e.clean("res")
+		e.restore()
+		e.checkSame()
+		r := e.verifyRepo()
+		if r.Errors != 0 || r.Missing != 0 || r.Unused != 0 {
+			e.t.Errorf("Should be 0, 0, 0: numErrors=%d numMissing=%d numUnused=%d", r.Errors, r.Missing, r.Unused)
+		}
+	})
+}
+
+func TestT29(t *testing.T) {
+	doTestSeq(t, "T29 recompress", func(e *TestEnv) {
+		testRecompress(e, 0)
+	})
+	doTestSeq(t, "T29 recompress packs", func(e *TestEnv) {
+		testRecompress(e, 50000)
+	})
+}
+
+func testRecompress(e *TestEnv, packSize int) {
+	e.setPW([]byte("fsdfsdfadfsdfasdd2349fhcif"))
+	opt.Compress = CompressionMode_NO
+	opt.ChunkSize = 10000
+	opt.PackSize = packSize
+	e.init()
+	for i := 0; i < 20; i++ {
+		e.addFileRepeatedPattern(fmt.Sprintf("d/f%d", i), 30000+i, 100, i)
+	}
+	e.addFile("r", 25000, 3)
+	e.backup()
+	opt.DryRun = true
+	st := e.recompress(CompressionMode_AUTO, CompressionType_ZSTD)
+	opt.DryRun = false
+	if st.Recompressed == 0 || st.NewSize >= st.OldSize {
+		e.t.Errorf("Dry run should recompress chunks: %+v", st)
+	}
+	if st2 := e.recompress(CompressionMode_AUTO, CompressionType_ZSTD); *st2 != *st {
+		e.t.Errorf("Stats should match dry run: %+v %+v", st2, st)
+	}
+	if st := e.recompress(CompressionMode_AUTO, CompressionType_ZSTD); st.Recompressed != 0 {
+		e.t.Errorf("Chunks should not be recompressed again: %+v", st)
+	}
+	cfg, err := GetConfig(PwFile(opt.PwFile), TheLocalSMgr, REPO)
+	e.failIfError("GetConfig", err)
+	if cfg.Compress != CompressionMode_AUTO || cfg.CompressionType != CompressionType_ZSTD {
+		e.t.Errorf("Config not updated: %+v", cfg)
+	}
+	for i, want := range []bool{true, false} {
+		var st RecompressStats
+		e.failIfError("recompress", Recompress(PwFile(opt.PwFile), opt.Repo, CompressionMode_AUTO, CompressionType_ZSTD, 19, false, opt.Verbose, opt.MaxDop, &st))
+		if (st.Recompressed != 0) != want {
+			e.t.Errorf("Recompress %d to a new level should recompress chunks %v: %+v", i, want, st)
+		}
+	}
+	cfg, err = GetConfig(PwFile(opt.PwFile), TheLocalSMgr, REPO)
+	e.failIfError("GetConfig", err)
+	if cfg.CompressionLevel != 19 {
+		e.t.Errorf("Compression level not updated: %+v", cfg)
+	}
+	e.addFileRepeatedPattern("new", 30000, 100, 99)
+	e.backup()
+	r := e.verifyRepo()
+	if r.Errors != 0 || r.Missing != 0 || r.Unused != 0 {
+		e.t.Errorf("Should be 0, 0, 0: numErrors=%d numMissing=%d numUnused=%d", r.Errors, r.Missing, r.Unused)
+	}
+	e.clean("res")
+	e.restore()
+	e.checkSame()
+	if st := e.recompress(CompressionMode_NO, CompressionType_ZLIB); st.Recompressed == 0 || st.NewSize <= st.OldSize {
+		e.t.Errorf("Chunks should be decompressed: %+v", st)
+	}
+	e.clean("res")
+	e.restore()
+	e.checkSame()
+}
+
+func TestT30(t *testing.T) {
+	doTestSeq(t, "T30 argon2id", func(e *TestEnv) {
+		e.setPW([]byte("fsdfsdfadfsdfasdd2349fhcif"))
+		opt.Kdf = KdfType_ARGON2ID
+		e.init()
+		e.addFile("a", 1000, 1)
+		e.addFile("b/c", 2000, 2)
+		e.backup()
+		e.failIfError("UpgradeKdf", UpgradeKdf(PwFile(opt.PwFile), opt.Repo, &KdfParams{Type: KdfType_ARGON2ID, Memory: 2048, Time: 2, Threads: 1}))
+		e.addFile("d", 3000, 3)
+		e.backup()
+		e.clean("res")
+		e.restore()
+		e.checkSame()
+		e.setPW([]byte("wrong password"))
+		if err := UpgradeKdf(PwFile(opt.PwFile), opt.Repo, &KdfParams{Iterations: 100000}); err == nil {
+			e.t.Errorf("Should not upgrade kdf with wrong password")
+		}
+	})
+}
+
+func TestT31(t *testing.T) {
+	doTestSeq(t, "T31 asymmetric encryption", func(e *TestEnv) {
+		cache := filepath.Join(TEMPDIR, "test_cache")
+		defer removeAll(e.t, cache)
+		defer SetCacheDir("")
+		SetCacheDir(cache)
+		e.setPW([]byte("fsdfsdfadfsdfasdd2349fhcif"))
+		opt.Asymmetric = true
+		opt.ChunkSize = 1000
+		e.init()
+		fullPwFile := opt.PwFile
+		backupPwFile := filepath.Join(TEMPDIR, "backup_pw")
+		e.failIfError("write pw", ioutil.WriteFile(backupPwFile, []byte("backup only"), 0444))
+		kdf := &KdfParams{Iterations: opt.Iterations}
+		e.failIfError("AddKey", AddKey(PwFile(fullPwFile), PwFile(backupPwFile), opt.Repo, "backup", kdf, true))
+		opt.PwFile = backupPwFile
+		e.addFile("a", 5000, 1)
+		e.addFile("b/c", 2000, 2)
+		e.backup()
+		e.addFile("d", 3000, 3)
+		if st := e.backup(); st.FilesNew != 1 {
+			e.t.Errorf("Local copy of previous version not used: %d new files", st.FilesNew)
+		}
+		if err := Restore(PwFile(opt.PwFile), opt.Repo, opt.Target, opt.Version, opt.Merge, opt.VerifyOnly, opt.DryRun, opt.Verbose, opt.MaxDop, nil); err == nil {
+			e.t.Errorf("Should not restore with a write-only key")
+		}
+		if err := AddKey(PwFile(backupPwFile), PwFile(backupPwFile), opt.Repo, "other", kdf, false); err == nil {
+			e.t.Errorf("Should not add a full key with a write-only key")
+		}
+		if err := Recompress(PwFile(backupPwFile), opt.Repo, CompressionMode_AUTO, CompressionType_ZSTD, 0, false, false, opt.MaxDop, &RecompressStats{}); err == nil || !strings.Contains(err.Error(), "write-only") {
+			e.t.Errorf("Should not recompress with a write-only key: %v", err)
+		}
+		opt.PwFile = fullPwFile
+		e.rm("a")
+		e.backup()
+		opt.PwFile = backupPwFile
+		// Another client made the last version so the local copy is out of date.
+		if st := e.backup(); st.FilesNew != 2 {
+			e.t.Errorf("Out of date local copy used: %d new files", st.FilesNew)
+		}
+		opt.PwFile = fullPwFile
+		r := e.verifyRepo()
+		if r.Errors != 0 || r.Missing != 0 {
+			e.t.Errorf("Should be 0, 0: numErrors=%d numMissing=%d", r.Errors, r.Missing)
+		}
+		e.clean("res")
+		e.restore()
+		e.checkSame()
+	})
+}
+
+func TestT32(t *testing.T) {
+	for _, asymmetric := range []bool{false, true} {
+		for _, packSize := range []int{0, 50000} {
+			doTestSeq(t, fmt.Sprintf("T32 rotate-key asymmetric=%v packs=%d", asymmetric, packSize), func(e *TestEnv) {
+				testRotateKey(e, asymmetric, packSize)
+			})
+		}
+	}
+}
+
+func testRotateKey(e *TestEnv, asymmetric bool, packSize int) {
+	e.setPW([]byte("fsdfsdfadfsdfasdd2349fhcif"))
+	opt.Asymmetric = asymmetric
+	opt.ChunkSize = 10000
+	opt.PackSize = packSize
+	e.init()
+	kdf := &KdfParams{Iterations: opt.Iterations}
+	otherPwFile := filepath.Join(TEMPDIR, "other_pw")
+	e.failIfError("write pw", ioutil.WriteFile(otherPwFile, []byte("other key"), 0444))
+	e.failIfError("AddKey", AddKey(PwFile(opt.PwFile), PwFile(otherPwFile), opt.Repo, "other", kdf, asymmetric))
+	for i := 0; i < 10; i++ {
+		e.addFile(fmt.Sprintf("d/f%d", i), 25000+i, i)
+	}
+	e.backup()
+	e.addFile("e", 30000, 99)
+	e.rm("d/f1")
+	e.backup()
+	oldCfg, err := GetConfig(PwFile(opt.PwFile), TheLocalSMgr, REPO)
+	e.failIfError("GetConfig", err)
+
+	newPw := []byte("rotated key")
+	newPwFile := filepath.Join(TEMPDIR, "new_pw")
+	os.Remove(newPwFile)
+	e.failIfError("write pw", ioutil.WriteFile(newPwFile, newPw, 0444))
+	_, oldEc, err := readEncConfig(TheLocalSMgr, REPO)
+	e.failIfError("readEncConfig", err)
+	_, oldConfigKey, _, err := decryptConfig(PwFile(opt.PwFile), oldEc)
+	e.failIfError("decryptConfig", err)
+	if err := RotateKey(PwFile(opt.PwFile), nil, opt.Repo, "", true, false, opt.MaxDop, &RotateKeyStats{}); err == nil {
+		e.t.Errorf("rotate-key without a new password should fail")
+	}
+	if err := RotateKey(PwFile(opt.PwFile), PwFile(opt.PwFile), opt.Repo, "", true, false, opt.MaxDop, &RotateKeyStats{}); err == nil || !strings.Contains(err.Error(), "different") {
+		e.t.Errorf("rotate-key with the same password should fail: %v", err)
+	}
+	if err := RotateKey(PwFile(opt.PwFile), PwFile(newPwFile), opt.Repo, "", false, false, opt.MaxDop, &RotateKeyStats{}); err == nil || !strings.Contains(err.Error(), "other") || !strings.Contains(err.Error(), "-remove-other-keys") {
+		e.t.Errorf("rotate-key should not remove other key slots without -remove-other-keys: %v", err)
+	}
+	if _, err := GetConfig(PwFile(otherPwFile), TheLocalSMgr, REPO); err != nil {
+		e.t.Errorf("Other key slots should be kept: %v", err)
+	}
+
+	// Interrupt rotate-key after rotating the chunks.
+	cfg, err := StartKeyRotation(PwFile(opt.PwFile), PwFile(newPwFile), TheLocalSMgr, REPO, true)
+	e.failIfError("StartKeyRotation", err)
+	var st RotateKeyStats
+	r, err := newKeyRotator(TheLocalSMgr, REPO, cfg, false, opt.MaxDop, &st)
+	e.failIfError("newKeyRotator", err)
+	if packSize > 0 {
+		e.failIfError("rotatePacks", r.rotatePacks())
+	} else {
+		e.failIfError("rotateChunks", r.rotateChunks())
+	}
+	if st.Chunks == 0 {
+		e.t.Errorf("No chunks rotated")
+	}
+	if err := Backup(PwFile(opt.PwFile), opt.Repo, "", "", false, false, false, false, "", nil, opt.MaxDop, []string{SRCDIR}, &BackupStats{}); err != errKeyRotation {
+		e.t.Errorf("Backup should fail during rotate-key: %v", err)
+	}
+	if err := AddKey(PwFile(opt.PwFile), PwFile(otherPwFile), opt.Repo, "other2", kdf, false); err == nil {
+		e.t.Errorf("Should not add a key during rotate-key")
+	}
+
+	if st := e.rotateKey(newPw, false); st.Chunks != 0 || st.Versions != 2 {
+		e.t.Errorf("Rotated chunks should not be rotated again: %+v", st)
+	}
+	if _, err := GetConfig(PwFile(PWFILE), TheLocalSMgr, REPO); err == nil {
+		e.t.Errorf("Old password should not open the config")
+	}
+	_, ec, err := readEncConfig(TheLocalSMgr, REPO)
+	e.failIfError("readEncConfig", err)
+	if _, err := decryptBytes(oldConfigKey, ec.Config, nil); err == nil {
+		e.t.Errorf("Old config key should not open the config")
+	}
+	newCfg, err := GetConfig(PwFile(opt.PwFile), TheLocalSMgr, REPO)
+	e.failIfError("GetConfig", err)
+	if newCfg.Rotation != nil || bytes.Equal(newCfg.FPSecret, oldCfg.FPSecret) || equalKey(newCfg.EncryptionKey, oldCfg.EncryptionKey) && !asymmetric || equalKey(newCfg.PublicKey, oldCfg.PublicKey) && asymmetric {
+		e.t.Errorf("Keys not rotated")
+	}
+	if _, err := GetConfig(PwFile(otherPwFile), TheLocalSMgr, REPO); err == nil {
+		e.t.Errorf("Other key slots should be removed")
+	}
+	if _, err := os.Stat(filepath.Join(REPO, ROTATE_DIR)); err == nil {
+		if files, _ := ioutil.ReadDir(filepath.Join(REPO, ROTATE_DIR)); len(files) > 0 {
+			e.t.Errorf("rotate-key progress not removed")
+		}
+	}
+	vr := e.verifyRepo()
+	if vr.Errors != 0 || vr.Missing != 0 || vr.Unused != 0 {
+		e.t.Errorf("Should be 0, 0, 0: numErrors=%d numMissing=%d numUnused=%d", vr.Errors, vr.Missing, vr.Unused)
+	}
+	e.clean("res")
+	e.restore()
+	e.checkSame()
+	e.addFile("f", 20000, 7)
+	e.backup()
+	e.clean("res")
+	e.restore()
+	e.checkSame()
+}
+
+func TestT33(t *testing.T) {
+	for _, asymmetric := range []bool{false, true} {
+		for _, packSize := range []int{0, 50000} {
+			doTestSeq(t, fmt.Sprintf("T33 padding asymmetric=%v packs=%d", asymmetric, packSize), func(e *TestEnv) {
+				testPadding(e, asymmetric, packSize)
+			})
+		}
+	}
+}
+
+func testPadding(e *TestEnv, asymmetric bool, packSize int) {
+	e.setPW([]byte("fsdfsdfadfsdfasdd2349fhcif"))
+	opt.Asymmetric = asymmetric
+	opt.ChunkSize = 10000
+	opt.PackSize = packSize
+	opt.Compress = CompressionMode_NO
+	opt.Padding = PaddingMode_POWER_OF_TWO
+	e.init()
+	for i := 0; i < 10; i++ {
+		e.addFile(fmt.Sprintf("d/f%d", i), 2000*i+i, i)
+	}
+	st := e.backup()
+	if st.Size != 90045 {
+		e.t.Errorf("Backup size should not include padding: %d", st.Size)
+	}
+	overhead := 24 + secretbox.Overhead
+	if asymmetric {
+		overhead = box.AnonymousOverhead
+	}
+	filepath.Walk(REPO, func(p string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() || filepath.Dir(filepath.Dir(p)) != filepath.Join(REPO, CHUNK_DIR) && filepath.Base(filepath.Dir(p)) != VERSION_DIR {
+			return err
+		}
+		if n := info.Size() - int64(overhead); n&(n-1) != 0 {
+			e.t.Errorf("%s is not padded: %d", p, info.Size())
+		}
+		return nil
+	})
+	if packSize > 0 {
+		cfg, err := GetConfig(PwFile(opt.PwFile), TheLocalSMgr, REPO)
+		e.failIfError("GetConfig", err)
+		cm := MakeCMgr(TheLocalSMgr, REPO, cfg)
+		e.failIfError("loadIndex", cm.loadIndex())
+		for name, entries := range cm.packs {
+			for _, pe := range entries {
+				if n := int64(pe.Length) - int64(overhead); n&(n-1) != 0 {
+					e.t.Errorf("Chunk in pack %s is not padded: %d", name, pe.Length)
+				}
+			}
+		}
+	}
+	vr := e.verifyRepo()
+	if vr.Errors != 0 || vr.Missing != 0 || vr.Unused != 0 {
+		e.t.Errorf("Should be 0, 0, 0: numErrors=%d numMissing=%d numUnused=%d", vr.Errors, vr.Missing, vr.Unused)
+	}
+	e.restore()
+	e.checkSame()
+	if packSize == 0 {
+		e.rotateKey([]byte("rotated key"), false)
+		e.clean("res")
+		e.restore()
+		e.checkSame()
+	}
+}
+
+func TestT34(t *testing.T) {
+	for _, sameKeys := range []bool{true, false} {
+		for _, packSize := range []int{0, 50000} {
+			doTestSeq(t, fmt.Sprintf("T34 copy sameKeys=%v packs=%d", sameKeys, packSize), func(e *TestEnv) {
+				testCopy(e, sameKeys, packSize)
+			})
+		}
+	}
+}
+
+func testCopy(e *TestEnv, sameKeys bool, packSize int) {
+	e.setPW([]byte("fsdfsdfadfsdfasdd2349fhcif"))
+	srcPw := opt.PwFile
+	opt.ChunkSize = 10000
+	opt.PackSize = packSize
+	e.init()
+	dst := filepath.Join(TEMPDIR, "test_copy")
+	dstPw := filepath.Join(TEMPDIR, "copy_pw")
+	e.failIfError("write pw", ioutil.WriteFile(dstPw, []byte("another password"), 0444))
+	kdf := &KdfParams{Type: opt.Kdf, Iterations: opt.Iterations}
+	if sameKeys {
+		b, err := ExportKeys(PwFile(srcPw), TheLocalSMgr, REPO)
+		e.failIfError("ExportKeys", err)
+		e.failIfError("mkdir", os.MkdirAll(dst, 0755))
+		e.failIfError("ImportKeys", ImportKeys(b, PwFile(dstPw), TheLocalSMgr, dst, kdf, false))
+	} else {
+		cfg := &Config{ChunkSize: 20000, Compress: CompressionMode_SLOW, CompressionType: CompressionType_ZSTD, PackSize: int32(50000 - packSize), Padding: PaddingMode_PADME}
+		e.failIfError("init", InitRepo(PwFile(dstPw), dst, kdf, true, cfg))
+	}
+	for i := 0; i < 10; i++ {
+		e.addFile(fmt.Sprintf("d/f%d", i), 25000+i, i)
+	}
+	e.backup()
+	e.addFile("e", 30000, 99)
+	e.rm("d/f1")
+	e.backup()
+	copyRepo := func() *CopyStats {
+		var st CopyStats
+		e.failIfError("Copy", Copy(PwFile(srcPw), PwFile(dstPw), REPO, dst, "", "", false, opt.MaxDop, &st))
+		return &st
+	}
+	if st := copyRepo(); st.Versions != 2 || st.Chunks == 0 {
+		e.t.Errorf("Should copy 2 versions: %d versions %d chunks", st.Versions, st.Chunks)
+	}
+	if sameKeys && packSize == 0 {
+		// The stored chunks are copied as they are.
+		filepath.Walk(filepath.Join(REPO, CHUNK_DIR), func(p string, info os.FileInfo, err error) error {
+			if err != nil || info.IsDir() {
+				return err
+			}
+			rel, _ := filepath.Rel(REPO, p)
+			if !compareFile(e.t, p, filepath.Join(dst, rel)) {
+				e.t.Errorf("Chunk %s changed", rel)
+			}
+			return nil
+		})
+	}
+	e.addFile("g", 30000, 77)
+	e.backup()
+	if st := copyRepo(); st.Versions != 1 || st.Chunks != 3 {
+		e.t.Errorf("Should copy 1 version and 3 chunks: %d versions %d chunks", st.Versions, st.Chunks)
+	}
+	versions := e.versions()
+	// Resume a copy interrupted after copying the chunks of a version.
+	e.failIfError("remove version", os.Remove(filepath.Join(dst, VERSION_DIR, VERSION_FILENAME_PREFIX+versions[2])))
+	if st := copyRepo(); st.Versions != 1 || st.Chunks != 0 {
+		e.t.Errorf("Should copy 1 version and no chunks: %d versions %d chunks", st.Versions, st.Chunks)
+	}
+	if st := copyRepo(); st.Versions != 0 || st.Chunks != 0 {
+		e.t.Errorf("Should copy nothing: %d versions %d chunks", st.Versions, st.Chunks)
+	}
+	var st CopyStats
+	if err := Copy(PwFile(srcPw), PwFile(dstPw), REPO, dst, "2000-01-01T00-00-00.000000000Z", "", false, opt.MaxDop, &st); err == nil {
+		e.t.Errorf("Should not copy a missing version")
+	}
+	old := e.ls(versions[0])
+	opt.Repo = dst
+	opt.PwFile = dstPw
+	if got := e.versions(); !reflect.DeepEqual(got, versions) {
+		e.t.Errorf("Versions mismatch: %v %v", got, versions)
+	}
+	if got := e.ls(versions[0]); !reflect.DeepEqual(got, old) {
+		e.t.Errorf("Files mismatch: %v %v", got, old)
+	}
+	vr := e.verifyRepo()
+	if vr.Errors != 0 || vr.Missing != 0 || vr.Unused != 0 {
+		e.t.Errorf("Should be 0, 0, 0: numErrors=%d numMissing=%d numUnused=%d", vr.Errors, vr.Missing, vr.Unused)
+	}
+	opt.Version = ""
+	e.restore()
+	e.checkSame()
+}
+
 func benchmarkBackup(numFiles int, b *testing.B) {
 	doTestSeq(b, "benchmark backup", func(e *TestEnv) {
 		for i := 0; i < numFiles; i++ {
@@ -7,9 +7,11 @@ import (
 	"encoding/binary"
 	"errors"
 	"fmt"
+	"github.com/klauspost/compress/zstd"
 	"google.golang.org/protobuf/proto"
 	"google.golang.org/protobuf/types/known/timestamppb"
 	"io"
+	"io/ioutil"
 	"math"
 	"os"
 	"path/filepath"
@@ -119,13 +121,17 @@ func (fd *FileData) PrettyPrint() string {
 //---------------------------------------------------------------------------
 
 type VMgr struct {
-	sm  StorageMgr
-	dir string
-	key *EncKey
+	sm        StorageMgr
+	dir       string
+	key       *storageKey
+	compType  CompressionType
+	compLevel int
+	// Local copy of the last version backed up by a write-only client.
+	manifestPath string
 }
 
-func MakeVMgr(sm StorageMgr, repo string, key *EncKey) *VMgr {
-	return &VMgr{sm: sm, dir: sm.JoinPath(repo, VERSION_DIR), key: key}
+func MakeVMgr(sm StorageMgr, repo string, cfg *Config) *VMgr {
+	return &VMgr{sm: sm, dir: sm.JoinPath(repo, VERSION_DIR), key: makeStorageKey(cfg), compType: cfg.CompressionType, compLevel: int(cfg.CompressionLevel)}
 }
 
 func (vm *VMgr) GetLatestVersion() (string, error) {
@@ -205,13 +211,20 @@ func ConvertToNodeDataProto(fd *FileData) *NodeDataProto {
 	return nil
 }
 
-func EncodeVersionFile(w io.Writer) (io.WriteCloser, error) {
+func EncodeVersionFile(w io.Writer, t CompressionType, level int) (io.WriteCloser, error) {
 	vp := &VersionProto{Version: VV_VERSION}
 	out, err := proto.Marshal(vp)
 	if err != nil {
 		return nil, err
 	}
-	zlw := zlib.NewWriter(w)
+	var zlw io.WriteCloser
+	if t == CompressionType_ZSTD {
+		if zlw, err = zstd.NewWriter(w, zstd.WithEncoderLevel(zstdLevel(level)), zstd.WithEncoderConcurrency(1)); err != nil {
+			return nil, err
+		}
+	} else if zlw, err = zlib.NewWriterLevel(w, zlibLevel(level)); err != nil {
+		return nil, err
+	}
 	if _, err := zlw.Write([]byte(VV_MAGIC)); err != nil {
 		return nil, err
 	}
@@ -242,16 +255,32 @@ func EncodeOneNodeData(vfd *NodeDataProto, w io.Writer) error {
 	return nil
 }
 
+var zstdMagic = []byte{0x28, 0xb5, 0x2f, 0xfd}
+
+// DecodeVersionFile reads the header of a zlib or zstd compressed version file.
 func DecodeVersionFile(r io.Reader) (*bufio.Reader, error) {
-	zlr, err := zlib.NewReader(r)
-	if err != nil {
-		return nil, err
+	var zlr io.Reader
+	br := bufio.NewReader(r)
+	if h, err := br.Peek(len(zstdMagic)); err == nil && bytes.Equal(h, zstdMagic) {
+		b, err := ioutil.ReadAll(br)
+		if err != nil {
+			return nil, err
+		}
+		if b, err = zstdDecoder.DecodeAll(b, nil); err != nil {
+			return nil, err
+		}
+		zlr = bytes.NewReader(b)
+	} else {
+		var err error
+		if zlr, err = zlib.NewReader(br); err != nil {
+			return nil, err
+		}
 	}
 	var h [len(VV_MAGIC)]byte
 	if _, err := io.ReadFull(zlr, h[:]); err != nil || bytes.Compare(h[:], []byte(VV_MAGIC)) != 0 {
 		return nil, errors.New("Invalid version file.")
 	}
-	br := bufio.NewReader(zlr)
+	br = bufio.NewReader(zlr)
 	n, err := binary.ReadUvarint(br)
 	if n > math.MaxInt32 {
 		return nil, errors.New("Invalid version file.")
@@ -290,16 +319,23 @@ func ReadNodeDataProto(r *bufio.Reader) (*NodeDataProto, error) {
 }
 
 func (vm *VMgr) LoadFiles(v string) ([]*FileData, error, int) {
-	fp := vm.sm.JoinPath(vm.dir, VERSION_FILENAME_PREFIX+v)
-	ciphertext, err := vm.sm.ReadFile(fp, &bytes.Buffer{}, &bytes.Buffer{})
-	if err != nil {
-		return nil, err, 0
-	}
 	var text []byte
-	if vm.key == nil {
-		text = ciphertext
+	if vm.key.writeOnly() {
+		var err error
+		if text, err = readManifestCache(vm.manifestPath, v); err != nil {
+			return nil, err, 0
+		}
 	} else {
-		text, err = decryptBytes(vm.key, ciphertext, nil)
+		fp := vm.sm.JoinPath(vm.dir, VERSION_FILENAME_PREFIX+v)
+		ciphertext, err := vm.sm.ReadFile(fp, &bytes.Buffer{}, &bytes.Buffer{})
+		if err != nil {
+			return nil, err, 0
+		}
+		if vm.key == nil {
+			text = ciphertext
+		} else if text, err = vm.key.decrypt(ciphertext, nil); err != nil {
+			return nil, err, 0
+		}
 	}
 	br, err := DecodeVersionFile(bytes.NewReader(text))
 	if err != nil {
@@ -330,7 +366,7 @@ func (vm *VMgr) LoadFiles(v string) ([]*FileData, error, int) {
 
 func (vm *VMgr) SaveFiles(version string, fds []*FileData) error {
 	var buf bytes.Buffer
-	nw, err := EncodeVersionFile(&buf)
+	nw, err := EncodeVersionFile(&buf, vm.compType, vm.compLevel)
 	if err != nil {
 		return err
 	}
@@ -351,7 +387,7 @@ func (vm *VMgr) SaveFiles(version string, fds []*FileData) error {
 		result = buf.Bytes()
 	} else {
 		var err error
-		if result, err = encryptBytes(vm.key, buf.Bytes(), nil); err != nil {
+		if result, err = vm.key.encrypt(buf.Bytes(), nil); err != nil {
 			return err
 		}
 	}
@@ -360,7 +396,15 @@ func (vm *VMgr) SaveFiles(version string, fds []*FileData) error {
 	if err != nil {
 		return fmt.Errorf("Cannot create repo dir: %s", err)
 	}
-	return vm.sm.WriteFile(fp, result)
+	if err = vm.sm.WriteFile(fp, result); err != nil {
+		return err
+	}
+	if vm.key.writeOnly() {
+		if err := writeManifestCache(vm.manifestPath, version, buf.Bytes()); err != nil {
+			stderr.Printf("Cannot save local copy of version %s: %s\n", version, err)
+		}
+	}
+	return nil
 }
 
 func ReduceVersions(cur time.Time, versions []string) []string {
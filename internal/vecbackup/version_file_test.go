@@ -7,12 +7,18 @@ import "testing"
 import "time"
 
 func TestVersionFileEnc(t *testing.T) {
+	testVersionFileEnc(t, CompressionType_ZLIB, 0)
+	testVersionFileEnc(t, CompressionType_ZSTD, 0)
+	testVersionFileEnc(t, CompressionType_ZSTD, 19)
+}
+
+func testVersionFileEnc(t *testing.T, ct CompressionType, level int) {
 	x1 := NodeDataProto{Name: "hello", Type: FileType_REGULAR_FILE, Size: 83032948, ModTime: timestamppb.New(time.Now()), Perm: 0755, FileChecksum: []byte("fsfasdfasdfsa"), Chunks: [][]byte{[]byte("fsfd"), []byte("fsfwef"), []byte("cscs")}, Sizes: []int32{234, 45, 5253, 22352}}
 	x2 := NodeDataProto{Name: "world!!!", Type: FileType_DIRECTORY, Perm: 0644}
 	x3 := NodeDataProto{Name: "93hoflds0230&^#", Type: FileType_SYMLINK, Target: "osfonscoasdijjfsa"}
 	var buf bytes.Buffer
 	l := []*NodeDataProto{&x1, &x2, &x3, &x1, &x1, &x2, &x3, &x2}
-	nw, err := EncodeVersionFile(&buf)
+	nw, err := EncodeVersionFile(&buf, ct, level)
 	if err != nil {
 		t.Fatal("Failed to encode version file", err)
 	}
@@ -28,6 +34,7 @@ func TestVersionFileEnc(t *testing.T) {
 	if err != nil {
 		t.Fatal("Failed reading header", err)
 	}
+	n := 0
 	for {
 		nd, err := ReadNodeDataProto(br)
 		if err == io.EOF {
@@ -37,6 +44,10 @@ func TestVersionFileEnc(t *testing.T) {
 			t.Fatal("Failed reading node data", err)
 		}
 		t.Log(nd)
+		n++
+	}
+	if n != len(l) {
+		t.Fatalf("Expected %d node data, got %d", len(l), n)
 	}
 }
 